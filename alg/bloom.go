@@ -17,5 +17,364 @@
 */
 package alg
 
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+	Bloom is a Bloom filter whose bits live in a file and are read and
+	written in place, so that filters far bigger than the available memory
+	only cost a few random reads per lookup. The file starts with a header
+	(magic, capacity, error rate, number of hashes, number of bits and
+	items inserted) followed by the bits. Like RedisBloom, the positions of
+	an item are a + i*b for i < hashes, a and b being two MurmurHash64A
+	hashes of the item.
+
+	ScalableBloom stacks Bloom filters in a directory: when the last one
+	reaches its capacity, a new one with Expansion times its capacity and
+	half its error rate is added, keeping the overall error rate bounded.
+*/
+
+const (
+	bloomMagic      = "GBDBLOOM"
+	bloomHeaderSize = 8 + 8 + 8 + 4 + 8 + 8
+	bloomItemsAt    = bloomHeaderSize - 8
+	bloomHashSeed   = 0xc6a4a7935bd1e995
+
+	bloomMetaFileName = "meta"
+	bloomMetaSize     = 4 + 1
+
+	// the error rate of every new filter of a ScalableBloom
+	bloomTighteningRatio = 0.5
+)
+
+var (
+	ErrBloomFull      = errors.New("non scaling filter is full")
+	ErrBloomCorrupted = errors.New("bloom filter file is corrupted")
+)
+
 type Bloom struct {
+	file      *os.File
+	Capacity  uint64
+	ErrorRate float64
+	Hashes    uint32
+	Bits      uint64
+	Items     uint64
+}
+
+// CreateBloom creates a filter for capacity items with the given false
+// positive rate
+func CreateBloom(path string, capacity uint64, errorRate float64) (*Bloom, error) {
+	bitsPerEntry := -math.Log(errorRate) / (math.Ln2 * math.Ln2)
+
+	b := &Bloom{
+		Capacity:  capacity,
+		ErrorRate: errorRate,
+		Hashes:    uint32(math.Ceil(math.Ln2 * bitsPerEntry)),
+		Bits:      uint64(math.Ceil(float64(capacity) * bitsPerEntry)),
+	}
+	if b.Bits < 64 {
+		b.Bits = 64
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	b.file = file
+
+	header := make([]byte, bloomHeaderSize)
+	copy(header, bloomMagic)
+	binary.BigEndian.PutUint64(header[8:], b.Capacity)
+	binary.BigEndian.PutUint64(header[16:], math.Float64bits(b.ErrorRate))
+	binary.BigEndian.PutUint32(header[24:], b.Hashes)
+	binary.BigEndian.PutUint64(header[28:], b.Bits)
+
+	if _, err := file.WriteAt(header, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// the bits start as a hole in the file
+	if err := file.Truncate(int64(bloomHeaderSize + (b.Bits+7)/8)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// OpenBloom opens a filter created by CreateBloom
+func OpenBloom(path string) (*Bloom, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, bloomHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != bloomMagic {
+		file.Close()
+		return nil, ErrBloomCorrupted
+	}
+
+	return &Bloom{
+		file:      file,
+		Capacity:  binary.BigEndian.Uint64(header[8:]),
+		ErrorRate: math.Float64frombits(binary.BigEndian.Uint64(header[16:])),
+		Hashes:    binary.BigEndian.Uint32(header[24:]),
+		Bits:      binary.BigEndian.Uint64(header[28:]),
+		Items:     binary.BigEndian.Uint64(header[bloomItemsAt:]),
+	}, nil
+}
+
+func (b *Bloom) Close() error {
+	return b.file.Close()
+}
+
+// Size returns the size of the filter in bytes
+func (b *Bloom) Size() uint64 {
+	return bloomHeaderSize + (b.Bits+7)/8
+}
+
+// Full reports whether the filter holds as many items as its capacity
+func (b *Bloom) Full() bool {
+	return b.Items >= b.Capacity
+}
+
+func bloomHashes(item []byte) (uint64, uint64) {
+	a := murmurHash64A(item, bloomHashSeed)
+
+	return a, murmurHash64A(item, a)
+}
+
+// positions calls fn on the bit positions of the item until it returns
+// false or an error
+func (b *Bloom) positions(a, h uint64, fn func(bit uint64) (bool, error)) error {
+	for i := uint64(0); i < uint64(b.Hashes); i++ {
+		ok, err := fn((a + i*h) % b.Bits)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *Bloom) readByte(bit uint64) (byte, error) {
+	buf := make([]byte, 1)
+	_, err := b.file.ReadAt(buf, int64(bloomHeaderSize+bit/8))
+
+	return buf[0], err
+}
+
+func (b *Bloom) test(a, h uint64) (bool, error) {
+	found := true
+	err := b.positions(a, h, func(bit uint64) (bool, error) {
+		value, err := b.readByte(bit)
+		found = value&(1<<(bit%8)) != 0
+
+		return found, err
+	})
+
+	return found && err == nil, err
+}
+
+// Test reports whether item may have been added
+func (b *Bloom) Test(item []byte) (bool, error) {
+	return b.test(bloomHashes(item))
+}
+
+// add sets the bits of the item, reporting whether any was unset
+func (b *Bloom) add(a, h uint64) (bool, error) {
+	added := false
+	err := b.positions(a, h, func(bit uint64) (bool, error) {
+		value, err := b.readByte(bit)
+		if err != nil || value&(1<<(bit%8)) != 0 {
+			return true, err
+		}
+
+		added = true
+		_, err = b.file.WriteAt([]byte{value | 1<<(bit%8)}, int64(bloomHeaderSize+bit/8))
+
+		return true, err
+	})
+	if err != nil || !added {
+		return false, err
+	}
+
+	b.Items++
+	items := make([]byte, 8)
+	binary.BigEndian.PutUint64(items, b.Items)
+	_, err = b.file.WriteAt(items, bloomItemsAt)
+
+	return true, err
+}
+
+// Add adds item, reporting whether it was not there yet
+func (b *Bloom) Add(item []byte) (bool, error) {
+	return b.add(bloomHashes(item))
+}
+
+type ScalableBloom struct {
+	dir        string
+	Expansion  uint32
+	NonScaling bool
+	Filters    []*Bloom
+}
+
+func bloomFilterPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d", i))
+}
+
+// CreateScalableBloom creates a scalable filter in dir, an existing
+// directory, starting with a filter for capacity items
+func CreateScalableBloom(dir string, capacity uint64, errorRate float64, expansion uint32, nonScaling bool) (*ScalableBloom, error) {
+	meta := make([]byte, bloomMetaSize)
+	binary.BigEndian.PutUint32(meta, expansion)
+	if nonScaling {
+		meta[4] = 1
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, bloomMetaFileName), meta, 0600); err != nil {
+		return nil, err
+	}
+
+	first, err := CreateBloom(bloomFilterPath(dir, 0), capacity, errorRate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScalableBloom{
+		dir:        dir,
+		Expansion:  expansion,
+		NonScaling: nonScaling,
+		Filters:    []*Bloom{first},
+	}, nil
+}
+
+// OpenScalableBloom opens a filter created by CreateScalableBloom
+func OpenScalableBloom(dir string) (*ScalableBloom, error) {
+	meta, err := os.ReadFile(filepath.Join(dir, bloomMetaFileName))
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) < bloomMetaSize {
+		return nil, ErrBloomCorrupted
+	}
+
+	s := &ScalableBloom{
+		dir:        dir,
+		Expansion:  binary.BigEndian.Uint32(meta),
+		NonScaling: meta[4] == 1,
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b, err := OpenBloom(name)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+
+		s.Filters = append(s.Filters, b)
+	}
+
+	if len(s.Filters) == 0 {
+		return nil, ErrBloomCorrupted
+	}
+
+	return s, nil
+}
+
+func (s *ScalableBloom) Close() error {
+	var err error
+	for _, b := range s.Filters {
+		if closeErr := b.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// Test reports whether item may have been added
+func (s *ScalableBloom) Test(item []byte) (bool, error) {
+	a, h := bloomHashes(item)
+
+	// the newest filters hold the most items
+	for i := len(s.Filters) - 1; i >= 0; i-- {
+		found, err := s.Filters[i].test(a, h)
+		if err != nil || found {
+			return found, err
+		}
+	}
+
+	return false, nil
+}
+
+// Add adds item, reporting whether it was not there yet. A full filter
+// grows unless NonScaling, in which case it returns ErrBloomFull.
+func (s *ScalableBloom) Add(item []byte) (bool, error) {
+	found, err := s.Test(item)
+	if err != nil || found {
+		return false, err
+	}
+
+	last := s.Filters[len(s.Filters)-1]
+	if last.Full() {
+		if s.NonScaling {
+			return false, ErrBloomFull
+		}
+
+		next, err := CreateBloom(bloomFilterPath(s.dir, len(s.Filters)), last.Capacity*uint64(s.Expansion), last.ErrorRate*bloomTighteningRatio)
+		if err != nil {
+			return false, err
+		}
+
+		s.Filters = append(s.Filters, next)
+		last = next
+	}
+
+	return last.add(bloomHashes(item))
+}
+
+// Capacity returns the number of items the filters can hold
+func (s *ScalableBloom) Capacity() uint64 {
+	capacity := uint64(0)
+	for _, b := range s.Filters {
+		capacity += b.Capacity
+	}
+
+	return capacity
+}
+
+// Items returns the number of items added
+func (s *ScalableBloom) Items() uint64 {
+	items := uint64(0)
+	for _, b := range s.Filters {
+		items += b.Items
+	}
+
+	return items
+}
+
+// Size returns the size of the filters in bytes
+func (s *ScalableBloom) Size() uint64 {
+	size := uint64(0)
+	for _, b := range s.Filters {
+		size += b.Size()
+	}
+
+	return size
 }
@@ -0,0 +1,259 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func bloomTestItem(i int) []byte {
+	return []byte(fmt.Sprintf("https://example.com/page/%d", i))
+}
+
+func TestBloomLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter")
+
+	// the sizing of RedisBloom for BF.RESERVE key 0.01 100
+	b, err := CreateBloom(path, 100, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Hashes != 7 || b.Bits != 959 {
+		t.Fatalf("the filter has %d hashes and %d bits, want 7 and 959", b.Hashes, b.Bits)
+	}
+
+	for i := 0; i < 50; i++ {
+		added, err := b.Add(bloomTestItem(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added {
+			t.Fatalf("item %d was already there", i)
+		}
+	}
+	if added, err := b.Add(bloomTestItem(0)); err != nil || added {
+		t.Fatalf("adding an item again returned %v: %v", added, err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := uint64(info.Size()); size != bloomHeaderSize+120 || size != b.Size() {
+		t.Fatalf("the file is %d bytes, want %d", size, bloomHeaderSize+120)
+	}
+
+	b, err = OpenBloom(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if b.Capacity != 100 || b.ErrorRate != 0.01 || b.Hashes != 7 || b.Bits != 959 || b.Items != 50 {
+		t.Fatalf("reopened %+v", b)
+	}
+	if b.Full() {
+		t.Fatal("the filter is full")
+	}
+	for i := 0; i < 50; i++ {
+		if found, err := b.Test(bloomTestItem(i)); err != nil || !found {
+			t.Fatalf("item %d is missing after reopening: %v", i, err)
+		}
+	}
+}
+
+func TestBloomCorrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "filter")
+	if err := os.WriteFile(path, []byte("NOTBLOOM and some bytes to fill the header"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBloom(path); err != ErrBloomCorrupted {
+		t.Fatalf("opening a wrong magic returned %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte(bloomMagic), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBloom(path); err != ErrBloomCorrupted {
+		t.Fatalf("opening a short header returned %v", err)
+	}
+
+	// a scalable filter without filters
+	if err := os.WriteFile(filepath.Join(dir, bloomMetaFileName), []byte{0, 0, 0, 2, 0}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenScalableBloom(dir); err != ErrBloomCorrupted {
+		t.Fatalf("opening a scalable filter without filters returned %v", err)
+	}
+}
+
+func TestBloomErrorRate(t *testing.T) {
+	const capacity = 10000
+
+	for _, errorRate := range []float64{0.1, 0.01, 0.001} {
+		b, err := CreateBloom(filepath.Join(t.TempDir(), "filter"), capacity, errorRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < capacity; i++ {
+			if _, err := b.Add(bloomTestItem(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// no false negatives, and about errorRate false positives
+		for i := 0; i < capacity; i++ {
+			if found, err := b.Test(bloomTestItem(i)); err != nil || !found {
+				t.Fatalf("item %d is missing: %v", i, err)
+			}
+		}
+
+		positives := 0
+		for i := capacity; i < 2*capacity; i++ {
+			found, err := b.Test(bloomTestItem(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				positives++
+			}
+		}
+		if rate := float64(positives) / capacity; rate > 2*errorRate {
+			t.Errorf("%f false positives, want about %f", rate, errorRate)
+		}
+
+		// items colliding with the ones already there are not counted
+		if b.Items > capacity || float64(b.Items) < capacity*(1-errorRate*2) {
+			t.Errorf("%d items counted out of %d", b.Items, capacity)
+		}
+
+		b.Close()
+	}
+}
+
+func TestScalableBloom(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := CreateScalableBloom(dir, 10, 0.01, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if _, err := s.Add(bloomTestItem(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenScalableBloom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// each filter doubles the capacity and halves the error rate
+	if s.Expansion != 2 || s.NonScaling || len(s.Filters) != 4 {
+		t.Fatalf("reopened expansion %d nonscaling %v with %d filters", s.Expansion, s.NonScaling, len(s.Filters))
+	}
+	for i, b := range s.Filters {
+		if want := uint64(10) << i; b.Capacity != want {
+			t.Fatalf("filter %d has capacity %d, want %d", i, b.Capacity, want)
+		}
+		if want := 0.01 / float64(uint64(1)<<i); b.ErrorRate != want {
+			t.Fatalf("filter %d has error rate %f, want %f", i, b.ErrorRate, want)
+		}
+		if i < len(s.Filters)-1 && !b.Full() {
+			t.Fatalf("filter %d was not full when the next one was added", i)
+		}
+		if _, err := os.Stat(bloomFilterPath(dir, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if capacity := s.Capacity(); capacity != 150 {
+		t.Fatalf("the capacity is %d, want 150", capacity)
+	}
+	if items := s.Items(); items < 90 || items > 100 {
+		t.Fatalf("%d items counted out of 100", items)
+	}
+
+	for i := 0; i < 100; i++ {
+		if found, err := s.Test(bloomTestItem(i)); err != nil || !found {
+			t.Fatalf("item %d is missing: %v", i, err)
+		}
+	}
+
+	// an item of an older filter is not added again to the last one
+	items := s.Items()
+	if added, err := s.Add(bloomTestItem(0)); err != nil || added || s.Items() != items {
+		t.Fatalf("adding an item again returned %v: %v", added, err)
+	}
+}
+
+func TestScalableBloomNonScaling(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := CreateScalableBloom(dir, 10, 0.001, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	full := false
+	for i := 0; i < 20 && !full; i++ {
+		_, err := s.Add(bloomTestItem(i))
+		switch {
+		case err == ErrBloomFull:
+			full = true
+		case err != nil:
+			t.Fatal(err)
+		}
+	}
+	if !full || s.Items() != 10 || len(s.Filters) != 1 {
+		t.Fatalf("full %v with %d items in %d filters", full, s.Items(), len(s.Filters))
+	}
+
+	// the items already there are still found
+	if added, err := s.Add(bloomTestItem(0)); err != nil || added {
+		t.Fatalf("adding an item of a full filter returned %v: %v", added, err)
+	}
+
+	reopened, err := OpenScalableBloom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if !reopened.NonScaling || reopened.Items() != 10 {
+		t.Fatalf("reopened nonscaling %v with %d items", reopened.NonScaling, reopened.Items())
+	}
+}
@@ -17,5 +17,1052 @@
 */
 package alg
 
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+/*
+	BTree is a persistent B+tree stored in a single file of fixed size pages.
+	Page 0 is the header, every other page is a leaf, an internal node or a
+	free page waiting to be reused. Leaves hold the entries sorted by key and
+	are linked both ways, internal nodes hold the separator keys and, for
+	every child, the number of entries in its subtree so that the rank of a
+	key and the entry at a given rank are found in O(log n).
+
+	Changes are kept in memory until Commit, which first saves the original
+	version of the pages about to be overwritten in a journal file: a crash
+	in the middle of a commit is rolled back by the next OpenBTree.
+	A BTree is not safe for concurrent use.
+*/
+
+const (
+	BTreePageSize     = 8192
+	BTreeMaxEntrySize = 2000 // max len(key)+len(value), a page always holds at least 4 entries
+
+	btreeMagic        = "GBDBTREE"
+	btreeJournalMagic = "GBDBJRNL"
+	btreeVersion      = 1
+	btreeCacheSize    = 4096 // clean pages kept in memory between operations
+
+	btreeLeaf     = 1
+	btreeInternal = 2
+	btreeFree     = 3
+
+	btreeLeafHeaderSize     = 1 + 2 + 4 + 4 // type, count, next, prev
+	btreeInternalHeaderSize = 1 + 2         // type, number of children
+)
+
+var (
+	ErrBTreeEntryTooBig = errors.New("btree entry too big")
+	ErrBTreeCorrupted   = errors.New("btree file is corrupted")
+)
+
 type BTree struct {
+	file        *os.File
+	journalPath string
+
+	root      uint32
+	freeHead  uint32 // first page of the free list, 0 if empty
+	pageCount uint32
+	length    uint64
+
+	committedPageCount uint32
+	headerDirty        bool
+	nodes              map[uint32]*btreeNode
+	dirty              map[uint32]bool
+}
+
+type btreeNode struct {
+	id   uint32
+	leaf bool
+	free bool
+
+	keys     [][]byte
+	values   [][]byte // leaves only
+	children []uint32 // internal nodes only, len(keys)+1 of them
+	counts   []uint64 // entries in the subtree of each child
+
+	next uint32 // next leaf, or next free page
+	prev uint32
+}
+
+// btreeSplit is what a node that split passes up to its parent
+type btreeSplit struct {
+	key   []byte
+	id    uint32
+	count uint64
+}
+
+// OpenBTree opens the tree stored at path, creating it if needed
+func OpenBTree(path string) (*BTree, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &BTree{
+		file:        file,
+		journalPath: path + "-journal",
+		nodes:       make(map[uint32]*btreeNode),
+		dirty:       make(map[uint32]bool),
+	}
+
+	if err := t.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := t.readHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Close closes the file, changes not committed are lost
+func (t *BTree) Close() error {
+	return t.file.Close()
+}
+
+// Len returns the number of entries
+func (t *BTree) Len() int {
+	return int(t.length)
+}
+
+func (t *BTree) readHeader() error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() == 0 {
+		// brand new tree: an empty leaf as root
+		t.root, t.pageCount = 1, 2
+		t.markDirty(&btreeNode{id: 1, leaf: true})
+		t.headerDirty = true
+
+		return t.Commit()
+	}
+
+	header := make([]byte, BTreePageSize)
+	if _, err := t.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+
+	if string(header[:8]) != btreeMagic ||
+		binary.BigEndian.Uint32(header[8:]) != btreeVersion ||
+		binary.BigEndian.Uint32(header[12:]) != BTreePageSize {
+		return ErrBTreeCorrupted
+	}
+
+	t.root = binary.BigEndian.Uint32(header[16:])
+	t.freeHead = binary.BigEndian.Uint32(header[20:])
+	t.pageCount = binary.BigEndian.Uint32(header[24:])
+	t.length = binary.BigEndian.Uint64(header[28:])
+	t.committedPageCount = t.pageCount
+
+	return nil
+}
+
+func (t *BTree) encodeHeader() []byte {
+	header := make([]byte, BTreePageSize)
+	copy(header, btreeMagic)
+	binary.BigEndian.PutUint32(header[8:], btreeVersion)
+	binary.BigEndian.PutUint32(header[12:], BTreePageSize)
+	binary.BigEndian.PutUint32(header[16:], t.root)
+	binary.BigEndian.PutUint32(header[20:], t.freeHead)
+	binary.BigEndian.PutUint32(header[24:], t.pageCount)
+	binary.BigEndian.PutUint64(header[28:], t.length)
+
+	return header
+}
+
+// recover rolls back a commit interrupted by a crash. A journal that was
+// not completely written means that the tree file was not touched yet.
+func (t *BTree) recover() error {
+	journal, err := os.ReadFile(t.journalPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if len(journal) < 8+4+4+4 || string(journal[:8]) != btreeJournalMagic ||
+		crc32.ChecksumIEEE(journal[:len(journal)-4]) != binary.BigEndian.Uint32(journal[len(journal)-4:]) {
+		return os.Remove(t.journalPath)
+	}
+
+	pageCount := binary.BigEndian.Uint32(journal[8:])
+	n := int(binary.BigEndian.Uint32(journal[12:]))
+	if len(journal) != 8+4+4+n*(4+BTreePageSize)+4 {
+		return ErrBTreeCorrupted
+	}
+
+	for i := 0; i < n; i++ {
+		entry := journal[16+i*(4+BTreePageSize):]
+		id := binary.BigEndian.Uint32(entry)
+
+		if _, err := t.file.WriteAt(entry[4:4+BTreePageSize], int64(id)*BTreePageSize); err != nil {
+			return err
+		}
+	}
+
+	if err := t.file.Truncate(int64(pageCount) * BTreePageSize); err != nil {
+		return err
+	}
+
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+
+	return os.Remove(t.journalPath)
+}
+
+// Commit makes the changes durable
+func (t *BTree) Commit() error {
+	if len(t.dirty) == 0 && !t.headerDirty {
+		return nil
+	}
+
+	ids := make([]uint32, 0, len(t.dirty))
+	for id := range t.dirty {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	// the journal holds the header and every page that already exists on
+	// disk, a brand new tree is rolled back to an empty file
+	saved := []uint32{}
+	if t.committedPageCount > 0 {
+		saved = append(saved, 0)
+		for _, id := range ids {
+			if id < t.committedPageCount {
+				saved = append(saved, id)
+			}
+		}
+	}
+
+	var journal bytes.Buffer
+	journal.WriteString(btreeJournalMagic)
+	binary.Write(&journal, binary.BigEndian, t.committedPageCount)
+	binary.Write(&journal, binary.BigEndian, uint32(len(saved)))
+
+	page := make([]byte, BTreePageSize)
+	for _, id := range saved {
+		if _, err := t.file.ReadAt(page, int64(id)*BTreePageSize); err != nil {
+			return err
+		}
+
+		binary.Write(&journal, binary.BigEndian, id)
+		journal.Write(page)
+	}
+	binary.Write(&journal, binary.BigEndian, crc32.ChecksumIEEE(journal.Bytes()))
+
+	if err := writeSynced(t.journalPath, journal.Bytes()); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err := t.file.WriteAt(t.nodes[id].encode(), int64(id)*BTreePageSize); err != nil {
+			return err
+		}
+	}
+
+	if _, err := t.file.WriteAt(t.encodeHeader(), 0); err != nil {
+		return err
+	}
+
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(t.journalPath); err != nil {
+		return err
+	}
+
+	t.committedPageCount = t.pageCount
+	t.dirty = make(map[uint32]bool)
+	t.headerDirty = false
+	t.trimCache()
+
+	return nil
+}
+
+// DirtyPages returns the number of pages changed since the last commit,
+// bulk loads should commit once in a while to bound memory usage
+func (t *BTree) DirtyPages() int {
+	return len(t.dirty)
+}
+
+func writeSynced(path string, content []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// trimCache drops the clean pages once there are too many of them.
+// It's only called between operations, when no node is being worked on.
+func (t *BTree) trimCache() {
+	if len(t.nodes) <= btreeCacheSize {
+		return
+	}
+
+	for id := range t.nodes {
+		if !t.dirty[id] {
+			delete(t.nodes, id)
+		}
+	}
+}
+
+func (t *BTree) node(id uint32) (*btreeNode, error) {
+	if n, ok := t.nodes[id]; ok {
+		return n, nil
+	}
+
+	if id == 0 || id >= t.pageCount {
+		return nil, ErrBTreeCorrupted
+	}
+
+	page := make([]byte, BTreePageSize)
+	if _, err := t.file.ReadAt(page, int64(id)*BTreePageSize); err != nil {
+		if err == io.EOF {
+			return nil, ErrBTreeCorrupted
+		}
+		return nil, err
+	}
+
+	n, err := decodeBTreeNode(id, page)
+	if err != nil {
+		return nil, err
+	}
+
+	t.nodes[id] = n
+
+	return n, nil
+}
+
+func (t *BTree) markDirty(n *btreeNode) {
+	t.nodes[n.id] = n
+	t.dirty[n.id] = true
+}
+
+func (t *BTree) allocPage() (uint32, error) {
+	t.headerDirty = true
+
+	if t.freeHead == 0 {
+		t.pageCount++
+		return t.pageCount - 1, nil
+	}
+
+	id := t.freeHead
+	n, err := t.node(id)
+	if err != nil {
+		return 0, err
+	}
+	if !n.free {
+		return 0, ErrBTreeCorrupted
+	}
+
+	t.freeHead = n.next
+
+	return id, nil
+}
+
+func (t *BTree) freePage(id uint32) {
+	t.markDirty(&btreeNode{
+		id:   id,
+		free: true,
+		next: t.freeHead,
+	})
+	t.freeHead = id
+	t.headerDirty = true
+}
+
+func decodeBTreeNode(id uint32, page []byte) (*btreeNode, error) {
+	n := &btreeNode{
+		id: id,
+	}
+
+	switch page[0] {
+	case btreeFree:
+		n.free = true
+		n.next = binary.BigEndian.Uint32(page[1:])
+	case btreeLeaf:
+		n.leaf = true
+		count := int(binary.BigEndian.Uint16(page[1:]))
+		n.next = binary.BigEndian.Uint32(page[3:])
+		n.prev = binary.BigEndian.Uint32(page[7:])
+		n.keys = make([][]byte, count)
+		n.values = make([][]byte, count)
+
+		offset := btreeLeafHeaderSize
+		for i := 0; i < count; i++ {
+			if offset+4 > len(page) {
+				return nil, ErrBTreeCorrupted
+			}
+			keyLen := int(binary.BigEndian.Uint16(page[offset:]))
+			valueLen := int(binary.BigEndian.Uint16(page[offset+2:]))
+			offset += 4
+
+			if offset+keyLen+valueLen > len(page) {
+				return nil, ErrBTreeCorrupted
+			}
+			n.keys[i] = page[offset : offset+keyLen : offset+keyLen]
+			offset += keyLen
+			n.values[i] = page[offset : offset+valueLen : offset+valueLen]
+			offset += valueLen
+		}
+	case btreeInternal:
+		count := int(binary.BigEndian.Uint16(page[1:]))
+		if count == 0 || btreeInternalHeaderSize+count*12 > len(page) {
+			return nil, ErrBTreeCorrupted
+		}
+		n.children = make([]uint32, count)
+		n.counts = make([]uint64, count)
+		n.keys = make([][]byte, count-1)
+
+		offset := btreeInternalHeaderSize
+		for i := 0; i < count; i++ {
+			n.children[i] = binary.BigEndian.Uint32(page[offset:])
+			n.counts[i] = binary.BigEndian.Uint64(page[offset+4:])
+			offset += 12
+		}
+
+		for i := range n.keys {
+			if offset+2 > len(page) {
+				return nil, ErrBTreeCorrupted
+			}
+			keyLen := int(binary.BigEndian.Uint16(page[offset:]))
+			offset += 2
+
+			if offset+keyLen > len(page) {
+				return nil, ErrBTreeCorrupted
+			}
+			n.keys[i] = page[offset : offset+keyLen : offset+keyLen]
+			offset += keyLen
+		}
+	default:
+		return nil, ErrBTreeCorrupted
+	}
+
+	return n, nil
+}
+
+func (n *btreeNode) encode() []byte {
+	page := make([]byte, BTreePageSize)
+
+	switch {
+	case n.free:
+		page[0] = btreeFree
+		binary.BigEndian.PutUint32(page[1:], n.next)
+	case n.leaf:
+		page[0] = btreeLeaf
+		binary.BigEndian.PutUint16(page[1:], uint16(len(n.keys)))
+		binary.BigEndian.PutUint32(page[3:], n.next)
+		binary.BigEndian.PutUint32(page[7:], n.prev)
+
+		offset := btreeLeafHeaderSize
+		for i := range n.keys {
+			binary.BigEndian.PutUint16(page[offset:], uint16(len(n.keys[i])))
+			binary.BigEndian.PutUint16(page[offset+2:], uint16(len(n.values[i])))
+			offset += 4
+			offset += copy(page[offset:], n.keys[i])
+			offset += copy(page[offset:], n.values[i])
+		}
+	default:
+		page[0] = btreeInternal
+		binary.BigEndian.PutUint16(page[1:], uint16(len(n.children)))
+
+		offset := btreeInternalHeaderSize
+		for i := range n.children {
+			binary.BigEndian.PutUint32(page[offset:], n.children[i])
+			binary.BigEndian.PutUint64(page[offset+4:], n.counts[i])
+			offset += 12
+		}
+
+		for _, key := range n.keys {
+			binary.BigEndian.PutUint16(page[offset:], uint16(len(key)))
+			offset += 2
+			offset += copy(page[offset:], key)
+		}
+	}
+
+	return page
+}
+
+// size returns the number of bytes taken by the encoded node
+func (n *btreeNode) size() int {
+	if n.leaf {
+		size := btreeLeafHeaderSize
+		for i := range n.keys {
+			size += 4 + len(n.keys[i]) + len(n.values[i])
+		}
+		return size
+	}
+
+	size := btreeInternalHeaderSize + 12*len(n.children)
+	for _, key := range n.keys {
+		size += 2 + len(key)
+	}
+
+	return size
+}
+
+// search returns the position of the first key not lower than key in a leaf
+func (n *btreeNode) search(key []byte) (int, bool) {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) >= 0
+	})
+
+	return i, i < len(n.keys) && bytes.Equal(n.keys[i], key)
+}
+
+// childIndex returns the child of an internal node that may hold key
+func (n *btreeNode) childIndex(key []byte) int {
+	return sort.Search(len(n.keys), func(i int) bool {
+		return bytes.Compare(n.keys[i], key) > 0
+	})
+}
+
+// Get returns the value stored at key
+func (t *BTree) Get(key []byte) ([]byte, bool, error) {
+	n, err := t.node(t.root)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for !n.leaf {
+		if n, err = t.node(n.children[n.childIndex(key)]); err != nil {
+			return nil, false, err
+		}
+	}
+
+	i, found := n.search(key)
+	if !found {
+		return nil, false, nil
+	}
+
+	return n.values[i], true, nil
+}
+
+// Put stores value at key, returning whether the key is new
+func (t *BTree) Put(key, value []byte) (bool, error) {
+	if len(key)+len(value) > BTreeMaxEntrySize {
+		return false, ErrBTreeEntryTooBig
+	}
+
+	t.trimCache()
+
+	root, err := t.node(t.root)
+	if err != nil {
+		return false, err
+	}
+
+	// the tree outlives the buffers of the caller
+	key = append([]byte{}, key...)
+	value = append([]byte{}, value...)
+
+	inserted, split, err := t.insert(root, key, value)
+	if err != nil {
+		return false, err
+	}
+
+	if inserted {
+		t.length++
+		t.headerDirty = true
+	}
+
+	if split != nil {
+		id, err := t.allocPage()
+		if err != nil {
+			return false, err
+		}
+
+		t.markDirty(&btreeNode{
+			id:       id,
+			keys:     [][]byte{split.key},
+			children: []uint32{t.root, split.id},
+			counts:   []uint64{t.length - split.count, split.count},
+		})
+		t.root = id
+	}
+
+	return inserted, nil
+}
+
+func (t *BTree) insert(n *btreeNode, key, value []byte) (bool, *btreeSplit, error) {
+	if n.leaf {
+		i, found := n.search(key)
+		if found {
+			n.values[i] = value
+		} else {
+			n.keys = insertBytes(n.keys, i, key)
+			n.values = insertBytes(n.values, i, value)
+		}
+		t.markDirty(n)
+
+		if n.size() <= BTreePageSize {
+			return !found, nil, nil
+		}
+
+		split, err := t.splitLeaf(n)
+		return !found, split, err
+	}
+
+	i := n.childIndex(key)
+	child, err := t.node(n.children[i])
+	if err != nil {
+		return false, nil, err
+	}
+
+	inserted, split, err := t.insert(child, key, value)
+	if err != nil || (!inserted && split == nil) {
+		return inserted, nil, err
+	}
+
+	if inserted {
+		n.counts[i]++
+	}
+
+	if split != nil {
+		n.counts[i] -= split.count
+		n.keys = insertBytes(n.keys, i, split.key)
+		n.children = insertUint32(n.children, i+1, split.id)
+		n.counts = insertUint64(n.counts, i+1, split.count)
+	}
+	t.markDirty(n)
+
+	if n.size() <= BTreePageSize {
+		return inserted, nil, nil
+	}
+
+	split, err = t.splitInternal(n)
+	return inserted, split, err
+}
+
+func (t *BTree) splitLeaf(n *btreeNode) (*btreeSplit, error) {
+	half := n.size() / 2
+	size := btreeLeafHeaderSize
+	m := 0
+	for m < len(n.keys)-1 && size < half {
+		size += 4 + len(n.keys[m]) + len(n.values[m])
+		m++
+	}
+	if m == 0 {
+		m = 1
+	}
+
+	id, err := t.allocPage()
+	if err != nil {
+		return nil, err
+	}
+
+	right := &btreeNode{
+		id:     id,
+		leaf:   true,
+		keys:   append([][]byte{}, n.keys[m:]...),
+		values: append([][]byte{}, n.values[m:]...),
+		next:   n.next,
+		prev:   n.id,
+	}
+
+	if n.next != 0 {
+		next, err := t.node(n.next)
+		if err != nil {
+			return nil, err
+		}
+
+		next.prev = id
+		t.markDirty(next)
+	}
+
+	n.keys = n.keys[:m]
+	n.values = n.values[:m]
+	n.next = id
+	t.markDirty(n)
+	t.markDirty(right)
+
+	return &btreeSplit{
+		key:   right.keys[0],
+		id:    id,
+		count: uint64(len(right.keys)),
+	}, nil
+}
+
+func (t *BTree) splitInternal(n *btreeNode) (*btreeSplit, error) {
+	// keys[m] moves up to the parent
+	half := n.size() / 2
+	size := btreeInternalHeaderSize + 12
+	m := 0
+	for m < len(n.keys)-1 && size < half {
+		size += 12 + 2 + len(n.keys[m])
+		m++
+	}
+	if m == 0 {
+		m = 1
+	}
+
+	id, err := t.allocPage()
+	if err != nil {
+		return nil, err
+	}
+
+	right := &btreeNode{
+		id:       id,
+		keys:     append([][]byte{}, n.keys[m+1:]...),
+		children: append([]uint32{}, n.children[m+1:]...),
+		counts:   append([]uint64{}, n.counts[m+1:]...),
+	}
+
+	split := &btreeSplit{
+		key: n.keys[m],
+		id:  id,
+	}
+	for _, count := range right.counts {
+		split.count += count
+	}
+
+	n.keys = n.keys[:m]
+	n.children = n.children[:m+1]
+	n.counts = n.counts[:m+1]
+	t.markDirty(n)
+	t.markDirty(right)
+
+	return split, nil
+}
+
+// Delete removes key, returning whether it was there
+func (t *BTree) Delete(key []byte) (bool, error) {
+	t.trimCache()
+
+	root, err := t.node(t.root)
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := t.remove(root, key)
+	if err != nil || !removed {
+		return false, err
+	}
+
+	t.length--
+	t.headerDirty = true
+
+	if !root.leaf && len(root.children) == 1 {
+		t.root = root.children[0]
+		t.freePage(root.id)
+	}
+
+	return true, nil
+}
+
+func (t *BTree) remove(n *btreeNode, key []byte) (bool, error) {
+	if n.leaf {
+		i, found := n.search(key)
+		if !found {
+			return false, nil
+		}
+
+		n.keys = removeBytes(n.keys, i)
+		n.values = removeBytes(n.values, i)
+		t.markDirty(n)
+
+		return true, nil
+	}
+
+	i := n.childIndex(key)
+	child, err := t.node(n.children[i])
+	if err != nil {
+		return false, err
+	}
+
+	removed, err := t.remove(child, key)
+	if err != nil || !removed {
+		return false, err
+	}
+
+	n.counts[i]--
+	t.markDirty(n)
+
+	if child.size() < BTreePageSize/4 && len(n.children) > 1 {
+		return true, t.mergeChild(n, i)
+	}
+
+	return true, nil
+}
+
+// mergeChild merges the ith child of n with a sibling if they fit in a
+// single page. Underfull nodes that can't be merged are left as they are.
+func (t *BTree) mergeChild(n *btreeNode, i int) error {
+	if i == 0 {
+		i = 1
+	}
+
+	left, err := t.node(n.children[i-1])
+	if err != nil {
+		return err
+	}
+
+	right, err := t.node(n.children[i])
+	if err != nil {
+		return err
+	}
+
+	if left.leaf {
+		if left.size()+right.size()-btreeLeafHeaderSize > BTreePageSize {
+			return nil
+		}
+
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+		left.next = right.next
+
+		if right.next != 0 {
+			next, err := t.node(right.next)
+			if err != nil {
+				return err
+			}
+
+			next.prev = left.id
+			t.markDirty(next)
+		}
+	} else {
+		if left.size()+right.size()-btreeInternalHeaderSize+2+len(n.keys[i-1]) > BTreePageSize {
+			return nil
+		}
+
+		left.keys = append(append(left.keys, n.keys[i-1]), right.keys...)
+		left.children = append(left.children, right.children...)
+		left.counts = append(left.counts, right.counts...)
+	}
+	t.markDirty(left)
+
+	n.counts[i-1] += n.counts[i]
+	n.keys = removeBytes(n.keys, i-1)
+	n.children = removeUint32(n.children, i)
+	n.counts = removeUint64(n.counts, i)
+	t.markDirty(n)
+	t.freePage(right.id)
+
+	return nil
+}
+
+// Rank returns the number of entries with a key lower than key
+func (t *BTree) Rank(key []byte) (int, error) {
+	n, err := t.node(t.root)
+	if err != nil {
+		return 0, err
+	}
+
+	rank := uint64(0)
+	for !n.leaf {
+		i := n.childIndex(key)
+		for _, count := range n.counts[:i] {
+			rank += count
+		}
+
+		if n, err = t.node(n.children[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	i, _ := n.search(key)
+
+	return int(rank) + i, nil
+}
+
+// BTreeCursor walks the entries in key order. It stays valid only as
+// long as the tree is not changed.
+type BTreeCursor struct {
+	t    *BTree
+	leaf *btreeNode
+	pos  int
+}
+
+// Seek returns a cursor at the first entry with a key not lower than key
+func (t *BTree) Seek(key []byte) (*BTreeCursor, error) {
+	t.trimCache()
+
+	n, err := t.node(t.root)
+	if err != nil {
+		return nil, err
+	}
+
+	for !n.leaf {
+		if n, err = t.node(n.children[n.childIndex(key)]); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &BTreeCursor{
+		t:    t,
+		leaf: n,
+	}
+	c.pos, _ = n.search(key)
+
+	return c, c.skipForward()
+}
+
+// SeekIndex returns a cursor at the entry with the given rank, the cursor
+// is not valid if there is no such entry
+func (t *BTree) SeekIndex(index int) (*BTreeCursor, error) {
+	t.trimCache()
+
+	c := &BTreeCursor{
+		t: t,
+	}
+	if index < 0 || index >= int(t.length) {
+		return c, nil
+	}
+
+	n, err := t.node(t.root)
+	if err != nil {
+		return nil, err
+	}
+
+	rest := uint64(index)
+	for !n.leaf {
+		i := 0
+		for i < len(n.counts)-1 && rest >= n.counts[i] {
+			rest -= n.counts[i]
+			i++
+		}
+
+		if n, err = t.node(n.children[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if int(rest) >= len(n.keys) {
+		return nil, ErrBTreeCorrupted
+	}
+
+	c.leaf, c.pos = n, int(rest)
+
+	return c, nil
+}
+
+// skipForward moves past the end of leaves, to the next non empty one
+func (c *BTreeCursor) skipForward() error {
+	for c.leaf != nil && c.pos >= len(c.leaf.keys) {
+		if c.leaf.next == 0 {
+			c.leaf = nil
+			return nil
+		}
+
+		next, err := c.t.node(c.leaf.next)
+		if err != nil {
+			return err
+		}
+
+		c.leaf, c.pos = next, 0
+	}
+
+	return nil
+}
+
+// Valid returns whether the cursor is on an entry
+func (c *BTreeCursor) Valid() bool {
+	return c.leaf != nil
+}
+
+func (c *BTreeCursor) Key() []byte {
+	return c.leaf.keys[c.pos]
+}
+
+func (c *BTreeCursor) Value() []byte {
+	return c.leaf.values[c.pos]
+}
+
+// Next moves to the following entry
+func (c *BTreeCursor) Next() error {
+	c.pos++
+
+	return c.skipForward()
+}
+
+// Prev moves to the previous entry
+func (c *BTreeCursor) Prev() error {
+	c.pos--
+
+	for c.leaf != nil && c.pos < 0 {
+		if c.leaf.prev == 0 {
+			c.leaf = nil
+			return nil
+		}
+
+		prev, err := c.t.node(c.leaf.prev)
+		if err != nil {
+			return err
+		}
+
+		c.leaf, c.pos = prev, len(prev.keys)-1
+	}
+
+	return nil
+}
+
+func insertBytes(s [][]byte, i int, v []byte) [][]byte {
+	s = append(s, nil)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+
+	return s
+}
+
+func insertUint32(s []uint32, i int, v uint32) []uint32 {
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+
+	return s
+}
+
+func insertUint64(s []uint64, i int, v uint64) []uint64 {
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+
+	return s
+}
+
+func removeBytes(s [][]byte, i int) [][]byte {
+	copy(s[i:], s[i+1:])
+
+	return s[:len(s)-1]
+}
+
+func removeUint32(s []uint32, i int) []uint32 {
+	copy(s[i:], s[i+1:])
+
+	return s[:len(s)-1]
+}
+
+func removeUint64(s []uint64, i int) []uint64 {
+	copy(s[i:], s[i+1:])
+
+	return s[:len(s)-1]
 }
@@ -0,0 +1,249 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func btreeTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+func btreeTestValue(i int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, 100+i%50)
+}
+
+// checkBTree checks that the tree holds exactly the entries of the keys
+// set in present, in order and with the right ranks
+func checkBTree(t *testing.T, tree *BTree, present []bool) {
+	t.Helper()
+
+	want := []int{}
+	for i, ok := range present {
+		if ok {
+			want = append(want, i)
+		}
+	}
+
+	if tree.Len() != len(want) {
+		t.Fatalf("Len is %d, want %d", tree.Len(), len(want))
+	}
+
+	for i, ok := range present {
+		value, found, err := tree.Get(btreeTestKey(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if found != ok {
+			t.Fatalf("key %d found: %v, want %v", i, found, ok)
+		}
+
+		if ok && !bytes.Equal(value, btreeTestValue(i)) {
+			t.Fatalf("key %d has a wrong value", i)
+		}
+	}
+
+	for rank := 0; rank < len(want); rank += 97 {
+		i := want[rank]
+
+		got, err := tree.Rank(btreeTestKey(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != rank {
+			t.Fatalf("rank of key %d is %d, want %d", i, got, rank)
+		}
+
+		c, err := tree.SeekIndex(rank)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !c.Valid() || !bytes.Equal(c.Key(), btreeTestKey(i)) {
+			t.Fatalf("entry at rank %d is not key %d", rank, i)
+		}
+	}
+
+	c, err := tree.Seek(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, i := range want {
+		if !c.Valid() || !bytes.Equal(c.Key(), btreeTestKey(i)) {
+			t.Fatalf("cursor is not on key %d", i)
+		}
+
+		if err := c.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c.Valid() {
+		t.Fatalf("cursor past the last key on %q", c.Key())
+	}
+}
+
+func reopenBTree(t *testing.T, tree *BTree, path string) *BTree {
+	t.Helper()
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := OpenBTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+func TestBTreeReopen(t *testing.T) {
+	const n = 20000
+
+	path := filepath.Join(t.TempDir(), "tree")
+	tree, err := OpenBTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		tree.Close()
+	}()
+
+	rnd := rand.New(rand.NewSource(1))
+	present := make([]bool, n)
+
+	for _, i := range rnd.Perm(n) {
+		added, err := tree.Put(btreeTestKey(i), btreeTestValue(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !added {
+			t.Fatalf("key %d already there", i)
+		}
+		present[i] = true
+	}
+
+	if err := tree.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree = reopenBTree(t, tree, path)
+	checkBTree(t, tree, present)
+
+	// delete most of the keys, merging the nodes left almost empty
+	for _, i := range rnd.Perm(n) {
+		if i%5 == 0 {
+			continue
+		}
+
+		deleted, err := tree.Delete(btreeTestKey(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !deleted {
+			t.Fatalf("key %d not deleted", i)
+		}
+		present[i] = false
+	}
+
+	if deleted, err := tree.Delete(btreeTestKey(n)); err != nil || deleted {
+		t.Fatalf("missing key deleted: %v, %v", deleted, err)
+	}
+
+	if err := tree.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree = reopenBTree(t, tree, path)
+	checkBTree(t, tree, present)
+
+	// the freed pages are reused by the next inserts
+	for i := 1; i < n; i += 5 {
+		if _, err := tree.Put(btreeTestKey(i), btreeTestValue(i)); err != nil {
+			t.Fatal(err)
+		}
+		present[i] = true
+	}
+
+	if err := tree.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree = reopenBTree(t, tree, path)
+	checkBTree(t, tree, present)
+}
+
+func TestBTreeUncommittedChangesAreLost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tree")
+	tree, err := OpenBTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		tree.Close()
+	}()
+
+	present := make([]bool, 1000)
+	for i := 0; i < 500; i++ {
+		if _, err := tree.Put(btreeTestKey(i), btreeTestValue(i)); err != nil {
+			t.Fatal(err)
+		}
+		present[i] = true
+	}
+
+	if err := tree.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if i < 500 {
+			_, err = tree.Delete(btreeTestKey(i))
+		} else {
+			_, err = tree.Put(btreeTestKey(i), btreeTestValue(i))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree = reopenBTree(t, tree, path)
+	checkBTree(t, tree, present)
+}
+
+func TestBTreeEntryTooBig(t *testing.T) {
+	tree, err := OpenBTree(filepath.Join(t.TempDir(), "tree"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if _, err := tree.Put([]byte("key"), make([]byte, BTreeMaxEntrySize)); err != ErrBTreeEntryTooBig {
+		t.Fatalf("got %v, want ErrBTreeEntryTooBig", err)
+	}
+}
@@ -36,6 +36,7 @@ type Cache struct {
 	MaxDBNum     int          // the max number of the DBs to consider
 	Root         string       // the parent folder of all the dbNum dirs
 	Data         atomic.Value // [dbNum][first][second][third]bool, this is the field that represents the source of truth for the cache
+	sizes        []int64      // the number of keys of every DB, accessed atomically
 	vacuumTicker *time.Ticker
 }
 
@@ -63,21 +64,66 @@ func (c *Cache) Add(key Key) {
 	c.Set(key, true)
 }
 
+// ClearDB forgets every key of a DB, the caller must hold c.FSRWL.Lock
+func (c *Cache) ClearDB(dbNum int) {
+	c.DataLock.Lock()
+	defer c.DataLock.Unlock()
+
+	data := c.Data.Load().([][][][]bool)
+
+	data[dbNum] = newDBData()
+
+	c.Data.Store(data)
+
+	atomic.StoreInt64(&c.sizes[dbNum], 0)
+}
+
+// SwapDB swaps the keys of two DBs, the caller must hold c.FSRWL.Lock
+func (c *Cache) SwapDB(a, b int) {
+	c.DataLock.Lock()
+	defer c.DataLock.Unlock()
+
+	data := c.Data.Load().([][][][]bool)
+
+	data[a], data[b] = data[b], data[a]
+
+	c.Data.Store(data)
+
+	sizeA, sizeB := atomic.LoadInt64(&c.sizes[a]), atomic.LoadInt64(&c.sizes[b])
+	atomic.StoreInt64(&c.sizes[a], sizeB)
+	atomic.StoreInt64(&c.sizes[b], sizeA)
+}
+
+// DBSize returns the number of keys of a DB
+func (c *Cache) DBSize(dbNum int) int64 {
+	return atomic.LoadInt64(&c.sizes[dbNum])
+}
+
+// Resize adds delta to the number of keys of a DB, to be called
+// whenever a key is created or deleted
+func (c *Cache) Resize(dbNum int, delta int64) {
+	atomic.AddInt64(&c.sizes[dbNum], delta)
+}
+
+func newDBData() [][][]bool {
+	data := make([][][]bool, 256)
+	for i := 0; i < 256; i++ {
+		data[i] = make([][]bool, 256)
+		for j := 0; j < 256; j++ {
+			data[i][j] = make([]bool, 256)
+		}
+	}
+
+	return data
+}
+
 // BuildCacheData builds a new Cache index from the filesystem
 func (c *Cache) BuildCacheData() {
 	data := make([][][][]bool, c.MaxDBNum)
 	for dbNum := 0; dbNum < c.MaxDBNum; dbNum++ {
-		data[dbNum] = make([][][]bool, 256)
-		for i := 0; i < 256; i++ {
-			data[dbNum][i] = make([][]bool, 256)
-			for j := 0; j < 256; j++ {
-				data[dbNum][i][j] = make([]bool, 256)
-				for k := 0; k < 256; k++ {
-					data[dbNum][i][j][k] = false
-				}
-			}
-		}
+		data[dbNum] = newDBData()
 	}
+	sizes := make([]int64, c.MaxDBNum)
 
 	c.FSRWL.Lock() // Lock instead of RLock to prevent inconsistent inserts
 	defer c.FSRWL.Unlock()
@@ -94,16 +140,19 @@ func (c *Cache) BuildCacheData() {
 				return err
 			}
 
-			if d.IsDir() {
-				return nil
-			}
-
 			hashedKey, err := hex.DecodeString(d.Name())
-			if err != nil {
-				return err
+			if err != nil || len(hashedKey) != len(Key{}.HashedKey) {
+				// a level dir or not a key at all, e.g. a leftover temporary file
+				return nil
 			}
 
 			data[dbNum][hashedKey[0]][hashedKey[1]][hashedKey[2]] = true
+			sizes[dbNum]++
+
+			if d.IsDir() {
+				// keys of the non-string types are dirs, don't look inside
+				return filepath.SkipDir
+			}
 
 			return nil
 		}); err != nil {
@@ -114,6 +163,13 @@ func (c *Cache) BuildCacheData() {
 	}
 
 	c.Data.Store(data)
+
+	if c.sizes == nil {
+		c.sizes = make([]int64, c.MaxDBNum)
+	}
+	for dbNum := range sizes {
+		atomic.StoreInt64(&c.sizes[dbNum], sizes[dbNum])
+	}
 }
 
 // Vacuum keeps the structure in sync with the filesystem representation.
@@ -0,0 +1,285 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+)
+
+/*
+	CountMinSketch is a Count-Min Sketch whose counters live in a file and
+	are updated in place. The file starts with a header (magic, width,
+	depth and the total of the increments) followed by depth rows of width
+	32 bits counters. Like RedisBloom, the counter of an item in row i is
+	the MurmurHash2 of the item seeded with i, modulo the width.
+*/
+
+const (
+	cmsMagic      = "GBDBCMS\x00"
+	cmsHeaderSize = 8 + 4 + 4 + 8
+	cmsCountAt    = cmsHeaderSize - 8
+)
+
+var (
+	ErrCMSOverflow  = errors.New("count-min sketch counter overflow")
+	ErrCMSCorrupted = errors.New("count-min sketch file is corrupted")
+)
+
+type CountMinSketch struct {
+	file  *os.File
+	Width uint32
+	Depth uint32
+	Count uint64
+}
+
+// murmurHash2 is the 32 bits hash function used by RedisBloom for the
+// Count-Min Sketch and Top-K
+func murmurHash2(key []byte, seed uint32) uint32 {
+	const m = 0x5bd1e995
+	const r = 24
+
+	h := seed ^ uint32(len(key))
+
+	for ; len(key) >= 4; key = key[4:] {
+		k := binary.LittleEndian.Uint32(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h *= m
+		h ^= k
+	}
+
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint32(key[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return h
+}
+
+// CMSDimensions returns the width and depth of a sketch overestimating
+// counts by at most errorRate times the total count with the given
+// probability, the way CMS.INITBYPROB computes them
+func CMSDimensions(errorRate, probability float64) (uint32, uint32) {
+	return uint32(math.Ceil(2 / errorRate)), uint32(math.Ceil(math.Log10(probability) / math.Log10(0.5)))
+}
+
+// CreateCountMinSketch creates a sketch with all the counters to zero
+func CreateCountMinSketch(path string, width, depth uint32) (*CountMinSketch, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, cmsHeaderSize)
+	copy(header, cmsMagic)
+	binary.BigEndian.PutUint32(header[8:], width)
+	binary.BigEndian.PutUint32(header[12:], depth)
+
+	if _, err := file.WriteAt(header, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// the counters start as a hole in the file
+	if err := file.Truncate(cmsHeaderSize + 4*int64(width)*int64(depth)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &CountMinSketch{
+		file:  file,
+		Width: width,
+		Depth: depth,
+	}, nil
+}
+
+// OpenCountMinSketch opens a sketch created by CreateCountMinSketch
+func OpenCountMinSketch(path string) (*CountMinSketch, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, cmsHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != cmsMagic {
+		file.Close()
+		return nil, ErrCMSCorrupted
+	}
+
+	return &CountMinSketch{
+		file:  file,
+		Width: binary.BigEndian.Uint32(header[8:]),
+		Depth: binary.BigEndian.Uint32(header[12:]),
+		Count: binary.BigEndian.Uint64(header[cmsCountAt:]),
+	}, nil
+}
+
+func (c *CountMinSketch) Close() error {
+	return c.file.Close()
+}
+
+// counterOffset returns the offset in the file of the counter of item in row
+func (c *CountMinSketch) counterOffset(item []byte, row uint32) int64 {
+	column := murmurHash2(item, row) % c.Width
+
+	return cmsHeaderSize + 4*(int64(row)*int64(c.Width)+int64(column))
+}
+
+// counters returns the counter of item in every row
+func (c *CountMinSketch) counters(item []byte) ([]uint32, error) {
+	counters := make([]uint32, c.Depth)
+	buf := make([]byte, 4)
+
+	for row := range counters {
+		if _, err := c.file.ReadAt(buf, c.counterOffset(item, uint32(row))); err != nil {
+			return nil, err
+		}
+
+		counters[row] = binary.BigEndian.Uint32(buf)
+	}
+
+	return counters, nil
+}
+
+func minCounter(counters []uint32) uint32 {
+	min := uint32(math.MaxUint32)
+	for _, counter := range counters {
+		if counter < min {
+			min = counter
+		}
+	}
+
+	return min
+}
+
+// Query returns the estimated count of item
+func (c *CountMinSketch) Query(item []byte) (uint32, error) {
+	counters, err := c.counters(item)
+	if err != nil {
+		return 0, err
+	}
+
+	return minCounter(counters), nil
+}
+
+func (c *CountMinSketch) saveCount() error {
+	count := make([]byte, 8)
+	binary.BigEndian.PutUint64(count, c.Count)
+	_, err := c.file.WriteAt(count, cmsCountAt)
+
+	return err
+}
+
+// IncrBy increments the count of item, returning its new estimated count.
+// Nothing is changed if a counter would overflow.
+func (c *CountMinSketch) IncrBy(item []byte, increment uint32) (uint32, error) {
+	counters, err := c.counters(item)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, counter := range counters {
+		if counter > math.MaxUint32-increment {
+			return 0, ErrCMSOverflow
+		}
+	}
+	if c.Count > math.MaxUint64-uint64(increment) {
+		return 0, ErrCMSOverflow
+	}
+
+	buf := make([]byte, 4)
+	for row := range counters {
+		counters[row] += increment
+
+		binary.BigEndian.PutUint32(buf, counters[row])
+		if _, err := c.file.WriteAt(buf, c.counterOffset(item, uint32(row))); err != nil {
+			return 0, err
+		}
+	}
+
+	c.Count += uint64(increment)
+
+	return minCounter(counters), c.saveCount()
+}
+
+// Merge overwrites the counters with the weighted sum of the counters of
+// sources, which must have the same dimensions. Nothing is written if a
+// counter would overflow or underflow with negative weights.
+func (c *CountMinSketch) Merge(sources []*CountMinSketch, weights []int64) error {
+	rowSize := 4 * int64(c.Width)
+	rows := make([][]uint32, c.Depth)
+	buf := make([]byte, rowSize)
+
+	count := int64(0)
+	for i, source := range sources {
+		count += int64(source.Count) * weights[i]
+	}
+	if count < 0 {
+		return ErrCMSOverflow
+	}
+
+	// computing every row before writing them keeps the sketch untouched
+	// on overflow, merging into one of the sources included
+	for row := range rows {
+		sums := make([]int64, c.Width)
+
+		for i, source := range sources {
+			if _, err := source.file.ReadAt(buf, cmsHeaderSize+int64(row)*rowSize); err != nil {
+				return err
+			}
+
+			for column := range sums {
+				sums[column] += int64(binary.BigEndian.Uint32(buf[4*column:])) * weights[i]
+			}
+		}
+
+		rows[row] = make([]uint32, c.Width)
+		for column, sum := range sums {
+			if sum < 0 || sum > math.MaxUint32 {
+				return ErrCMSOverflow
+			}
+
+			rows[row][column] = uint32(sum)
+		}
+	}
+
+	for row := range rows {
+		for column, counter := range rows[row] {
+			binary.BigEndian.PutUint32(buf[4*column:], counter)
+		}
+
+		if _, err := c.file.WriteAt(buf, cmsHeaderSize+int64(row)*rowSize); err != nil {
+			return err
+		}
+	}
+
+	c.Count = uint64(count)
+
+	return c.saveCount()
+}
@@ -0,0 +1,250 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMurmurHash2(t *testing.T) {
+	// the values of the reference implementation
+	for _, c := range []struct {
+		key  string
+		seed uint32
+		hash uint32
+	}{
+		{"", 0, 0},
+		{"a", 0x9747b28c, 0xa2d0b27c},
+		{"abc", 0, 0x13577c9b},
+		{"hello world", topKFingerprintSeed, 0xfba01f39},
+		{"The quick brown fox jumps over the lazy dog", 0x9747b28c, 0x1d84d036},
+	} {
+		if hash := murmurHash2([]byte(c.key), c.seed); hash != c.hash {
+			t.Fatalf("the hash of %q seeded with %d is %08x, want %08x", c.key, c.seed, hash, c.hash)
+		}
+	}
+}
+
+func TestCMSDimensions(t *testing.T) {
+	// CMS.INITBYPROB key 0.001 0.01 of RedisBloom
+	if width, depth := CMSDimensions(0.001, 0.01); width != 2000 || depth != 7 {
+		t.Fatalf("the dimensions are %d x %d, want 2000 x 7", width, depth)
+	}
+	if width, depth := CMSDimensions(0.5, 0.5); width != 4 || depth != 1 {
+		t.Fatalf("the dimensions are %d x %d, want 4 x 1", width, depth)
+	}
+}
+
+func cmsTestCreate(t *testing.T, width, depth uint32) (*CountMinSketch, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "sketch")
+	c, err := CreateCountMinSketch(path, width, depth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, path
+}
+
+func TestCountMinSketchLayout(t *testing.T) {
+	c, path := cmsTestCreate(t, 100, 5)
+
+	if count, err := c.IncrBy([]byte("a"), 3); err != nil || count != 3 {
+		t.Fatalf("INCRBY a 3 returned %d: %v", count, err)
+	}
+	if count, err := c.IncrBy([]byte("a"), 2); err != nil || count != 5 {
+		t.Fatalf("INCRBY a 2 returned %d: %v", count, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a counter per row, at the column of the hash seeded with the row
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != cmsHeaderSize+4*100*5 {
+		t.Fatalf("the file is %d bytes, want %d", len(data), cmsHeaderSize+4*100*5)
+	}
+	if string(data[:8]) != cmsMagic || binary.BigEndian.Uint64(data[cmsCountAt:]) != 5 {
+		t.Fatalf("the header is %q", data[:cmsHeaderSize])
+	}
+	nonZero := 0
+	for offset := cmsHeaderSize; offset < len(data); offset += 4 {
+		if binary.BigEndian.Uint32(data[offset:]) != 0 {
+			nonZero++
+		}
+	}
+	if nonZero != 5 {
+		t.Fatalf("%d counters are set, want 5", nonZero)
+	}
+	for row := 0; row < 5; row++ {
+		column := murmurHash2([]byte("a"), uint32(row)) % 100
+		if counter := binary.BigEndian.Uint32(data[cmsHeaderSize+4*(row*100+int(column)):]); counter != 5 {
+			t.Fatalf("the counter of row %d is %d, want 5", row, counter)
+		}
+	}
+
+	c, err = OpenCountMinSketch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.Width != 100 || c.Depth != 5 || c.Count != 5 {
+		t.Fatalf("reopened %d x %d counting %d", c.Width, c.Depth, c.Count)
+	}
+	if count, err := c.Query([]byte("a")); err != nil || count != 5 {
+		t.Fatalf("a counts %d: %v", count, err)
+	}
+	if count, err := c.Query([]byte("b")); err != nil || count != 0 {
+		t.Fatalf("b counts %d: %v", count, err)
+	}
+
+	if err := os.WriteFile(path, []byte("GBDBTOPK and a header"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCountMinSketch(path); err != ErrCMSCorrupted {
+		t.Fatalf("opening another magic returned %v", err)
+	}
+}
+
+func TestCountMinSketchOverestimates(t *testing.T) {
+	// a narrow sketch has collisions, the counts are never underestimated
+	c, _ := cmsTestCreate(t, 20, 4)
+	defer c.Close()
+
+	counts := map[string]uint32{}
+	for i := 0; i < 1000; i++ {
+		item := fmt.Sprintf("item:%d", i%50)
+		counts[item] += uint32(i%7) + 1
+
+		if _, err := c.IncrBy([]byte(item), uint32(i%7)+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	total := uint64(0)
+	overestimated := 0
+	for item, want := range counts {
+		count, err := c.Query([]byte(item))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count < want {
+			t.Fatalf("%s counts %d, want at least %d", item, count, want)
+		}
+		if count > want {
+			overestimated++
+		}
+
+		total += uint64(want)
+	}
+	if c.Count != total {
+		t.Fatalf("the total is %d, want %d", c.Count, total)
+	}
+	if overestimated == 0 {
+		t.Fatal("no item is overestimated in a sketch 20 counters wide")
+	}
+}
+
+func TestCountMinSketchOverflow(t *testing.T) {
+	c, _ := cmsTestCreate(t, 10, 2)
+	defer c.Close()
+
+	if _, err := c.IncrBy([]byte("a"), math.MaxUint32); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing changes on overflow
+	if _, err := c.IncrBy([]byte("a"), 1); err != ErrCMSOverflow {
+		t.Fatalf("overflowing returned %v", err)
+	}
+	if count, err := c.Query([]byte("a")); err != nil || count != math.MaxUint32 {
+		t.Fatalf("a counts %d after an overflow: %v", count, err)
+	}
+	if c.Count != math.MaxUint32 {
+		t.Fatalf("the total is %d after an overflow", c.Count)
+	}
+}
+
+func TestCountMinSketchMerge(t *testing.T) {
+	a, _ := cmsTestCreate(t, 50, 3)
+	defer a.Close()
+	b, _ := cmsTestCreate(t, 50, 3)
+	defer b.Close()
+	dst, dstPath := cmsTestCreate(t, 50, 3)
+	defer dst.Close()
+
+	for item, n := range map[string]uint32{"x": 10, "y": 20} {
+		if _, err := a.IncrBy([]byte(item), n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := b.IncrBy([]byte("x"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	checkCounts := func(c *CountMinSketch, total uint64, counts map[string]uint32) {
+		t.Helper()
+
+		if c.Count != total {
+			t.Fatalf("the total is %d, want %d", c.Count, total)
+		}
+		for item, want := range counts {
+			if count, err := c.Query([]byte(item)); err != nil || count != want {
+				t.Fatalf("%s counts %d, want %d: %v", item, count, want, err)
+			}
+		}
+	}
+
+	// CMS.MERGE dst 2 a b WEIGHTS 1 3
+	if err := dst.Merge([]*CountMinSketch{a, b}, []int64{1, 3}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(dst, 45, map[string]uint32{"x": 25, "y": 20})
+
+	reopened, err := OpenCountMinSketch(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(reopened, 45, map[string]uint32{"x": 25, "y": 20})
+	reopened.Close()
+
+	// merging into a source, with a negative weight
+	if err := a.Merge([]*CountMinSketch{a, b}, []int64{1, -2}); err != nil {
+		t.Fatal(err)
+	}
+	checkCounts(a, 20, map[string]uint32{"x": 0, "y": 20})
+
+	// an underflow or overflow changes nothing
+	if err := dst.Merge([]*CountMinSketch{b}, []int64{-1}); err != ErrCMSOverflow {
+		t.Fatalf("underflowing returned %v", err)
+	}
+	if err := dst.Merge([]*CountMinSketch{a, b}, []int64{math.MaxInt32, 1}); err != ErrCMSOverflow {
+		t.Fatalf("overflowing returned %v", err)
+	}
+	checkCounts(dst, 45, map[string]uint32{"x": 25, "y": 20})
+}
@@ -0,0 +1,377 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"math"
+)
+
+/*
+	The geohash functions of the Redis server: a point is encoded by
+	interleaving the bits of its latitude (even bits) and of its longitude
+	(odd bits), both scaled to the 2^step cells of the Web Mercator bounds,
+	and stored with step 26 as the 52 bits score of a sorted set member.
+	Searches look at the cell of the center, at a step large enough for the
+	searched area, and at its 8 neighbors, each of them being a range of
+	scores.
+*/
+
+const (
+	GeoStep = 26
+
+	GeoLatMin = -85.05112878
+	GeoLatMax = 85.05112878
+	GeoLonMin = -180.0
+	GeoLonMax = 180.0
+
+	geoEarthRadius = 6372797.560856 // in meters
+	geoMercatorMax = 20037726.37
+	geoAlphabet    = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// GeoHashBits is a geohash with step * 2 significant bits
+type GeoHashBits struct {
+	Bits uint64
+	Step uint
+}
+
+func (h GeoHashBits) isZero() bool {
+	return h.Bits == 0 && h.Step == 0
+}
+
+// GeoHashArea is the cell of a geohash
+type GeoHashArea struct {
+	LonMin, LonMax float64
+	LatMin, LatMax float64
+}
+
+func interleave64(x, y uint32) uint64 {
+	spread := func(v uint64) uint64 {
+		v = (v | v<<16) & 0x0000FFFF0000FFFF
+		v = (v | v<<8) & 0x00FF00FF00FF00FF
+		v = (v | v<<4) & 0x0F0F0F0F0F0F0F0F
+		v = (v | v<<2) & 0x3333333333333333
+		v = (v | v<<1) & 0x5555555555555555
+		return v
+	}
+
+	return spread(uint64(x)) | spread(uint64(y))<<1
+}
+
+func deinterleave64(v uint64) (uint32, uint32) {
+	squash := func(v uint64) uint32 {
+		v &= 0x5555555555555555
+		v = (v | v>>1) & 0x3333333333333333
+		v = (v | v>>2) & 0x0F0F0F0F0F0F0F0F
+		v = (v | v>>4) & 0x00FF00FF00FF00FF
+		v = (v | v>>8) & 0x0000FFFF0000FFFF
+		v = (v | v>>16) & 0x00000000FFFFFFFF
+		return uint32(v)
+	}
+
+	return squash(v), squash(v >> 1)
+}
+
+// GeoValid reports whether a point can be encoded
+func GeoValid(lon, lat float64) bool {
+	return lon >= GeoLonMin && lon <= GeoLonMax && lat >= GeoLatMin && lat <= GeoLatMax
+}
+
+func geoEncodeRange(lon, lat, latMin, latMax float64, step uint) GeoHashBits {
+	latOffset := (lat - latMin) / (latMax - latMin) * float64(uint64(1)<<step)
+	lonOffset := (lon - GeoLonMin) / (GeoLonMax - GeoLonMin) * float64(uint64(1)<<step)
+
+	return GeoHashBits{
+		Bits: interleave64(uint32(latOffset), uint32(lonOffset)),
+		Step: step,
+	}
+}
+
+// GeoEncode returns the geohash of a valid point
+func GeoEncode(lon, lat float64, step uint) GeoHashBits {
+	return geoEncodeRange(lon, lat, GeoLatMin, GeoLatMax, step)
+}
+
+// GeoDecode returns the cell of hash
+func GeoDecode(hash GeoHashBits) GeoHashArea {
+	lat, lon := deinterleave64(hash.Bits)
+	cells := float64(uint64(1) << hash.Step)
+
+	return GeoHashArea{
+		LatMin: GeoLatMin + float64(lat)/cells*(GeoLatMax-GeoLatMin),
+		LatMax: GeoLatMin + (float64(lat)+1)/cells*(GeoLatMax-GeoLatMin),
+		LonMin: GeoLonMin + float64(lon)/cells*(GeoLonMax-GeoLonMin),
+		LonMax: GeoLonMin + (float64(lon)+1)/cells*(GeoLonMax-GeoLonMin),
+	}
+}
+
+// GeoDecodeScore returns the point at the center of the cell of a score
+func GeoDecodeScore(score uint64) (float64, float64) {
+	area := GeoDecode(GeoHashBits{
+		Bits: score,
+		Step: GeoStep,
+	})
+
+	lon := math.Max(GeoLonMin, math.Min(GeoLonMax, (area.LonMin+area.LonMax)/2))
+	lat := math.Max(GeoLatMin, math.Min(GeoLatMax, (area.LatMin+area.LatMax)/2))
+
+	return lon, lat
+}
+
+// GeoHashString returns the standard 11 characters geohash of a point
+func GeoHashString(lon, lat float64) string {
+	// standard geohashes use the whole latitude range
+	hash := geoEncodeRange(lon, lat, -90, 90, GeoStep)
+
+	buf := make([]byte, 11)
+	for i := range buf {
+		idx := uint64(0)
+		if i < 10 {
+			// the last character is past the 52 bits, assumed zero
+			idx = (hash.Bits >> (52 - (uint(i)+1)*5)) & 0x1f
+		}
+		buf[i] = geoAlphabet[idx]
+	}
+
+	return string(buf)
+}
+
+func degToRad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func radToDeg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return geoEarthRadius * math.Abs(degToRad(lat2)-degToRad(lat1))
+}
+
+// GeoDistance returns the distance in meters between two points
+func GeoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lat1r, lon1r := degToRad(lat1), degToRad(lon1)
+	lat2r, lon2r := degToRad(lat2), degToRad(lon2)
+
+	v := math.Sin((lon2r - lon1r) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+
+	return 2 * geoEarthRadius * math.Asin(math.Sqrt(a))
+}
+
+// GeoShape is the area of a search, a circle of Radius meters or a box
+// of Width x Height meters around its center
+type GeoShape struct {
+	Lon, Lat      float64
+	Box           bool
+	Radius        float64
+	Width, Height float64
+}
+
+// Contains reports whether the point is inside the shape, along with its
+// distance in meters from the center
+func (s GeoShape) Contains(lon, lat float64) (float64, bool) {
+	if !s.Box {
+		distance := GeoDistance(s.Lon, s.Lat, lon, lat)
+		return distance, distance <= s.Radius
+	}
+
+	// the latitude distance is cheaper, check it first
+	if geoLatDistance(lat, s.Lat) > s.Height/2 {
+		return 0, false
+	}
+	if GeoDistance(lon, lat, s.Lon, lat) > s.Width/2 {
+		return 0, false
+	}
+
+	return GeoDistance(s.Lon, s.Lat, lon, lat), true
+}
+
+// boundingBox returns the min lon, min lat, max lon and max lat of s
+func (s GeoShape) boundingBox() (float64, float64, float64, float64) {
+	height, width := s.Radius, s.Radius
+	if s.Box {
+		height, width = s.Height/2, s.Width/2
+	}
+
+	latDelta := radToDeg(height / geoEarthRadius)
+	lonDeltaTop := radToDeg(width / geoEarthRadius / math.Cos(degToRad(s.Lat+latDelta)))
+	lonDeltaBottom := radToDeg(width / geoEarthRadius / math.Cos(degToRad(s.Lat-latDelta)))
+
+	// the hemispheres go in opposite directions
+	lonDelta := lonDeltaTop
+	if s.Lat < 0 {
+		lonDelta = lonDeltaBottom
+	}
+
+	return s.Lon - lonDelta, s.Lat - latDelta, s.Lon + lonDelta, s.Lat + latDelta
+}
+
+func geoEstimateSteps(meters, lat float64) uint {
+	if meters == 0 {
+		return GeoStep
+	}
+
+	step := 1
+	for meters < geoMercatorMax {
+		meters *= 2
+		step++
+	}
+	// make sure the range is included in most cases
+	step -= 2
+
+	// wider ranges towards the poles
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+
+	if step < 1 {
+		step = 1
+	}
+	if step > GeoStep {
+		step = GeoStep
+	}
+
+	return uint(step)
+}
+
+func (h GeoHashBits) moveX(d int) GeoHashBits {
+	x := h.Bits & 0xaaaaaaaaaaaaaaaa
+	y := h.Bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - h.Step*2)
+
+	if d > 0 {
+		x += zz + 1
+	} else {
+		x |= zz
+		x -= zz + 1
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - h.Step*2)
+
+	return GeoHashBits{
+		Bits: x | y,
+		Step: h.Step,
+	}
+}
+
+func (h GeoHashBits) moveY(d int) GeoHashBits {
+	x := h.Bits & 0xaaaaaaaaaaaaaaaa
+	y := h.Bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - h.Step*2)
+
+	if d > 0 {
+		y += zz + 1
+	} else {
+		y |= zz
+		y -= zz + 1
+	}
+	y &= 0x5555555555555555 >> (64 - h.Step*2)
+
+	return GeoHashBits{
+		Bits: x | y,
+		Step: h.Step,
+	}
+}
+
+// Areas returns the cells to look into to find the points of the shape:
+// the one of the center and its neighbors, skipping the useless ones
+func (s GeoShape) Areas() []GeoHashBits {
+	minLon, minLat, maxLon, maxLat := s.boundingBox()
+
+	radius := s.Radius
+	if s.Box {
+		radius = math.Sqrt(s.Width/2*s.Width/2 + s.Height/2*s.Height/2)
+	}
+
+	steps := geoEstimateSteps(radius, s.Lat)
+
+	var hash GeoHashBits
+	var north, south, east, west GeoHashBits
+	neighbors := func() {
+		hash = GeoEncode(s.Lon, s.Lat, steps)
+		north, south = hash.moveY(1), hash.moveY(-1)
+		east, west = hash.moveX(1), hash.moveX(-1)
+	}
+	neighbors()
+
+	// near the edges of its cell the step may be too large to cover
+	// everything with the neighbors
+	if steps > 1 && (GeoDecode(north).LatMax < maxLat || GeoDecode(south).LatMin > minLat ||
+		GeoDecode(east).LonMax < maxLon || GeoDecode(west).LonMin > minLon) {
+		steps--
+		neighbors()
+	}
+
+	// center, north, south, east, west, north east, north west, south east, south west
+	areas := []GeoHashBits{
+		hash, north, south, east, west,
+		east.moveY(1), west.moveY(1), east.moveY(-1), west.moveY(-1),
+	}
+
+	// exclude the cells that are useless
+	if steps >= 2 {
+		area := GeoDecode(hash)
+		zero := func(indexes ...int) {
+			for _, i := range indexes {
+				areas[i] = GeoHashBits{}
+			}
+		}
+
+		if area.LatMin < minLat {
+			zero(2, 7, 8)
+		}
+		if area.LatMax > maxLat {
+			zero(1, 5, 6)
+		}
+		if area.LonMin < minLon {
+			zero(4, 6, 8)
+		}
+		if area.LonMax > maxLon {
+			zero(3, 5, 7)
+		}
+	}
+
+	result := []GeoHashBits{}
+	seen := map[GeoHashBits]bool{}
+	for _, area := range areas {
+		if area.isZero() || seen[area] {
+			continue
+		}
+		seen[area] = true
+
+		result = append(result, area)
+	}
+
+	return result
+}
+
+// GeoScoreRange returns the range [min, max) of the scores of the points
+// in the cell of hash
+func GeoScoreRange(hash GeoHashBits) (uint64, uint64) {
+	shift := 52 - hash.Step*2
+
+	return hash.Bits << shift, (hash.Bits + 1) << shift
+}
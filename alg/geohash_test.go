@@ -0,0 +1,222 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// the GEOADD Sicily example of the Redis documentation
+var geoTestPoints = []struct {
+	name     string
+	lon, lat float64
+	score    uint64
+	hash     string
+}{
+	{"Palermo", 13.361389, 38.115556, 3479099956230698, "sqc8b49rny0"},
+	{"Catania", 15.087269, 37.502669, 3479447370796909, "sqdtr74hyu0"},
+}
+
+func TestGeoInterleave(t *testing.T) {
+	for _, v := range [][2]uint32{{0, 0}, {1, 0}, {0, 1}, {0xffffffff, 0}, {0x12345678, 0x9abcdef0}} {
+		bits := interleave64(v[0], v[1])
+		if x, y := deinterleave64(bits); x != v[0] || y != v[1] {
+			t.Fatalf("%x %x interleaved to %x and back to %x %x", v[0], v[1], bits, x, y)
+		}
+	}
+
+	// the latitude bits are the even ones
+	if bits := interleave64(1, 0); bits != 1 {
+		t.Fatalf("latitude bit interleaved to %x", bits)
+	}
+	if bits := interleave64(0, 1); bits != 2 {
+		t.Fatalf("longitude bit interleaved to %x", bits)
+	}
+}
+
+func TestGeoEncode(t *testing.T) {
+	for _, p := range geoTestPoints {
+		hash := GeoEncode(p.lon, p.lat, GeoStep)
+		if hash.Bits != p.score || hash.Step != GeoStep {
+			t.Fatalf("%s encoded to %d step %d, want %d", p.name, hash.Bits, hash.Step, p.score)
+		}
+
+		// the decoded point is the center of a cell containing it
+		area := GeoDecode(hash)
+		if p.lon < area.LonMin || p.lon > area.LonMax || p.lat < area.LatMin || p.lat > area.LatMax {
+			t.Fatalf("%s is not in its cell %+v", p.name, area)
+		}
+
+		lon, lat := GeoDecodeScore(p.score)
+		if math.Abs(lon-p.lon) > 1e-5 || math.Abs(lat-p.lat) > 1e-5 {
+			t.Fatalf("%s decoded to %f,%f", p.name, lon, lat)
+		}
+
+		if s := GeoHashString(lon, lat); s != p.hash {
+			t.Fatalf("%s geohash is %s, want %s", p.name, s, p.hash)
+		}
+
+		// a coarser hash is a prefix of the full one
+		coarse := GeoEncode(p.lon, p.lat, 10)
+		if coarse.Bits != p.score>>32 {
+			t.Fatalf("%s encoded with step 10 to %x, want %x", p.name, coarse.Bits, p.score>>32)
+		}
+
+		min, max := GeoScoreRange(coarse)
+		if p.score < min || p.score >= max {
+			t.Fatalf("%s score %d is not in [%d, %d)", p.name, p.score, min, max)
+		}
+	}
+}
+
+func TestGeoEncodeBounds(t *testing.T) {
+	lon, lat := GeoDecodeScore(GeoEncode(GeoLonMin, GeoLatMin, GeoStep).Bits)
+	if math.Abs(lon-GeoLonMin) > 1e-5 || math.Abs(lat-GeoLatMin) > 1e-5 {
+		t.Fatalf("min corner decoded to %f,%f", lon, lat)
+	}
+
+	// the max corner would be the first cell past the bounds, decoding
+	// clamps it back
+	lon, lat = GeoDecodeScore(uint64(1)<<52 - 1)
+	if lon > GeoLonMax || lat > GeoLatMax || math.Abs(lon-GeoLonMax) > 1e-5 || math.Abs(lat-GeoLatMax) > 1e-5 {
+		t.Fatalf("max corner decoded to %f,%f", lon, lat)
+	}
+}
+
+func TestGeoValid(t *testing.T) {
+	valid := [][2]float64{{0, 0}, {GeoLonMin, GeoLatMin}, {GeoLonMax, GeoLatMax}, {13.361389, 38.115556}}
+	for _, p := range valid {
+		if !GeoValid(p[0], p[1]) {
+			t.Fatalf("%f,%f is not valid", p[0], p[1])
+		}
+	}
+
+	invalid := [][2]float64{{-180.1, 0}, {180.1, 0}, {0, 85.06}, {0, -85.06}, {0, 90}, {math.NaN(), 0}}
+	for _, p := range invalid {
+		if GeoValid(p[0], p[1]) {
+			t.Fatalf("%f,%f is valid", p[0], p[1])
+		}
+	}
+}
+
+func TestGeoDistance(t *testing.T) {
+	palermo, catania := geoTestPoints[0], geoTestPoints[1]
+	lon1, lat1 := GeoDecodeScore(palermo.score)
+	lon2, lat2 := GeoDecodeScore(catania.score)
+
+	// GEODIST Sicily Palermo Catania
+	dist := GeoDistance(lon1, lat1, lon2, lat2)
+	if s := strconv.FormatFloat(dist, 'f', 4, 64); s != "166274.1516" {
+		t.Fatalf("distance is %s, want 166274.1516", s)
+	}
+	if back := GeoDistance(lon2, lat2, lon1, lat1); math.Abs(back-dist) > 1e-6 {
+		t.Fatalf("distance back is %f, want %f", back, dist)
+	}
+
+	if dist := GeoDistance(lon1, lat1, lon1, lat1); dist != 0 {
+		t.Fatalf("distance to itself is %f", dist)
+	}
+
+	// on a meridian only the latitude counts, 1 degree is about 111 km
+	if dist := GeoDistance(10, 40, 10, 41); math.Abs(dist-111226.3) > 1 {
+		t.Fatalf("a degree of latitude is %f m", dist)
+	}
+}
+
+func TestGeoShape(t *testing.T) {
+	palermo, catania := geoTestPoints[0], geoTestPoints[1]
+
+	// GEOSEARCH Sicily FROMLONLAT 15 37 BYRADIUS 200 km
+	circle := GeoShape{Lon: 15, Lat: 37, Radius: 200000}
+	for _, p := range []struct {
+		score uint64
+		dist  string
+	}{{palermo.score, "190.4424"}, {catania.score, "56.4413"}} {
+		lon, lat := GeoDecodeScore(p.score)
+		dist, ok := circle.Contains(lon, lat)
+		if !ok {
+			t.Fatalf("%d is not in the circle", p.score)
+		}
+		if s := strconv.FormatFloat(dist/1000, 'f', 4, 64); s != p.dist {
+			t.Fatalf("%d is %s km away, want %s", p.score, s, p.dist)
+		}
+	}
+
+	if _, ok := (GeoShape{Lon: 15, Lat: 37, Radius: 100000}).Contains(GeoDecodeScore(palermo.score)); ok {
+		t.Fatal("Palermo is within 100 km")
+	}
+
+	// a box reaches farther than the circle in its corners
+	box := GeoShape{Lon: 15, Lat: 37, Box: true, Width: 400000, Height: 400000}
+	if _, ok := box.Contains(16.9, 38.7); !ok {
+		t.Fatal("the corner is not in the box")
+	}
+	if _, ok := circle.Contains(16.9, 38.7); ok {
+		t.Fatal("the corner is in the circle")
+	}
+	if _, ok := box.Contains(15, 38.9); ok {
+		t.Fatal("a point north of the box is in it")
+	}
+}
+
+func TestGeoShapeAreas(t *testing.T) {
+	shapes := []GeoShape{
+		{Lon: 15, Lat: 37, Radius: 200000},
+		{Lon: 15, Lat: 37, Radius: 10},
+		{Lon: 15, Lat: 37, Box: true, Width: 400000, Height: 100000},
+		{Lon: 179.99, Lat: 0, Radius: 5000},
+		{Lon: 0, Lat: 84, Radius: 50000},
+		{Lon: 0, Lat: 0, Radius: 0},
+	}
+
+	for _, shape := range shapes {
+		areas := shape.Areas()
+		if len(areas) == 0 || len(areas) > 9 {
+			t.Fatalf("%+v has %d areas", shape, len(areas))
+		}
+
+		inAreas := func(lon, lat float64) bool {
+			score := GeoEncode(lon, lat, GeoStep).Bits
+			for _, area := range areas {
+				min, max := GeoScoreRange(area)
+				if score >= min && score < max {
+					return true
+				}
+			}
+			return false
+		}
+
+		// every point of the shape is in one of the areas
+		minLon, minLat, maxLon, maxLat := shape.boundingBox()
+		for i := 0; i <= 20; i++ {
+			for j := 0; j <= 20; j++ {
+				lon := minLon + (maxLon-minLon)*float64(i)/20
+				lat := minLat + (maxLat-minLat)*float64(j)/20
+				if !GeoValid(lon, lat) {
+					continue
+				}
+
+				if _, ok := shape.Contains(lon, lat); ok && !inAreas(lon, lat) {
+					t.Fatalf("%f,%f of %+v is in none of the areas", lon, lat, shape)
+				}
+			}
+		}
+	}
+}
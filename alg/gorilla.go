@@ -0,0 +1,389 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"os"
+)
+
+/*
+	GorillaChunk is an append-only file of time series samples compressed
+	like in Facebook's Gorilla paper: the timestamps as the difference
+	between consecutive deltas (delta-of-delta), which is zero most of the
+	times for regular series, and the values as the XOR with the previous
+	one, which has long runs of zero bits for slowly changing series.
+
+	The file starts with a header holding the number of samples, the
+	number of bits written, the first and last timestamps and the state
+	needed to keep encoding (last delta, last value and the zero bits
+	around the last XOR). Appending a sample rewrites in place the last
+	partial byte of the bits and the header.
+*/
+
+const (
+	gorillaMagic      = "GBDBGRLA"
+	gorillaHeaderSize = 8 + 4 + 8 + 8 + 8 + 8 + 8 + 1 + 1
+
+	// leading zeros are encoded in 5 bits
+	gorillaMaxLeading = 31
+	// no previous XOR to reuse the zero bits of
+	gorillaNoZeros = 0xff
+)
+
+var (
+	ErrGorillaOrder     = errors.New("samples must be appended in timestamp order")
+	ErrGorillaCorrupted = errors.New("gorilla chunk file is corrupted")
+)
+
+type Sample struct {
+	Timestamp int64
+	Value     float64
+}
+
+type GorillaChunk struct {
+	file  *os.File
+	Count uint32
+	First int64
+	Last  int64
+
+	bits     uint64
+	delta    int64
+	value    uint64
+	leading  uint8
+	trailing uint8
+}
+
+// CreateGorillaChunk creates an empty chunk
+func CreateGorillaChunk(path string) (*GorillaChunk, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &GorillaChunk{
+		file:     file,
+		leading:  gorillaNoZeros,
+		trailing: gorillaNoZeros,
+	}
+
+	if err := c.saveHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// OpenGorillaChunk opens a chunk created by CreateGorillaChunk
+func OpenGorillaChunk(path string) (*GorillaChunk, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, gorillaHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != gorillaMagic {
+		file.Close()
+		return nil, ErrGorillaCorrupted
+	}
+
+	return &GorillaChunk{
+		file:     file,
+		Count:    binary.BigEndian.Uint32(header[8:]),
+		bits:     binary.BigEndian.Uint64(header[12:]),
+		First:    int64(binary.BigEndian.Uint64(header[20:])),
+		Last:     int64(binary.BigEndian.Uint64(header[28:])),
+		delta:    int64(binary.BigEndian.Uint64(header[36:])),
+		value:    binary.BigEndian.Uint64(header[44:]),
+		leading:  header[52],
+		trailing: header[53],
+	}, nil
+}
+
+func (c *GorillaChunk) Close() error {
+	return c.file.Close()
+}
+
+// Size returns the size of the compressed samples in bytes
+func (c *GorillaChunk) Size() uint64 {
+	return (c.bits + 7) / 8
+}
+
+func (c *GorillaChunk) saveHeader() error {
+	header := make([]byte, gorillaHeaderSize)
+	copy(header, gorillaMagic)
+	binary.BigEndian.PutUint32(header[8:], c.Count)
+	binary.BigEndian.PutUint64(header[12:], c.bits)
+	binary.BigEndian.PutUint64(header[20:], uint64(c.First))
+	binary.BigEndian.PutUint64(header[28:], uint64(c.Last))
+	binary.BigEndian.PutUint64(header[36:], uint64(c.delta))
+	binary.BigEndian.PutUint64(header[44:], c.value)
+	header[52] = c.leading
+	header[53] = c.trailing
+
+	_, err := c.file.WriteAt(header, 0)
+
+	return err
+}
+
+type bitWriter struct {
+	buf []byte
+	pos uint64 // bits written in buf
+}
+
+func (w *bitWriter) write(value uint64, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if w.pos/8 == uint64(len(w.buf)) {
+			w.buf = append(w.buf, 0)
+		}
+
+		if value&(1<<uint(i)) != 0 {
+			w.buf[w.pos/8] |= 0x80 >> (w.pos % 8)
+		}
+		w.pos++
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint64
+	end uint64
+}
+
+func (r *bitReader) read(n uint) (uint64, error) {
+	if r.pos+uint64(n) > r.end {
+		return 0, ErrGorillaCorrupted
+	}
+
+	value := uint64(0)
+	for i := uint(0); i < n; i++ {
+		value <<= 1
+		if r.buf[r.pos/8]&(0x80>>(r.pos%8)) != 0 {
+			value |= 1
+		}
+		r.pos++
+	}
+
+	return value, nil
+}
+
+// the ranges of the delta-of-delta encodings, as control bits and width
+var gorillaDeltaOfDeltas = []struct {
+	control uint64
+	size    uint
+	width   uint
+}{
+	{0x2, 2, 7},
+	{0x6, 3, 9},
+	{0xe, 4, 12},
+	{0xf, 4, 64},
+}
+
+// Append adds a sample newer than the last one
+func (c *GorillaChunk) Append(sample Sample) error {
+	if c.Count > 0 && sample.Timestamp <= c.Last {
+		return ErrGorillaOrder
+	}
+
+	// the writer starts from the last partial byte
+	w := &bitWriter{
+		pos: c.bits % 8,
+	}
+	if w.pos > 0 {
+		w.buf = make([]byte, 1)
+		if _, err := c.file.ReadAt(w.buf, gorillaHeaderSize+int64(c.bits/8)); err != nil {
+			return err
+		}
+	}
+
+	value := math.Float64bits(sample.Value)
+
+	if c.Count == 0 {
+		w.write(uint64(sample.Timestamp), 64)
+		w.write(value, 64)
+
+		c.First = sample.Timestamp
+	} else {
+		delta := sample.Timestamp - c.Last
+		deltaOfDelta := delta - c.delta
+
+		if deltaOfDelta == 0 {
+			w.write(0, 1)
+		} else {
+			for _, encoding := range gorillaDeltaOfDeltas {
+				limit := int64(1) << (encoding.width - 1)
+				if encoding.width == 64 || (deltaOfDelta >= -limit && deltaOfDelta < limit) {
+					w.write(encoding.control, encoding.size)
+					w.write(uint64(deltaOfDelta)&(math.MaxUint64>>(64-encoding.width)), encoding.width)
+					break
+				}
+			}
+		}
+
+		c.delta = delta
+		c.encodeValue(w, value)
+	}
+
+	if _, err := c.file.WriteAt(w.buf, gorillaHeaderSize+int64(c.bits/8)); err != nil {
+		return err
+	}
+
+	c.bits += w.pos - c.bits%8
+	c.Count++
+	c.Last = sample.Timestamp
+	c.value = value
+
+	return c.saveHeader()
+}
+
+func (c *GorillaChunk) encodeValue(w *bitWriter, value uint64) {
+	xor := value ^ c.value
+	if xor == 0 {
+		w.write(0, 1)
+		return
+	}
+
+	w.write(1, 1)
+
+	leading := uint8(bits.LeadingZeros64(xor))
+	trailing := uint8(bits.TrailingZeros64(xor))
+	if leading > gorillaMaxLeading {
+		leading = gorillaMaxLeading
+	}
+
+	// the meaningful bits fit in the window of the previous XOR
+	if c.leading != gorillaNoZeros && leading >= c.leading && trailing >= c.trailing {
+		w.write(0, 1)
+		w.write(xor>>c.trailing, uint(64-c.leading-c.trailing))
+		return
+	}
+
+	meaningful := 64 - leading - trailing
+
+	w.write(1, 1)
+	w.write(uint64(leading), 5)
+	// 64 meaningful bits are written as 0
+	w.write(uint64(meaningful)&0x3f, 6)
+	w.write(xor>>trailing, uint(meaningful))
+
+	c.leading = leading
+	c.trailing = trailing
+}
+
+// Samples decodes all the samples of the chunk
+func (c *GorillaChunk) Samples() ([]Sample, error) {
+	if c.Count == 0 {
+		return nil, nil
+	}
+
+	r := &bitReader{
+		buf: make([]byte, c.Size()),
+		end: c.bits,
+	}
+	if _, err := c.file.ReadAt(r.buf, gorillaHeaderSize); err != nil {
+		return nil, err
+	}
+
+	timestamp, err := r.read(64)
+	if err != nil {
+		return nil, err
+	}
+	value, err := r.read(64)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]Sample, 1, c.Count)
+	samples[0] = Sample{int64(timestamp), math.Float64frombits(value)}
+
+	delta := int64(0)
+	leading, trailing := uint(0), uint(0)
+
+	for uint32(len(samples)) < c.Count {
+		// the number of ones of the control bits picks the encoding
+		ones := 0
+		for ones < len(gorillaDeltaOfDeltas) {
+			bit, err := r.read(1)
+			if err != nil {
+				return nil, err
+			}
+			if bit == 0 {
+				break
+			}
+			ones++
+		}
+
+		if ones > 0 {
+			width := gorillaDeltaOfDeltas[ones-1].width
+
+			raw, err := r.read(width)
+			if err != nil {
+				return nil, err
+			}
+
+			// sign extension
+			delta += int64(raw<<(64-width)) >> (64 - width)
+		}
+
+		timestamp += uint64(delta)
+
+		changed, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if changed == 1 {
+			newWindow, err := r.read(1)
+			if err != nil {
+				return nil, err
+			}
+
+			if newWindow == 1 {
+				l, err := r.read(5)
+				if err != nil {
+					return nil, err
+				}
+				meaningful, err := r.read(6)
+				if err != nil {
+					return nil, err
+				}
+				if meaningful == 0 {
+					meaningful = 64
+				}
+
+				leading = uint(l)
+				trailing = 64 - leading - uint(meaningful)
+			}
+
+			xor, err := r.read(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+
+			value ^= xor << trailing
+		}
+
+		samples = append(samples, Sample{int64(timestamp), math.Float64frombits(value)})
+	}
+
+	return samples, nil
+}
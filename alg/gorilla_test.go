@@ -0,0 +1,189 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkGorillaSamples checks the samples of c bit for bit, NaNs included
+func checkGorillaSamples(t *testing.T, c *GorillaChunk, want []Sample) {
+	t.Helper()
+
+	got, err := c.Samples()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+
+	for i := range got {
+		if got[i].Timestamp != want[i].Timestamp || math.Float64bits(got[i].Value) != math.Float64bits(want[i].Value) {
+			t.Fatalf("sample %d is %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if c.Count != uint32(len(want)) || c.First != want[0].Timestamp || c.Last != want[len(want)-1].Timestamp {
+		t.Fatalf("header has %d samples from %d to %d", c.Count, c.First, c.Last)
+	}
+}
+
+func TestGorillaRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	series := map[string]func(i int) Sample{
+		"regular constant": func(i int) Sample {
+			return Sample{1600000000000 + int64(i)*1000, 42}
+		},
+		"regular slow": func(i int) Sample {
+			return Sample{int64(i) * 10, 20 + math.Sin(float64(i)/100)}
+		},
+		"jittered counter": func(i int) Sample {
+			return Sample{int64(i)*1000 + rnd.Int63n(50), float64(i / 3)}
+		},
+		// delta-of-deltas of every width, down to negative timestamps
+		"irregular": func(i int) Sample {
+			jumps := []int64{1, 60, 255, 4000, 1 << 20, 1 << 40}
+			return Sample{-1<<50 + int64(i)*(1<<41) + jumps[i%len(jumps)], rnd.NormFloat64() * 1e6}
+		},
+		"random bits": func(i int) Sample {
+			return Sample{int64(i), math.Float64frombits(rnd.Uint64())}
+		},
+		"special values": func(i int) Sample {
+			values := []float64{0, math.Copysign(0, -1), math.Inf(1), math.Inf(-1), math.NaN(), math.MaxFloat64, math.SmallestNonzeroFloat64, -1}
+			return Sample{int64(i), values[i%len(values)]}
+		},
+	}
+
+	for name, sample := range series {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "chunk")
+			c, err := CreateGorillaChunk(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				c.Close()
+			}()
+
+			const n = 2000
+			want := make([]Sample, 0, n)
+			for i := 0; i < n; i++ {
+				s := sample(i)
+				if err := c.Append(s); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, s)
+
+				// the encoding state survives reopening
+				if i == n/2 {
+					if err := c.Close(); err != nil {
+						t.Fatal(err)
+					}
+
+					if c, err = OpenGorillaChunk(path); err != nil {
+						t.Fatal(err)
+					}
+
+					checkGorillaSamples(t, c, want)
+				}
+			}
+
+			checkGorillaSamples(t, c, want)
+		})
+	}
+}
+
+func TestGorillaCompression(t *testing.T) {
+	c, err := CreateGorillaChunk(filepath.Join(t.TempDir(), "chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const n = 10000
+	for i := 0; i < n; i++ {
+		if err := c.Append(Sample{int64(i) * 1000, 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 16 bytes for the first sample, 16 bits for the first delta, then
+	// 2 bits per sample
+	if size, max := c.Size(), uint64(16+2+(2*n+7)/8); size > max {
+		t.Fatalf("%d samples of a regular series take %d bytes, want at most %d", n, size, max)
+	}
+}
+
+func TestGorillaOrder(t *testing.T) {
+	c, err := CreateGorillaChunk(filepath.Join(t.TempDir(), "chunk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Append(Sample{100, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, timestamp := range []int64{100, 99} {
+		if err := c.Append(Sample{timestamp, 2}); err != ErrGorillaOrder {
+			t.Fatalf("appending at %d: got %v, want ErrGorillaOrder", timestamp, err)
+		}
+	}
+
+	checkGorillaSamples(t, c, []Sample{{100, 1}})
+}
+
+func TestGorillaCorrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	garbage := filepath.Join(dir, "garbage")
+	if err := os.WriteFile(garbage, []byte("not a chunk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenGorillaChunk(garbage); err != ErrGorillaCorrupted {
+		t.Fatalf("got %v, want ErrGorillaCorrupted", err)
+	}
+
+	// samples lost after the header was written
+	path := filepath.Join(dir, "chunk")
+	c, err := CreateGorillaChunk(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := c.Append(Sample{int64(i), float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.bits -= 8
+	if _, err := c.Samples(); err != ErrGorillaCorrupted {
+		t.Fatalf("got %v, want ErrGorillaCorrupted", err)
+	}
+}
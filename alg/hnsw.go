@@ -0,0 +1,349 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/*
+	HNSW is an in memory Hierarchical Navigable Small World graph, the
+	approximate nearest neighbors index of Malkov and Yashunin: every vector
+	is a node linked to its closest ones on a random number of layers, each
+	layer holding exponentially fewer nodes than the one below, and a search
+	greedily walks from the top layer down to the bottom one.
+	Removed nodes stay in the graph to keep it connected until they
+	outnumber the others, then the graph is built again.
+	An HNSW is not safe for concurrent use, but searches can run concurrently
+	with each other.
+*/
+
+type HNSW struct {
+	m              int
+	efConstruction int
+	distance       func(a, b []float32) float32
+	levelMult      float64
+	rng            *rand.Rand
+
+	nodes   []*hnswNode
+	ids     map[[32]byte]int32
+	entry   int32 // the node on the top layer, -1 if the graph is empty
+	removed int
+}
+
+type hnswNode struct {
+	id      [32]byte
+	vector  []float32
+	links   [][]int32 // the neighbors on each layer, from the bottom one
+	removed bool
+}
+
+type hnswCandidate struct {
+	node     int32
+	distance float32
+}
+
+// NewHNSW creates an empty graph linking every node to m neighbors, twice
+// as many on the bottom layer, chosen among the efConstruction closest ones
+func NewHNSW(metric string, m, efConstruction int) *HNSW {
+	return &HNSW{
+		m:              m,
+		efConstruction: efConstruction,
+		distance:       VectorDistance(metric),
+		levelMult:      1 / math.Log(float64(m)),
+		rng:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		ids:            make(map[[32]byte]int32),
+		entry:          -1,
+	}
+}
+
+// Len returns the number of vectors in the graph
+func (h *HNSW) Len() int {
+	return len(h.ids)
+}
+
+func (h *HNSW) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * h.m
+	}
+
+	return h.m
+}
+
+// Add inserts the vector of id, replacing the previous one
+func (h *HNSW) Add(id [32]byte, vector []float32) {
+	h.Remove(id)
+
+	level := int(-math.Log(1-h.rng.Float64()) * h.levelMult)
+	n := int32(len(h.nodes))
+	node := &hnswNode{
+		id:     id,
+		vector: vector,
+		links:  make([][]int32, level+1),
+	}
+	h.nodes = append(h.nodes, node)
+	h.ids[id] = n
+
+	if h.entry < 0 {
+		h.entry = n
+		return
+	}
+
+	top := len(h.nodes[h.entry].links) - 1
+	entries := []hnswCandidate{{
+		node:     h.entry,
+		distance: h.distance(vector, h.nodes[h.entry].vector),
+	}}
+	for layer := top; layer > level; layer-- {
+		entries = h.searchLayer(vector, entries, 1, layer)
+	}
+
+	for layer := minInt(top, level); layer >= 0; layer-- {
+		candidates := h.searchLayer(vector, entries, h.efConstruction, layer)
+
+		node.links[layer] = h.selectNeighbors(candidates, h.m)
+		for _, neighbor := range node.links[layer] {
+			other := h.nodes[neighbor]
+			other.links[layer] = append(other.links[layer], n)
+
+			if len(other.links[layer]) > h.maxLinks(layer) {
+				h.shrink(other, layer)
+			}
+		}
+
+		entries = candidates
+	}
+
+	if level > top {
+		h.entry = n
+	}
+}
+
+// Remove removes the vector of id, if any
+func (h *HNSW) Remove(id [32]byte) {
+	n, ok := h.ids[id]
+	if !ok {
+		return
+	}
+
+	delete(h.ids, id)
+	h.nodes[n].removed = true
+	h.removed++
+
+	if h.removed > len(h.ids) {
+		h.rebuild()
+	}
+}
+
+// rebuild builds the graph again without the removed nodes
+func (h *HNSW) rebuild() {
+	nodes := h.nodes
+
+	h.nodes = nil
+	h.ids = make(map[[32]byte]int32)
+	h.entry = -1
+	h.removed = 0
+
+	for _, node := range nodes {
+		if !node.removed {
+			h.Add(node.id, node.vector)
+		}
+	}
+}
+
+// Search returns the k nearest vectors found looking at the ef nearest
+// nodes of the bottom layer, closest first
+func (h *HNSW) Search(query []float32, k, ef int) []VectorResult {
+	if h.entry < 0 {
+		return nil
+	}
+
+	entries := []hnswCandidate{{
+		node:     h.entry,
+		distance: h.distance(query, h.nodes[h.entry].vector),
+	}}
+	for layer := len(h.nodes[h.entry].links) - 1; layer > 0; layer-- {
+		entries = h.searchLayer(query, entries, 1, layer)
+	}
+
+	if ef < k {
+		ef = k
+	}
+
+	nearest := NewNearestVectors(k)
+	for _, candidate := range h.searchLayer(query, entries, ef, 0) {
+		if node := h.nodes[candidate.node]; !node.removed {
+			nearest.Add(node.id, candidate.distance)
+		}
+	}
+
+	return nearest.Results()
+}
+
+// searchLayer returns the ef nodes of a layer closest to query found
+// walking from entries, closest first
+func (h *HNSW) searchLayer(query []float32, entries []hnswCandidate, ef, layer int) []hnswCandidate {
+	visited := make(map[int32]bool)
+	candidates := &hnswHeap{}
+	results := &hnswHeap{
+		max: true,
+	}
+
+	for _, entry := range entries {
+		visited[entry.node] = true
+		heap.Push(candidates, entry)
+		heap.Push(results, entry)
+	}
+	for results.Len() > ef {
+		heap.Pop(results)
+	}
+
+	for candidates.Len() > 0 {
+		current := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && current.distance > results.items[0].distance {
+			break
+		}
+
+		for _, neighbor := range h.nodes[current.node].links[layer] {
+			if visited[neighbor] {
+				continue
+			}
+			visited[neighbor] = true
+
+			distance := h.distance(query, h.nodes[neighbor].vector)
+			if results.Len() < ef || distance < results.items[0].distance {
+				candidate := hnswCandidate{
+					node:     neighbor,
+					distance: distance,
+				}
+				heap.Push(candidates, candidate)
+				heap.Push(results, candidate)
+
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	sort.Slice(results.items, func(i, j int) bool {
+		return results.items[i].distance < results.items[j].distance
+	})
+
+	return results.items
+}
+
+// selectNeighbors picks up to m of the candidates sorted by distance,
+// preferring the ones closer to the node than to the already picked
+// ones so that the links spread in every direction
+func (h *HNSW) selectNeighbors(candidates []hnswCandidate, m int) []int32 {
+	selected := []int32{}
+	pruned := []int32{}
+	for _, candidate := range candidates {
+		if len(selected) == m {
+			break
+		}
+
+		vector := h.nodes[candidate.node].vector
+		good := true
+		for _, other := range selected {
+			if h.distance(vector, h.nodes[other].vector) < candidate.distance {
+				good = false
+				break
+			}
+		}
+
+		if good {
+			selected = append(selected, candidate.node)
+		} else {
+			pruned = append(pruned, candidate.node)
+		}
+	}
+
+	for _, node := range pruned {
+		if len(selected) == m {
+			break
+		}
+
+		selected = append(selected, node)
+	}
+
+	return selected
+}
+
+// shrink keeps the best neighbors of a node having too many on a layer
+func (h *HNSW) shrink(node *hnswNode, layer int) {
+	candidates := make([]hnswCandidate, len(node.links[layer]))
+	for i, neighbor := range node.links[layer] {
+		candidates[i] = hnswCandidate{
+			node:     neighbor,
+			distance: h.distance(node.vector, h.nodes[neighbor].vector),
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	node.links[layer] = h.selectNeighbors(candidates, h.maxLinks(layer))
+}
+
+// hnswHeap has the closest candidate on top, or the farthest if max is set
+type hnswHeap struct {
+	items []hnswCandidate
+	max   bool
+}
+
+func (h *hnswHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *hnswHeap) Less(i, j int) bool {
+	if h.max {
+		return h.items[i].distance > h.items[j].distance
+	}
+
+	return h.items[i].distance < h.items[j].distance
+}
+
+func (h *hnswHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *hnswHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(hnswCandidate))
+}
+
+func (h *hnswHeap) Pop() interface{} {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+
+	return x
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,177 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+func vectorTestID(i int) [32]byte {
+	var id [32]byte
+	binary.BigEndian.PutUint32(id[:], uint32(i))
+
+	return id
+}
+
+func randomVectors(rnd *rand.Rand, n, dim int) [][]float32 {
+	vectors := make([][]float32, n)
+	for i := range vectors {
+		vectors[i] = make([]float32, dim)
+		for j := range vectors[i] {
+			vectors[i][j] = float32(rnd.NormFloat64())
+		}
+	}
+
+	return vectors
+}
+
+// flatSearch is the exact k nearest neighbors search of the FLAT indexes
+func flatSearch(metric string, vectors [][]float32, present []bool, query []float32, k int) []VectorResult {
+	distance := VectorDistance(metric)
+	nearest := NewNearestVectors(k)
+	for i, vector := range vectors {
+		if present[i] {
+			nearest.Add(vectorTestID(i), distance(query, vector))
+		}
+	}
+
+	return nearest.Results()
+}
+
+// checkRecall checks that the graph finds most of the exact nearest
+// neighbors of random queries, and none of the removed vectors
+func checkRecall(t *testing.T, h *HNSW, metric string, vectors [][]float32, present []bool, queries [][]float32) {
+	t.Helper()
+
+	const k, ef = 10, 100
+
+	found, total := 0, 0
+	for _, query := range queries {
+		want := map[[32]byte]bool{}
+		for _, result := range flatSearch(metric, vectors, present, query, k) {
+			want[result.ID] = true
+		}
+
+		results := h.Search(query, k, ef)
+		if len(results) != len(want) {
+			t.Fatalf("got %d results, want %d", len(results), len(want))
+		}
+
+		for i, result := range results {
+			if !present[binary.BigEndian.Uint32(result.ID[:])] {
+				t.Fatalf("removed vector %x found", result.ID[:4])
+			}
+
+			if i > 0 && result.Distance < results[i-1].Distance {
+				t.Fatal("results not sorted by distance")
+			}
+
+			if want[result.ID] {
+				found++
+			}
+		}
+		total += len(want)
+	}
+
+	if recall := float64(found) / float64(total); recall < 0.9 {
+		t.Errorf("recall is %.3f, want at least 0.9", recall)
+	}
+}
+
+func TestHNSWRecall(t *testing.T) {
+	const n, dim = 2000, 16
+
+	for _, metric := range []string{VectorL2, VectorIP, VectorCosine} {
+		t.Run(metric, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+			vectors := randomVectors(rnd, n, dim)
+			queries := randomVectors(rnd, 100, dim)
+
+			h := NewHNSW(metric, 16, 200)
+			present := make([]bool, n)
+			for i, vector := range vectors {
+				h.Add(vectorTestID(i), vector)
+				present[i] = true
+			}
+
+			if h.Len() != n {
+				t.Fatalf("Len is %d, want %d", h.Len(), n)
+			}
+
+			checkRecall(t, h, metric, vectors, present, queries)
+		})
+	}
+}
+
+func TestHNSWRemove(t *testing.T) {
+	const n, dim = 2000, 8
+
+	rnd := rand.New(rand.NewSource(2))
+	vectors := randomVectors(rnd, n, dim)
+	queries := randomVectors(rnd, 50, dim)
+
+	h := NewHNSW(VectorL2, 16, 200)
+	present := make([]bool, n)
+	for i, vector := range vectors {
+		h.Add(vectorTestID(i), vector)
+		present[i] = true
+	}
+
+	// removed nodes are skipped while they stay in the graph
+	for i := 0; i < n; i += 3 {
+		h.Remove(vectorTestID(i))
+		present[i] = false
+	}
+	checkRecall(t, h, VectorL2, vectors, present, queries)
+
+	// then the graph is built again without them
+	for i := 1; i < n; i += 3 {
+		h.Remove(vectorTestID(i))
+		present[i] = false
+	}
+	if len(h.nodes) >= n {
+		t.Fatalf("graph not rebuilt, %d nodes for %d vectors", len(h.nodes), h.Len())
+	}
+	checkRecall(t, h, VectorL2, vectors, present, queries)
+
+	// replacing a vector moves it
+	vectors[2] = queries[0]
+	h.Add(vectorTestID(2), vectors[2])
+	if results := h.Search(queries[0], 1, 10); len(results) != 1 || results[0].ID != vectorTestID(2) || results[0].Distance != 0 {
+		t.Fatalf("replaced vector not found: %v", results)
+	}
+
+	if h.Len() != n/3 {
+		t.Fatalf("Len is %d, want %d", h.Len(), n/3)
+	}
+}
+
+func TestHNSWEmpty(t *testing.T) {
+	h := NewHNSW(VectorL2, 16, 200)
+	if results := h.Search([]float32{1, 2}, 10, 10); len(results) != 0 {
+		t.Fatalf("empty graph returned %v", results)
+	}
+
+	h.Add(vectorTestID(1), []float32{1, 2})
+	h.Remove(vectorTestID(1))
+	if results := h.Search([]float32{1, 2}, 10, 10); len(results) != 0 {
+		t.Fatalf("graph emptied by Remove returned %v", results)
+	}
+}
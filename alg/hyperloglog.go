@@ -0,0 +1,377 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+)
+
+/*
+	HyperLogLog implements the Redis HyperLogLog, byte for byte compatible
+	with the values of the Redis server: a 16 bytes header ("HYLL", the
+	encoding, 3 unused bytes and the cached cardinality, little endian,
+	invalid when its most significant bit is set) followed by the 16384
+	registers of 6 bits each, either packed (dense encoding) or run length
+	encoded (sparse encoding) with the opcodes:
+	- ZERO  00xxxxxx: 1-64 registers set to 0
+	- XZERO 01xxxxxx yyyyyyyy: 1-16384 registers set to 0
+	- VAL   1vvvvvxx: 1-4 registers set to 1-32
+	Values are decoded to one byte per register when loaded and encoded
+	again by Bytes, which keeps small counters sparse until they grow.
+*/
+
+const (
+	HLLRegisters = 1 << hllP
+
+	hllP          = 14
+	hllQ          = 64 - hllP
+	hllBits       = 6
+	hllHeaderSize = 16
+	hllDenseSize  = hllHeaderSize + (HLLRegisters*hllBits+7)/8
+	hllSeed       = 0xadc83b19
+
+	hllDense  = 0
+	hllSparse = 1
+
+	// like the default hll-sparse-max-bytes of Redis
+	hllSparseMaxBytes = 3000
+	hllSparseValMax   = 32
+	hllSparseValLen   = 4
+	hllSparseZeroLen  = 64
+	hllSparseXZeroLen = 16384
+
+	hllAlphaInf = 0.721347520444481703680
+)
+
+var (
+	ErrHLLInvalid   = errors.New("WRONGTYPE Key is not a valid HyperLogLog string value.")
+	ErrHLLCorrupted = errors.New("INVALIDOBJ Corrupted HLL object detected")
+)
+
+type HyperLogLog struct {
+	registers [HLLRegisters]uint8
+	dense     bool
+	card      uint64
+	cardValid bool
+}
+
+// NewHyperLogLog returns an empty HyperLogLog, sparse encoded
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{
+		cardValid: true,
+	}
+}
+
+// LoadHyperLogLog decodes a HyperLogLog stored by Bytes or by Redis
+func LoadHyperLogLog(data []byte) (*HyperLogLog, error) {
+	if len(data) < hllHeaderSize || string(data[:4]) != "HYLL" || data[4] > hllSparse {
+		return nil, ErrHLLInvalid
+	}
+
+	h := &HyperLogLog{
+		dense:     data[4] == hllDense,
+		card:      binary.LittleEndian.Uint64(data[8:16]),
+		cardValid: data[15]&0x80 == 0,
+	}
+
+	if h.dense {
+		if len(data) != hllDenseSize {
+			return nil, ErrHLLInvalid
+		}
+
+		for i := range h.registers {
+			h.registers[i] = denseRegister(data[hllHeaderSize:], i)
+		}
+
+		return h, nil
+	}
+
+	i := 0
+	for p := data[hllHeaderSize:]; len(p) > 0; {
+		var runLen int
+		var value uint8
+
+		switch {
+		case p[0]&0xc0 == 0x00: // ZERO
+			runLen = int(p[0]&0x3f) + 1
+			p = p[1:]
+		case p[0]&0xc0 == 0x40: // XZERO
+			if len(p) < 2 {
+				return nil, ErrHLLCorrupted
+			}
+			runLen = (int(p[0]&0x3f)<<8 | int(p[1])) + 1
+			p = p[2:]
+		default: // VAL
+			runLen = int(p[0]&0x03) + 1
+			value = (p[0]>>2)&0x1f + 1
+			p = p[1:]
+		}
+
+		if i+runLen > HLLRegisters {
+			return nil, ErrHLLCorrupted
+		}
+
+		for ; runLen > 0; runLen-- {
+			h.registers[i] = value
+			i++
+		}
+	}
+
+	if i != HLLRegisters {
+		return nil, ErrHLLCorrupted
+	}
+
+	return h, nil
+}
+
+func denseRegister(p []byte, i int) uint8 {
+	bit := i * hllBits
+	b0, fb := bit/8, uint(bit%8)
+
+	value := int(p[b0]) >> fb
+	if b0+1 < len(p) {
+		value |= int(p[b0+1]) << (8 - fb)
+	}
+
+	return uint8(value & 0x3f)
+}
+
+func setDenseRegister(p []byte, i int, value uint8) {
+	bit := i * hllBits
+	b0, fb := bit/8, uint(bit%8)
+
+	p[b0] &^= 0x3f << fb
+	p[b0] |= value << fb
+	if b0+1 < len(p) {
+		p[b0+1] &^= 0x3f >> (8 - fb)
+		p[b0+1] |= value >> (8 - fb)
+	}
+}
+
+// Bytes encodes the HyperLogLog, sparse only while it is small enough
+func (h *HyperLogLog) Bytes() []byte {
+	var data []byte
+	if !h.dense {
+		if data = h.sparse(); data == nil {
+			h.dense = true
+		}
+	}
+
+	if h.dense {
+		data = make([]byte, hllDenseSize)
+		for i, value := range h.registers {
+			setDenseRegister(data[hllHeaderSize:], i, value)
+		}
+	}
+
+	copy(data, "HYLL")
+	if h.dense {
+		data[4] = hllDense
+	} else {
+		data[4] = hllSparse
+	}
+
+	binary.LittleEndian.PutUint64(data[8:16], h.card)
+	if !h.cardValid {
+		data[15] |= 0x80
+	}
+
+	return data
+}
+
+// sparse returns the sparse encoding, nil if it doesn't fit
+func (h *HyperLogLog) sparse() []byte {
+	data := make([]byte, hllHeaderSize, 64)
+
+	for i := 0; i < HLLRegisters; {
+		value := h.registers[i]
+		if value > hllSparseValMax {
+			return nil
+		}
+
+		runLen := 1
+		for i+runLen < HLLRegisters && h.registers[i+runLen] == value {
+			runLen++
+		}
+		i += runLen
+
+		for runLen > 0 {
+			switch {
+			case value != 0:
+				n := runLen
+				if n > hllSparseValLen {
+					n = hllSparseValLen
+				}
+				data = append(data, 0x80|(value-1)<<2|byte(n-1))
+				runLen -= n
+			case runLen > hllSparseZeroLen:
+				n := runLen
+				if n > hllSparseXZeroLen {
+					n = hllSparseXZeroLen
+				}
+				data = append(data, 0x40|byte((n-1)>>8), byte(n-1))
+				runLen -= n
+			default:
+				data = append(data, byte(runLen-1))
+				runLen = 0
+			}
+		}
+
+		if len(data) > hllSparseMaxBytes {
+			return nil
+		}
+	}
+
+	return data
+}
+
+// murmurHash64A is the hash function used by Redis for the HyperLogLog
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(key))*m
+
+	for ; len(key) >= 8; key = key[8:] {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+	}
+
+	if len(key) > 0 {
+		for i := len(key) - 1; i >= 0; i-- {
+			h ^= uint64(key[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+
+	return h
+}
+
+// Add adds element, reporting whether a register changed
+func (h *HyperLogLog) Add(element []byte) bool {
+	hash := murmurHash64A(element, hllSeed)
+	index := hash & (HLLRegisters - 1)
+
+	// the position of the first set bit after the index bits, at most Q+1
+	hash >>= hllP
+	hash |= 1 << hllQ
+	count := uint8(bits.TrailingZeros64(hash) + 1)
+
+	if h.registers[index] >= count {
+		return false
+	}
+
+	h.registers[index] = count
+	h.cardValid = false
+
+	return true
+}
+
+// Merge sets every register to the greatest value between h and other
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, value := range other.registers {
+		if value > h.registers[i] {
+			h.registers[i] = value
+			h.cardValid = false
+		}
+	}
+}
+
+// SetDense makes Bytes use the dense encoding
+func (h *HyperLogLog) SetDense() {
+	h.dense = true
+}
+
+// CachedCount returns the cardinality cached in the value, if valid
+func (h *HyperLogLog) CachedCount() (uint64, bool) {
+	return h.card, h.cardValid
+}
+
+// Count estimates the cardinality and caches it
+func (h *HyperLogLog) Count() uint64 {
+	if h.cardValid {
+		return h.card
+	}
+
+	histogram := [hllQ + 2]int{}
+	for _, value := range h.registers {
+		histogram[value]++
+	}
+
+	m := float64(HLLRegisters)
+	z := m * hllTau((m-float64(histogram[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	h.card = uint64(math.Round(hllAlphaInf * m * m / z))
+	h.cardValid = true
+
+	return h.card
+}
+
+// hllSigma and hllTau are the corrections of the estimator of
+// "New cardinality estimation algorithms for HyperLogLog sketches"
+// (Otmar Ertl, 2017), the one Redis uses
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
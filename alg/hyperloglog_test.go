@@ -0,0 +1,194 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+)
+
+func hllTestElement(i int) []byte {
+	return []byte(fmt.Sprintf("element:%d", i))
+}
+
+func TestHyperLogLogEmpty(t *testing.T) {
+	h := NewHyperLogLog()
+
+	// the value of PFADD key on a Redis server
+	want := []byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff")
+	if got := h.Bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("empty HyperLogLog is %q, want %q", got, want)
+	}
+
+	if count := h.Count(); count != 0 {
+		t.Fatalf("empty HyperLogLog counts %d", count)
+	}
+}
+
+func TestHyperLogLogError(t *testing.T) {
+	h := NewHyperLogLog()
+
+	added := 0
+	for _, n := range []int{1, 10, 100, 1000, 10000, 100000, 1000000} {
+		for ; added < n; added++ {
+			h.Add(hllTestElement(added))
+		}
+
+		// the standard error is 1.04/sqrt(16384), 0.81%
+		count := h.Count()
+		if diff := math.Abs(float64(count) - float64(n)); diff > math.Max(0.03*float64(n), 1) {
+			t.Errorf("counted %d elements out of %d", count, n)
+		}
+
+		// adding them again changes nothing
+		for i := 0; i < n; i += 1 + n/100 {
+			if h.Add(hllTestElement(i)) {
+				t.Fatalf("element %d added twice", i)
+			}
+		}
+
+		if again := h.Count(); again != count {
+			t.Fatalf("count changed from %d to %d", count, again)
+		}
+	}
+}
+
+func TestHyperLogLogSparseToDense(t *testing.T) {
+	h := NewHyperLogLog()
+
+	prev := h.Bytes()
+	for i := 0; ; i++ {
+		h.Add(hllTestElement(i))
+
+		data := h.Bytes()
+		if data[4] == hllDense {
+			if len(prev) > hllHeaderSize+hllSparseMaxBytes {
+				t.Fatalf("sparse value of %d bytes", len(prev))
+			}
+
+			if len(data) != hllDenseSize {
+				t.Fatalf("dense value of %d bytes, want %d", len(data), hllDenseSize)
+			}
+
+			if i < 100 {
+				t.Fatalf("promoted to dense after only %d elements", i+1)
+			}
+
+			break
+		}
+
+		if data[4] != hllSparse {
+			t.Fatalf("unknown encoding %d", data[4])
+		}
+
+		checkHyperLogLogRoundTrip(t, h, data)
+		prev = data
+	}
+
+	checkHyperLogLogRoundTrip(t, h, h.Bytes())
+
+	// dense values stay dense
+	loaded, err := LoadHyperLogLog(h.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data := loaded.Bytes(); data[4] != hllDense {
+		t.Fatal("dense value loaded back as sparse")
+	}
+}
+
+// checkHyperLogLogRoundTrip checks that data, the encoding of h, decodes to
+// the registers and the count of h
+func checkHyperLogLogRoundTrip(t *testing.T, h *HyperLogLog, data []byte) {
+	t.Helper()
+
+	loaded, err := LoadHyperLogLog(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.registers != h.registers {
+		t.Fatal("registers changed by the encoding")
+	}
+
+	if loaded.Count() != h.Count() {
+		t.Fatalf("loaded value counts %d, want %d", loaded.Count(), h.Count())
+	}
+}
+
+func TestHyperLogLogCachedCount(t *testing.T) {
+	h := NewHyperLogLog()
+	h.Add([]byte("a"))
+
+	loaded, err := LoadHyperLogLog(h.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, valid := loaded.CachedCount(); valid {
+		t.Fatal("cached count valid after an Add")
+	}
+
+	count := h.Count()
+	if loaded, err = LoadHyperLogLog(h.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if cached, valid := loaded.CachedCount(); !valid || cached != count {
+		t.Fatalf("cached count is %d, %v, want %d", cached, valid, count)
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, b, both := NewHyperLogLog(), NewHyperLogLog(), NewHyperLogLog()
+	for i := 0; i < 20000; i++ {
+		both.Add(hllTestElement(i))
+		if i < 15000 {
+			a.Add(hllTestElement(i))
+		}
+		if i >= 5000 {
+			b.Add(hllTestElement(i))
+		}
+	}
+
+	a.Merge(b)
+	if a.registers != both.registers {
+		t.Fatal("merge differs from the union")
+	}
+}
+
+func TestHyperLogLogInvalid(t *testing.T) {
+	valid := NewHyperLogLog().Bytes()
+
+	for _, data := range [][]byte{
+		nil,
+		[]byte("HYLL"),
+		append([]byte("HYLX"), valid[4:]...),
+		valid[:hllHeaderSize+1],                  // truncated XZERO
+		append(append([]byte{}, valid...), 0x00), // one register too many
+		append(append([]byte{}, valid[:hllHeaderSize]...), 0x00),
+		append([]byte("HYLL\x00"), make([]byte, 11)...), // dense without registers
+	} {
+		if _, err := LoadHyperLogLog(data); err == nil {
+			t.Errorf("%q loaded", data)
+		}
+	}
+}
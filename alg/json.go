@@ -0,0 +1,594 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+	JSON documents are decoded with encoding/json into plain values: nil,
+	bool, string and json.Number for the scalars, *JSONObject (which keeps
+	the insertion order of its keys, like RedisJSON does) and *JSONArray
+	for the containers, pointers so that they can be updated in place.
+
+	JSONPath is the subset of JSONPath supported by RedisJSON commands:
+	$ for the root, .name and ['name'] for object members, [n] for array
+	elements (negative counting from the end), .* and [*] for every child
+	and ..name for members at any depth. Paths not starting with $ use the
+	legacy RedisJSON syntax, where . is the root and the first dot can be
+	omitted, and select a single value.
+*/
+
+var (
+	ErrJSONInvalid = errors.New("invalid JSON")
+	ErrJSONPath    = errors.New("invalid JSON path")
+)
+
+type JSONObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+type JSONArray struct {
+	Values []interface{}
+}
+
+func NewJSONObject() *JSONObject {
+	return &JSONObject{
+		values: map[string]interface{}{},
+	}
+}
+
+// Keys returns the keys of the object in insertion order
+func (o *JSONObject) Keys() []string {
+	return o.keys
+}
+
+func (o *JSONObject) Get(key string) (interface{}, bool) {
+	value, ok := o.values[key]
+
+	return value, ok
+}
+
+// Set sets the value of key, appending it to the keys if new
+func (o *JSONObject) Set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+
+	o.values[key] = value
+}
+
+func (o *JSONObject) Delete(key string) {
+	if _, ok := o.values[key]; !ok {
+		return
+	}
+
+	delete(o.values, key)
+	for i := range o.keys {
+		if o.keys[i] == key {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// ParseJSON decodes a single JSON value
+func ParseJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	value, err := parseJSONValue(dec)
+	if err != nil {
+		return nil, ErrJSONInvalid
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, ErrJSONInvalid
+	}
+
+	return value, nil
+}
+
+func parseJSONValue(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		o := NewJSONObject()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			value, err := parseJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			o.Set(key.(string), value)
+		}
+
+		_, err := dec.Token()
+
+		return o, err
+	case json.Delim('['):
+		a := &JSONArray{
+			Values: []interface{}{},
+		}
+		for dec.More() {
+			value, err := parseJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			a.Values = append(a.Values, value)
+		}
+
+		_, err := dec.Token()
+
+		return a, err
+	}
+
+	return token, nil
+}
+
+// CloneJSON returns a deep copy of value
+func CloneJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *JSONObject:
+		o := NewJSONObject()
+		for _, key := range v.keys {
+			o.Set(key, CloneJSON(v.values[key]))
+		}
+
+		return o
+	case *JSONArray:
+		a := &JSONArray{
+			Values: make([]interface{}, len(v.Values)),
+		}
+		for i := range v.Values {
+			a.Values[i] = CloneJSON(v.Values[i])
+		}
+
+		return a
+	}
+
+	return value
+}
+
+// JSONTypeName returns the type of value as named by JSON.TYPE
+func JSONTypeName(value interface{}) string {
+	switch v := value.(type) {
+	case *JSONObject:
+		return "object"
+	case *JSONArray:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+
+	return "null"
+}
+
+type JSONFormat struct {
+	Indent  string
+	Newline string
+	Space   string
+}
+
+// MarshalJSON encodes value, compact unless format says otherwise
+func MarshalJSON(value interface{}, format JSONFormat) []byte {
+	var buf bytes.Buffer
+	marshalJSON(&buf, value, format, 0)
+
+	return buf.Bytes()
+}
+
+func marshalJSONString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+
+	// the encoder terminates every value with a newline
+	buf.Truncate(buf.Len() - 1)
+}
+
+func marshalJSONIndent(buf *bytes.Buffer, format JSONFormat, level int) {
+	buf.WriteString(format.Newline)
+	buf.WriteString(strings.Repeat(format.Indent, level))
+}
+
+func marshalJSON(buf *bytes.Buffer, value interface{}, format JSONFormat, level int) {
+	switch v := value.(type) {
+	case *JSONObject:
+		if len(v.keys) == 0 {
+			buf.WriteString("{}")
+			return
+		}
+
+		buf.WriteByte('{')
+		for i, key := range v.keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+
+			marshalJSONIndent(buf, format, level+1)
+			marshalJSONString(buf, key)
+			buf.WriteByte(':')
+			buf.WriteString(format.Space)
+			marshalJSON(buf, v.values[key], format, level+1)
+		}
+		marshalJSONIndent(buf, format, level)
+		buf.WriteByte('}')
+	case *JSONArray:
+		if len(v.Values) == 0 {
+			buf.WriteString("[]")
+			return
+		}
+
+		buf.WriteByte('[')
+		for i, element := range v.Values {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+
+			marshalJSONIndent(buf, format, level+1)
+			marshalJSON(buf, element, format, level+1)
+		}
+		marshalJSONIndent(buf, format, level)
+		buf.WriteByte(']')
+	case string:
+		marshalJSONString(buf, v)
+	case json.Number:
+		buf.WriteString(string(v))
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	default:
+		buf.WriteString("null")
+	}
+}
+
+type jsonSegmentKind int
+
+const (
+	jsonSegmentKey jsonSegmentKind = iota
+	jsonSegmentIndex
+	jsonSegmentWildcard
+)
+
+type jsonSegment struct {
+	kind      jsonSegmentKind
+	key       string
+	index     int
+	recursive bool // matches at any depth
+}
+
+type JSONPath struct {
+	Legacy   bool
+	segments []jsonSegment
+}
+
+// JSONRef is a value found by a path, along with where it is
+type JSONRef struct {
+	Parent interface{} // *JSONObject, *JSONArray or nil for the root
+	Key    string
+	Index  int
+	Value  interface{}
+}
+
+// ParseJSONPath parses a JSONPath or a legacy RedisJSON path
+func ParseJSONPath(path string) (*JSONPath, error) {
+	p := &JSONPath{}
+
+	rest := path
+	if strings.HasPrefix(rest, "$") {
+		rest = rest[1:]
+	} else {
+		p.Legacy = true
+
+		if rest == "." {
+			rest = ""
+		} else if !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "[") {
+			rest = "." + rest
+		}
+	}
+
+	for len(rest) > 0 {
+		recursive := false
+		if strings.HasPrefix(rest, "..") {
+			recursive = true
+			rest = rest[1:]
+
+			if len(rest) > 1 && rest[1] == '[' {
+				rest = rest[1:]
+			}
+		}
+
+		var segment jsonSegment
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+
+			name := rest[1:end]
+			rest = rest[end:]
+
+			switch name {
+			case "":
+				return nil, ErrJSONPath
+			case "*":
+				segment.kind = jsonSegmentWildcard
+			default:
+				segment.key = name
+			}
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, ErrJSONPath
+			}
+
+			inside := rest[1:end]
+			switch {
+			case inside == "*":
+				segment.kind = jsonSegmentWildcard
+			case len(inside) >= 2 && (inside[0] == '\'' || inside[0] == '"'):
+				// a quoted name may contain the closing bracket
+				quote := inside[0]
+				closing := strings.IndexByte(rest[2:], quote) + 2
+				if closing < 2 || closing+1 >= len(rest) || rest[closing+1] != ']' {
+					return nil, ErrJSONPath
+				}
+
+				segment.key = rest[2:closing]
+				end = closing + 1
+			default:
+				index, err := strconv.Atoi(inside)
+				if err != nil {
+					return nil, ErrJSONPath
+				}
+
+				segment.kind = jsonSegmentIndex
+				segment.index = index
+			}
+
+			rest = rest[end+1:]
+		default:
+			return nil, ErrJSONPath
+		}
+
+		segment.recursive = recursive
+		p.segments = append(p.segments, segment)
+	}
+
+	return p, nil
+}
+
+// IsRoot reports whether the path selects the root only
+func (p *JSONPath) IsRoot() bool {
+	return len(p.segments) == 0
+}
+
+// Parent returns the path without its last segment, the root being its
+// own parent
+func (p *JSONPath) Parent() *JSONPath {
+	if p.IsRoot() {
+		return p
+	}
+
+	return &JSONPath{
+		Legacy:   p.Legacy,
+		segments: p.segments[:len(p.segments)-1],
+	}
+}
+
+// descendants returns ref and every value below it
+func descendants(ref JSONRef) []JSONRef {
+	refs := []JSONRef{ref}
+	for _, child := range children(ref.Value) {
+		refs = append(refs, descendants(child)...)
+	}
+
+	return refs
+}
+
+func children(value interface{}) []JSONRef {
+	refs := []JSONRef{}
+
+	switch v := value.(type) {
+	case *JSONObject:
+		for _, key := range v.keys {
+			refs = append(refs, JSONRef{Parent: v, Key: key, Value: v.values[key]})
+		}
+	case *JSONArray:
+		for i := range v.Values {
+			refs = append(refs, JSONRef{Parent: v, Index: i, Value: v.Values[i]})
+		}
+	}
+
+	return refs
+}
+
+func (s jsonSegment) apply(value interface{}) []JSONRef {
+	switch s.kind {
+	case jsonSegmentKey:
+		if o, ok := value.(*JSONObject); ok {
+			if child, ok := o.values[s.key]; ok {
+				return []JSONRef{{Parent: o, Key: s.key, Value: child}}
+			}
+		}
+	case jsonSegmentIndex:
+		if a, ok := value.(*JSONArray); ok {
+			index := s.index
+			if index < 0 {
+				index += len(a.Values)
+			}
+
+			if index >= 0 && index < len(a.Values) {
+				return []JSONRef{{Parent: a, Index: index, Value: a.Values[index]}}
+			}
+		}
+	case jsonSegmentWildcard:
+		return children(value)
+	}
+
+	return nil
+}
+
+func findJSON(root interface{}, segments []jsonSegment) []JSONRef {
+	refs := []JSONRef{{Value: root}}
+
+	for _, segment := range segments {
+		next := []JSONRef{}
+		for _, ref := range refs {
+			candidates := []JSONRef{ref}
+			if segment.recursive {
+				candidates = descendants(ref)
+			}
+
+			for _, candidate := range candidates {
+				next = append(next, segment.apply(candidate.Value)...)
+			}
+		}
+
+		refs = next
+	}
+
+	return refs
+}
+
+// Find returns the values selected by the path
+func (p *JSONPath) Find(root interface{}) []JSONRef {
+	return findJSON(root, p.segments)
+}
+
+// Replace sets the value referenced by ref, which must not be the root
+func (ref JSONRef) Replace(value interface{}) {
+	switch parent := ref.Parent.(type) {
+	case *JSONObject:
+		parent.Set(ref.Key, value)
+	case *JSONArray:
+		parent.Values[ref.Index] = value
+	}
+}
+
+// Set sets the values selected by the path to copies of value, returning
+// the new root and how many values were set. Missing object members are
+// added if the path ends with a name, unless onlyExisting; existing
+// values are replaced unless onlyNew.
+func (p *JSONPath) Set(root, value interface{}, onlyNew, onlyExisting bool) (interface{}, int) {
+	if p.IsRoot() {
+		if onlyNew && root != nil {
+			return root, 0
+		}
+
+		return CloneJSON(value), 1
+	}
+
+	last := p.segments[len(p.segments)-1]
+	set := 0
+
+	for _, parent := range findJSON(root, p.segments[:len(p.segments)-1]) {
+		candidates := []JSONRef{parent}
+		if last.recursive {
+			candidates = descendants(parent)
+		}
+
+		for _, candidate := range candidates {
+			found := last.apply(candidate.Value)
+
+			if len(found) == 0 && last.kind == jsonSegmentKey && !last.recursive && !onlyExisting {
+				if o, ok := candidate.Value.(*JSONObject); ok {
+					o.Set(last.key, CloneJSON(value))
+					set++
+				}
+			}
+
+			if onlyNew {
+				continue
+			}
+
+			for _, ref := range found {
+				ref.Replace(CloneJSON(value))
+				set++
+			}
+		}
+	}
+
+	return root, set
+}
+
+// Delete removes the values selected by the path, which must not be the
+// root, returning how many were removed
+func (p *JSONPath) Delete(root interface{}) int {
+	refs := p.Find(root)
+
+	// array elements are removed from the last one so that the indexes
+	// of the others stay valid
+	removed := map[*JSONArray]map[int]bool{}
+	deleted := 0
+
+	for _, ref := range refs {
+		switch parent := ref.Parent.(type) {
+		case *JSONObject:
+			if _, ok := parent.values[ref.Key]; ok {
+				parent.Delete(ref.Key)
+				deleted++
+			}
+		case *JSONArray:
+			if removed[parent] == nil {
+				removed[parent] = map[int]bool{}
+			}
+			removed[parent][ref.Index] = true
+		}
+	}
+
+	for a, indexes := range removed {
+		values := a.Values[:0]
+		for i, value := range a.Values {
+			if indexes[i] {
+				deleted++
+			} else {
+				values = append(values, value)
+			}
+		}
+
+		a.Values = values
+	}
+
+	return deleted
+}
@@ -0,0 +1,296 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"strings"
+	"testing"
+)
+
+func jsonTestParse(t *testing.T, data string) interface{} {
+	t.Helper()
+
+	value, err := ParseJSON([]byte(data))
+	if err != nil {
+		t.Fatalf("parsing %s: %v", data, err)
+	}
+
+	return value
+}
+
+func checkJSON(t *testing.T, value interface{}, want string) {
+	t.Helper()
+
+	if data := MarshalJSON(value, JSONFormat{}); string(data) != want {
+		t.Fatalf("got %s, want %s", data, want)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	// the keys keep their order, the numbers their text and the strings
+	// their HTML characters
+	for _, data := range []string{
+		`{"z":1,"a":[true,false,null],"m":{"1.50":1.50,"e":1e400,"big":123456789012345678901234567890}}`,
+		`"<&> é \n"`,
+		`[]`,
+		`{}`,
+		`-0`,
+	} {
+		checkJSON(t, jsonTestParse(t, data), data)
+	}
+
+	checkJSON(t, jsonTestParse(t, " { \"a\" : [ 1 , 2 ] } "), `{"a":[1,2]}`)
+
+	for _, data := range []string{``, `{`, `[1,]`, `{"a"}`, `1 2`, `{"a":1}}`, `nul`, `'a'`} {
+		if _, err := ParseJSON([]byte(data)); err != ErrJSONInvalid {
+			t.Fatalf("parsing %q returned %v", data, err)
+		}
+	}
+}
+
+func TestMarshalJSONFormat(t *testing.T) {
+	value := jsonTestParse(t, `{"a":[1,{}],"b":{"c":"d"},"e":[]}`)
+
+	// JSON.GET key INDENT "  " NEWLINE "\n" SPACE " "
+	want := strings.Join([]string{
+		`{`,
+		`  "a": [`,
+		`    1,`,
+		`    {}`,
+		`  ],`,
+		`  "b": {`,
+		`    "c": "d"`,
+		`  },`,
+		`  "e": []`,
+		`}`,
+	}, "\n")
+	if data := MarshalJSON(value, JSONFormat{Indent: "  ", Newline: "\n", Space: " "}); string(data) != want {
+		t.Fatalf("got\n%s\nwant\n%s", data, want)
+	}
+}
+
+func TestJSONObject(t *testing.T) {
+	o := NewJSONObject()
+	o.Set("b", "1")
+	o.Set("a", "2")
+	o.Set("b", "3")
+	o.Delete("missing")
+
+	if keys := strings.Join(o.Keys(), ","); keys != "b,a" {
+		t.Fatalf("the keys are %s", keys)
+	}
+	checkJSON(t, o, `{"b":"3","a":"2"}`)
+
+	o.Delete("b")
+	o.Set("b", "4")
+	checkJSON(t, o, `{"a":"2","b":"4"}`)
+
+	// a clone shares nothing with the original
+	original := jsonTestParse(t, `{"a":[{"b":1}]}`)
+	clone := CloneJSON(original)
+	clone.(*JSONObject).values["a"].(*JSONArray).Values[0].(*JSONObject).Set("c", true)
+	checkJSON(t, original, `{"a":[{"b":1}]}`)
+	checkJSON(t, clone, `{"a":[{"b":1,"c":true}]}`)
+}
+
+func TestJSONTypeName(t *testing.T) {
+	for data, want := range map[string]string{
+		`{}`:    "object",
+		`[]`:    "array",
+		`"s"`:   "string",
+		`true`:  "boolean",
+		`1`:     "integer",
+		`-1`:    "integer",
+		`1.0`:   "number",
+		`1e2`:   "number",
+		`1e100`: "number",
+		`null`:  "null",
+	} {
+		if name := JSONTypeName(jsonTestParse(t, data)); name != want {
+			t.Fatalf("the type of %s is %s, want %s", data, name, want)
+		}
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	for _, c := range []struct {
+		path     string
+		legacy   bool
+		segments []jsonSegment
+	}{
+		{"$", false, nil},
+		{".", true, nil},
+		{"a", true, []jsonSegment{{key: "a"}}},
+		{".a.b", true, []jsonSegment{{key: "a"}, {key: "b"}}},
+		{"[0]", true, []jsonSegment{{kind: jsonSegmentIndex}}},
+		{"$.a[-1]", false, []jsonSegment{{key: "a"}, {kind: jsonSegmentIndex, index: -1}}},
+		{"$['a.b']", false, []jsonSegment{{key: "a.b"}}},
+		{`$["a]"]`, false, []jsonSegment{{key: "a]"}}},
+		{"$.*[*]", false, []jsonSegment{{kind: jsonSegmentWildcard}, {kind: jsonSegmentWildcard}}},
+		{"$..a", false, []jsonSegment{{key: "a", recursive: true}}},
+		{"$..[1]", false, []jsonSegment{{kind: jsonSegmentIndex, index: 1, recursive: true}}},
+		{"$..*", false, []jsonSegment{{kind: jsonSegmentWildcard, recursive: true}}},
+	} {
+		p, err := ParseJSONPath(c.path)
+		if err != nil {
+			t.Fatalf("parsing %s: %v", c.path, err)
+		}
+		if p.Legacy != c.legacy || len(p.segments) != len(c.segments) {
+			t.Fatalf("%s parsed to %+v", c.path, p)
+		}
+		for i := range c.segments {
+			if p.segments[i] != c.segments[i] {
+				t.Fatalf("segment %d of %s is %+v, want %+v", i, c.path, p.segments[i], c.segments[i])
+			}
+		}
+		if p.IsRoot() != (len(c.segments) == 0) {
+			t.Fatalf("%s is root: %v", c.path, p.IsRoot())
+		}
+	}
+
+	for _, path := range []string{"$.", "$a", "$.a.", "$[", "$[x]", "$['a]", "$['a'", "$..", "a..", "$[1]x"} {
+		if _, err := ParseJSONPath(path); err != ErrJSONPath {
+			t.Fatalf("parsing %q returned %v", path, err)
+		}
+	}
+
+	p, err := ParseJSONPath("$.a[0]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent := p.Parent(); len(parent.segments) != 1 || parent.segments[0].key != "a" || parent.Parent().Parent() == nil || !parent.Parent().IsRoot() {
+		t.Fatalf("the parent of $.a[0] is %+v", parent)
+	}
+}
+
+func jsonTestFind(t *testing.T, root interface{}, path string) string {
+	t.Helper()
+
+	p, err := ParseJSONPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := &JSONArray{Values: []interface{}{}}
+	for _, ref := range p.Find(root) {
+		found.Values = append(found.Values, ref.Value)
+	}
+
+	return string(MarshalJSON(found, JSONFormat{}))
+}
+
+func TestJSONPathFind(t *testing.T) {
+	root := jsonTestParse(t, `{"a":{"b":1,"c":[2,3,{"b":4}]},"b":5,"d.e":6}`)
+
+	for path, want := range map[string]string{
+		"$":          `[{"a":{"b":1,"c":[2,3,{"b":4}]},"b":5,"d.e":6}]`,
+		"$.a.b":      `[1]`,
+		"a.b":        `[1]`,
+		"$.a.c[0]":   `[2]`,
+		"$.a.c[-1]":  `[{"b":4}]`,
+		"$.a.c[3]":   `[]`,
+		"$.a.c[-4]":  `[]`,
+		"$.a.*":      `[1,[2,3,{"b":4}]]`,
+		"$.a.c[*]":   `[2,3,{"b":4}]`,
+		"$..b":       `[5,1,4]`,
+		"$..c[1]":    `[3]`,
+		"$['d.e']":   `[6]`,
+		"$.missing":  `[]`,
+		"$.b.c":      `[]`,
+		"$.a[0]":     `[]`,
+		"$.a.c.b":    `[]`,
+		"$..missing": `[]`,
+	} {
+		if got := jsonTestFind(t, root, path); got != want {
+			t.Fatalf("%s found %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestJSONPathSet(t *testing.T) {
+	set := func(data, path, value string, onlyNew, onlyExisting bool) (interface{}, int) {
+		t.Helper()
+
+		p, err := ParseJSONPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return p.Set(jsonTestParse(t, data), jsonTestParse(t, value), onlyNew, onlyExisting)
+	}
+
+	for _, c := range []struct {
+		data, path, value     string
+		onlyNew, onlyExisting bool
+		want                  string
+		set                   int
+	}{
+		{`{"a":1}`, "$", `[1]`, false, false, `[1]`, 1},
+		{`{"a":1}`, "$", `[1]`, true, false, `{"a":1}`, 0},
+		{`{"a":1}`, "$.a", `2`, false, false, `{"a":2}`, 1},
+		{`{"a":1}`, "$.b", `2`, false, false, `{"a":1,"b":2}`, 1},
+		{`{"a":1}`, "$.a", `2`, true, false, `{"a":1}`, 0},
+		{`{"a":1}`, "$.b", `2`, true, false, `{"a":1,"b":2}`, 1},
+		{`{"a":1}`, "$.b", `2`, false, true, `{"a":1}`, 0},
+		{`{"a":1}`, "$.a", `2`, false, true, `{"a":2}`, 1},
+		{`{"a":[1,2]}`, "$.a[-1]", `3`, false, false, `{"a":[1,3]}`, 1},
+		{`{"a":[1,2]}`, "$.a[2]", `3`, false, false, `{"a":[1,2]}`, 0},
+		{`{"a":[1,2]}`, "$.a[*]", `0`, false, false, `{"a":[0,0]}`, 2},
+		{`{"a":{"x":1},"b":{"x":2}}`, "$..x", `0`, false, false, `{"a":{"x":0},"b":{"x":0}}`, 2},
+		{`{"a":{"x":1},"b":[]}`, "$.*.y", `0`, false, false, `{"a":{"x":1,"y":0},"b":[]}`, 1},
+		{`{"a":1}`, "$.a.b", `2`, false, false, `{"a":1}`, 0},
+	} {
+		root, set := set(c.data, c.path, c.value, c.onlyNew, c.onlyExisting)
+		if got := string(MarshalJSON(root, JSONFormat{})); got != c.want || set != c.set {
+			t.Fatalf("setting %s of %s to %s set %d and got %s, want %d and %s", c.path, c.data, c.value, set, got, c.set, c.want)
+		}
+	}
+
+	// every value set is a copy
+	root, _ := set(`{"a":null,"b":null}`, "$.*", `{"c":1}`, false, false)
+	o := root.(*JSONObject)
+	a, _ := o.Get("a")
+	a.(*JSONObject).Set("d", true)
+	checkJSON(t, root, `{"a":{"c":1,"d":true},"b":{"c":1}}`)
+}
+
+func TestJSONPathDelete(t *testing.T) {
+	for _, c := range []struct {
+		data, path, want string
+		deleted          int
+	}{
+		{`{"a":1,"b":2}`, "$.a", `{"b":2}`, 1},
+		{`{"a":1,"b":2}`, "$.c", `{"a":1,"b":2}`, 0},
+		{`{"a":[0,1,2,3]}`, "$.a[1]", `{"a":[0,2,3]}`, 1},
+		{`{"a":[0,1,2,3]}`, "$.a[*]", `{"a":[]}`, 4},
+		{`{"a":[{"x":1},{"x":2}],"x":3}`, "$..x", `{"a":[{},{}]}`, 3},
+		{`{"a":[[0,1],[2,3]]}`, "$.a[*][0]", `{"a":[[1],[3]]}`, 2},
+		{`{"a":[0,1,2]}`, "$.a[-1]", `{"a":[0,1]}`, 1},
+	} {
+		root := jsonTestParse(t, c.data)
+		p, err := ParseJSONPath(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deleted := p.Delete(root)
+		if got := string(MarshalJSON(root, JSONFormat{})); got != c.want || deleted != c.deleted {
+			t.Fatalf("deleting %s of %s deleted %d and got %s, want %d and %s", c.path, c.data, deleted, got, c.deleted, c.want)
+		}
+	}
+}
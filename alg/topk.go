@@ -0,0 +1,350 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+/*
+	TopK keeps the k heaviest items of a stream with the HeavyKeeper
+	algorithm, like RedisBloom does. Its buckets live in a file and are
+	updated in place: the file starts with a header (magic, k, width, depth
+	and decay) followed by depth rows of width buckets, each holding the 32
+	bits fingerprint of an item and its count. The min-heap of the top k
+	items is small and encoded by HeapBytes, to be stored by the caller.
+*/
+
+const (
+	topKMagic      = "GBDBTOPK"
+	topKHeaderSize = 8 + 4 + 4 + 4 + 8
+	topKBucketSize = 4 + 4
+
+	// the seed of the fingerprints
+	topKFingerprintSeed = 1919
+
+	// the size of the table of the powers of the decay
+	topKDecayTable = 256
+)
+
+var ErrTopKCorrupted = errors.New("top-k file is corrupted")
+
+type TopKItem struct {
+	Item  []byte
+	Count uint32
+
+	fingerprint uint32
+}
+
+type TopK struct {
+	file   *os.File
+	K      uint32
+	Width  uint32
+	Depth  uint32
+	Decay  float64
+	heap   []TopKItem
+	decays []float64
+}
+
+// CreateTopK creates an empty Top-K
+func CreateTopK(path string, k, width, depth uint32, decay float64) (*TopK, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, topKHeaderSize)
+	copy(header, topKMagic)
+	binary.BigEndian.PutUint32(header[8:], k)
+	binary.BigEndian.PutUint32(header[12:], width)
+	binary.BigEndian.PutUint32(header[16:], depth)
+	binary.BigEndian.PutUint64(header[20:], math.Float64bits(decay))
+
+	if _, err := file.WriteAt(header, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// the buckets start as a hole in the file
+	if err := file.Truncate(topKHeaderSize + topKBucketSize*int64(width)*int64(depth)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return newTopK(file, k, width, depth, decay), nil
+}
+
+// OpenTopK opens a Top-K created by CreateTopK, heap being the last
+// HeapBytes of it
+func OpenTopK(path string, heap []byte) (*TopK, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, topKHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != topKMagic {
+		file.Close()
+		return nil, ErrTopKCorrupted
+	}
+
+	t := newTopK(file,
+		binary.BigEndian.Uint32(header[8:]),
+		binary.BigEndian.Uint32(header[12:]),
+		binary.BigEndian.Uint32(header[16:]),
+		math.Float64frombits(binary.BigEndian.Uint64(header[20:])),
+	)
+
+	for i := range t.heap {
+		if len(heap) < 12 {
+			file.Close()
+			return nil, ErrTopKCorrupted
+		}
+
+		t.heap[i].fingerprint = binary.BigEndian.Uint32(heap)
+		t.heap[i].Count = binary.BigEndian.Uint32(heap[4:])
+		size := binary.BigEndian.Uint32(heap[8:])
+		heap = heap[12:]
+
+		if uint32(len(heap)) < size {
+			file.Close()
+			return nil, ErrTopKCorrupted
+		}
+
+		t.heap[i].Item = heap[:size:size]
+		heap = heap[size:]
+	}
+
+	return t, nil
+}
+
+func newTopK(file *os.File, k, width, depth uint32, decay float64) *TopK {
+	t := &TopK{
+		file:   file,
+		K:      k,
+		Width:  width,
+		Depth:  depth,
+		Decay:  decay,
+		heap:   make([]TopKItem, k),
+		decays: make([]float64, topKDecayTable),
+	}
+
+	for i := range t.decays {
+		t.decays[i] = math.Pow(decay, float64(i))
+	}
+
+	return t
+}
+
+func (t *TopK) Close() error {
+	return t.file.Close()
+}
+
+// HeapBytes encodes the heap of the top k items
+func (t *TopK) HeapBytes() []byte {
+	var buf bytes.Buffer
+	entry := make([]byte, 12)
+
+	for _, item := range t.heap {
+		binary.BigEndian.PutUint32(entry, item.fingerprint)
+		binary.BigEndian.PutUint32(entry[4:], item.Count)
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(item.Item)))
+		buf.Write(entry)
+		buf.Write(item.Item)
+	}
+
+	return buf.Bytes()
+}
+
+func (t *TopK) bucketOffset(item []byte, row uint32) int64 {
+	column := murmurHash2(item, row) % t.Width
+
+	return topKHeaderSize + topKBucketSize*(int64(row)*int64(t.Width)+int64(column))
+}
+
+// decayProbability returns the probability of decrementing a count
+func (t *TopK) decayProbability(count uint32) float64 {
+	if count < topKDecayTable {
+		return t.decays[count]
+	}
+
+	last := topKDecayTable - 1
+
+	return math.Pow(t.decays[last], float64(count/uint32(last))) * t.decays[count%uint32(last)]
+}
+
+// find returns the index of item in the heap, -1 if missing
+func (t *TopK) find(item []byte, fingerprint uint32) int {
+	for i := range t.heap {
+		if t.heap[i].fingerprint == fingerprint && t.heap[i].Count > 0 && bytes.Equal(t.heap[i].Item, item) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// heapifyDown restores the min-heap after the count at i grew
+func (t *TopK) heapifyDown(i int) {
+	for {
+		smallest := i
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(t.heap) && t.heap[child].Count < t.heap[smallest].Count {
+				smallest = child
+			}
+		}
+
+		if smallest == i {
+			return
+		}
+
+		t.heap[i], t.heap[smallest] = t.heap[smallest], t.heap[i]
+		i = smallest
+	}
+}
+
+// IncrBy increments the count of item, returning the item expelled from
+// the top k to make room for it, if any
+func (t *TopK) IncrBy(item []byte, increment uint32) ([]byte, error) {
+	fingerprint := murmurHash2(item, topKFingerprintSeed)
+	bucket := make([]byte, topKBucketSize)
+	maxCount := uint32(0)
+
+	for row := uint32(0); row < t.Depth; row++ {
+		offset := t.bucketOffset(item, row)
+		if _, err := t.file.ReadAt(bucket, offset); err != nil {
+			return nil, err
+		}
+
+		bucketFingerprint := binary.BigEndian.Uint32(bucket)
+		count := binary.BigEndian.Uint32(bucket[4:])
+
+		switch {
+		case count == 0:
+			bucketFingerprint = fingerprint
+			count = increment
+		case bucketFingerprint == fingerprint:
+			if count > math.MaxUint32-increment {
+				count = math.MaxUint32
+			} else {
+				count += increment
+			}
+		default:
+			// the count of another item decays, and item takes the bucket
+			// if it drops to zero
+			for left := increment; left > 0; left-- {
+				if rand.Float64() < t.decayProbability(count) {
+					count--
+
+					if count == 0 {
+						bucketFingerprint = fingerprint
+						count = left
+						break
+					}
+				}
+			}
+		}
+
+		binary.BigEndian.PutUint32(bucket, bucketFingerprint)
+		binary.BigEndian.PutUint32(bucket[4:], count)
+		if _, err := t.file.WriteAt(bucket, offset); err != nil {
+			return nil, err
+		}
+
+		if bucketFingerprint == fingerprint && count > maxCount {
+			maxCount = count
+		}
+	}
+
+	if maxCount == 0 || maxCount < t.heap[0].Count {
+		return nil, nil
+	}
+
+	if i := t.find(item, fingerprint); i >= 0 {
+		t.heap[i].Count = maxCount
+		t.heapifyDown(i)
+
+		return nil, nil
+	}
+
+	var expelled []byte
+	if t.heap[0].Count > 0 {
+		expelled = t.heap[0].Item
+	}
+
+	t.heap[0] = TopKItem{
+		Item:        append([]byte{}, item...),
+		Count:       maxCount,
+		fingerprint: fingerprint,
+	}
+	t.heapifyDown(0)
+
+	return expelled, nil
+}
+
+// Count returns the estimated count of item
+func (t *TopK) Count(item []byte) (uint32, error) {
+	fingerprint := murmurHash2(item, topKFingerprintSeed)
+	bucket := make([]byte, topKBucketSize)
+	maxCount := uint32(0)
+
+	for row := uint32(0); row < t.Depth; row++ {
+		if _, err := t.file.ReadAt(bucket, t.bucketOffset(item, row)); err != nil {
+			return 0, err
+		}
+
+		count := binary.BigEndian.Uint32(bucket[4:])
+		if binary.BigEndian.Uint32(bucket) == fingerprint && count > maxCount {
+			maxCount = count
+		}
+	}
+
+	return maxCount, nil
+}
+
+// Query reports whether item is in the top k
+func (t *TopK) Query(item []byte) (bool, error) {
+	count, err := t.Count(item)
+	if err != nil {
+		return false, err
+	}
+
+	return count >= t.heap[0].Count && t.find(item, murmurHash2(item, topKFingerprintSeed)) >= 0, nil
+}
+
+// List returns the top k items, the heaviest first
+func (t *TopK) List() []TopKItem {
+	items := []TopKItem{}
+	for _, item := range t.heap {
+		if item.Count > 0 {
+			items = append(items, item)
+		}
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Count > items[j].Count
+	})
+
+	return items
+}
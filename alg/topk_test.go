@@ -0,0 +1,198 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func topKTestCreate(t *testing.T, k, width, depth uint32) (*TopK, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "buckets")
+	topK, err := CreateTopK(path, k, width, depth, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return topK, path
+}
+
+func checkTopKList(t *testing.T, topK *TopK, want ...string) {
+	t.Helper()
+
+	items := topK.List()
+	if len(items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(items), len(want))
+	}
+	for i, item := range items {
+		if string(item.Item) != want[i] {
+			t.Fatalf("item %d is %s, want %s", i, item.Item, want[i])
+		}
+	}
+}
+
+func TestTopKLayout(t *testing.T) {
+	topK, path := topKTestCreate(t, 3, 8, 7)
+
+	// the heap of an empty Top-K has k empty entries
+	if heap := topK.HeapBytes(); len(heap) != 3*12 {
+		t.Fatalf("the empty heap is %d bytes, want 36", len(heap))
+	}
+
+	for item, n := range map[string]uint32{"a": 30, "b": 20, "c": 10} {
+		if expelled, err := topK.IncrBy([]byte(item), n); err != nil || expelled != nil {
+			t.Fatalf("adding %s expelled %q: %v", item, expelled, err)
+		}
+	}
+	checkTopKList(t, topK, "a", "b", "c")
+
+	heap := topK.HeapBytes()
+	if len(heap) != 3*13 {
+		t.Fatalf("the heap is %d bytes, want 39", len(heap))
+	}
+	if err := topK.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != topKHeaderSize+topKBucketSize*8*7 {
+		t.Fatalf("the file is %d bytes, want %d", info.Size(), topKHeaderSize+topKBucketSize*8*7)
+	}
+
+	topK, err = OpenTopK(path, heap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topK.Close()
+
+	if topK.K != 3 || topK.Width != 8 || topK.Depth != 7 || topK.Decay != 0.9 {
+		t.Fatalf("reopened %d %d x %d decaying %f", topK.K, topK.Width, topK.Depth, topK.Decay)
+	}
+	checkTopKList(t, topK, "a", "b", "c")
+	for item, want := range map[string]uint32{"a": 30, "b": 20, "c": 10, "d": 0} {
+		if count, err := topK.Count([]byte(item)); err != nil || count != want {
+			t.Fatalf("%s counts %d, want %d: %v", item, count, want, err)
+		}
+	}
+	if found, err := topK.Query([]byte("c")); err != nil || !found {
+		t.Fatalf("c is not in the top 3: %v", err)
+	}
+	if found, err := topK.Query([]byte("d")); err != nil || found {
+		t.Fatalf("d is in the top 3: %v", err)
+	}
+
+	// heaps cut short are corrupted
+	topK.Close()
+	for _, short := range [][]byte{heap[:10], heap[:14], heap[:len(heap)-1]} {
+		if _, err := OpenTopK(path, short); err != ErrTopKCorrupted {
+			t.Fatalf("opening a heap of %d bytes returned %v", len(short), err)
+		}
+	}
+}
+
+func TestTopKExpels(t *testing.T) {
+	topK, _ := topKTestCreate(t, 1, 8, 7)
+	defer topK.Close()
+
+	if expelled, err := topK.IncrBy([]byte("a"), 5); err != nil || expelled != nil {
+		t.Fatalf("adding a expelled %q: %v", expelled, err)
+	}
+
+	// a lighter item does not make it in the top, a heavier one expels
+	if expelled, err := topK.IncrBy([]byte("b"), 2); err != nil || expelled != nil {
+		t.Fatalf("adding b expelled %q: %v", expelled, err)
+	}
+	if expelled, err := topK.IncrBy([]byte("c"), 10); err != nil || string(expelled) != "a" {
+		t.Fatalf("adding c expelled %q, want a: %v", expelled, err)
+	}
+	checkTopKList(t, topK, "c")
+
+	// the count of an item in the top grows in place
+	if expelled, err := topK.IncrBy([]byte("c"), 1); err != nil || expelled != nil {
+		t.Fatalf("adding c again expelled %q: %v", expelled, err)
+	}
+	if items := topK.List(); items[0].Count != 11 {
+		t.Fatalf("c counts %d, want 11", items[0].Count)
+	}
+
+	// counts saturate
+	if _, err := topK.IncrBy([]byte("c"), math.MaxUint32); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := topK.Count([]byte("c")); err != nil || count != math.MaxUint32 {
+		t.Fatalf("c counts %d: %v", count, err)
+	}
+}
+
+func TestTopKHeavyHitters(t *testing.T) {
+	topK, _ := topKTestCreate(t, 3, 50, 5)
+	defer topK.Close()
+
+	// the heavy items are mixed with a long tail of light ones
+	for i := 0; i < 1000; i++ {
+		items := []string{fmt.Sprintf("light:%d", i%300)}
+		if i%2 == 0 {
+			items = append(items, "heavy:0")
+		}
+		if i%4 == 0 {
+			items = append(items, "heavy:1")
+		}
+		if i%8 == 0 {
+			items = append(items, "heavy:2")
+		}
+
+		for _, item := range items {
+			if _, err := topK.IncrBy([]byte(item), 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	checkTopKList(t, topK, "heavy:0", "heavy:1", "heavy:2")
+
+	// the counts of HeavyKeeper may only be underestimated
+	for item, max := range map[string]uint32{"heavy:0": 500, "heavy:1": 250, "heavy:2": 125} {
+		count, err := topK.Count([]byte(item))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count > max || count < max*9/10 {
+			t.Fatalf("%s counts %d, want about %d", item, count, max)
+		}
+	}
+}
+
+func TestTopKDecayProbability(t *testing.T) {
+	topK, _ := topKTestCreate(t, 1, 1, 1)
+	defer topK.Close()
+
+	for _, count := range []uint32{0, 1, 10, topKDecayTable - 1, topKDecayTable, 1000} {
+		want := math.Pow(0.9, float64(count))
+		if p := topK.decayProbability(count); math.Abs(p-want) > want*1e-9 {
+			t.Fatalf("the decay of %d is %g, want %g", count, p, want)
+		}
+	}
+}
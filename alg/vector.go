@@ -0,0 +1,307 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+/*
+	VectorFile stores float32 vectors of a fixed dimension in numbered
+	slots, so that a vector is read or replaced with a single positioned
+	I/O. The file starts with a header (magic and dimension) followed by
+	the slots, each made of a byte telling whether it is used, the 32
+	bytes id of its owner and the vector, little endian like the blobs
+	the clients send. Which slots are free is up to the caller, usually
+	learnt by scanning the file once.
+*/
+
+const (
+	vectorFileMagic      = "GBDBVECT"
+	vectorFileHeaderSize = 8 + 4
+
+	VectorL2     = "L2"
+	VectorIP     = "IP"
+	VectorCosine = "COSINE"
+)
+
+var ErrVectorFileCorrupted = errors.New("vector file is corrupted")
+
+type VectorFile struct {
+	file     *os.File
+	Dim      int
+	slotSize int64
+	slots    uint32
+}
+
+type VectorResult struct {
+	ID       [32]byte
+	Distance float32
+}
+
+// VectorDistance returns the distance function of a metric, lower
+// meaning closer: the squared euclidean distance for L2 and one minus
+// the inner product or the cosine similarity for IP and COSINE, the
+// same RediSearch uses
+func VectorDistance(metric string) func(a, b []float32) float32 {
+	switch metric {
+	case VectorIP:
+		return func(a, b []float32) float32 {
+			return 1 - dot(a, b)
+		}
+	case VectorCosine:
+		return func(a, b []float32) float32 {
+			norms := float32(math.Sqrt(float64(dot(a, a)) * float64(dot(b, b))))
+			if norms == 0 {
+				return 1
+			}
+
+			return 1 - dot(a, b)/norms
+		}
+	}
+
+	return func(a, b []float32) float32 {
+		var distance float32
+		for i := range a {
+			d := a[i] - b[i]
+			distance += d * d
+		}
+
+		return distance
+	}
+}
+
+func dot(a, b []float32) float32 {
+	var product float32
+	for i := range a {
+		product += a[i] * b[i]
+	}
+
+	return product
+}
+
+// DecodeVector decodes a blob of little endian float32, nil if its
+// length is not the one of a vector of dimension dim
+func DecodeVector(blob []byte, dim int) []float32 {
+	if len(blob) != 4*dim {
+		return nil
+	}
+
+	vector := make([]float32, dim)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(blob[4*i:]))
+	}
+
+	return vector
+}
+
+// OpenVectorFile opens the vector file at path, creating it if needed
+func OpenVectorFile(path string, dim int) (*VectorFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	header := make([]byte, vectorFileHeaderSize)
+	if info.Size() == 0 {
+		copy(header, vectorFileMagic)
+		binary.BigEndian.PutUint32(header[8:], uint32(dim))
+
+		if _, err := file.WriteAt(header, 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if _, err := file.ReadAt(header, 0); err != nil || string(header[:8]) != vectorFileMagic ||
+		binary.BigEndian.Uint32(header[8:]) != uint32(dim) {
+		file.Close()
+		return nil, ErrVectorFileCorrupted
+	}
+
+	f := &VectorFile{
+		file:     file,
+		Dim:      dim,
+		slotSize: 1 + 32 + 4*int64(dim),
+	}
+	if info.Size() > vectorFileHeaderSize {
+		f.slots = uint32((info.Size() - vectorFileHeaderSize) / f.slotSize)
+	}
+
+	return f, nil
+}
+
+func (f *VectorFile) Close() error {
+	return f.file.Close()
+}
+
+// Slots returns the number of slots, used or not
+func (f *VectorFile) Slots() uint32 {
+	return f.slots
+}
+
+func (f *VectorFile) slotOffset(slot uint32) int64 {
+	return vectorFileHeaderSize + int64(slot)*f.slotSize
+}
+
+// Write stores the vector of id in slot, growing the file if needed
+func (f *VectorFile) Write(slot uint32, id [32]byte, vector []float32) error {
+	buf := make([]byte, f.slotSize)
+	buf[0] = 1
+	copy(buf[1:], id[:])
+	for i, value := range vector {
+		binary.LittleEndian.PutUint32(buf[33+4*i:], math.Float32bits(value))
+	}
+
+	if _, err := f.file.WriteAt(buf, f.slotOffset(slot)); err != nil {
+		return err
+	}
+
+	if slot >= f.slots {
+		f.slots = slot + 1
+	}
+
+	return nil
+}
+
+// Free marks slot as unused
+func (f *VectorFile) Free(slot uint32) error {
+	_, err := f.file.WriteAt([]byte{0}, f.slotOffset(slot))
+
+	return err
+}
+
+// Read returns the vector in slot, nil if the slot is unused
+func (f *VectorFile) Read(slot uint32) ([]float32, error) {
+	buf := make([]byte, f.slotSize)
+	if _, err := f.file.ReadAt(buf, f.slotOffset(slot)); err != nil {
+		return nil, err
+	}
+
+	if buf[0] == 0 {
+		return nil, nil
+	}
+
+	return DecodeVector(buf[33:], f.Dim), nil
+}
+
+// Scan calls fn with the used slots in order, until it returns false
+func (f *VectorFile) Scan(fn func(slot uint32, id [32]byte, vector []float32) bool) error {
+	r := bufio.NewReaderSize(io.NewSectionReader(f.file, vectorFileHeaderSize, int64(f.slots)*f.slotSize), 1<<20)
+
+	buf := make([]byte, f.slotSize)
+	for slot := uint32(0); slot < f.slots; slot++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+
+		if buf[0] == 0 {
+			continue
+		}
+
+		var id [32]byte
+		copy(id[:], buf[1:33])
+		if !fn(slot, id, DecodeVector(buf[33:], f.Dim)) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// NearestVectors keeps the k results closest to a query
+type NearestVectors struct {
+	k       int
+	results vectorMaxHeap
+}
+
+func NewNearestVectors(k int) *NearestVectors {
+	return &NearestVectors{
+		k: k,
+	}
+}
+
+// Add considers a result, reporting whether it is kept
+func (n *NearestVectors) Add(id [32]byte, distance float32) bool {
+	if n.k <= 0 {
+		return false
+	}
+
+	if len(n.results) == n.k {
+		if distance >= n.results[0].Distance {
+			return false
+		}
+
+		heap.Pop(&n.results)
+	}
+
+	heap.Push(&n.results, VectorResult{
+		ID:       id,
+		Distance: distance,
+	})
+
+	return true
+}
+
+// Results returns the kept results, closest first
+func (n *NearestVectors) Results() []VectorResult {
+	results := append([]VectorResult{}, n.results...)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Distance < results[j].Distance
+	})
+
+	return results
+}
+
+// vectorMaxHeap has the farthest result on top
+type vectorMaxHeap []VectorResult
+
+func (h vectorMaxHeap) Len() int {
+	return len(h)
+}
+
+func (h vectorMaxHeap) Less(i, j int) bool {
+	return h[i].Distance > h[j].Distance
+}
+
+func (h vectorMaxHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *vectorMaxHeap) Push(x interface{}) {
+	*h = append(*h, x.(VectorResult))
+}
+
+func (h *vectorMaxHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return x
+}
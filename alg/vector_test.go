@@ -0,0 +1,155 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package alg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVectorFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vectors")
+
+	f, err := OpenVectorFile(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vectors := map[uint32][]float32{
+		0: {1, 2, 3},
+		1: {-1, 0.5, 1e30},
+		4: {0, 0, 0},
+	}
+	for slot, vector := range vectors {
+		if err := f.Write(slot, vectorTestID(int(slot)), vector); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.Free(1); err != nil {
+		t.Fatal(err)
+	}
+	delete(vectors, 1)
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err = OpenVectorFile(path, 3); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.Slots() != 5 {
+		t.Fatalf("%d slots, want 5", f.Slots())
+	}
+
+	scanned := map[uint32][]float32{}
+	err = f.Scan(func(slot uint32, id [32]byte, vector []float32) bool {
+		if id != vectorTestID(int(slot)) {
+			t.Errorf("slot %d has the id %x", slot, id[:4])
+		}
+		scanned[slot] = vector
+
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(scanned, vectors) {
+		t.Fatalf("scanned %v, want %v", scanned, vectors)
+	}
+
+	for slot := uint32(0); slot < f.Slots(); slot++ {
+		vector, err := f.Read(slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(vector, vectors[slot]) {
+			t.Fatalf("slot %d holds %v, want %v", slot, vector, vectors[slot])
+		}
+	}
+}
+
+func TestVectorFileDim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vectors")
+
+	f, err := OpenVectorFile(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := OpenVectorFile(path, 4); err != ErrVectorFileCorrupted {
+		t.Fatalf("got %v, want ErrVectorFileCorrupted", err)
+	}
+
+	if err := os.WriteFile(path, []byte("not a vector file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenVectorFile(path, 3); err != ErrVectorFileCorrupted {
+		t.Fatalf("got %v, want ErrVectorFileCorrupted", err)
+	}
+}
+
+func TestVectorDistance(t *testing.T) {
+	a, b := []float32{1, 0}, []float32{0, 2}
+
+	for _, test := range []struct {
+		metric string
+		a, b   []float32
+		want   float32
+	}{
+		{VectorL2, a, b, 5},
+		{VectorL2, a, a, 0},
+		{VectorIP, a, []float32{0.5, 3}, 0.5},
+		{VectorCosine, a, b, 1},
+		{VectorCosine, b, []float32{0, 7}, 0},
+		{VectorCosine, a, []float32{0, 0}, 1},
+	} {
+		if got := VectorDistance(test.metric)(test.a, test.b); got != test.want {
+			t.Errorf("%s distance between %v and %v is %v, want %v", test.metric, test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestNearestVectors(t *testing.T) {
+	nearest := NewNearestVectors(3)
+	for i, distance := range []float32{5, 1, 4, 2, 3, 0.5} {
+		nearest.Add(vectorTestID(i), distance)
+	}
+
+	results := nearest.Results()
+	want := []VectorResult{
+		{vectorTestID(5), 0.5},
+		{vectorTestID(1), 1},
+		{vectorTestID(3), 2},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Fatalf("got %v, want %v", results, want)
+	}
+
+	if NewNearestVectors(0).Add(vectorTestID(0), 0) {
+		t.Fatal("result kept with k = 0")
+	}
+}
@@ -77,6 +77,7 @@ func Init(configFile, dbRoot, host string, port int) {
 		Config.DBConfig.DBDirPath = dbRoot
 		splittedDBDirPath := strings.Split(Config.DBConfig.DBDirPath, string(filepath.Separator))
 		Config.DBConfig.DBDirName = splittedDBDirPath[len(splittedDBDirPath)-1]
+		Config.DBConfig.InternalDirPath = filepath.Join(dbRoot, "_internal")
 	}
 
 	if host != "" {
@@ -0,0 +1,236 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+// commandArity is the number of arguments of the commands, counting the
+// command name, like the arity of the Redis COMMAND reply: a negative
+// arity is the minimum number of arguments. The handlers check their
+// arguments by themselves when they run, it's used to reject the commands
+// that can't work while they are queued by MULTI.
+var commandArity = map[string]int{
+	// keys and server
+	"command":  -1,
+	"config":   -2,
+	"copy":     -3,
+	"dbsize":   1,
+	"del":      -2,
+	"exists":   -2,
+	"flushall": -1,
+	"flushdb":  -1,
+	"info":     -1,
+	"move":     3,
+	"ping":     -1,
+	"rename":   3,
+	"renamenx": 3,
+	"select":   2,
+	"swapdb":   3,
+	"touch":    -2,
+	"type":     2,
+	"unlink":   -2,
+
+	// transactions
+	"discard": 1,
+	"exec":    1,
+	"multi":   1,
+	"unwatch": 1,
+	"watch":   -2,
+
+	// strings
+	"decr":        2,
+	"decrby":      3,
+	"get":         2,
+	"getdel":      2,
+	"getset":      3,
+	"incr":        2,
+	"incrby":      3,
+	"incrbyfloat": 3,
+	"mget":        -2,
+	"mset":        -3,
+	"msetnx":      -3,
+	"set":         -3,
+	"setnx":       3,
+
+	// bitmaps
+	"bitcount": -2,
+	"bitfield": -2,
+	"bitop":    -4,
+	"bitpos":   -3,
+	"getbit":   3,
+	"setbit":   4,
+
+	// hashes
+	"hdel":         -3,
+	"hexists":      3,
+	"hget":         3,
+	"hgetall":      2,
+	"hincrby":      4,
+	"hincrbyfloat": 4,
+	"hkeys":        2,
+	"hlen":         2,
+	"hmget":        -3,
+	"hmset":        -4,
+	"hscan":        -3,
+	"hset":         -4,
+	"hsetnx":       4,
+	"hstrlen":      3,
+	"hvals":        2,
+
+	// lists
+	"blmove":     6,
+	"blpop":      -3,
+	"brpop":      -3,
+	"brpoplpush": 4,
+	"lindex":     3,
+	"linsert":    5,
+	"llen":       2,
+	"lmove":      5,
+	"lpop":       -2,
+	"lpos":       -3,
+	"lpush":      -3,
+	"lpushx":     -3,
+	"lrange":     4,
+	"lrem":       4,
+	"lset":       4,
+	"ltrim":      4,
+	"rpop":       -2,
+	"rpoplpush":  3,
+	"rpush":      -3,
+	"rpushx":     -3,
+
+	// sets
+	"sadd":        -3,
+	"scard":       2,
+	"sdiff":       -2,
+	"sdiffstore":  -3,
+	"sinter":      -2,
+	"sinterstore": -3,
+	"sismember":   3,
+	"smembers":    2,
+	"smismember":  -3,
+	"smove":       4,
+	"spop":        -2,
+	"srandmember": -2,
+	"srem":        -3,
+	"sscan":       -3,
+	"sunion":      -2,
+	"sunionstore": -3,
+
+	// sorted sets
+	"zadd":        -4,
+	"zcard":       2,
+	"zcount":      4,
+	"zincrby":     4,
+	"zinterstore": -4,
+	"zpopmax":     -2,
+	"zpopmin":     -2,
+	"zrange":      -4,
+	"zrangestore": -5,
+	"zrank":       -3,
+	"zrem":        -3,
+	"zrevrank":    -3,
+	"zscore":      3,
+	"zunionstore": -4,
+
+	// hyperloglogs
+	"pfadd":   -2,
+	"pfcount": -2,
+	"pfmerge": -2,
+
+	// geo
+	"geoadd":         -5,
+	"geodist":        -4,
+	"geohash":        -2,
+	"geopos":         -2,
+	"geosearch":      -7,
+	"geosearchstore": -8,
+
+	// streams
+	"xack":       -4,
+	"xadd":       -5,
+	"xautoclaim": -6,
+	"xclaim":     -6,
+	"xdel":       -2,
+	"xgroup":     -2,
+	"xinfo":      -2,
+	"xlen":       2,
+	"xpending":   -3,
+	"xrange":     -4,
+	"xread":      -4,
+	"xreadgroup": -7,
+	"xrevrange":  -4,
+	"xtrim":      -4,
+
+	// bloom filters, count-min sketches and top-k
+	"bf.add":         3,
+	"bf.exists":      3,
+	"bf.info":        -2,
+	"bf.madd":        -3,
+	"bf.mexists":     -3,
+	"bf.reserve":     -4,
+	"cms.incrby":     -4,
+	"cms.info":       2,
+	"cms.initbydim":  4,
+	"cms.initbyprob": 4,
+	"cms.merge":      -4,
+	"cms.query":      -3,
+	"topk.add":       -3,
+	"topk.count":     -3,
+	"topk.incrby":    -4,
+	"topk.list":      -2,
+	"topk.query":     -3,
+	"topk.reserve":   -3,
+
+	// JSON
+	"json.arrappend": -4,
+	"json.del":       -2,
+	"json.get":       -2,
+	"json.mget":      -3,
+	"json.numincrby": 4,
+	"json.objkeys":   -2,
+	"json.set":       -4,
+	"json.type":      -2,
+
+	// time series
+	"ts.add":        -4,
+	"ts.create":     -2,
+	"ts.createrule": -6,
+	"ts.deleterule": 3,
+	"ts.mrange":     -5,
+	"ts.range":      -4,
+
+	// search
+	"ft.create":    -5,
+	"ft.dropindex": -2,
+	"ft.info":      2,
+	"ft.search":    -3,
+}
+
+// checkArity reports whether r has a number of arguments its command
+// accepts. The commands missing from commandArity accept any number.
+func checkArity(r *Request) bool {
+	arity, ok := commandArity[r.Name]
+	if !ok {
+		return true
+	}
+
+	if arity < 0 {
+		return len(r.Args)+1 >= -arity
+	}
+
+	return len(r.Args)+1 == arity
+}
@@ -0,0 +1,238 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// parseBitRange parses the [start end [BYTE|BIT]] range of BITCOUNT and
+// the [start [end [BYTE|BIT]]] one of BITPOS
+func parseBitRange(args [][]byte, needEnd bool) (storage.BitRange, error) {
+	r := storage.BitRange{}
+	if len(args) == 0 {
+		return r, nil
+	}
+
+	if len(args) > 3 || (needEnd && len(args) == 1) {
+		return r, storage.ErrSyntax
+	}
+
+	if len(args) == 3 {
+		switch strings.ToLower(string(args[2])) {
+		case "byte":
+		case "bit":
+			r.Bit = true
+		default:
+			return r, storage.ErrSyntax
+		}
+	}
+
+	start, err := storage.ParseInt(args[0])
+	if err != nil {
+		return r, storage.ErrNotInteger
+	}
+	r.Start, r.HasStart = int(start), true
+
+	if len(args) > 1 {
+		end, err := storage.ParseInt(args[1])
+		if err != nil {
+			return r, storage.ErrNotInteger
+		}
+		r.End, r.HasEnd = int(end), true
+	}
+
+	return r, nil
+}
+
+func registerBitmapHandlers(m map[string]HandlerFn) {
+	m["setbit"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'setbit' command")
+		}
+
+		offset, err := storage.ParseBitOffset(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		bit, ok := storage.ParseBit(r.Args[2])
+		if !ok {
+			return errors.New("bit is not an integer or out of range")
+		}
+
+		old, err := storage.SetBit(r.GetDBNum(), r.Args[0], offset, bit)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: old,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["getbit"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'getbit' command")
+		}
+
+		offset, err := storage.ParseBitOffset(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		bit, err := storage.GetBit(r.GetDBNum(), r.Args[0], offset)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: bit,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bitcount"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'bitcount' command")
+		}
+
+		bitRange, err := parseBitRange(r.Args[1:], true)
+		if err != nil {
+			return err
+		}
+
+		count, err := storage.BitCount(r.GetDBNum(), r.Args[0], bitRange)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: count,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bitpos"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'bitpos' command")
+		}
+
+		bit, ok := storage.ParseBit(r.Args[1])
+		if !ok {
+			return errors.New("The bit argument must be 1 or 0.")
+		}
+
+		bitRange, err := parseBitRange(r.Args[2:], false)
+		if err != nil {
+			return err
+		}
+
+		pos, err := storage.BitPos(r.GetDBNum(), r.Args[0], bit, bitRange)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: pos,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bitop"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'bitop' command")
+		}
+
+		length, err := storage.BitOp(r.GetDBNum(), string(r.Args[0]), r.Args[1], r.Args[2:])
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: length,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	bitfield := func(name string, readOnly bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) < 1 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			ops, err := storage.ParseBitFieldOps(r.Args[1:], readOnly)
+			if err != nil {
+				return err
+			}
+
+			results, err := storage.BitField(r.GetDBNum(), r.Args[0], ops)
+			if err != nil {
+				return err
+			}
+
+			values := make([]interface{}, len(results))
+			for i, result := range results {
+				if result != nil {
+					values[i] = int(*result)
+				}
+			}
+
+			reply := &MultiBulkReply{
+				values: values,
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["bitfield"] = bitfield("bitfield", false)
+	m["bitfield_ro"] = bitfield("bitfield_ro", true)
+}
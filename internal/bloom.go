@@ -0,0 +1,169 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerBloomHandlers(m map[string]HandlerFn) {
+	m["bf.reserve"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'bf.reserve' command")
+		}
+
+		reserve, err := storage.ParseBFReserveArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.BFReserve(r.GetDBNum(), r.Args[0], reserve); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bf.add"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'bf.add' command")
+		}
+
+		added, err := storage.BFAdd(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+		if err, ok := added[0].(error); ok {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: added[0].(int),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bf.madd"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'bf.madd' command")
+		}
+
+		added, err := storage.BFAdd(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: added,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bf.exists"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'bf.exists' command")
+		}
+
+		found, err := storage.BFExists(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: found[0],
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bf.mexists"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'bf.mexists' command")
+		}
+
+		found, err := storage.BFExists(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(found))
+		for i := range found {
+			values[i] = found[i]
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bf.info"] = func(r *Request) error {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return errors.New("wrong number of arguments for 'bf.info' command")
+		}
+
+		var field []byte
+		if len(r.Args) == 2 {
+			field = r.Args[1]
+		}
+
+		info, err := storage.BFInfo(r.GetDBNum(), r.Args[0], field)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: info,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,179 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerCountMinSketchHandlers(m map[string]HandlerFn) {
+	m["cms.initbydim"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'cms.initbydim' command")
+		}
+
+		width, depth, err := storage.ParseCMSInitByDimArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.CMSInit(r.GetDBNum(), r.Args[0], width, depth); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["cms.initbyprob"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'cms.initbyprob' command")
+		}
+
+		width, depth, err := storage.ParseCMSInitByProbArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.CMSInit(r.GetDBNum(), r.Args[0], width, depth); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["cms.incrby"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'cms.incrby' command")
+		}
+
+		items, increments, err := storage.ParseCMSIncrByArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		counts, err := storage.CMSIncrBy(r.GetDBNum(), r.Args[0], items, increments)
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(counts))
+		for i := range counts {
+			values[i] = counts[i]
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["cms.query"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'cms.query' command")
+		}
+
+		counts, err := storage.CMSQuery(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(counts))
+		for i := range counts {
+			values[i] = counts[i]
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["cms.merge"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'cms.merge' command")
+		}
+
+		sources, weights, err := storage.ParseCMSMergeArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.CMSMerge(r.GetDBNum(), r.Args[0], sources, weights); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["cms.info"] = func(r *Request) error {
+		if len(r.Args) != 1 {
+			return errors.New("wrong number of arguments for 'cms.info' command")
+		}
+
+		info, err := storage.CMSInfo(r.GetDBNum(), r.Args[0])
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: info,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
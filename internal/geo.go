@@ -0,0 +1,202 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerGeoHandlers(m map[string]HandlerFn) {
+	m["geoadd"] = func(r *Request) error {
+		if len(r.Args) < 4 {
+			return errors.New("wrong number of arguments for 'geoadd' command")
+		}
+
+		added, err := storage.GeoAdd(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: added,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["geodist"] = func(r *Request) error {
+		if len(r.Args) != 3 && len(r.Args) != 4 {
+			return errors.New("wrong number of arguments for 'geodist' command")
+		}
+
+		unit := 1.0
+		if len(r.Args) == 4 {
+			var err error
+			if unit, err = storage.ParseGeoUnit(r.Args[3]); err != nil {
+				return err
+			}
+		}
+
+		dist, found, err := storage.GeoDist(r.GetDBNum(), r.Args[0], r.Args[1], r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{}
+		if found {
+			reply.value = []byte(storage.FormatGeoDistance(dist, unit))
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["geopos"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'geopos' command")
+		}
+
+		positions, err := storage.GeoPos(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(positions))
+		for i, position := range positions {
+			if position != nil {
+				values[i] = []interface{}{
+					[]byte(storage.FormatGeoCoordinate(position[0])),
+					[]byte(storage.FormatGeoCoordinate(position[1])),
+				}
+			}
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["geohash"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'geohash' command")
+		}
+
+		hashes, err := storage.GeoHash(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		reply := MultiBulkFromBytes(hashes)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["geosearch"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'geosearch' command")
+		}
+
+		search, err := storage.ParseGeoSearchArgs(r.Args[1:], false)
+		if err != nil {
+			return err
+		}
+
+		points, err := storage.GeoSearch(r.GetDBNum(), r.Args[0], search)
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(points))
+		for i, point := range points {
+			if !search.WithDist && !search.WithHash && !search.WithCoord {
+				values[i] = point.Member
+				continue
+			}
+
+			value := []interface{}{point.Member}
+			if search.WithDist {
+				value = append(value, []byte(storage.FormatGeoDistance(point.Dist, search.Unit)))
+			}
+			if search.WithHash {
+				value = append(value, int(point.Score))
+			}
+			if search.WithCoord {
+				value = append(value, []interface{}{
+					[]byte(storage.FormatGeoCoordinate(point.Lon)),
+					[]byte(storage.FormatGeoCoordinate(point.Lat)),
+				})
+			}
+			values[i] = value
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["geosearchstore"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'geosearchstore' command")
+		}
+
+		search, err := storage.ParseGeoSearchArgs(r.Args[2:], true)
+		if err != nil {
+			return err
+		}
+
+		stored, err := storage.GeoSearchStore(r.GetDBNum(), r.Args[0], r.Args[1], search)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: stored,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -18,9 +18,13 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 
+	"github.com/RcrdBrt/gobigdis/config"
 	"github.com/RcrdBrt/gobigdis/storage"
 )
 
@@ -42,15 +46,21 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["select"] = func(r *Request) error {
+		if len(r.Args) != 1 {
+			return errors.New("wrong number of arguments for 'select' command")
+		}
+
 		dbNum, err := strconv.Atoi(string(r.Args[0]))
 		if err != nil {
-			return err
+			return errors.New("value is not an integer or out of range")
 		}
 
 		if err := storage.NewDB(dbNum); err != nil {
 			return err
 		}
 
+		r.Session.DB = r.Args[:1]
+
 		reply := &StatusReply{
 			Code: "OK",
 		}
@@ -92,12 +102,184 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["set"] = func(r *Request) error {
-		if err := storage.Set(r.GetDBNum(), r.Args); err != nil {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'set' command")
+		}
+
+		opts, err := storage.ParseSetOptions(r.Args[2:])
+		if err != nil {
+			return err
+		}
+
+		done, old, err := storage.Set(r.GetDBNum(), r.Args[:2], opts)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter
+		switch {
+		case opts.Get:
+			reply = &BulkReply{
+				value: old,
+			}
+		case !done:
+			reply = &BulkReply{}
+		default:
+			reply = &StatusReply{
+				Code: "OK",
+			}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["setnx"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'setnx' command")
+		}
+
+		done, _, err := storage.Set(r.GetDBNum(), r.Args, storage.SetOptions{NX: true})
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{}
+		if done {
+			reply.number = 1
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["getset"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'getset' command")
+		}
+
+		_, old, err := storage.Set(r.GetDBNum(), r.Args, storage.SetOptions{Get: true})
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: old,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["getdel"] = func(r *Request) error {
+		value, err := storage.GetDel(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["incr"] = func(r *Request) error {
+		if len(r.Args) != 1 {
+			return errors.New("wrong number of arguments for 'incr' command")
+		}
+
+		return incrBy(r, 1)
+	}
+
+	m["decr"] = func(r *Request) error {
+		if len(r.Args) != 1 {
+			return errors.New("wrong number of arguments for 'decr' command")
+		}
+
+		return incrBy(r, -1)
+	}
+
+	m["incrby"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'incrby' command")
+		}
+
+		delta, err := storage.ParseInt(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		return incrBy(r, delta)
+	}
+
+	m["decrby"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'decrby' command")
+		}
+
+		delta, err := storage.ParseInt(r.Args[1])
+		if err != nil {
+			return err
+		}
+		if delta == math.MinInt64 {
+			return storage.ErrNotInteger
+		}
+
+		return incrBy(r, -delta)
+	}
+
+	m["incrbyfloat"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'incrbyfloat' command")
+		}
+
+		delta, err := storage.ParseFloat(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		value, err := storage.IncrByFloat(r.GetDBNum(), r.Args[0], delta)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["type"] = func(r *Request) error {
+		if len(r.Args) != 1 {
+			return errors.New("wrong number of arguments for 'type' command")
+		}
+
+		typ, err := storage.Type(r.GetDBNum(), r.Args[0])
+		if err != nil {
 			return err
 		}
 
 		reply := &StatusReply{
-			Code: "OK",
+			Code: typ,
 		}
 
 		if _, err := reply.WriteTo(r.Conn); err != nil {
@@ -108,7 +290,33 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["flushdb"] = func(r *Request) error {
-		if err := storage.FlushDB(r.GetDBNum()); err != nil {
+		async, err := storage.ParseFlushMode(r.Args)
+		if err != nil {
+			return err
+		}
+
+		if err := storage.FlushDB(r.GetDBNum(), async); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["flushall"] = func(r *Request) error {
+		async, err := storage.ParseFlushMode(r.Args)
+		if err != nil {
+			return err
+		}
+
+		if err := storage.FlushAll(async); err != nil {
 			return err
 		}
 
@@ -123,6 +331,93 @@ func NewV1Handler() map[string]HandlerFn {
 		return nil
 	}
 
+	m["swapdb"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'swapdb' command")
+		}
+
+		a, err := storage.ParseDBIndex(r.Args[0])
+		if err != nil {
+			return err
+		}
+
+		b, err := storage.ParseDBIndex(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.SwapDB(a, b); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["dbsize"] = func(r *Request) error {
+		if len(r.Args) != 0 {
+			return errors.New("wrong number of arguments for 'dbsize' command")
+		}
+
+		reply := IntegerReply{
+			number: storage.DBSize(r.GetDBNum()),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["info"] = func(r *Request) error {
+		if len(r.Args) > 1 {
+			return errors.New("wrong number of arguments for 'info' command")
+		}
+
+		section := "all"
+		if len(r.Args) == 1 {
+			section = strings.ToLower(string(r.Args[0]))
+		}
+
+		var info strings.Builder
+
+		if section == "all" || section == "stats" {
+			pending, freed := storage.TrashStats()
+
+			info.WriteString("# Stats\r\n")
+			fmt.Fprintf(&info, "lazyfree_pending_objects:%d\r\n", pending)
+			fmt.Fprintf(&info, "lazyfreed_objects:%d\r\n", freed)
+			info.WriteString("\r\n")
+		}
+
+		if section == "all" || section == "keyspace" {
+			info.WriteString("# Keyspace\r\n")
+			for dbNum := 0; dbNum < config.Config.DBConfig.DBMaxNum; dbNum++ {
+				if keys := storage.DBSize(dbNum); keys > 0 {
+					fmt.Fprintf(&info, "db%d:keys=%d,expires=0,avg_ttl=0\r\n", dbNum, keys)
+				}
+			}
+		}
+
+		reply := &BulkReply{
+			value: []byte(info.String()),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
 	m["del"] = func(r *Request) error {
 		deleted, err := storage.Del(r.GetDBNum(), r.Args)
 		if err != nil {
@@ -140,6 +435,88 @@ func NewV1Handler() map[string]HandlerFn {
 		return nil
 	}
 
+	m["unlink"] = func(r *Request) error {
+		unlinked, err := storage.Unlink(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: unlinked,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["exists"] = func(r *Request) error {
+		found, err := storage.Exists(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: found,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["mget"] = func(r *Request) error {
+		values, err := storage.MGet(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := MultiBulkFromBytes(values)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["mset"] = func(r *Request) error {
+		if err := storage.MSet(r.GetDBNum(), r.Args); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["msetnx"] = func(r *Request) error {
+		set, err := storage.MSetNX(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: set,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
 	m["config"] = func(r *Request) error {
 		reply := BulkReply{
 			value: []byte(""),
@@ -162,5 +539,50 @@ func NewV1Handler() map[string]HandlerFn {
 		return nil
 	}
 
+	registerKeyspaceHandlers(m)
+	registerTransactionHandlers(m)
+	registerHashHandlers(m)
+	registerListHandlers(m)
+	registerSetHandlers(m)
+	registerZSetHandlers(m)
+	registerStreamHandlers(m)
+	registerStreamGroupHandlers(m)
+	registerBitmapHandlers(m)
+	registerHyperLogLogHandlers(m)
+	registerGeoHandlers(m)
+	registerBloomHandlers(m)
+	registerCountMinSketchHandlers(m)
+	registerTopKHandlers(m)
+	registerJSONHandlers(m)
+	registerTimeSeriesHandlers(m)
+	registerSearchHandlers(m)
+
 	return m
 }
+
+func incrBy(r *Request, delta int64) error {
+	value, err := storage.IncrBy(r.GetDBNum(), r.Args[0], delta)
+	if err != nil {
+		return err
+	}
+
+	reply := IntegerReply{
+		number: int(value),
+	}
+
+	if _, err := reply.WriteTo(r.Conn); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// atoi parses an integer argument of a command
+func atoi(b []byte) (int, error) {
+	n, err := storage.ParseInt(b)
+	if err != nil || n > math.MaxInt32 || n < math.MinInt32 {
+		return 0, storage.ErrNotInteger
+	}
+
+	return int(n), nil
+}
@@ -0,0 +1,46 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"testing"
+)
+
+func TestSetReplies(t *testing.T) {
+	ts := newTestSession(t)
+
+	ts.expect("$-1\r\n", "set", "set-replies", "1", "xx")
+	ts.expect("+OK\r\n", "set", "set-replies", "1", "nx")
+	ts.expect("$-1\r\n", "set", "set-replies", "2", "nx")
+	ts.expect("$1\r\n1\r\n", "set", "set-replies", "2", "xx", "get")
+	ts.expect("-ERR syntax error\r\n", "set", "set-replies", "3", "nx", "xx")
+	ts.expect("-ERR syntax error\r\n", "set", "set-replies", "3", "ex", "10")
+	ts.expect("+OK\r\n", "set", "set-replies", "3", "keepttl")
+
+	ts.expect(":0\r\n", "setnx", "set-replies", "4")
+	ts.expect(":1\r\n", "setnx", "setnx-replies", "4")
+
+	ts.expect("$1\r\n3\r\n", "getset", "set-replies", "5")
+	ts.expect("$-1\r\n", "getset", "getset-replies", "6")
+
+	ts.expect("$1\r\n5\r\n", "getdel", "set-replies")
+	ts.expect("$-1\r\n", "getdel", "set-replies")
+	ts.expect("$-1\r\n", "get", "set-replies")
+
+	ts.expect(":2\r\n", "del", "setnx-replies", "getset-replies")
+}
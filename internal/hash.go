@@ -0,0 +1,276 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerHashHandlers(m map[string]HandlerFn) {
+	m["hset"] = func(r *Request) error {
+		added, err := storage.HSet(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: added,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hmset"] = func(r *Request) error {
+		if _, err := storage.HSet(r.GetDBNum(), r.Args); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hsetnx"] = func(r *Request) error {
+		added, err := storage.HSetNX(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: added,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hget"] = func(r *Request) error {
+		value, err := storage.HGet(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hmget"] = func(r *Request) error {
+		values, err := storage.HMGet(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := MultiBulkFromBytes(values)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hdel"] = func(r *Request) error {
+		deleted, err := storage.HDel(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: deleted,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hexists"] = func(r *Request) error {
+		found, err := storage.HExists(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: found,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hlen"] = func(r *Request) error {
+		length, err := storage.HLen(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: length,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hstrlen"] = func(r *Request) error {
+		length, err := storage.HStrLen(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: length,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	hgetall := func(name string, withFields, withValues bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) != 1 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			values, err := storage.HGetAll(r.GetDBNum(), r.Args[0], withFields, withValues)
+			if err != nil {
+				return err
+			}
+
+			reply := MultiBulkFromBytes(values)
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["hkeys"] = hgetall("hkeys", true, false)
+	m["hvals"] = hgetall("hvals", false, true)
+	m["hgetall"] = hgetall("hgetall", true, true)
+
+	m["hincrby"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'hincrby' command")
+		}
+
+		delta, err := storage.ParseInt(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		value, err := storage.HIncrBy(r.GetDBNum(), r.Args[0], r.Args[1], delta)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: int(value),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hincrbyfloat"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'hincrbyfloat' command")
+		}
+
+		delta, err := storage.ParseFloat(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		value, err := storage.HIncrByFloat(r.GetDBNum(), r.Args[0], r.Args[1], delta)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hscan"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'hscan' command")
+		}
+
+		scan, err := parseScanArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		cursor, items, err := storage.HScan(r.GetDBNum(), r.Args[0], scan.cursor, scan.pattern, scan.count)
+		if err != nil {
+			return err
+		}
+
+		reply := scanReply(cursor, items)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,88 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerHyperLogLogHandlers(m map[string]HandlerFn) {
+	m["pfadd"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'pfadd' command")
+		}
+
+		changed, err := storage.PFAdd(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: changed,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["pfcount"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'pfcount' command")
+		}
+
+		count, err := storage.PFCount(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: count,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["pfmerge"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'pfmerge' command")
+		}
+
+		if err := storage.PFMerge(r.GetDBNum(), r.Args[0], r.Args[1:]); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,241 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// jsonReply builds the reply of the JSON.* commands replying an integer,
+// a string, an array of them or nil depending on the path
+func jsonReply(result interface{}) ReplyWriter {
+	switch v := result.(type) {
+	case int:
+		return &IntegerReply{
+			number: v,
+		}
+	case []interface{}:
+		return &MultiBulkReply{
+			values: v,
+		}
+	case []byte:
+		return &BulkReply{
+			value: v,
+		}
+	}
+
+	return &BulkReply{}
+}
+
+// jsonPathArg returns the optional path argument at i, the root if missing
+func jsonPathArg(args [][]byte, i int) string {
+	if len(args) > i {
+		return string(args[i])
+	}
+
+	return "."
+}
+
+func registerJSONHandlers(m map[string]HandlerFn) {
+	m["json.set"] = func(r *Request) error {
+		if len(r.Args) < 3 || len(r.Args) > 4 {
+			return errors.New("wrong number of arguments for 'json.set' command")
+		}
+
+		nx, xx := false, false
+		if len(r.Args) == 4 {
+			switch strings.ToLower(string(r.Args[3])) {
+			case "nx":
+				nx = true
+			case "xx":
+				xx = true
+			default:
+				return storage.ErrSyntax
+			}
+		}
+
+		set, err := storage.JSONSet(r.GetDBNum(), r.Args[0], string(r.Args[1]), r.Args[2], nx, xx)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter = &BulkReply{}
+		if set {
+			reply = &StatusReply{
+				Code: "OK",
+			}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["json.get"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'json.get' command")
+		}
+
+		format, paths, err := storage.ParseJSONGetArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		value, err := storage.JSONGet(r.GetDBNum(), r.Args[0], paths, format)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["json.mget"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'json.mget' command")
+		}
+
+		values, err := storage.JSONMGet(r.GetDBNum(), r.Args[:len(r.Args)-1], string(r.Args[len(r.Args)-1]))
+		if err != nil {
+			return err
+		}
+
+		reply := MultiBulkFromBytes(values)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["json.del"] = func(r *Request) error {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return errors.New("wrong number of arguments for 'json.del' command")
+		}
+
+		deleted, err := storage.JSONDel(r.GetDBNum(), r.Args[0], jsonPathArg(r.Args, 1))
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: deleted,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["json.arrappend"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'json.arrappend' command")
+		}
+
+		lengths, err := storage.JSONArrAppend(r.GetDBNum(), r.Args[0], string(r.Args[1]), r.Args[2:])
+		if err != nil {
+			return err
+		}
+
+		if _, err := jsonReply(lengths).WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["json.numincrby"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'json.numincrby' command")
+		}
+
+		value, err := storage.JSONNumIncrBy(r.GetDBNum(), r.Args[0], string(r.Args[1]), r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["json.type"] = func(r *Request) error {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return errors.New("wrong number of arguments for 'json.type' command")
+		}
+
+		types, err := storage.JSONType(r.GetDBNum(), r.Args[0], jsonPathArg(r.Args, 1))
+		if err != nil {
+			return err
+		}
+
+		// the type at a legacy path is a simple string
+		var reply ReplyWriter
+		if typ, ok := types.([]byte); ok {
+			reply = &StatusReply{
+				Code: string(typ),
+			}
+		} else {
+			reply = jsonReply(types)
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["json.objkeys"] = func(r *Request) error {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return errors.New("wrong number of arguments for 'json.objkeys' command")
+		}
+
+		keys, err := storage.JSONObjKeys(r.GetDBNum(), r.Args[0], jsonPathArg(r.Args, 1))
+		if err != nil {
+			return err
+		}
+
+		if _, err := jsonReply(keys).WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
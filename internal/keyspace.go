@@ -0,0 +1,139 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerKeyspaceHandlers(m map[string]HandlerFn) {
+	m["rename"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'rename' command")
+		}
+
+		if _, err := storage.Rename(r.GetDBNum(), r.Args[0], r.Args[1], false); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["renamenx"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'renamenx' command")
+		}
+
+		renamed, err := storage.Rename(r.GetDBNum(), r.Args[0], r.Args[1], true)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{}
+		if renamed {
+			reply.number = 1
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["copy"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'copy' command")
+		}
+
+		opts, err := storage.ParseCopyOptions(r.GetDBNum(), r.Args[2:])
+		if err != nil {
+			return err
+		}
+
+		copied, err := storage.Copy(r.GetDBNum(), r.Args[0], r.Args[1], opts)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{}
+		if copied {
+			reply.number = 1
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["move"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'move' command")
+		}
+
+		db, err := storage.ParseDBIndex(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		moved, err := storage.Move(r.GetDBNum(), r.Args[0], db)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{}
+		if moved {
+			reply.number = 1
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["touch"] = func(r *Request) error {
+		touched, err := storage.Touch(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: touched,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,580 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// parseSide parses the LEFT|RIGHT arguments of LMOVE and BLMOVE,
+// returning true for LEFT
+func parseSide(arg []byte) (bool, error) {
+	switch strings.ToLower(string(arg)) {
+	case "left":
+		return true, nil
+	case "right":
+		return false, nil
+	default:
+		return false, storage.ErrSyntax
+	}
+}
+
+// parseTimeout parses the timeout in seconds of the blocking commands
+func parseTimeout(arg []byte) (time.Duration, error) {
+	seconds, err := storage.ParseFloat(arg)
+	if err != nil || math.IsInf(seconds, 0) {
+		return 0, errors.New("timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return 0, errors.New("timeout is negative")
+	}
+	if seconds >= float64(math.MaxInt64)/float64(time.Second) {
+		// it would overflow time.Duration
+		return 0, errors.New("timeout is out of range")
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// blockingPop pops from the first non-empty list among keys, blocking up
+// to timeout if they are all empty. Inside a transaction it never blocks.
+// The result is nil if the timeout expired.
+func blockingPop(r *Request, keys [][]byte, left bool, dst []byte, toLeft bool, timeout time.Duration) (*storage.BlockedResult, error) {
+	if r.Session.inExec {
+		// EXEC already holds execLock
+		result, _, err := storage.BlockingPop(r.GetDBNum(), keys, left, dst, toLeft, true)
+		return result, err
+	}
+
+	execLock.RLock()
+	result, waiter, err := storage.BlockingPop(r.GetDBNum(), keys, left, dst, toLeft, false)
+	if err == nil {
+		// BLMOVE might have pushed to a list other clients are waiting for
+		storage.ServeBlocked()
+	}
+	execLock.RUnlock()
+
+	if err != nil || waiter == nil {
+		return result, err
+	}
+
+	gone, stop := r.Session.watchDisconnect()
+	result = waiter.Wait(timeout, gone)
+	stop()
+
+	if result != nil && result.Err != nil {
+		return nil, result.Err
+	}
+
+	return result, nil
+}
+
+// restorePopped pushes the element popped for a client that went away back
+// where it was, for the next client to get it
+func restorePopped(r *Request, result *storage.BlockedResult, left bool) {
+	if !r.Session.inExec {
+		// EXEC already holds execLock
+		execLock.RLock()
+		defer execLock.RUnlock()
+	}
+
+	if _, err := storage.Push(r.GetDBNum(), [][]byte{result.Key, result.Value}, left, false); err != nil {
+		log.Println(err)
+		return
+	}
+
+	storage.ServeBlocked()
+}
+
+func registerListHandlers(m map[string]HandlerFn) {
+	push := func(name string, left, onlyExisting bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) < 2 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			length, err := storage.Push(r.GetDBNum(), r.Args, left, onlyExisting)
+			if err != nil {
+				return err
+			}
+
+			reply := IntegerReply{
+				number: length,
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["lpush"] = push("lpush", true, false)
+	m["rpush"] = push("rpush", false, false)
+	m["lpushx"] = push("lpushx", true, true)
+	m["rpushx"] = push("rpushx", false, true)
+
+	pop := func(name string, left bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) < 1 || len(r.Args) > 2 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			count := 1
+			if len(r.Args) == 2 {
+				var err error
+				if count, err = atoi(r.Args[1]); err != nil || count < 0 {
+					return errors.New("value is out of range, must be positive")
+				}
+			}
+
+			values, err := storage.Pop(r.GetDBNum(), r.Args[0], count, left)
+			if err != nil {
+				return err
+			}
+
+			var reply ReplyWriter
+			switch {
+			case len(r.Args) == 1 && len(values) == 0:
+				reply = &BulkReply{}
+			case len(r.Args) == 1:
+				reply = &BulkReply{
+					value: values[0],
+				}
+			case values == nil:
+				reply = &NilMultiBulkReply{}
+			default:
+				reply = MultiBulkFromBytes(values)
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["lpop"] = pop("lpop", true)
+	m["rpop"] = pop("rpop", false)
+
+	m["llen"] = func(r *Request) error {
+		length, err := storage.LLen(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: length,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lindex"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'lindex' command")
+		}
+
+		index, err := atoi(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		value, err := storage.LIndex(r.GetDBNum(), r.Args[0], index)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lrange"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'lrange' command")
+		}
+
+		start, err := atoi(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		stop, err := atoi(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		values, err := storage.LRange(r.GetDBNum(), r.Args[0], start, stop)
+		if err != nil {
+			return err
+		}
+
+		reply := MultiBulkFromBytes(values)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ltrim"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'ltrim' command")
+		}
+
+		start, err := atoi(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		stop, err := atoi(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.LTrim(r.GetDBNum(), r.Args[0], start, stop); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lset"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'lset' command")
+		}
+
+		index, err := atoi(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.LSet(r.GetDBNum(), r.Args[0], index, r.Args[2]); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["linsert"] = func(r *Request) error {
+		if len(r.Args) != 4 {
+			return errors.New("wrong number of arguments for 'linsert' command")
+		}
+
+		var before bool
+		switch strings.ToLower(string(r.Args[1])) {
+		case "before":
+			before = true
+		case "after":
+		default:
+			return storage.ErrSyntax
+		}
+
+		length, err := storage.LInsert(r.GetDBNum(), r.Args[0], before, r.Args[2], r.Args[3])
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: length,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lrem"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'lrem' command")
+		}
+
+		count, err := atoi(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		removed, err := storage.LRem(r.GetDBNum(), r.Args[0], count, r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: removed,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lpos"] = func(r *Request) error {
+		if len(r.Args) < 2 || len(r.Args)%2 != 0 {
+			return errors.New("wrong number of arguments for 'lpos' command")
+		}
+
+		rank, count, maxLen := 1, 1, 0
+		withCount := false
+		for i := 2; i < len(r.Args); i += 2 {
+			value, err := atoi(r.Args[i+1])
+			if err != nil {
+				return err
+			}
+
+			switch strings.ToLower(string(r.Args[i])) {
+			case "rank":
+				if value == 0 {
+					return errors.New("RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+				}
+				rank = value
+			case "count":
+				if value < 0 {
+					return errors.New("COUNT can't be negative")
+				}
+				count = value
+				withCount = true
+			case "maxlen":
+				if value < 0 {
+					return errors.New("MAXLEN can't be negative")
+				}
+				maxLen = value
+			default:
+				return storage.ErrSyntax
+			}
+		}
+
+		indexes, err := storage.LPos(r.GetDBNum(), r.Args[0], r.Args[1], rank, count, maxLen)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter
+		switch {
+		case withCount:
+			values := make([]interface{}, len(indexes))
+			for i := range indexes {
+				values[i] = indexes[i]
+			}
+			reply = &MultiBulkReply{
+				values: values,
+			}
+		case len(indexes) == 0:
+			reply = &BulkReply{}
+		default:
+			reply = &IntegerReply{
+				number: indexes[0],
+			}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lmove"] = func(r *Request) error {
+		if len(r.Args) != 4 {
+			return errors.New("wrong number of arguments for 'lmove' command")
+		}
+
+		fromLeft, err := parseSide(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		toLeft, err := parseSide(r.Args[3])
+		if err != nil {
+			return err
+		}
+
+		value, err := storage.LMove(r.GetDBNum(), r.Args[0], r.Args[1], fromLeft, toLeft)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["rpoplpush"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'rpoplpush' command")
+		}
+
+		value, err := storage.LMove(r.GetDBNum(), r.Args[0], r.Args[1], false, true)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	bpop := func(name string, left bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) < 2 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			timeout, err := parseTimeout(r.Args[len(r.Args)-1])
+			if err != nil {
+				return err
+			}
+
+			result, err := blockingPop(r, r.Args[:len(r.Args)-1], left, nil, false, timeout)
+			if err != nil {
+				return err
+			}
+
+			var reply ReplyWriter
+			if result == nil {
+				reply = &NilMultiBulkReply{}
+			} else {
+				reply = MultiBulkFromBytes([][]byte{result.Key, result.Value})
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				if result != nil {
+					restorePopped(r, result, left)
+				}
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["blpop"] = bpop("blpop", true)
+	m["brpop"] = bpop("brpop", false)
+
+	m["blmove"] = func(r *Request) error {
+		if len(r.Args) != 5 {
+			return errors.New("wrong number of arguments for 'blmove' command")
+		}
+
+		fromLeft, err := parseSide(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		toLeft, err := parseSide(r.Args[3])
+		if err != nil {
+			return err
+		}
+
+		timeout, err := parseTimeout(r.Args[4])
+		if err != nil {
+			return err
+		}
+
+		result, err := blockingPop(r, r.Args[:1], fromLeft, r.Args[1], toLeft, timeout)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{}
+		if result != nil {
+			reply.value = result.Value
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["brpoplpush"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'brpoplpush' command")
+		}
+
+		timeout, err := parseTimeout(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		result, err := blockingPop(r, r.Args[:1], false, r.Args[1], true, timeout)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{}
+		if result != nil {
+			reply.value = result.Value
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -200,6 +200,7 @@ import (
 	"io"
 	"reflect"
 	"strconv"
+	"strings"
 )
 
 type ReplyWriter io.WriterTo
@@ -217,6 +218,32 @@ func (r *StatusReply) WriteTo(w io.Writer) (int64, error) {
 	return int64(n), err
 }
 
+type ErrorReply struct {
+	Message string
+}
+
+// NewErrorReply builds the reply for err, prefixing it with the generic
+// ERR code unless the message already starts with its own error code
+// (e.g. WRONGTYPE, EXECABORT)
+func NewErrorReply(err error) *ErrorReply {
+	message := strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+
+	code := message
+	if i := strings.IndexByte(message, ' '); i >= 0 {
+		code = message[:i]
+	}
+	if code == "" || strings.TrimLeft(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		message = "ERR " + message
+	}
+
+	return &ErrorReply{message}
+}
+
+func (r *ErrorReply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("-" + r.Message + "\r\n"))
+	return int64(n), err
+}
+
 type IntegerReply struct {
 	number int
 }
@@ -261,7 +288,8 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 		wroteCrLf, err := w.Write([]byte("\r\n"))
 		return int64(wrote + wroteBytes + wroteCrLf), err
 	case []byte:
-		if len(v) == 0 {
+		// only a nil slice is a NullBulkReply, an empty one is an empty string
+		if v == nil {
 			n, err := w.Write([]byte("$-1\r\n"))
 			return int64(n), err
 		}
@@ -275,6 +303,9 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 		}
 		wroteCrLf, err := w.Write([]byte("\r\n"))
 		return int64(wrote + wroteBytes + wroteCrLf), err
+	case error:
+		// an error in a multi bulk reply, e.g. for a single item of BF.MADD
+		return NewErrorReply(v).WriteTo(w)
 	case int:
 		wrote, err := w.Write([]byte(":" + strconv.Itoa(v) + "\r\n"))
 		if err != nil {
@@ -333,6 +364,15 @@ func MultiBulkFromMap(m map[string]interface{}) *MultiBulkReply {
 	return &MultiBulkReply{values: values}
 }
 
+// MultiBulkFromBytes builds a multi bulk reply, nil values are NullBulkReplies
+func MultiBulkFromBytes(values [][]byte) *MultiBulkReply {
+	result := make([]interface{}, len(values))
+	for i := range values {
+		result[i] = values[i]
+	}
+	return &MultiBulkReply{values: result}
+}
+
 func writeMultiBytes(values []interface{}, w io.Writer) (int64, error) {
 	if values == nil {
 		return 0, errors.New("nil in multi bulk replies are not ok")
@@ -352,6 +392,14 @@ func writeMultiBytes(values []interface{}, w io.Writer) (int64, error) {
 	return wrote64, err
 }
 
+// NilMultiBulkReply is the null array, e.g. the reply to an aborted EXEC
+type NilMultiBulkReply struct{}
+
+func (r *NilMultiBulkReply) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write([]byte("*-1\r\n"))
+	return int64(n), err
+}
+
 func (r *MultiBulkReply) WriteTo(w io.Writer) (int64, error) {
 	return writeMultiBytes(r.values, w)
 }
@@ -23,10 +23,11 @@ import (
 )
 
 type Request struct {
-	DB   [][]byte
-	Name string
-	Args [][]byte
-	Conn net.Conn
+	DB      [][]byte
+	Name    string
+	Args    [][]byte
+	Conn    net.Conn
+	Session *Session
 }
 
 func (r *Request) GetDBNum() int {
@@ -0,0 +1,87 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+type scanArgs struct {
+	cursor  uint64
+	pattern []byte
+	count   int
+}
+
+// parseScanArgs parses the "cursor [MATCH pattern] [COUNT count]"
+// arguments shared by the SCAN family of commands
+func parseScanArgs(args [][]byte) (scanArgs, error) {
+	result := scanArgs{
+		count: 10,
+	}
+
+	if len(args) < 1 {
+		return result, errors.New("wrong number of arguments")
+	}
+
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return result, errInvalidCursor
+	}
+	result.cursor = cursor
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return result, errors.New("syntax error")
+		}
+
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			result.pattern = args[i+1]
+			if string(result.pattern) == "*" {
+				result.pattern = nil
+			}
+		case "count":
+			count, err := strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return result, errors.New("value is not an integer or out of range")
+			}
+			if count < 1 {
+				return result, errors.New("syntax error")
+			}
+			result.count = count
+		default:
+			return result, errors.New("syntax error")
+		}
+	}
+
+	return result, nil
+}
+
+// scanReply builds the [cursor, [items...]] reply of the SCAN family
+func scanReply(cursor uint64, items [][]byte) *MultiBulkReply {
+	return &MultiBulkReply{
+		values: []interface{}{
+			[]byte(strconv.FormatUint(cursor, 10)),
+			MultiBulkFromBytes(items).values,
+		},
+	}
+}
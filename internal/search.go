@@ -0,0 +1,211 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// searchInfoReply builds the reply of FT.INFO
+func searchInfoReply(info *storage.FTIndexInfo) []interface{} {
+	prefixes := make([]interface{}, len(info.SearchIndexDef.Prefixes))
+	for i, prefix := range info.SearchIndexDef.Prefixes {
+		prefixes[i] = []byte(prefix)
+	}
+	if len(prefixes) == 0 {
+		prefixes = append(prefixes, []byte{})
+	}
+
+	attributes := make([]interface{}, len(info.SearchIndexDef.Fields))
+	for i, field := range info.SearchIndexDef.Fields {
+		attribute := []interface{}{
+			[]byte("identifier"), []byte(field.Name),
+			[]byte("attribute"), []byte(field.Name),
+			[]byte("type"), []byte(field.Type),
+		}
+
+		switch field.Type {
+		case storage.SearchText:
+			attribute = append(attribute, []byte("WEIGHT"), []byte(storage.FormatFloat(field.Weight)))
+		case storage.SearchTag:
+			attribute = append(attribute, []byte("SEPARATOR"), []byte(field.Separator))
+			if field.CaseSensitive {
+				attribute = append(attribute, []byte("CASESENSITIVE"))
+			}
+		case storage.SearchVector:
+			attribute = append(attribute,
+				[]byte("algorithm"), []byte(field.Algorithm),
+				[]byte("data_type"), []byte("FLOAT32"),
+				[]byte("dim"), field.Dim,
+				[]byte("distance_metric"), []byte(field.DistanceMetric),
+			)
+			if field.M > 0 {
+				attribute = append(attribute,
+					[]byte("M"), field.M,
+					[]byte("ef_construction"), field.EFConstruction,
+					[]byte("ef_runtime"), field.EFRuntime,
+				)
+			}
+		}
+		if field.Sortable {
+			attribute = append(attribute, []byte("SORTABLE"))
+		}
+
+		attributes[i] = attribute
+	}
+
+	indexing := 0
+	if info.Indexing {
+		indexing = 1
+	}
+
+	return []interface{}{
+		[]byte("index_name"), []byte(info.Name),
+		[]byte("index_definition"), []interface{}{
+			[]byte("key_type"), []byte(info.SearchIndexDef.On),
+			[]byte("prefixes"), prefixes,
+		},
+		[]byte("attributes"), attributes,
+		[]byte("num_docs"), info.NumDocs,
+		[]byte("indexing"), indexing,
+		[]byte("percent_indexed"), []byte(storage.FormatFloat(info.PercentIndexed)),
+	}
+}
+
+func registerSearchHandlers(m map[string]HandlerFn) {
+	m["ft.create"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'ft.create' command")
+		}
+
+		def, err := storage.ParseFTCreateArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.FTCreate(r.GetDBNum(), r.Args[0], def); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ft.search"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'ft.search' command")
+		}
+
+		args, err := storage.ParseFTSearchArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		total, matches, err := storage.FTSearch(r.GetDBNum(), r.Args[0], args)
+		if err != nil {
+			return err
+		}
+
+		values := []interface{}{total}
+		for _, match := range matches {
+			values = append(values, match.Key)
+
+			if args.WithScores {
+				values = append(values, []byte(storage.FormatFloat(match.Score)))
+			}
+
+			if !args.NoContent {
+				fields := make([]interface{}, len(match.Fields))
+				for i, field := range match.Fields {
+					fields[i] = field
+				}
+
+				values = append(values, fields)
+			}
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ft.info"] = func(r *Request) error {
+		if len(r.Args) != 1 {
+			return errors.New("wrong number of arguments for 'ft.info' command")
+		}
+
+		info, err := storage.FTInfo(r.GetDBNum(), r.Args[0])
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: searchInfoReply(info),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ft.dropindex"] = func(r *Request) error {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return errors.New("wrong number of arguments for 'ft.dropindex' command")
+		}
+
+		deleteDocs := false
+		if len(r.Args) == 2 {
+			if strings.ToUpper(string(r.Args[1])) != "DD" {
+				return storage.ErrSyntax
+			}
+			deleteDocs = true
+		}
+
+		if err := storage.FTDropIndex(r.GetDBNum(), r.Args[0], deleteDocs); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
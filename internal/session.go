@@ -0,0 +1,227 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// execLock makes EXEC atomic: every command runs holding it for reading
+// while EXEC holds it for writing, so that no other client's command
+// can interleave with the ones of a transaction
+var execLock sync.RWMutex
+
+// transactionCommands are executed right away even inside a MULTI block
+var transactionCommands = map[string]bool{
+	"multi":   true,
+	"exec":    true,
+	"discard": true,
+	"watch":   true,
+	"unwatch": true,
+	"quit":    true,
+}
+
+type watch struct {
+	db      int
+	key     []byte
+	version uint64
+}
+
+// blockingCommands release execLock while they wait, so they take it by themselves
+var blockingCommands = map[string]bool{
+	"blpop":      true,
+	"brpop":      true,
+	"blmove":     true,
+	"brpoplpush": true,
+	"xread":      true,
+	"xreadgroup": true,
+}
+
+// Session holds the state of a single client connection
+type Session struct {
+	Conn    net.Conn
+	DB      [][]byte
+	reader  *bufio.Reader
+	inMulti bool
+	inExec  bool // commands must not block while EXEC runs them
+	dirty   bool // a command was rejected inside MULTI, EXEC must abort
+	queue   []*Request
+	watches []watch
+}
+
+func NewSession(conn net.Conn, reader *bufio.Reader) *Session {
+	return &Session{
+		Conn:   conn,
+		DB:     [][]byte{[]byte("0")},
+		reader: reader,
+	}
+}
+
+// Handle runs or queues a request, replying with an error
+// to the client if the command fails. The returned error is non-nil
+// only when the client connection can't be used anymore.
+func (s *Session) Handle(methods map[string]HandlerFn, r *Request) error {
+	r.Conn = s.Conn
+	r.Session = s
+	r.DB = s.DB
+
+	handler, ok := methods[r.Name]
+	if !ok {
+		if s.inMulti {
+			s.dirty = true
+		}
+
+		return writeError(r.Conn, fmt.Errorf("unknown command '%s'", r.Name))
+	}
+
+	if s.inMulti && !transactionCommands[r.Name] {
+		if !checkArity(r) {
+			s.dirty = true
+
+			return writeError(r.Conn, fmt.Errorf("wrong number of arguments for '%s' command", r.Name))
+		}
+
+		s.queue = append(s.queue, r)
+
+		reply := &StatusReply{
+			Code: "QUEUED",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	if r.Name == "exec" || blockingCommands[r.Name] {
+		// these take execLock by themselves
+		return s.call(handler, r)
+	}
+
+	execLock.RLock()
+	defer execLock.RUnlock()
+
+	if err := s.call(handler, r); err != nil {
+		return err
+	}
+
+	storage.ServeBlocked()
+
+	return nil
+}
+
+func (s *Session) call(handler HandlerFn, r *Request) error {
+	r.DB = s.DB
+
+	if err := handler(r); err != nil {
+		return writeError(r.Conn, err)
+	}
+
+	return nil
+}
+
+// watchDisconnect notices a client going away while its command blocks.
+// The returned channel is closed when the client disconnects, stop must be
+// called once the command is done blocking, before reading any other request.
+func (s *Session) watchDisconnect() (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			// wait for a byte past the pipelined requests already buffered,
+			// or they would hide the disconnection
+			_, err := s.reader.Peek(s.reader.Buffered() + 1)
+			if err == nil {
+				// more requests pipelined
+				continue
+			}
+
+			if err == bufio.ErrBufferFull {
+				// nothing more can be read until the command is over,
+				// the reply failing to be written is the only sign left
+				return
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// interrupted by stop
+				return
+			}
+
+			close(gone)
+			return
+		}
+	}()
+
+	stop := func() {
+		// unblock the pending Peek, the data already read stays buffered
+		s.Conn.SetReadDeadline(time.Now())
+		<-done
+		s.Conn.SetReadDeadline(time.Time{})
+	}
+
+	return gone, stop
+}
+
+// Close releases the resources held by the session
+func (s *Session) Close() {
+	s.unwatchAll()
+}
+
+func (s *Session) unwatchAll() {
+	for _, w := range s.watches {
+		storage.Unwatch(w.db, w.key)
+	}
+	s.watches = nil
+}
+
+// watchedKeysChanged reports if any WATCHed key was modified
+// since the WATCH command
+func (s *Session) watchedKeysChanged() bool {
+	for _, w := range s.watches {
+		if storage.Version(w.db, w.key) != w.version {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Session) discard() {
+	s.inMulti = false
+	s.dirty = false
+	s.queue = nil
+	s.unwatchAll()
+}
+
+func writeError(w net.Conn, err error) error {
+	if _, err := NewErrorReply(err).WriteTo(w); err != nil {
+		return err
+	}
+
+	return nil
+}
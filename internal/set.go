@@ -0,0 +1,296 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerSetHandlers(m map[string]HandlerFn) {
+	m["sadd"] = func(r *Request) error {
+		added, err := storage.SAdd(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: added,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["srem"] = func(r *Request) error {
+		removed, err := storage.SRem(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: removed,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["sismember"] = func(r *Request) error {
+		found, err := storage.SIsMember(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: found,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["smismember"] = func(r *Request) error {
+		found, err := storage.SMIsMember(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(found))
+		for i := range found {
+			values[i] = found[i]
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["smembers"] = func(r *Request) error {
+		members, err := storage.SMembers(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := MultiBulkFromBytes(members)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["scard"] = func(r *Request) error {
+		card, err := storage.SCard(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: card,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	operation := func(name, op string) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) < 1 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			members, err := storage.SetOperation(r.GetDBNum(), r.Args, op)
+			if err != nil {
+				return err
+			}
+
+			reply := MultiBulkFromBytes(members)
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["sinter"] = operation("sinter", "inter")
+	m["sunion"] = operation("sunion", "union")
+	m["sdiff"] = operation("sdiff", "diff")
+
+	operationStore := func(name, op string) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) < 2 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			card, err := storage.SetOperationStore(r.GetDBNum(), r.Args[0], r.Args[1:], op)
+			if err != nil {
+				return err
+			}
+
+			reply := IntegerReply{
+				number: card,
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["sinterstore"] = operationStore("sinterstore", "inter")
+	m["sunionstore"] = operationStore("sunionstore", "union")
+	m["sdiffstore"] = operationStore("sdiffstore", "diff")
+
+	m["srandmember"] = func(r *Request) error {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return errors.New("wrong number of arguments for 'srandmember' command")
+		}
+
+		count := 1
+		if len(r.Args) == 2 {
+			var err error
+			if count, err = atoi(r.Args[1]); err != nil {
+				return err
+			}
+		}
+
+		members, err := storage.SRandMember(r.GetDBNum(), r.Args[0], count)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter
+		switch {
+		case len(r.Args) == 1 && len(members) == 0:
+			reply = &BulkReply{}
+		case len(r.Args) == 1:
+			reply = &BulkReply{
+				value: members[0],
+			}
+		default:
+			reply = MultiBulkFromBytes(members)
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["spop"] = func(r *Request) error {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return errors.New("wrong number of arguments for 'spop' command")
+		}
+
+		count := 1
+		if len(r.Args) == 2 {
+			var err error
+			if count, err = atoi(r.Args[1]); err != nil || count < 0 {
+				return errors.New("value is out of range, must be positive")
+			}
+		}
+
+		members, err := storage.SPop(r.GetDBNum(), r.Args[0], count)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter
+		switch {
+		case len(r.Args) == 1 && len(members) == 0:
+			reply = &BulkReply{}
+		case len(r.Args) == 1:
+			reply = &BulkReply{
+				value: members[0],
+			}
+		default:
+			reply = MultiBulkFromBytes(members)
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["smove"] = func(r *Request) error {
+		moved, err := storage.SMove(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: moved,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["sscan"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'sscan' command")
+		}
+
+		scan, err := parseScanArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		cursor, items, err := storage.SScan(r.GetDBNum(), r.Args[0], scan.cursor, scan.pattern, scan.count)
+		if err != nil {
+			return err
+		}
+
+		reply := scanReply(cursor, items)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,384 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// streamEntriesReply builds the [id, [field, value, ...]] pairs of entries,
+// [id, nil] for the ones deleted from the stream
+func streamEntriesReply(entries []storage.StreamEntry) []interface{} {
+	values := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		if entry.Fields == nil {
+			values[i] = []interface{}{[]byte(entry.ID.String()), nil}
+			continue
+		}
+
+		fields := make([]interface{}, len(entry.Fields))
+		for j := range entry.Fields {
+			fields[j] = entry.Fields[j]
+		}
+
+		values[i] = []interface{}{[]byte(entry.ID.String()), fields}
+	}
+
+	return values
+}
+
+func streamReadReply(results []storage.StreamRead) ReplyWriter {
+	if len(results) == 0 {
+		return &NilMultiBulkReply{}
+	}
+
+	values := make([]interface{}, len(results))
+	for i, result := range results {
+		values[i] = []interface{}{result.Key, streamEntriesReply(result.Entries)}
+	}
+
+	return &MultiBulkReply{
+		values: values,
+	}
+}
+
+// readStreams calls read until it returns something, waiting for the streams
+// to change up to timeout (forever if 0) when block is set. Inside a
+// transaction it never blocks.
+func readStreams(r *Request, block bool, timeout time.Duration, read func(block bool) ([]storage.StreamRead, *storage.StreamWaiter, error)) ([]storage.StreamRead, error) {
+	if !block || r.Session.inExec {
+		// EXEC already holds execLock
+		if !r.Session.inExec {
+			execLock.RLock()
+			defer execLock.RUnlock()
+		}
+
+		results, _, err := read(false)
+		return results, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Duration(0)
+		if timeout > 0 {
+			if remaining = time.Until(deadline); remaining <= 0 {
+				return nil, nil
+			}
+		}
+
+		execLock.RLock()
+		results, waiter, err := read(true)
+		execLock.RUnlock()
+
+		if err != nil || waiter == nil {
+			return results, err
+		}
+
+		gone, stop := r.Session.watchDisconnect()
+		ready := waiter.Wait(remaining, gone)
+		stop()
+
+		if !ready {
+			return nil, nil
+		}
+	}
+}
+
+// streamReadArgs are the arguments of XREAD and XREADGROUP
+type streamReadArgs struct {
+	group    []byte
+	consumer []byte
+	count    int
+	block    bool
+	timeout  time.Duration
+	noAck    bool
+	keys     [][]byte
+	ids      [][]byte
+}
+
+func parseStreamReadArgs(name string, args [][]byte, group bool) (*streamReadArgs, error) {
+	read := &streamReadArgs{}
+
+	i := 0
+options:
+	for ; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "count":
+			if i+1 >= len(args) {
+				return nil, storage.ErrSyntax
+			}
+
+			n, err := storage.ParseInt(args[i+1])
+			if err != nil {
+				return nil, storage.ErrNotInteger
+			}
+			read.count = int(n)
+			i++
+		case option == "block":
+			if i+1 >= len(args) {
+				return nil, storage.ErrSyntax
+			}
+
+			ms, err := storage.ParseInt(args[i+1])
+			if err != nil {
+				return nil, errors.New("timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return nil, errors.New("timeout is negative")
+			}
+			read.block, read.timeout = true, time.Duration(ms)*time.Millisecond
+			i++
+		case option == "group" && group:
+			if i+2 >= len(args) {
+				return nil, storage.ErrSyntax
+			}
+
+			read.group, read.consumer = args[i+1], args[i+2]
+			i += 2
+		case option == "noack" && group:
+			read.noAck = true
+		case option == "streams":
+			break options
+		default:
+			return nil, storage.ErrSyntax
+		}
+	}
+
+	if i >= len(args) {
+		return nil, storage.ErrSyntax
+	}
+
+	if group && read.group == nil {
+		return nil, errors.New("Missing GROUP option for XREADGROUP")
+	}
+
+	streams := args[i+1:]
+	if len(streams) == 0 || len(streams)%2 != 0 {
+		special := "'$'"
+		if group {
+			special = "'>'"
+		}
+		return nil, errors.New("Unbalanced '" + name + "' list of streams: for each stream key an ID or " + special + " must be specified.")
+	}
+
+	read.keys = streams[:len(streams)/2]
+	read.ids = streams[len(streams)/2:]
+
+	return read, nil
+}
+
+func registerStreamHandlers(m map[string]HandlerFn) {
+	m["xadd"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'xadd' command")
+		}
+
+		xadd, err := storage.ParseXAddArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		id, err := storage.XAdd(r.GetDBNum(), r.Args[0], xadd)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: id,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xlen"] = func(r *Request) error {
+		length, err := storage.XLen(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: length,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	xrange := func(name string, rev bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) != 3 && len(r.Args) != 5 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			first, second := r.Args[1], r.Args[2]
+			if rev {
+				first, second = second, first
+			}
+
+			start, err := storage.ParseStreamRangeBound(first, true)
+			if err != nil {
+				return err
+			}
+
+			end, err := storage.ParseStreamRangeBound(second, false)
+			if err != nil {
+				return err
+			}
+
+			count := -1
+			if len(r.Args) == 5 {
+				if strings.ToLower(string(r.Args[3])) != "count" {
+					return storage.ErrSyntax
+				}
+
+				n, err := storage.ParseInt(r.Args[4])
+				if err != nil {
+					return storage.ErrNotInteger
+				}
+
+				count = 0
+				if n > 0 {
+					count = int(n)
+				}
+			}
+
+			entries, err := storage.XRange(r.GetDBNum(), r.Args[0], start, end, count, rev)
+			if err != nil {
+				return err
+			}
+
+			reply := &MultiBulkReply{
+				values: streamEntriesReply(entries),
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["xrange"] = xrange("xrange", false)
+	m["xrevrange"] = xrange("xrevrange", true)
+
+	m["xdel"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'xdel' command")
+		}
+
+		ids := make([]storage.StreamID, len(r.Args)-1)
+		for i, arg := range r.Args[1:] {
+			id, err := storage.ParseStreamID(arg, 0)
+			if err != nil {
+				return err
+			}
+			ids[i] = id
+		}
+
+		deleted, err := storage.XDel(r.GetDBNum(), r.Args[0], ids)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: deleted,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xtrim"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'xtrim' command")
+		}
+
+		trim, err := storage.ParseXTrimArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		trimmed, err := storage.XTrim(r.GetDBNum(), r.Args[0], trim)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: trimmed,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xread"] = func(r *Request) error {
+		read, err := parseStreamReadArgs("xread", r.Args, false)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]storage.StreamID, len(read.keys))
+		last := make([]bool, len(read.keys))
+		for j, arg := range read.ids {
+			if string(arg) == "$" {
+				last[j] = true
+				continue
+			}
+
+			id, err := storage.ParseStreamID(arg, 0)
+			if err != nil {
+				return err
+			}
+			ids[j] = id
+		}
+
+		results, err := readStreams(r, read.block, read.timeout, func(block bool) ([]storage.StreamRead, *storage.StreamWaiter, error) {
+			return storage.XRead(r.GetDBNum(), read.keys, ids, last, read.count, block)
+		})
+		if err != nil {
+			return err
+		}
+
+		reply := streamReadReply(results)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+}
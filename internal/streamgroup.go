@@ -0,0 +1,530 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// idleSince returns the ms elapsed since the unix time in ms t
+func idleSince(t uint64) int {
+	idle := int(time.Now().UnixNano()/int64(time.Millisecond)) - int(t)
+	if idle < 0 {
+		return 0
+	}
+
+	return idle
+}
+
+func streamIDsReply(ids []storage.StreamID) []interface{} {
+	values := make([]interface{}, len(ids))
+	for i, id := range ids {
+		values[i] = []byte(id.String())
+	}
+
+	return values
+}
+
+// claimedReply builds the reply of the claimed entries, only their IDs if justID
+func claimedReply(entries []storage.StreamEntry, justID bool) []interface{} {
+	if !justID {
+		return streamEntriesReply(entries)
+	}
+
+	ids := make([]storage.StreamID, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+	}
+
+	return streamIDsReply(ids)
+}
+
+func parseMinIdle(arg []byte, command string) (uint64, error) {
+	n, err := storage.ParseInt(arg)
+	if err != nil || n < 0 {
+		return 0, errors.New("Invalid min-idle-time argument for " + command)
+	}
+
+	return uint64(n), nil
+}
+
+func streamGroupInfoReply(info *storage.StreamGroupInfo) []interface{} {
+	return []interface{}{
+		[]byte("name"), info.Name,
+		[]byte("consumers"), info.Consumers,
+		[]byte("pending"), info.Pending,
+		[]byte("last-delivered-id"), []byte(info.LastDeliveredID.String()),
+		[]byte("entries-read"), info.EntriesRead,
+		[]byte("lag"), info.Lag,
+	}
+}
+
+func streamInfoReply(info *storage.StreamInfo, full bool) []interface{} {
+	values := []interface{}{
+		[]byte("length"), info.Length,
+		[]byte("last-generated-id"), []byte(info.LastGeneratedID.String()),
+		[]byte("max-deleted-entry-id"), []byte(info.MaxDeletedID.String()),
+		[]byte("entries-added"), int(info.EntriesAdded),
+		[]byte("recorded-first-entry-id"), []byte(info.RecordedFirstEntryID.String()),
+	}
+
+	if !full {
+		values = append(values, []byte("groups"), info.Groups)
+
+		for _, entry := range []*storage.StreamEntry{info.FirstEntry, info.LastEntry} {
+			name := []byte("first-entry")
+			if entry == info.LastEntry {
+				name = []byte("last-entry")
+			}
+
+			if entry == nil {
+				values = append(values, name, nil)
+			} else {
+				values = append(values, name, streamEntriesReply([]storage.StreamEntry{*entry})[0])
+			}
+		}
+
+		return values
+	}
+
+	groups := make([]interface{}, len(info.GroupInfos))
+	for i, group := range info.GroupInfos {
+		pending := make([]interface{}, len(group.PendingEntries))
+		for j, entry := range group.PendingEntries {
+			pending[j] = []interface{}{
+				[]byte(entry.ID.String()),
+				entry.Consumer,
+				int(entry.DeliveryTime),
+				int(entry.DeliveryCount),
+			}
+		}
+
+		consumers := make([]interface{}, len(group.ConsumerInfos))
+		for j, consumer := range group.ConsumerInfos {
+			consumerPending := make([]interface{}, len(consumer.PendingEntries))
+			for k, entry := range consumer.PendingEntries {
+				consumerPending[k] = []interface{}{
+					[]byte(entry.ID.String()),
+					int(entry.DeliveryTime),
+					int(entry.DeliveryCount),
+				}
+			}
+
+			consumers[j] = []interface{}{
+				[]byte("name"), consumer.Name,
+				[]byte("seen-time"), int(consumer.SeenTime),
+				[]byte("active-time"), int(consumer.ActiveTime),
+				[]byte("pel-count"), consumer.Pending,
+				[]byte("pending"), consumerPending,
+			}
+		}
+
+		groups[i] = []interface{}{
+			[]byte("name"), group.Name,
+			[]byte("last-delivered-id"), []byte(group.LastDeliveredID.String()),
+			[]byte("entries-read"), group.EntriesRead,
+			[]byte("lag"), group.Lag,
+			[]byte("pel-count"), group.Pending,
+			[]byte("pending"), pending,
+			[]byte("consumers"), consumers,
+		}
+	}
+
+	return append(values,
+		[]byte("entries"), streamEntriesReply(info.Entries),
+		[]byte("groups"), groups,
+	)
+}
+
+func registerStreamGroupHandlers(m map[string]HandlerFn) {
+	m["xgroup"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'xgroup' command")
+		}
+
+		result, err := storage.XGroup(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter
+		switch v := result.(type) {
+		case string:
+			reply = &StatusReply{
+				Code: v,
+			}
+		case int:
+			reply = &IntegerReply{
+				number: v,
+			}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xreadgroup"] = func(r *Request) error {
+		read, err := parseStreamReadArgs("xreadgroup", r.Args, true)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]storage.StreamID, len(read.keys))
+		newOnly := make([]bool, len(read.keys))
+		for j, arg := range read.ids {
+			if string(arg) == ">" {
+				newOnly[j] = true
+				continue
+			}
+
+			id, err := storage.ParseStreamID(arg, 0)
+			if err != nil {
+				return err
+			}
+			ids[j] = id
+		}
+
+		results, err := readStreams(r, read.block, read.timeout, func(block bool) ([]storage.StreamRead, *storage.StreamWaiter, error) {
+			return storage.XReadGroup(r.GetDBNum(), read.group, read.consumer, read.keys, ids, newOnly, read.count, read.noAck, block)
+		})
+		if err != nil {
+			return err
+		}
+
+		reply := streamReadReply(results)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xack"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'xack' command")
+		}
+
+		ids := make([]storage.StreamID, len(r.Args)-2)
+		for i, arg := range r.Args[2:] {
+			id, err := storage.ParseStreamID(arg, 0)
+			if err != nil {
+				return err
+			}
+			ids[i] = id
+		}
+
+		acked, err := storage.XAck(r.GetDBNum(), r.Args[0], r.Args[1], ids)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: acked,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xpending"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'xpending' command")
+		}
+
+		if len(r.Args) == 2 {
+			summary, err := storage.XPendingSummaryOf(r.GetDBNum(), r.Args[0], r.Args[1])
+			if err != nil {
+				return err
+			}
+
+			values := []interface{}{0, nil, nil, nil}
+			if summary.Count > 0 {
+				consumers := make([]interface{}, len(summary.Consumers))
+				for i, consumer := range summary.Consumers {
+					consumers[i] = []interface{}{consumer.Name, []byte(strconv.Itoa(consumer.Pending))}
+				}
+
+				values = []interface{}{
+					summary.Count,
+					[]byte(summary.First.String()),
+					[]byte(summary.Last.String()),
+					consumers,
+				}
+			}
+
+			reply := &MultiBulkReply{
+				values: values,
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+
+		args := r.Args[2:]
+		minIdle := uint64(0)
+		if strings.ToLower(string(args[0])) == "idle" {
+			if len(args) < 2 {
+				return storage.ErrSyntax
+			}
+
+			n, err := storage.ParseInt(args[1])
+			if err != nil {
+				return storage.ErrNotInteger
+			}
+			if n > 0 {
+				minIdle = uint64(n)
+			}
+			args = args[2:]
+		}
+
+		if len(args) != 3 && len(args) != 4 {
+			return storage.ErrSyntax
+		}
+
+		start, err := storage.ParseStreamRangeBound(args[0], true)
+		if err != nil {
+			return err
+		}
+
+		end, err := storage.ParseStreamRangeBound(args[1], false)
+		if err != nil {
+			return err
+		}
+
+		count, err := storage.ParseInt(args[2])
+		if err != nil {
+			return storage.ErrNotInteger
+		}
+
+		var consumer []byte
+		if len(args) == 4 {
+			consumer = args[3]
+		}
+
+		entries, err := storage.XPending(r.GetDBNum(), r.Args[0], r.Args[1], minIdle, start, end, int(count), consumer)
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(entries))
+		for i, entry := range entries {
+			values[i] = []interface{}{
+				[]byte(entry.ID.String()),
+				entry.Consumer,
+				idleSince(entry.DeliveryTime),
+				int(entry.DeliveryCount),
+			}
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xclaim"] = func(r *Request) error {
+		if len(r.Args) < 5 {
+			return errors.New("wrong number of arguments for 'xclaim' command")
+		}
+
+		minIdle, err := parseMinIdle(r.Args[3], "XCLAIM")
+		if err != nil {
+			return err
+		}
+
+		claim, err := storage.ParseXClaimArgs(r.Args[4:])
+		if err != nil {
+			return err
+		}
+
+		entries, err := storage.XClaim(r.GetDBNum(), r.Args[0], r.Args[1], r.Args[2], minIdle, claim)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: claimedReply(entries, claim.JustID),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xautoclaim"] = func(r *Request) error {
+		if len(r.Args) < 5 {
+			return errors.New("wrong number of arguments for 'xautoclaim' command")
+		}
+
+		minIdle, err := parseMinIdle(r.Args[3], "XAUTOCLAIM")
+		if err != nil {
+			return err
+		}
+
+		start, err := storage.ParseStreamRangeBound(r.Args[4], true)
+		if err != nil {
+			return err
+		}
+
+		count, justID := 100, false
+		for i := 5; i < len(r.Args); i++ {
+			switch strings.ToLower(string(r.Args[i])) {
+			case "count":
+				if i+1 >= len(r.Args) {
+					return storage.ErrSyntax
+				}
+
+				n, err := storage.ParseInt(r.Args[i+1])
+				if err != nil || n < 1 || n > 1<<20 {
+					return errors.New("COUNT must be > 0")
+				}
+				count = int(n)
+				i++
+			case "justid":
+				justID = true
+			default:
+				return storage.ErrSyntax
+			}
+		}
+
+		next, entries, deleted, err := storage.XAutoClaim(r.GetDBNum(), r.Args[0], r.Args[1], r.Args[2], minIdle, start, count, justID)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: []interface{}{
+				[]byte(next.String()),
+				claimedReply(entries, justID),
+				streamIDsReply(deleted),
+			},
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["xinfo"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'xinfo' command")
+		}
+
+		var values []interface{}
+		switch subcommand := strings.ToLower(string(r.Args[0])); subcommand {
+		case "stream":
+			full, count := false, 0
+			switch {
+			case len(r.Args) == 2:
+			case strings.ToLower(string(r.Args[2])) != "full":
+				return storage.ErrSyntax
+			case len(r.Args) == 3:
+				full, count = true, 10
+			case len(r.Args) == 5 && strings.ToLower(string(r.Args[3])) == "count":
+				n, err := storage.ParseInt(r.Args[4])
+				if err != nil {
+					return storage.ErrNotInteger
+				}
+				full, count = true, int(n)
+			default:
+				return storage.ErrSyntax
+			}
+
+			info, err := storage.XInfoStream(r.GetDBNum(), r.Args[1], full, count)
+			if err != nil {
+				return err
+			}
+
+			values = streamInfoReply(info, full)
+		case "groups":
+			if len(r.Args) != 2 {
+				return errors.New("wrong number of arguments for 'xinfo|groups' command")
+			}
+
+			groups, err := storage.XInfoGroups(r.GetDBNum(), r.Args[1])
+			if err != nil {
+				return err
+			}
+
+			values = make([]interface{}, len(groups))
+			for i, group := range groups {
+				values[i] = streamGroupInfoReply(group)
+			}
+		case "consumers":
+			if len(r.Args) != 3 {
+				return errors.New("wrong number of arguments for 'xinfo|consumers' command")
+			}
+
+			consumers, err := storage.XInfoConsumers(r.GetDBNum(), r.Args[1], r.Args[2])
+			if err != nil {
+				return err
+			}
+
+			values = make([]interface{}, len(consumers))
+			for i, consumer := range consumers {
+				inactive := -1
+				if consumer.ActiveTime > 0 {
+					inactive = idleSince(consumer.ActiveTime)
+				}
+
+				values[i] = []interface{}{
+					[]byte("name"), consumer.Name,
+					[]byte("pending"), consumer.Pending,
+					[]byte("idle"), idleSince(consumer.SeenTime),
+					[]byte("inactive"), inactive,
+				}
+			}
+		default:
+			return errors.New("unknown subcommand '" + string(r.Args[0]) + "'. Try XINFO HELP.")
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
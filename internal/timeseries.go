@@ -0,0 +1,209 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// samplesReply builds the [timestamp, value] pairs of TS.RANGE and TS.MRANGE
+func samplesReply(samples []alg.Sample) []interface{} {
+	values := make([]interface{}, len(samples))
+	for i, sample := range samples {
+		values[i] = []interface{}{
+			int(sample.Timestamp),
+			[]byte(storage.FormatFloat(sample.Value)),
+		}
+	}
+
+	return values
+}
+
+func registerTimeSeriesHandlers(m map[string]HandlerFn) {
+	m["ts.create"] = func(r *Request) error {
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'ts.create' command")
+		}
+
+		opts, err := storage.ParseTSOptions(r.Args[1:], false)
+		if err != nil {
+			return err
+		}
+
+		if err := storage.TSCreate(r.GetDBNum(), r.Args[0], opts); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ts.add"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'ts.add' command")
+		}
+
+		timestamp, err := storage.ParseTSTimestamp(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		value, err := storage.ParseTSValue(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		opts, err := storage.ParseTSOptions(r.Args[3:], true)
+		if err != nil {
+			return err
+		}
+
+		sample := alg.Sample{
+			Timestamp: timestamp,
+			Value:     value,
+		}
+
+		if err := storage.TSAdd(r.GetDBNum(), r.Args[0], sample, opts); err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: int(timestamp),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ts.range"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'ts.range' command")
+		}
+
+		rangeArgs, err := storage.ParseTSRangeArgs(r.Args[1:], false)
+		if err != nil {
+			return err
+		}
+
+		samples, err := storage.TSRange(r.GetDBNum(), r.Args[0], rangeArgs)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: samplesReply(samples),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ts.mrange"] = func(r *Request) error {
+		if len(r.Args) < 4 {
+			return errors.New("wrong number of arguments for 'ts.mrange' command")
+		}
+
+		rangeArgs, err := storage.ParseTSRangeArgs(r.Args, true)
+		if err != nil {
+			return err
+		}
+
+		series, err := storage.TSMRange(r.GetDBNum(), rangeArgs)
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(series))
+		for i, s := range series {
+			labels := []interface{}{}
+			if rangeArgs.WithLabels {
+				for _, label := range s.Labels {
+					labels = append(labels, []interface{}{[]byte(label.Name), []byte(label.Value)})
+				}
+			}
+
+			values[i] = []interface{}{s.Key, labels, samplesReply(s.Samples)}
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ts.createrule"] = func(r *Request) error {
+		if len(r.Args) != 5 {
+			return errors.New("wrong number of arguments for 'ts.createrule' command")
+		}
+
+		if err := storage.TSCreateRule(r.GetDBNum(), r.Args[0], r.Args[1], r.Args[2:]); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ts.deleterule"] = func(r *Request) error {
+		if len(r.Args) != 2 {
+			return errors.New("wrong number of arguments for 'ts.deleterule' command")
+		}
+
+		if err := storage.TSDeleteRule(r.GetDBNum(), r.Args[0], r.Args[1]); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,194 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerTopKHandlers(m map[string]HandlerFn) {
+	m["topk.reserve"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'topk.reserve' command")
+		}
+
+		reserve, err := storage.ParseTopKReserveArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		if err := storage.TopKReserve(r.GetDBNum(), r.Args[0], reserve); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["topk.add"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'topk.add' command")
+		}
+
+		items := r.Args[1:]
+		increments := make([]uint32, len(items))
+		for i := range increments {
+			increments[i] = 1
+		}
+
+		expelled, err := storage.TopKIncrBy(r.GetDBNum(), r.Args[0], items, increments)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: expelled,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["topk.incrby"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'topk.incrby' command")
+		}
+
+		items, increments, err := storage.ParseTopKIncrByArgs(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		expelled, err := storage.TopKIncrBy(r.GetDBNum(), r.Args[0], items, increments)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: expelled,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["topk.query"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'topk.query' command")
+		}
+
+		found, err := storage.TopKQuery(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(found))
+		for i := range found {
+			values[i] = found[i]
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["topk.count"] = func(r *Request) error {
+		if len(r.Args) < 2 {
+			return errors.New("wrong number of arguments for 'topk.count' command")
+		}
+
+		counts, err := storage.TopKCount(r.GetDBNum(), r.Args[0], r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		values := make([]interface{}, len(counts))
+		for i := range counts {
+			values[i] = counts[i]
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["topk.list"] = func(r *Request) error {
+		if len(r.Args) < 1 || len(r.Args) > 2 {
+			return errors.New("wrong number of arguments for 'topk.list' command")
+		}
+
+		withCount := false
+		if len(r.Args) == 2 {
+			if strings.ToLower(string(r.Args[1])) != "withcount" {
+				return storage.ErrSyntax
+			}
+			withCount = true
+		}
+
+		items, err := storage.TopKList(r.GetDBNum(), r.Args[0])
+		if err != nil {
+			return err
+		}
+
+		values := []interface{}{}
+		for _, item := range items {
+			values = append(values, item.Item)
+			if withCount {
+				values = append(values, int(item.Count))
+			}
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerTransactionHandlers(m map[string]HandlerFn) {
+	m["multi"] = func(r *Request) error {
+		if r.Session.inMulti {
+			r.Session.dirty = true
+			return errors.New("ERR MULTI calls can not be nested")
+		}
+
+		r.Session.inMulti = true
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["exec"] = func(r *Request) error {
+		s := r.Session
+		if !s.inMulti {
+			return errors.New("ERR EXEC without MULTI")
+		}
+
+		if s.dirty {
+			s.discard()
+			return errors.New("EXECABORT Transaction discarded because of previous errors.")
+		}
+
+		execLock.Lock()
+		defer execLock.Unlock()
+
+		if s.watchedKeysChanged() {
+			s.discard()
+
+			reply := &NilMultiBulkReply{}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+
+		queue := s.queue
+		s.discard()
+
+		if _, err := fmt.Fprintf(r.Conn, "*%d\r\n", len(queue)); err != nil {
+			return err
+		}
+
+		s.inExec = true
+		defer func() {
+			s.inExec = false
+		}()
+
+		for _, queued := range queue {
+			if err := s.call(m[queued.Name], queued); err != nil {
+				return err
+			}
+		}
+
+		// serve the clients blocked on the lists the transaction pushed to
+		storage.ServeBlocked()
+
+		return nil
+	}
+
+	m["discard"] = func(r *Request) error {
+		if !r.Session.inMulti {
+			return errors.New("ERR DISCARD without MULTI")
+		}
+
+		r.Session.discard()
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["watch"] = func(r *Request) error {
+		if r.Session.inMulti {
+			r.Session.dirty = true
+			return errors.New("ERR WATCH inside MULTI is not allowed")
+		}
+
+		if len(r.Args) < 1 {
+			return errors.New("wrong number of arguments for 'watch' command")
+		}
+
+		dbNum := r.GetDBNum()
+		for _, key := range r.Args {
+			r.Session.watches = append(r.Session.watches, watch{
+				db:      dbNum,
+				key:     key,
+				version: storage.Watch(dbNum, key),
+			})
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["unwatch"] = func(r *Request) error {
+		r.Session.unwatchAll()
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
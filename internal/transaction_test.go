@@ -0,0 +1,144 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/RcrdBrt/gobigdis/config"
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+// TestMain runs the tests against a DB in a temporary dir
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gobigdis-test")
+	if err != nil {
+		panic(err)
+	}
+
+	config.Init("", dir, "", 0)
+	storage.Init()
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testConn records the replies written to the client
+type testConn struct {
+	net.Conn
+	replies bytes.Buffer
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	return c.replies.Write(b)
+}
+
+// testSession runs the commands of a client and returns its replies
+type testSession struct {
+	t       *testing.T
+	methods map[string]HandlerFn
+	conn    *testConn
+	session *Session
+}
+
+func newTestSession(t *testing.T) *testSession {
+	conn := &testConn{}
+
+	return &testSession{
+		t:       t,
+		methods: NewV1Handler(),
+		conn:    conn,
+		session: NewSession(conn, nil),
+	}
+}
+
+// do runs a command and returns its reply
+func (ts *testSession) do(name string, args ...string) string {
+	ts.t.Helper()
+
+	r := &Request{Name: name}
+	for _, arg := range args {
+		r.Args = append(r.Args, []byte(arg))
+	}
+
+	ts.conn.replies.Reset()
+	if err := ts.session.Handle(ts.methods, r); err != nil {
+		ts.t.Fatalf("%s failed: %v", name, err)
+	}
+
+	return ts.conn.replies.String()
+}
+
+func (ts *testSession) expect(want string, name string, args ...string) {
+	ts.t.Helper()
+
+	if got := ts.do(name, args...); got != want {
+		ts.t.Errorf("%s %s: got %q, want %q", name, strings.Join(args, " "), got, want)
+	}
+}
+
+const execAbort = "-EXECABORT Transaction discarded because of previous errors.\r\n"
+
+func TestExecAbortsAfterWatchInMulti(t *testing.T) {
+	ts := newTestSession(t)
+
+	ts.expect("+OK\r\n", "multi")
+	ts.expect("+QUEUED\r\n", "set", "watch-in-multi", "v")
+	ts.expect("-ERR WATCH inside MULTI is not allowed\r\n", "watch", "watch-in-multi")
+	ts.expect(execAbort, "exec")
+
+	ts.expect("$-1\r\n", "get", "watch-in-multi")
+}
+
+func TestExecAbortsAfterArityError(t *testing.T) {
+	ts := newTestSession(t)
+
+	ts.expect("+OK\r\n", "multi")
+	ts.expect("+QUEUED\r\n", "set", "arity-in-multi", "v")
+	ts.expect("-ERR wrong number of arguments for 'get' command\r\n", "get", "arity-in-multi", "extra")
+	ts.expect("-ERR wrong number of arguments for 'set' command\r\n", "set", "arity-in-multi")
+	ts.expect(execAbort, "exec")
+
+	ts.expect("$-1\r\n", "get", "arity-in-multi")
+
+	// the next transaction starts clean
+	ts.expect("+OK\r\n", "multi")
+	ts.expect("+QUEUED\r\n", "set", "arity-in-multi", "v")
+	ts.expect("*1\r\n+OK\r\n", "exec")
+}
+
+func TestExecAbortsAfterNestedMulti(t *testing.T) {
+	ts := newTestSession(t)
+
+	ts.expect("+OK\r\n", "multi")
+	ts.expect("-ERR MULTI calls can not be nested\r\n", "multi")
+	ts.expect(execAbort, "exec")
+}
+
+func TestTransactionCommandsOutsideMulti(t *testing.T) {
+	ts := newTestSession(t)
+
+	ts.expect("-ERR EXEC without MULTI\r\n", "exec")
+	ts.expect("-ERR DISCARD without MULTI\r\n", "discard")
+}
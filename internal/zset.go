@@ -0,0 +1,292 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package internal
+
+import (
+	"errors"
+
+	"github.com/RcrdBrt/gobigdis/storage"
+)
+
+func registerZSetHandlers(m map[string]HandlerFn) {
+	m["zadd"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'zadd' command")
+		}
+
+		opts, pairs, err := storage.ParseZAddOptions(r.Args[1:])
+		if err != nil {
+			return err
+		}
+
+		counter, score, err := storage.ZAdd(r.GetDBNum(), r.Args[0], opts, pairs)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter
+		if opts.Incr {
+			reply = &BulkReply{
+				value: score,
+			}
+		} else {
+			reply = &IntegerReply{
+				number: counter,
+			}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["zincrby"] = func(r *Request) error {
+		score, err := storage.ZIncrBy(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: score,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["zrem"] = func(r *Request) error {
+		removed, err := storage.ZRem(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: removed,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["zscore"] = func(r *Request) error {
+		score, err := storage.ZScore(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: score,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["zcard"] = func(r *Request) error {
+		card, err := storage.ZCard(r.GetDBNum(), r.Args)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: card,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	rank := func(name string, rev bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) != 2 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			rank, found, err := storage.ZRank(r.GetDBNum(), r.Args[0], r.Args[1], rev)
+			if err != nil {
+				return err
+			}
+
+			var reply ReplyWriter = &BulkReply{}
+			if found {
+				reply = &IntegerReply{
+					number: rank,
+				}
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["zrank"] = rank("zrank", false)
+	m["zrevrank"] = rank("zrevrank", true)
+
+	m["zcount"] = func(r *Request) error {
+		if len(r.Args) != 3 {
+			return errors.New("wrong number of arguments for 'zcount' command")
+		}
+
+		min, err := storage.ParseZScoreBound(r.Args[1])
+		if err != nil {
+			return err
+		}
+
+		max, err := storage.ParseZScoreBound(r.Args[2])
+		if err != nil {
+			return err
+		}
+
+		count, err := storage.ZCount(r.GetDBNum(), r.Args[0], min, max)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: count,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["zrange"] = func(r *Request) error {
+		if len(r.Args) < 3 {
+			return errors.New("wrong number of arguments for 'zrange' command")
+		}
+
+		spec, err := storage.ParseZRangeSpec(r.Args[1:], false)
+		if err != nil {
+			return err
+		}
+
+		members, err := storage.ZRange(r.GetDBNum(), r.Args[0], spec)
+		if err != nil {
+			return err
+		}
+
+		reply := MultiBulkFromBytes(members)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["zrangestore"] = func(r *Request) error {
+		if len(r.Args) < 4 {
+			return errors.New("wrong number of arguments for 'zrangestore' command")
+		}
+
+		spec, err := storage.ParseZRangeSpec(r.Args[2:], true)
+		if err != nil {
+			return err
+		}
+
+		count, err := storage.ZRangeStore(r.GetDBNum(), r.Args[0], r.Args[1], spec)
+		if err != nil {
+			return err
+		}
+
+		reply := IntegerReply{
+			number: count,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	pop := func(name string, max bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) < 1 || len(r.Args) > 2 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			count := 1
+			if len(r.Args) == 2 {
+				var err error
+				if count, err = atoi(r.Args[1]); err != nil || count < 0 {
+					return errors.New("value is out of range, must be positive")
+				}
+			}
+
+			members, err := storage.ZPop(r.GetDBNum(), r.Args[0], count, max)
+			if err != nil {
+				return err
+			}
+
+			reply := MultiBulkFromBytes(members)
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["zpopmin"] = pop("zpopmin", false)
+	m["zpopmax"] = pop("zpopmax", true)
+
+	store := func(name string, inter bool) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) < 3 {
+				return errors.New("wrong number of arguments for '" + name + "' command")
+			}
+
+			card, err := storage.ZStore(r.GetDBNum(), r.Args[0], r.Args[1:], inter)
+			if err != nil {
+				return err
+			}
+
+			reply := IntegerReply{
+				number: card,
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+	m["zunionstore"] = store("zunionstore", false)
+	m["zinterstore"] = store("zinterstore", true)
+}
@@ -20,6 +20,9 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/RcrdBrt/gobigdis/config"
 	"github.com/RcrdBrt/gobigdis/network"
@@ -40,5 +43,16 @@ func main() {
 
 	storage.Init()
 
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		if err := storage.Close(); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}()
+
 	log.Fatal(network.StartServer())
 }
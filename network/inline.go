@@ -0,0 +1,178 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package network
+
+import (
+	"bufio"
+	"errors"
+)
+
+// maxInlineSize is the longest inline request line accepted from a client,
+// same as PROTO_INLINE_MAX_SIZE in the Redis server
+const maxInlineSize = 64 * 1024
+
+var (
+	errInlineTooBig     = errors.New("ERR Protocol error: too big inline request")
+	errUnbalancedQuotes = errors.New("ERR Protocol error: unbalanced quotes in request")
+)
+
+// readLine reads a single '\n' terminated line without letting it grow
+// past maxSize bytes. The returned line still has the trailing '\n'.
+func readLine(r *bufio.Reader, maxSize int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxSize {
+			return nil, errInlineTooBig
+		}
+
+		switch err {
+		case nil:
+			return line, nil
+		case bufio.ErrBufferFull:
+			continue
+		default:
+			return nil, err
+		}
+	}
+}
+
+// splitInlineArgs splits an inline request line the same way redis-cli
+// and the Redis server do (sdssplitargs): arguments are separated by any
+// amount of whitespace, can be wrapped in double quotes (supporting the
+// \xHH, \n, \r, \t, \b, \a escapes) or single quotes (supporting only \').
+func splitInlineArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var (
+			current  = []byte{}
+			inDouble bool
+			inSingle bool
+			done     bool
+		)
+		for !done {
+			if inDouble {
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' &&
+					isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					current = append(current, hexDigitToInt(line[i+2])<<4|hexDigitToInt(line[i+3]))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				case line[i] == '"':
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					current = append(current, line[i])
+				}
+			} else if inSingle {
+				if i == len(line) {
+					return nil, errUnbalancedQuotes
+				}
+
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					current = append(current, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					current = append(current, line[i])
+				}
+			} else {
+				if i == len(line) {
+					break
+				}
+
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', '\v', '\f', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					current = append(current, line[i])
+				}
+			}
+
+			if i < len(line) {
+				i++
+			}
+		}
+
+		args = append(args, current)
+	}
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\n', '\r', '\t', '\v', '\f':
+		return true
+	}
+
+	return false
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -196,80 +196,130 @@ package network
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"strings"
 
 	"github.com/RcrdBrt/gobigdis/internal"
 )
 
-func parseRequest(r *bufio.Reader) (*internal.Request, error) {
-	// first line of redis request should be:
-	// *<number of arguments>CRLF
-	line, err := r.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
-	// note that this line also protects us from negative integers
-	var argsCount int
+const (
+	// maxMultiBulkLength is the max number of arguments of a single request
+	maxMultiBulkLength = 1024 * 1024
+	// maxBulkLength is the max size of a single argument, same as the
+	// default proto-max-bulk-len of the Redis server
+	maxBulkLength = 512 * 1024 * 1024
+)
 
-	// Multiline request:
-	if line[0] == '*' {
-		if _, err := fmt.Sscanf(line, "*%d\r\n", &argsCount); err != nil {
-			return nil, malformed("*<numberOfArguments>", line)
-		}
-		// All next lines are pairs of:
-		//$<number of bytes of argument 1> CR LF
-		//<argument data> CR LF
-		// first argument is a command name, so just convert
-		firstArg, err := readArgument(r)
+var errInvalidHeader = errors.New("invalid header line")
+
+func parseRequest(r *bufio.Reader) (*internal.Request, error) {
+	for {
+		// first line of redis request should be:
+		// *<number of arguments>CRLF
+		rawLine, err := readLine(r, maxInlineSize)
 		if err != nil {
 			return nil, err
 		}
+		if len(rawLine) == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
 
-		args := make([][]byte, argsCount-1)
-		for i := 0; i < argsCount-1; i += 1 {
-			if args[i], err = readArgument(r); err != nil {
+		// Multiline request:
+		if rawLine[0] == '*' {
+			argsCount, err := parseHeader(rawLine, '*')
+			if err != nil || argsCount > maxMultiBulkLength {
+				return nil, malformed("*<numberOfArguments>", string(rawLine))
+			}
+			if argsCount <= 0 {
+				// empty multibulk requests are ignored, as the Redis server does
+				continue
+			}
+
+			// All next lines are pairs of:
+			//$<number of bytes of argument 1> CR LF
+			//<argument data> CR LF
+			// first argument is a command name, so just convert
+			firstArg, err := readArgument(r)
+			if err != nil {
 				return nil, err
 			}
+
+			// the count is client-supplied, so don't trust it for the allocation
+			args := make([][]byte, 0, minInt(argsCount-1, 1024))
+			for i := 0; i < argsCount-1; i += 1 {
+				arg, err := readArgument(r)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+			}
+
+			return &internal.Request{
+				Name: strings.ToLower(string(firstArg)),
+				Args: args,
+			}, nil
+		}
+
+		// Inline request:
+		fields, err := splitInlineArgs(rawLine)
+		if err != nil {
+			internal.Debugf("Malformed inline request: %q\n", rawLine)
+			return nil, err
+		}
+
+		if len(fields) == 0 {
+			// empty lines are simply ignored, as the Redis server does
+			continue
 		}
 
 		return &internal.Request{
-			Name: strings.ToLower(string(firstArg)),
-			Args: args,
+			Name: strings.ToLower(string(fields[0])),
+			Args: fields[1:],
 		}, nil
 	}
+}
 
-	// Inline request:
-	fields := strings.Split(strings.Trim(line, "\r\n"), " ")
+// parseHeader parses a "<prefix><integer>\r\n" protocol line strictly:
+// no signs other than a leading '-', no spaces and a mandatory CRLF
+func parseHeader(line []byte, prefix byte) (int, error) {
+	if len(line) < 4 || line[0] != prefix || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return 0, errInvalidHeader
+	}
 
-	var args [][]byte
-	if len(fields) > 1 {
-		for _, arg := range fields[1:] {
-			args = append(args, []byte(arg))
-		}
+	digits := line[1 : len(line)-2]
+	if digits[0] == '+' {
+		return 0, errInvalidHeader
+	}
+
+	n, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return 0, errInvalidHeader
 	}
-	return &internal.Request{
-		Name: strings.ToLower(string(fields[0])),
-		Args: args,
-	}, nil
 
+	return n, nil
 }
 
 func readArgument(r *bufio.Reader) ([]byte, error) {
-
-	line, err := r.ReadString('\n')
+	line, err := readLine(r, maxInlineSize)
 	if err != nil {
-		return nil, malformed("$<argumentLength>", line)
+		if err == errInlineTooBig {
+			return nil, malformed("$<argumentLength>", "")
+		}
+		return nil, err
 	}
-	var argSize int
-	if _, err := fmt.Sscanf(line, "$%d\r\n", &argSize); err != nil {
-		return nil, malformed("$<argumentSize>", line)
+
+	argSize, err := parseHeader(line, '$')
+	if err != nil || argSize < 0 || argSize > maxBulkLength {
+		return nil, malformed("$<argumentSize>", string(line))
 	}
 
-	// I think int is safe here as the max length of request
-	// should be less then max int value?
+	// the size is client-supplied too: let the buffer grow with the data
+	// actually received instead of allocating argSize bytes upfront
 	data, err := ioutil.ReadAll(io.LimitReader(r, int64(argSize)))
 	if err != nil {
 		return nil, err
@@ -292,15 +342,23 @@ func readArgument(r *bufio.Reader) ([]byte, error) {
 	return data, nil
 }
 
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
 func malformed(expected string, got string) error {
 	internal.Debugf("Malformed request: %q does not match %q\n", got, expected)
-	return fmt.Errorf("malformed request: %q does not match %q\r", got, expected)
+	return fmt.Errorf("ERR Protocol error: %q does not match %q", got, expected)
 }
 
 func malformedLength(expected int, got int) error {
-	return fmt.Errorf("malformed request: argument length %d does not match %d\r", got, expected)
+	return fmt.Errorf("ERR Protocol error: argument length %d does not match %d", got, expected)
 }
 
 func malformedMissingCRLF() error {
-	return fmt.Errorf("malformed request: line should end with %q\r", "\r\n")
+	return fmt.Errorf("ERR Protocol error: line should end with %q", "\r\n")
 }
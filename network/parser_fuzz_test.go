@@ -0,0 +1,87 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The fuzzers need testing.F, added in Go 1.18
+
+func encodeMultiBulk(args [][]byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	return b.Bytes()
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte("*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"))
+	f.Add([]byte("*1\r\n$-5\r\n"))
+	f.Add([]byte("*0\r\n"))
+	f.Add([]byte("*99999999999\r\n"))
+	f.Add([]byte("SET k \"hello \\x41 world\"\r\n"))
+	f.Add([]byte("set k 'a\\'b'\n"))
+	f.Add([]byte("\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for i := 0; i < 16; i++ {
+			request, err := parseRequest(r)
+			if err != nil {
+				return
+			}
+			if len(request.Args) >= maxMultiBulkLength {
+				t.Fatalf("too many arguments: %d", len(request.Args))
+			}
+		}
+	})
+}
+
+func FuzzParseMultiBulkRoundTrip(f *testing.F) {
+	f.Add([]byte("get"), []byte("key"), []byte(""))
+	f.Add([]byte("set"), []byte("k\r\n"), []byte("\x00\xff"))
+
+	f.Fuzz(func(t *testing.T, name, arg1, arg2 []byte) {
+		if len(name) == 0 {
+			return
+		}
+
+		command, args, err := parseString(string(encodeMultiBulk([][]byte{name, arg1, arg2})))
+		if err != nil {
+			t.Fatalf("valid request rejected: %v", err)
+		}
+
+		if command != strings.ToLower(string(name)) {
+			t.Errorf("command: got %q, want %q", command, strings.ToLower(string(name)))
+		}
+		if len(args) != 2 || !bytes.Equal(args[0], arg1) || !bytes.Equal(args[1], arg2) {
+			t.Errorf("args: got %q, want %q", args, [][]byte{arg1, arg2})
+		}
+	})
+}
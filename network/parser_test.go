@@ -0,0 +1,100 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func parseString(input string) (string, [][]byte, error) {
+	request, err := parseRequest(bufio.NewReader(strings.NewReader(input)))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return request.Name, request.Args, nil
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		command string
+		args    []string
+		wantErr bool
+	}{
+		{name: "multibulk", input: "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", command: "get", args: []string{"k"}},
+		{name: "multibulk binary arg", input: "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n", command: "set", args: []string{"k", "a\r\nb"}},
+		{name: "multibulk empty arg", input: "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$0\r\n\r\n", command: "set", args: []string{"k", ""}},
+		{name: "empty multibulk is skipped", input: "*0\r\n*1\r\n$4\r\nping\r\n", command: "ping", args: []string{}},
+		{name: "negative multibulk is skipped", input: "*-1\r\n*1\r\n$4\r\nping\r\n", command: "ping", args: []string{}},
+		{name: "multibulk too long", input: fmt.Sprintf("*%d\r\n", maxMultiBulkLength+1), wantErr: true},
+		{name: "multibulk not a number", input: "*x\r\n", wantErr: true},
+		{name: "multibulk with plus sign", input: "*+1\r\n$4\r\nping\r\n", wantErr: true},
+		{name: "multibulk missing CR", input: "*1\n$4\r\nping\r\n", wantErr: true},
+		{name: "multibulk truncated", input: "*2\r\n$3\r\nGET\r\n", wantErr: true},
+		{name: "bulk negative length", input: "*1\r\n$-5\r\nping\r\n", wantErr: true},
+		{name: "bulk too long", input: fmt.Sprintf("*1\r\n$%d\r\n", maxBulkLength+1), wantErr: true},
+		{name: "bulk wrong prefix", input: "*1\r\n:4\r\nping\r\n", wantErr: true},
+		{name: "bulk short data", input: "*1\r\n$10\r\nping\r\n", wantErr: true},
+		{name: "bulk missing CRLF", input: "*1\r\n$4\r\npingxx", wantErr: true},
+		{name: "empty input", input: "", wantErr: true},
+		{name: "inline", input: "GET k\r\n", command: "get", args: []string{"k"}},
+		{name: "inline without CR", input: "get k\n", command: "get", args: []string{"k"}},
+		{name: "inline repeated spaces", input: "  set   k   v  \r\n", command: "set", args: []string{"k", "v"}},
+		{name: "inline double quotes", input: "SET k \"hello world\"\r\n", command: "set", args: []string{"k", "hello world"}},
+		{name: "inline escapes", input: "set k \"a\\x41\\n\\t\\\"\"\r\n", command: "set", args: []string{"k", "aA\n\t\""}},
+		{name: "inline single quotes", input: "set k 'it\\'s \\n'\r\n", command: "set", args: []string{"k", "it's \\n"}},
+		{name: "inline empty quotes", input: "set k \"\"\r\n", command: "set", args: []string{"k", ""}},
+		{name: "inline empty lines are skipped", input: "\r\n   \r\nping\r\n", command: "ping", args: []string{}},
+		{name: "inline unbalanced double quotes", input: "set k \"abc\r\n", wantErr: true},
+		{name: "inline unbalanced single quotes", input: "set k 'abc\r\n", wantErr: true},
+		{name: "inline text after closing quote", input: "set k \"a\"b\r\n", wantErr: true},
+		{name: "inline too long", input: strings.Repeat("a", maxInlineSize+1) + "\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, args, err := parseString(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q %q", command, args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if command != tt.command {
+				t.Errorf("command: got %q, want %q", command, tt.command)
+			}
+			if len(args) != len(tt.args) {
+				t.Fatalf("args: got %q, want %q", args, tt.args)
+			}
+			for i := range args {
+				if string(args[i]) != tt.args[i] {
+					t.Errorf("arg %d: got %q, want %q", i, args[i], tt.args[i])
+				}
+			}
+		})
+	}
+}
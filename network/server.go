@@ -79,25 +79,20 @@ func (srv *server) serveClient(conn net.Conn) {
 	}()
 
 	reader := bufio.NewReader(conn)
-	dbNum := [][]byte{[]byte("0")}
+	session := internal.NewSession(conn, reader)
+	defer session.Close()
 	for {
 		request, err := parseRequest(reader)
 		if err != nil {
 			panic(err)
 		}
-		request.Conn = conn
-
-		if request.Name == "select" {
-			dbNum = request.Args
-		}
-		request.DB = dbNum
 
 		if request.Name == "quit" {
 			fmt.Fprint(conn, "+OK\r\n")
 			return
 		}
 
-		if err := srv.methods[request.Name](request); err != nil {
+		if err := session.Handle(srv.methods, request); err != nil {
 			panic(err)
 		}
 	}
@@ -0,0 +1,796 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	Bitmaps are plain string values: bit 0 is the most significant bit of
+	the first byte of the file. SETBIT and BITFIELD read and write only the
+	bytes they touch, extending the file with zeroes when writing past its
+	end, while BITCOUNT, BITPOS and BITOP stream over the files in blocks
+	so that bitmaps of hundreds of MB never have to fit in memory.
+*/
+
+const bitmapBlockSize = 64 * 1024
+
+// like Redis, bitmaps are limited to 512 MB
+const maxBitOffset = 512*1024*1024*8 - 1
+
+var (
+	errBitOffset  = errors.New("ERR bit offset is not an integer or out of range")
+	errBitOpNot   = errors.New("ERR BITOP NOT must be called with a single source key.")
+	errBitField   = errors.New("ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	errOverflow   = errors.New("ERR Invalid OVERFLOW type specified")
+	errBitFieldRO = errors.New("ERR BITFIELD_RO only supports the GET subcommand")
+)
+
+// ParseBitOffset parses the offset of SETBIT and GETBIT
+func ParseBitOffset(b []byte) (uint64, error) {
+	n, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil || n > maxBitOffset {
+		return 0, errBitOffset
+	}
+
+	return n, nil
+}
+
+// ParseBit parses a 0 or 1 bit argument
+func ParseBit(b []byte) (int, bool) {
+	switch string(b) {
+	case "0":
+		return 0, true
+	case "1":
+		return 1, true
+	}
+
+	return 0, false
+}
+
+// openValue opens the file holding the string value of key, nil if there
+// is none unless write is set, in which case it is created.
+// The caller must hold cache.FSRWL.Lock to write, at least RLock otherwise.
+func openValue(key alg.Key, write bool) (*os.File, error) {
+	if cache.Match(key) {
+		if info, err := os.Lstat(key.FilePath()); err == nil && info.IsDir() {
+			return nil, ErrWrongType
+		}
+	}
+
+	if !write {
+		if !cache.Match(key) {
+			return nil, nil
+		}
+
+		f, err := os.Open(key.FilePath())
+		if err != nil && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return f, err
+	}
+
+	if err := prepareStringKey(key); err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(key.FilePath(), os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// readAt fills buf with the bytes of f starting at off, zeroes past its end
+func readAt(f *os.File, buf []byte, off int64) error {
+	n, err := f.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+
+	return err
+}
+
+// SetBit sets the bit at offset of the value of keyName, returning its
+// previous value
+func SetBit(dbNum int, keyName []byte, offset uint64, bit int) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	f, err := openValue(key, true)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	if err := readAt(f, b, int64(offset/8)); err != nil {
+		return 0, err
+	}
+
+	mask := byte(0x80 >> (offset % 8))
+	old := 0
+	if b[0]&mask != 0 {
+		old = 1
+	}
+
+	if bit == 1 {
+		b[0] |= mask
+	} else {
+		b[0] &^= mask
+	}
+
+	if _, err := f.WriteAt(b, int64(offset/8)); err != nil {
+		return 0, err
+	}
+
+	touch(key)
+
+	return old, nil
+}
+
+// GetBit returns the bit at offset of the value of keyName
+func GetBit(dbNum int, keyName []byte, offset uint64) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	f, err := openValue(key, false)
+	if err != nil || f == nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	b := make([]byte, 1)
+	if err := readAt(f, b, int64(offset/8)); err != nil {
+		return 0, err
+	}
+
+	return int(b[0]>>(7-offset%8)) & 1, nil
+}
+
+// BitRange is the optional range of BITCOUNT and BITPOS, in bytes
+// unless Bit is set
+type BitRange struct {
+	Start    int
+	End      int
+	HasStart bool
+	HasEnd   bool
+	Bit      bool
+}
+
+// bits returns the first and the last bit of the value of f in r,
+// false if the range is empty
+func (r BitRange) bits(f *os.File) (int64, int64, bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	length := int(info.Size())
+	if r.Bit {
+		length *= 8
+	}
+
+	start, end := 0, length-1
+	if r.HasStart {
+		start = r.Start
+	}
+	if r.HasEnd {
+		end = r.End
+	}
+
+	start, end, ok := clampRange(start, end, length)
+	if !ok {
+		return 0, 0, false, nil
+	}
+
+	if r.Bit {
+		return int64(start), int64(end), true, nil
+	}
+
+	return int64(start) * 8, int64(end)*8 + 7, true, nil
+}
+
+// scanBits calls fn on the blocks of f holding the bits from first to
+// last, the bits of the edge bytes outside of the range being set to pad.
+// It stops when fn returns false.
+func scanBits(f *os.File, first, last int64, pad byte, fn func(block []byte, off int64) bool) error {
+	from, to := first/8, last/8
+	buf := make([]byte, bitmapBlockSize)
+
+	for off := from; off <= to; off += bitmapBlockSize {
+		block := buf
+		if to-off+1 < bitmapBlockSize {
+			block = buf[:to-off+1]
+		}
+
+		if err := readAt(f, block, off); err != nil {
+			return err
+		}
+
+		if off == from {
+			mask := byte(0xff >> (first % 8))
+			block[0] = block[0]&mask | pad&^mask
+		}
+		if off+int64(len(block))-1 == to {
+			mask := byte(0xff << (7 - last%8))
+			block[len(block)-1] = block[len(block)-1]&mask | pad&^mask
+		}
+
+		if !fn(block, off) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func popCount(block []byte) int {
+	count := 0
+
+	i := 0
+	for ; i+8 <= len(block); i += 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(block[i:]))
+	}
+
+	for ; i < len(block); i++ {
+		count += bits.OnesCount8(block[i])
+	}
+
+	return count
+}
+
+// BitCount returns the number of set bits of the value of keyName in r
+func BitCount(dbNum int, keyName []byte, r BitRange) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	f, err := openValue(key, false)
+	if err != nil || f == nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	first, last, ok, err := r.bits(f)
+	if err != nil || !ok {
+		return 0, err
+	}
+
+	count := 0
+	err = scanBits(f, first, last, 0, func(block []byte, _ int64) bool {
+		count += popCount(block)
+		return true
+	})
+
+	return count, err
+}
+
+// BitPos returns the position of the first bit set to bit in r of the
+// value of keyName, -1 if there is none
+func BitPos(dbNum int, keyName []byte, bit int, r BitRange) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	f, err := openValue(key, false)
+	if err != nil {
+		return 0, err
+	}
+	if f == nil {
+		// a missing key is an empty string, looking for a 0 finds the padding
+		if bit == 1 {
+			return -1, nil
+		}
+		return 0, nil
+	}
+	defer f.Close()
+
+	first, last, ok, err := r.bits(f)
+	if err != nil || !ok {
+		return -1, err
+	}
+
+	// the bits outside of the range must not match
+	skip, skipWord := byte(0), uint64(0)
+	if bit == 0 {
+		skip, skipWord = 0xff, math.MaxUint64
+	}
+
+	pos := int64(-1)
+	err = scanBits(f, first, last, skip, func(block []byte, off int64) bool {
+		i := 0
+		for ; i+8 <= len(block); i += 8 {
+			if binary.LittleEndian.Uint64(block[i:]) != skipWord {
+				break
+			}
+		}
+
+		for ; i < len(block); i++ {
+			if block[i] != skip {
+				pos = (off+int64(i))*8 + int64(bits.LeadingZeros8(block[i]^skip))
+				return false
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if pos < 0 && bit == 0 && !r.HasEnd {
+		// without an explicit end the value is padded with zeroes
+		return int(last + 1), nil
+	}
+
+	return int(pos), nil
+}
+
+// BitOp stores at dst the bitwise op (AND, OR, XOR or NOT) of the values
+// of keys, returning the length of the result. Shorter values are padded
+// with zeroes.
+func BitOp(dbNum int, op string, dstName []byte, keys [][]byte) (int, error) {
+	op = strings.ToLower(op)
+	switch op {
+	case "and", "or", "xor":
+	case "not":
+		if len(keys) != 1 {
+			return 0, errBitOpNot
+		}
+	default:
+		return 0, ErrSyntax
+	}
+
+	dst := cache.NewKey(dbNum, dstName)
+
+	// purged once the lock is released
+	var trashed string
+	defer func() {
+		purgeAsync([]string{trashed})
+	}()
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	sources := make([]*os.File, len(keys))
+	defer func() {
+		for _, f := range sources {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+
+	length := int64(0)
+	for i, keyName := range keys {
+		f, err := openValue(cache.NewKey(dbNum, keyName), false)
+		if err != nil {
+			return 0, err
+		}
+		if f == nil {
+			continue
+		}
+		sources[i] = f
+
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if info.Size() > length {
+			length = info.Size()
+		}
+	}
+
+	if length == 0 {
+		var err error
+		trashed, err = unlinkKey(dst)
+		return 0, err
+	}
+
+	tmp, err := createTempFile("bitop")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	result := make([]byte, bitmapBlockSize)
+	block := make([]byte, bitmapBlockSize)
+	for off := int64(0); off < length; off += bitmapBlockSize {
+		n := int64(bitmapBlockSize)
+		if length-off < n {
+			n = length - off
+		}
+
+		for i, f := range sources {
+			in := block[:n]
+			if i == 0 {
+				in = result[:n]
+			}
+
+			if f == nil {
+				for j := range in {
+					in[j] = 0
+				}
+			} else if err := readAt(f, in, off); err != nil {
+				return 0, err
+			}
+
+			if i == 0 {
+				continue
+			}
+
+			for j := range in {
+				switch op {
+				case "and":
+					result[j] &= in[j]
+				case "or":
+					result[j] |= in[j]
+				case "xor":
+					result[j] ^= in[j]
+				}
+			}
+		}
+
+		if op == "not" {
+			for j := range result[:n] {
+				result[j] = ^result[j]
+			}
+		}
+
+		if _, err := tmp.Write(result[:n]); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	trashed, err = storeTemp(tmp.Name(), dst)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(length), nil
+}
+
+// Overflow policies of BITFIELD
+const (
+	OverflowWrap = iota
+	OverflowSat
+	OverflowFail
+)
+
+// BitFieldOp is a GET, SET or INCRBY subcommand of BITFIELD
+type BitFieldOp struct {
+	Op       string // get, set or incrby
+	Signed   bool
+	Bits     uint
+	Offset   uint64
+	Value    int64
+	Overflow int
+}
+
+func parseBitFieldType(b []byte) (bool, uint, error) {
+	if len(b) < 2 || (b[0] != 'i' && b[0] != 'I' && b[0] != 'u' && b[0] != 'U') {
+		return false, 0, errBitField
+	}
+
+	signed := b[0] == 'i' || b[0] == 'I'
+	n, err := strconv.ParseUint(string(b[1:]), 10, 8)
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, errBitField
+	}
+
+	return signed, uint(n), nil
+}
+
+// parseBitFieldOffset parses an offset in bits, or in multiples of the
+// field size when prefixed by #
+func parseBitFieldOffset(b []byte, size uint) (uint64, error) {
+	multiply := len(b) > 0 && b[0] == '#'
+	if multiply {
+		b = b[1:]
+	}
+
+	n, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return 0, errBitOffset
+	}
+
+	if multiply {
+		if n > maxBitOffset/uint64(size) {
+			return 0, errBitOffset
+		}
+		n *= uint64(size)
+	}
+
+	if n+uint64(size)-1 > maxBitOffset {
+		return 0, errBitOffset
+	}
+
+	return n, nil
+}
+
+// ParseBitFieldOps parses the subcommands of BITFIELD, only GET is
+// allowed if readOnly is set (BITFIELD_RO)
+func ParseBitFieldOps(args [][]byte, readOnly bool) ([]BitFieldOp, error) {
+	ops := []BitFieldOp{}
+	overflow := OverflowWrap
+
+	for i := 0; i < len(args); i++ {
+		op := strings.ToLower(string(args[i]))
+
+		need := 0
+		switch op {
+		case "get":
+			need = 2
+		case "set", "incrby":
+			if readOnly {
+				return nil, errBitFieldRO
+			}
+			need = 3
+		case "overflow":
+			if readOnly {
+				return nil, errBitFieldRO
+			}
+			need = 1
+		default:
+			return nil, ErrSyntax
+		}
+
+		if i+need >= len(args) {
+			return nil, ErrSyntax
+		}
+
+		if op == "overflow" {
+			switch strings.ToLower(string(args[i+1])) {
+			case "wrap":
+				overflow = OverflowWrap
+			case "sat":
+				overflow = OverflowSat
+			case "fail":
+				overflow = OverflowFail
+			default:
+				return nil, errOverflow
+			}
+			i++
+			continue
+		}
+
+		signed, size, err := parseBitFieldType(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+
+		offset, err := parseBitFieldOffset(args[i+2], size)
+		if err != nil {
+			return nil, err
+		}
+
+		bitField := BitFieldOp{
+			Op:       op,
+			Signed:   signed,
+			Bits:     size,
+			Offset:   offset,
+			Overflow: overflow,
+		}
+
+		if need == 3 {
+			if bitField.Value, err = ParseInt(args[i+3]); err != nil {
+				return nil, ErrNotInteger
+			}
+		}
+
+		ops = append(ops, bitField)
+		i += need
+	}
+
+	return ops, nil
+}
+
+// getBits returns the size bits of buf starting at bit off
+func getBits(buf []byte, off uint64, size uint) uint64 {
+	value := uint64(0)
+	for i := uint64(0); i < uint64(size); i++ {
+		bit := off + i
+		value = value<<1 | uint64(buf[bit/8]>>(7-bit%8))&1
+	}
+
+	return value
+}
+
+// setBits writes the lowest size bits of value to buf starting at bit off
+func setBits(buf []byte, off uint64, size uint, value uint64) {
+	for i := uint64(0); i < uint64(size); i++ {
+		bit := off + i
+		mask := byte(0x80 >> (bit % 8))
+		if value>>(uint64(size)-1-i)&1 == 1 {
+			buf[bit/8] |= mask
+		} else {
+			buf[bit/8] &^= mask
+		}
+	}
+}
+
+// unsignedOverflow adds incr to value, a size bits unsigned integer,
+// reporting whether it overflows and the result according to overflow
+func unsignedOverflow(value uint64, incr int64, size uint, overflow int) (uint64, bool) {
+	max := uint64(1)<<size - 1
+
+	switch {
+	case value > max || (incr > 0 && uint64(incr) > max-value):
+		if overflow == OverflowSat {
+			return max, true
+		}
+	case incr < 0 && uint64(-incr) > value:
+		if overflow == OverflowSat {
+			return 0, true
+		}
+	default:
+		return value + uint64(incr), false
+	}
+
+	return (value + uint64(incr)) & max, true
+}
+
+// signedOverflow is like unsignedOverflow for size bits signed integers
+func signedOverflow(value, incr int64, size uint, overflow int) (int64, bool) {
+	max := int64(math.MaxInt64)
+	if size < 64 {
+		max = int64(1)<<(size-1) - 1
+	}
+	min := -max - 1
+
+	switch {
+	case value > max || (incr > 0 && value > max-incr):
+		if overflow == OverflowSat {
+			return max, true
+		}
+	case value < min || (incr < 0 && value < min-incr):
+		if overflow == OverflowSat {
+			return min, true
+		}
+	default:
+		return value + incr, false
+	}
+
+	// wrap around, two's complement style
+	wrapped := uint64(value) + uint64(incr)
+	if size < 64 {
+		if wrapped&(1<<(size-1)) != 0 {
+			wrapped |= math.MaxUint64 << size
+		} else {
+			wrapped &^= math.MaxUint64 << size
+		}
+	}
+
+	return int64(wrapped), true
+}
+
+// BitField runs the BITFIELD subcommands on the value of keyName, the
+// result of an operation is nil when it fails because of OVERFLOW FAIL
+func BitField(dbNum int, keyName []byte, ops []BitFieldOp) ([]*int64, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	write := false
+	for _, op := range ops {
+		write = write || op.Op != "get"
+	}
+
+	if write {
+		cache.FSRWL.Lock()
+		defer cache.FSRWL.Unlock()
+	} else {
+		cache.FSRWL.RLock()
+		defer cache.FSRWL.RUnlock()
+	}
+
+	f, err := openValue(key, write)
+	if err != nil {
+		return nil, err
+	}
+	if f != nil {
+		defer f.Close()
+	}
+
+	results := make([]*int64, len(ops))
+	changed := false
+	for i, op := range ops {
+		from := op.Offset / 8
+		buf := make([]byte, (op.Offset+uint64(op.Bits)-1)/8-from+1)
+		if f != nil {
+			if err := readAt(f, buf, int64(from)); err != nil {
+				return nil, err
+			}
+		}
+
+		off := op.Offset % 8
+		raw := getBits(buf, off, op.Bits)
+
+		var old, value int64
+		failed := false
+		if op.Signed {
+			// sign extension
+			old = int64(raw<<(64-op.Bits)) >> (64 - op.Bits)
+
+			switch op.Op {
+			case "set":
+				value, failed = signedOverflow(op.Value, 0, op.Bits, op.Overflow)
+			case "incrby":
+				value, failed = signedOverflow(old, op.Value, op.Bits, op.Overflow)
+			}
+		} else {
+			old = int64(raw)
+
+			var unsigned uint64
+			switch op.Op {
+			case "set":
+				unsigned, failed = unsignedOverflow(uint64(op.Value), 0, op.Bits, op.Overflow)
+			case "incrby":
+				unsigned, failed = unsignedOverflow(raw, op.Value, op.Bits, op.Overflow)
+			}
+			value = int64(unsigned)
+		}
+
+		if op.Op == "get" {
+			results[i] = &old
+			continue
+		}
+
+		if failed && op.Overflow == OverflowFail {
+			continue
+		}
+
+		setBits(buf, off, op.Bits, uint64(value))
+		if _, err := f.WriteAt(buf, int64(from)); err != nil {
+			return nil, err
+		}
+		changed = true
+
+		if op.Op == "set" {
+			results[i] = &old
+		} else {
+			results[i] = &value
+		}
+	}
+
+	if changed {
+		touch(key)
+	}
+
+	return results, nil
+}
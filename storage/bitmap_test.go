@@ -0,0 +1,282 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func checkBitmapFile(t *testing.T, db int, keyName string, want []byte) {
+	t.Helper()
+
+	content, err := os.ReadFile(testKeyPath(db, keyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, want) {
+		t.Fatalf("the file of %s holds %x, want %x", keyName, content, want)
+	}
+}
+
+func TestSetBitLayout(t *testing.T) {
+	const db = 5
+	const key = "bitmap-setbit"
+
+	for _, step := range []struct {
+		offset uint64
+		bit    int
+		old    int
+	}{
+		{7, 1, 0},
+		{0, 1, 0},
+		{7, 1, 1},
+		{7, 0, 1},
+		{100, 1, 0},
+	} {
+		old, err := SetBit(db, []byte(key), step.offset, step.bit)
+		if err != nil || old != step.old {
+			t.Fatalf("SETBIT %d %d returned %d, want %d: %v", step.offset, step.bit, old, step.old, err)
+		}
+	}
+
+	// bit 0 is the most significant bit of the first byte, and the file
+	// is extended with zeroes up to the byte of bit 100
+	want := make([]byte, 13)
+	want[0], want[12] = 0x80, 0x08
+	checkBitmapFile(t, db, key, want)
+
+	reopen(t, db)
+
+	checkBitmapFile(t, db, key, want)
+	for offset, want := range map[uint64]int{0: 1, 7: 0, 100: 1, 101: 0, 1 << 20: 0} {
+		if bit, err := GetBit(db, []byte(key), offset); err != nil || bit != want {
+			t.Fatalf("GETBIT %d returned %d, want %d: %v", offset, bit, want, err)
+		}
+	}
+
+	if _, err := ParseBitOffset([]byte("4294967296")); err != errBitOffset {
+		t.Fatalf("an offset past 512MB returned %v", err)
+	}
+	if _, err := HSet(db, testArgs("bitmap-hash", "f", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetBit(db, []byte("bitmap-hash"), 0, 1); err != ErrWrongType {
+		t.Fatalf("SETBIT of a hash returned %v", err)
+	}
+
+	if _, err := Del(db, testArgs(key, "bitmap-hash")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bitmapTestCount and bitmapTestPos are BITCOUNT and BITPOS over the bits
+// first to last of value, in memory
+func bitmapTestCount(value []byte, first, last int) int {
+	count := 0
+	for i := first; i <= last; i++ {
+		count += int(value[i/8]>>(7-i%8)) & 1
+	}
+
+	return count
+}
+
+func bitmapTestPos(value []byte, bit, first, last int) int {
+	for i := first; i <= last; i++ {
+		if int(value[i/8]>>(7-i%8))&1 == bit {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func TestBitCountAndPosAcrossBlocks(t *testing.T) {
+	const db = 5
+	const key = "bitmap-blocks"
+
+	// sparse bits, so that BITPOS has to skip whole blocks
+	value := make([]byte, 3*bitmapBlockSize+100)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		value[rnd.Intn(len(value))] |= byte(1 << rnd.Intn(8))
+	}
+	value[len(value)-1] = 0xff
+	if _, _, err := Set(db, [][]byte{[]byte(key), value}, SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0
+	for _, b := range value {
+		total += bits.OnesCount8(b)
+	}
+	if count, err := BitCount(db, []byte(key), BitRange{}); err != nil || count != total {
+		t.Fatalf("BITCOUNT returned %d, want %d: %v", count, total, err)
+	}
+
+	length := len(value)
+	ranges := []BitRange{
+		{Start: 1, End: bitmapBlockSize, HasStart: true, HasEnd: true},
+		{Start: -bitmapBlockSize - 3, End: -2, HasStart: true, HasEnd: true},
+		{Start: 13, End: 8*bitmapBlockSize + 3, HasStart: true, HasEnd: true, Bit: true},
+		{Start: -8*bitmapBlockSize - 5, End: -9, HasStart: true, HasEnd: true, Bit: true},
+		{Start: 2 * bitmapBlockSize, HasStart: true},
+	}
+	for i, r := range ranges {
+		first, last := r.Start, r.End
+		if !r.HasEnd {
+			last = length - 1
+		}
+		if first < 0 {
+			first += length
+			if r.Bit {
+				first += 7 * length
+			}
+		}
+		if last < 0 {
+			last += length
+			if r.Bit {
+				last += 7 * length
+			}
+		}
+		if !r.Bit {
+			first, last = first*8, last*8+7
+		}
+
+		if count, err := BitCount(db, []byte(key), r); err != nil || count != bitmapTestCount(value, first, last) {
+			t.Fatalf("range %d: BITCOUNT returned %d, want %d: %v", i, count, bitmapTestCount(value, first, last), err)
+		}
+
+		for bit := 0; bit <= 1; bit++ {
+			want := bitmapTestPos(value, bit, first, last)
+			if pos, err := BitPos(db, []byte(key), bit, r); err != nil || pos != want {
+				t.Fatalf("range %d: BITPOS %d returned %d, want %d: %v", i, bit, pos, want, err)
+			}
+		}
+	}
+
+	// looking for a 0 in the ones finds the padding unless there's an end
+	if _, _, err := Set(db, testArgs("bitmap-ones", "\xff\xff"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err := BitPos(db, []byte("bitmap-ones"), 0, BitRange{}); err != nil || pos != 16 {
+		t.Fatalf("BITPOS 0 of the ones returned %d, want 16: %v", pos, err)
+	}
+	if pos, err := BitPos(db, []byte("bitmap-ones"), 0, BitRange{End: -1, HasStart: true, HasEnd: true}); err != nil || pos != -1 {
+		t.Fatalf("BITPOS 0 0 -1 of the ones returned %d, want -1: %v", pos, err)
+	}
+	if pos, err := BitPos(db, []byte("bitmap-missing"), 1, BitRange{}); err != nil || pos != -1 {
+		t.Fatalf("BITPOS 1 of a missing key returned %d, want -1: %v", pos, err)
+	}
+
+	if _, err := Del(db, testArgs(key, "bitmap-ones")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBitOp(t *testing.T) {
+	const db = 5
+
+	if err := MSet(db, testArgs("bitop-a", "\xf0\x0f\xff", "bitop-b", "\x3c")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shorter values and the missing keys are padded with zeroes
+	for _, step := range []struct {
+		op   string
+		keys []string
+		want string
+	}{
+		{"and", []string{"bitop-a", "bitop-b"}, "\x30\x00\x00"},
+		{"or", []string{"bitop-a", "bitop-b", "bitop-missing"}, "\xfc\x0f\xff"},
+		{"xor", []string{"bitop-a", "bitop-b"}, "\xcc\x0f\xff"},
+		{"not", []string{"bitop-a"}, "\x0f\xf0\x00"},
+	} {
+		length, err := BitOp(db, step.op, []byte("bitop-dst"), testArgs(step.keys...))
+		if err != nil || length != len(step.want) {
+			t.Fatalf("BITOP %s returned %d: %v", step.op, length, err)
+		}
+		checkBitmapFile(t, db, "bitop-dst", []byte(step.want))
+	}
+
+	if _, err := BitOp(db, "not", []byte("bitop-dst"), testArgs("bitop-a", "bitop-b")); err != errBitOpNot {
+		t.Fatalf("BITOP NOT of two keys returned %v", err)
+	}
+
+	// an empty result deletes the destination
+	if length, err := BitOp(db, "and", []byte("bitop-dst"), testArgs("bitop-missing")); err != nil || length != 0 {
+		t.Fatalf("BITOP of a missing key returned %d: %v", length, err)
+	}
+
+	reopen(t, db)
+
+	if found, err := Exists(db, testArgs("bitop-dst")); err != nil || found != 0 {
+		t.Fatalf("the empty BITOP result exists: %v", err)
+	}
+	checkEmptyTempDir(t)
+
+	if _, err := Del(db, testArgs("bitop-a", "bitop-b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBitField(t *testing.T) {
+	const db = 5
+	const key = "bitfield"
+
+	ops, err := ParseBitFieldOps(testArgs(
+		"set", "u8", "#1", "200",
+		"incrby", "u8", "#1", "100",
+		"overflow", "sat", "incrby", "u8", "8", "100",
+		"overflow", "fail", "incrby", "u8", "8", "112",
+		"set", "i5", "20", "-3",
+		"get", "i5", "20",
+		"get", "u4", "4"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := BitField(db, []byte(key), ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{int64(0), int64(44), int64(144), nil, int64(0), int64(-3), int64(0)}
+	for i := range want {
+		if (results[i] == nil) != (want[i] == nil) || (results[i] != nil && *results[i] != want[i].(int64)) {
+			t.Fatalf("op %d returned %v, want %v", i, results[i], want[i])
+		}
+	}
+
+	// the signed field straddles the second and the third byte
+	reopen(t, db)
+	checkBitmapFile(t, db, key, []byte{0x00, 0x90, 0x0e, 0x80})
+
+	if _, err := ParseBitFieldOps(testArgs("set", "u8", "0", "1"), true); err != errBitFieldRO {
+		t.Fatalf("BITFIELD_RO SET returned %v", err)
+	}
+	if _, err := ParseBitFieldOps(testArgs("get", "u64", "0"), false); err != errBitField {
+		t.Fatalf("BITFIELD GET u64 returned %v", err)
+	}
+
+	if _, err := Del(db, testArgs(key)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,401 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	Clients blocked by BLPOP, BRPOP and BLMOVE park a waiter in the FIFO
+	queue of every key they are waiting for. Pushes don't hand the elements
+	over right away: they only mark the key as ready, and the ready keys are
+	served by ServeBlocked once the command (or the whole transaction) that
+	pushed is over, the same way the Redis server does.
+	Clients blocked by XREAD don't consume anything and are simply woken up
+	by XADD, reading again once the command that added is over.
+*/
+
+// BlockedResult is what a blocked client receives once served
+type BlockedResult struct {
+	Key   []byte
+	Value []byte
+	Err   error
+}
+
+// Waiter is a client blocked on one or more lists
+type Waiter struct {
+	keys    []alg.Key
+	names   [][]byte
+	left    bool
+	dst     *alg.Key
+	toLeft  bool
+	served  bool
+	results chan BlockedResult
+}
+
+var blocked = struct {
+	sync.Mutex
+	queues  map[alg.Key][]*Waiter
+	ready   map[alg.Key]bool
+	streams map[alg.Key][]*StreamWaiter
+}{
+	queues:  make(map[alg.Key][]*Waiter),
+	ready:   make(map[alg.Key]bool),
+	streams: make(map[alg.Key][]*StreamWaiter),
+}
+
+// BlockingPop pops an element from the first non-empty list among keys,
+// moving it to dst if dst is not nil. If all the lists are empty and
+// noBlock is false, it registers and returns a Waiter instead.
+func BlockingPop(dbNum int, keys [][]byte, left bool, dst []byte, toLeft, noBlock bool) (*BlockedResult, *Waiter, error) {
+	w := &Waiter{
+		names:   keys,
+		left:    left,
+		toLeft:  toLeft,
+		results: make(chan BlockedResult, 1),
+	}
+	for _, name := range keys {
+		w.keys = append(w.keys, cache.NewKey(dbNum, name))
+	}
+	if dst != nil {
+		dstKey := cache.NewKey(dbNum, dst)
+		w.dst = &dstKey
+	}
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	for i, key := range w.keys {
+		l, err := loadList(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if l == nil {
+			continue
+		}
+
+		value, err := w.pop(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &BlockedResult{Key: w.names[i], Value: value}, nil, nil
+	}
+
+	if noBlock {
+		return nil, nil, nil
+	}
+
+	blocked.Lock()
+	defer blocked.Unlock()
+
+	for _, key := range w.keys {
+		blocked.queues[key] = append(blocked.queues[key], w)
+	}
+
+	return nil, w, nil
+}
+
+// pop pops an element for w from key, which must be a non-empty list.
+// The caller must hold cache.FSRWL.Lock.
+func (w *Waiter) pop(key alg.Key) ([]byte, error) {
+	if w.dst != nil {
+		return listMove(key, *w.dst, w.left, w.toLeft)
+	}
+
+	popped, err := listPop(key, 1, w.left)
+	if err != nil || len(popped) == 0 {
+		return nil, err
+	}
+
+	return popped[0], nil
+}
+
+// Wait blocks until w is served, the timeout expires (0 means forever)
+// or cancel is closed. It returns nil if w has not been served.
+func (w *Waiter) Wait(timeout time.Duration, cancel <-chan struct{}) *BlockedResult {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case result := <-w.results:
+		return &result
+	case <-expired:
+	case <-cancel:
+	}
+
+	blocked.Lock()
+	served := w.served
+	if !served {
+		w.unregister()
+	}
+	blocked.Unlock()
+
+	if served {
+		// served in the meantime, the result is on its way
+		result := <-w.results
+		return &result
+	}
+
+	return nil
+}
+
+// unregister removes w from all its queues, the caller must hold blocked
+func (w *Waiter) unregister() {
+	for _, key := range w.keys {
+		queue := blocked.queues[key]
+		for i := range queue {
+			if queue[i] == w {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+
+		if len(queue) == 0 {
+			delete(blocked.queues, key)
+		} else {
+			blocked.queues[key] = queue
+		}
+	}
+}
+
+// signalKeyReady marks key as ready to serve its blocked clients, if any
+func signalKeyReady(key alg.Key) {
+	blocked.Lock()
+	defer blocked.Unlock()
+
+	if len(blocked.queues[key]) > 0 {
+		blocked.ready[key] = true
+	}
+}
+
+// signalDBReady wakes up the clients blocked on the keys of a DB whose
+// content has been replaced by SWAPDB
+func signalDBReady(dbNum int) {
+	blocked.Lock()
+	defer blocked.Unlock()
+
+	for key, queue := range blocked.queues {
+		if key.DB == dbNum && len(queue) > 0 {
+			blocked.ready[key] = true
+		}
+	}
+
+	for key, queue := range blocked.streams {
+		if key.DB != dbNum {
+			continue
+		}
+
+		for _, w := range append([]*StreamWaiter{}, queue...) {
+			w.unregister()
+			close(w.ready)
+		}
+	}
+}
+
+// ServeBlocked serves the clients blocked on the keys that received
+// some elements, in FIFO order
+func ServeBlocked() {
+	blocked.Lock()
+	pending := len(blocked.ready)
+	blocked.Unlock()
+
+	if pending == 0 {
+		return
+	}
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	for {
+		blocked.Lock()
+		var keys []alg.Key
+		for key := range blocked.ready {
+			keys = append(keys, key)
+		}
+		blocked.ready = make(map[alg.Key]bool)
+		blocked.Unlock()
+
+		if len(keys) == 0 {
+			return
+		}
+
+		for _, key := range keys {
+			serveKey(key)
+		}
+	}
+}
+
+// serveKey hands the elements of the list at key over to its blocked
+// clients, the caller must hold cache.FSRWL.Lock
+func serveKey(key alg.Key) {
+	for {
+		blocked.Lock()
+
+		queue := blocked.queues[key]
+		if len(queue) == 0 {
+			blocked.Unlock()
+			return
+		}
+
+		l, err := loadList(key)
+		if err != nil || l == nil {
+			blocked.Unlock()
+			return
+		}
+
+		w := queue[0]
+
+		var name []byte
+		for i := range w.keys {
+			if w.keys[i] == key {
+				name = w.names[i]
+			}
+		}
+
+		result := BlockedResult{
+			Key: name,
+		}
+		if w.dst != nil {
+			if _, err := checkType(*w.dst, TypeList); err != nil {
+				result.Err = err
+			}
+		}
+
+		// the element is popped holding blocked, so that w can't time out
+		// in the meantime and the element can't get lost
+		if result.Err == nil {
+			popped, err := listPop(key, 1, w.left)
+			if err != nil {
+				result.Err = err
+			} else if len(popped) > 0 {
+				result.Value = popped[0]
+			}
+		}
+
+		w.unregister()
+		w.served = true
+
+		blocked.Unlock()
+
+		// w can't time out anymore, so blocked can be released before
+		// pushing, which might serve other clients waiting on dst
+		if w.dst != nil && result.Err == nil && result.Value != nil {
+			if err := listPushOrRestore(key, *w.dst, result.Value, w.left, w.toLeft); err != nil {
+				result.Value, result.Err = nil, err
+			}
+		}
+
+		w.results <- result
+	}
+}
+
+// StreamWaiter is a client blocked by XREAD on one or more streams.
+// Reading does not consume the entries, so it's enough to wake it up when
+// any of the streams gets a new entry and let it read them again.
+type StreamWaiter struct {
+	keys  []alg.Key
+	ready chan struct{}
+}
+
+func registerStreamWaiter(keys []alg.Key) *StreamWaiter {
+	w := &StreamWaiter{
+		keys:  keys,
+		ready: make(chan struct{}),
+	}
+
+	blocked.Lock()
+	defer blocked.Unlock()
+
+	for _, key := range keys {
+		blocked.streams[key] = append(blocked.streams[key], w)
+	}
+
+	return w
+}
+
+// Wait blocks until one of the streams of w gets a new entry, the timeout
+// expires (0 means forever) or cancel is closed. It reports whether there
+// is a new entry to read.
+func (w *StreamWaiter) Wait(timeout time.Duration, cancel <-chan struct{}) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-w.ready:
+		return true
+	case <-expired:
+	case <-cancel:
+	}
+
+	blocked.Lock()
+	defer blocked.Unlock()
+
+	select {
+	case <-w.ready:
+		return true
+	default:
+	}
+
+	w.unregister()
+
+	return false
+}
+
+// unregister removes w from all its queues, the caller must hold blocked
+func (w *StreamWaiter) unregister() {
+	for _, key := range w.keys {
+		queue := blocked.streams[key]
+		for i := range queue {
+			if queue[i] == w {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+
+		if len(queue) == 0 {
+			delete(blocked.streams, key)
+		} else {
+			blocked.streams[key] = queue
+		}
+	}
+}
+
+// signalStreamWaiters wakes up the clients waiting for entries at key
+func signalStreamWaiters(key alg.Key) {
+	blocked.Lock()
+	defer blocked.Unlock()
+
+	waiters := append([]*StreamWaiter{}, blocked.streams[key]...)
+	for _, w := range waiters {
+		w.unregister()
+		close(w.ready)
+	}
+}
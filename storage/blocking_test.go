@@ -0,0 +1,97 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// breakList makes every push to the list at keyName fail
+func breakList(t *testing.T, db int, keyName string) {
+	t.Helper()
+
+	key := cache.NewKey(db, []byte(keyName))
+	if err := os.Remove(filepath.Join(key.FilePath(), listMetaFileName)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkList(t *testing.T, db int, keyName string, want ...string) {
+	t.Helper()
+
+	values, err := LRange(db, []byte(keyName), 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != len(want) {
+		t.Fatalf("%s holds %q, want %q", keyName, values, want)
+	}
+	for i := range want {
+		if string(values[i]) != want[i] {
+			t.Fatalf("%s holds %q, want %q", keyName, values, want)
+		}
+	}
+}
+
+func TestBlockingMoveRestoresOnPushFailure(t *testing.T) {
+	const db = 2
+
+	if _, err := Push(db, testArgs("bmove-src", "a", "b"), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(db, testArgs("bmove-dst", "x"), false, false); err != nil {
+		t.Fatal(err)
+	}
+	breakList(t, db, "bmove-dst")
+
+	if _, _, err := BlockingPop(db, testArgs("bmove-src"), true, []byte("bmove-dst"), true, true); err == nil {
+		t.Fatal("the move succeeded despite the broken destination")
+	}
+
+	checkList(t, db, "bmove-src", "a", "b")
+}
+
+func TestServedMoveRestoresOnPushFailure(t *testing.T) {
+	const db = 3
+
+	if _, err := Push(db, testArgs("served-dst", "x"), false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, waiter, err := BlockingPop(db, testArgs("served-src"), true, []byte("served-dst"), true, false)
+	if err != nil || waiter == nil {
+		t.Fatalf("BlockingPop did not block: %v", err)
+	}
+
+	breakList(t, db, "served-dst")
+
+	if _, err := Push(db, testArgs("served-src", "a"), false, false); err != nil {
+		t.Fatal(err)
+	}
+	ServeBlocked()
+
+	result := waiter.Wait(0, nil)
+	if result == nil || result.Err == nil {
+		t.Fatalf("the waiter got %+v, want an error", result)
+	}
+
+	checkList(t, db, "served-src", "a")
+}
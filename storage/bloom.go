@@ -0,0 +1,284 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+// Bloom filters are alg.ScalableBloom dirs, their bits are updated in place
+
+const (
+	// the defaults of RedisBloom for filters created by BF.ADD and BF.MADD
+	bloomDefaultErrorRate = 0.01
+	bloomDefaultCapacity  = 100
+	bloomDefaultExpansion = 2
+)
+
+var (
+	errBloomExists     = errors.New("ERR item exists")
+	errBloomNotFound   = errors.New("ERR not found")
+	errBloomFull       = errors.New("ERR non scaling filter is full")
+	errBloomErrorRate  = errors.New("ERR (0 < error rate range < 1)")
+	errBloomCapacity   = errors.New("ERR (capacity should be larger than 0)")
+	errBloomExpansion  = errors.New("ERR expansion should be greater or equal to 1")
+	errBloomNonScaling = errors.New("ERR Nonscaling filters cannot expand")
+)
+
+type BFReserveArgs struct {
+	ErrorRate  float64
+	Capacity   uint64
+	Expansion  uint32
+	NonScaling bool
+}
+
+// ParseBFReserveArgs parses the arguments of BF.RESERVE following the key
+func ParseBFReserveArgs(args [][]byte) (*BFReserveArgs, error) {
+	if len(args) < 2 {
+		return nil, errors.New("wrong number of arguments for 'bf.reserve' command")
+	}
+
+	errorRate, err := ParseFloat(args[0])
+	if err != nil {
+		return nil, errors.New("ERR bad error rate")
+	}
+	if errorRate <= 0 || errorRate >= 1 {
+		return nil, errBloomErrorRate
+	}
+
+	capacity, err := ParseInt(args[1])
+	if err != nil {
+		return nil, errors.New("ERR bad capacity")
+	}
+	if capacity <= 0 {
+		return nil, errBloomCapacity
+	}
+
+	reserve := &BFReserveArgs{
+		ErrorRate: errorRate,
+		Capacity:  uint64(capacity),
+		Expansion: bloomDefaultExpansion,
+	}
+
+	expansionGiven := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "expansion":
+			if i+1 == len(args) {
+				return nil, ErrSyntax
+			}
+			i++
+
+			expansion, err := ParseInt(args[i])
+			if err != nil {
+				return nil, errors.New("ERR bad expansion")
+			}
+			if expansion < 1 || expansion > 1<<31 {
+				return nil, errBloomExpansion
+			}
+
+			reserve.Expansion = uint32(expansion)
+			expansionGiven = true
+		case "nonscaling":
+			reserve.NonScaling = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if expansionGiven && reserve.NonScaling {
+		return nil, errBloomNonScaling
+	}
+
+	return reserve, nil
+}
+
+// openBloom opens the filter at key, nil if the key does not exist.
+// The caller must hold at least cache.FSRWL.RLock and close the filter.
+func openBloom(key alg.Key) (*alg.ScalableBloom, error) {
+	found, err := checkType(key, TypeBloom)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return alg.OpenScalableBloom(key.FilePath())
+}
+
+// createBloom creates an empty filter at key.
+// The caller must hold cache.FSRWL.Lock and close the filter.
+func createBloom(key alg.Key, reserve *BFReserveArgs) (*alg.ScalableBloom, error) {
+	if err := createTyped(key, TypeBloom, nil); err != nil {
+		return nil, err
+	}
+
+	touch(key)
+
+	return alg.CreateScalableBloom(key.FilePath(), reserve.Capacity, reserve.ErrorRate, reserve.Expansion, reserve.NonScaling)
+}
+
+// BFReserve creates an empty filter at keyName
+func BFReserve(dbNum int, keyName []byte, reserve *BFReserveArgs) error {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	typ, err := keyType(key)
+	if err != nil {
+		return err
+	}
+	if typ != TypeNone {
+		return errBloomExists
+	}
+
+	b, err := createBloom(key, reserve)
+	if err != nil {
+		return err
+	}
+
+	return b.Close()
+}
+
+// BFAdd adds items to the filter at keyName, creating it with the default
+// parameters if missing. Every item is replied 1 if it was added, 0 if it
+// may have been added already or an error if the filter is full.
+func BFAdd(dbNum int, keyName []byte, items [][]byte) ([]interface{}, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	b, err := openBloom(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if b == nil {
+		b, err = createBloom(key, &BFReserveArgs{
+			ErrorRate: bloomDefaultErrorRate,
+			Capacity:  bloomDefaultCapacity,
+			Expansion: bloomDefaultExpansion,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer b.Close()
+
+	result := make([]interface{}, len(items))
+	for i, item := range items {
+		added, err := b.Add(item)
+		switch {
+		case err == alg.ErrBloomFull:
+			result[i] = errBloomFull
+		case err != nil:
+			return nil, err
+		case added:
+			result[i] = 1
+			touch(key)
+		default:
+			result[i] = 0
+		}
+	}
+
+	return result, nil
+}
+
+// BFExists reports for every item whether it may have been added to the
+// filter at keyName
+func BFExists(dbNum int, keyName []byte, items [][]byte) ([]int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	result := make([]int, len(items))
+
+	b, err := openBloom(key)
+	if err != nil || b == nil {
+		return result, err
+	}
+	defer b.Close()
+
+	for i, item := range items {
+		found, err := b.Test(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			result[i] = 1
+		}
+	}
+
+	return result, nil
+}
+
+// BFInfo returns the field/value pairs replied by BF.INFO, only the one
+// of field if not nil. Nonscaling filters have a nil expansion rate.
+func BFInfo(dbNum int, keyName []byte, field []byte) ([]interface{}, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	b, err := openBloom(key)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return nil, errBloomNotFound
+	}
+	defer b.Close()
+
+	var expansion interface{}
+	if !b.NonScaling {
+		expansion = int(b.Expansion)
+	}
+
+	info := []struct {
+		field string
+		name  string
+		value interface{}
+	}{
+		{"capacity", "Capacity", int(b.Capacity())},
+		{"size", "Size", int(b.Size())},
+		{"filters", "Number of filters", len(b.Filters)},
+		{"items", "Number of items inserted", int(b.Items())},
+		{"expansion", "Expansion rate", expansion},
+	}
+
+	result := []interface{}{}
+	for _, i := range info {
+		if field == nil {
+			result = append(result, []byte(i.name), i.value)
+		} else if bytes.EqualFold(field, []byte(i.field)) {
+			result = append(result, i.value)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, errors.New("ERR Invalid information value")
+	}
+
+	return result, nil
+}
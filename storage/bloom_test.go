@@ -0,0 +1,237 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bfTestItems returns n items starting from the first one
+func bfTestItems(first, n int) [][]byte {
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("https://example.com/%d", first+i))
+	}
+
+	return items
+}
+
+// bfTestInfo returns the BF.INFO values of keyName by field name
+func bfTestInfo(t *testing.T, db int, keyName string) map[string]interface{} {
+	t.Helper()
+
+	info, err := BFInfo(db, []byte(keyName), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]interface{}{}
+	for i := 0; i < len(info); i += 2 {
+		values[string(info[i].([]byte))] = info[i+1]
+	}
+
+	return values
+}
+
+func checkBFInfo(t *testing.T, db int, keyName string, capacity, filters, items int, expansion interface{}) {
+	t.Helper()
+
+	info := bfTestInfo(t, db, keyName)
+	if info["Capacity"] != capacity || info["Number of filters"] != filters ||
+		info["Number of items inserted"] != items || info["Expansion rate"] != expansion {
+		t.Fatalf("BF.INFO %s is %v", keyName, info)
+	}
+}
+
+func TestBFReserveLayout(t *testing.T) {
+	const db = 5
+
+	reserve, err := ParseBFReserveArgs(testArgs("0.001", "1000", "expansion", "4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := BFReserve(db, []byte("bf"), reserve); err != nil {
+		t.Fatal(err)
+	}
+	if err := BFReserve(db, []byte("bf"), reserve); err != errBloomExists {
+		t.Fatalf("reserving an existing filter returned %v", err)
+	}
+
+	// a dir with the type, the meta file and the first filter
+	dir := testKeyPath(db, "bf")
+	if typ, err := os.ReadFile(filepath.Join(dir, typeFileName)); err != nil || string(typ) != TypeBloom {
+		t.Fatalf("the type file holds %q: %v", typ, err)
+	}
+	for _, name := range []string{"meta", "00000000"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := BFAdd(db, []byte("bf"), bfTestItems(0, 1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := 0
+	for _, r := range result {
+		if r == 1 {
+			added++
+		}
+	}
+	if added < 1495 {
+		t.Fatalf("added %d items out of 1500", added)
+	}
+
+	reopen(t, db)
+
+	// the second filter has expansion times the capacity
+	checkBFInfo(t, db, "bf", 5000, 2, added, 4)
+	if _, err := os.Stat(filepath.Join(dir, "00000001")); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := BFExists(db, []byte("bf"), bfTestItems(0, 1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range found {
+		if f != 1 {
+			t.Fatalf("item %d is missing after reopening", i)
+		}
+	}
+
+	if typ, err := Type(db, []byte("bf")); err != nil || typ != TypeBloom {
+		t.Fatalf("the type is %s: %v", typ, err)
+	}
+
+	if _, err := Del(db, testArgs("bf")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBFAddDefaults(t *testing.T) {
+	const db = 5
+
+	// BF.ADD creates the filter with the defaults of RedisBloom
+	result, err := BFAdd(db, []byte("bfdefault"), testArgs("a", "b", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 || result[0] != 1 || result[1] != 1 || result[2] != 0 {
+		t.Fatalf("BF.MADD replied %v", result)
+	}
+	checkBFInfo(t, db, "bfdefault", 100, 1, 2, 2)
+
+	info, err := BFInfo(db, []byte("bfdefault"), []byte("CAPACITY"))
+	if err != nil || len(info) != 1 || info[0] != 100 {
+		t.Fatalf("BF.INFO CAPACITY is %v: %v", info, err)
+	}
+	if _, err := BFInfo(db, []byte("bfdefault"), []byte("bits")); err == nil {
+		t.Fatal("BF.INFO of an unknown field did not fail")
+	}
+	if _, err := BFInfo(db, []byte("bfmissing"), nil); err != errBloomNotFound {
+		t.Fatalf("BF.INFO of a missing key returned %v", err)
+	}
+
+	found, err := BFExists(db, []byte("bfmissing"), testArgs("a"))
+	if err != nil || len(found) != 1 || found[0] != 0 {
+		t.Fatalf("BF.EXISTS of a missing key replied %v: %v", found, err)
+	}
+
+	// the commands fail on other types
+	if _, _, err := Set(db, testArgs("bfstring", "value"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BFAdd(db, []byte("bfstring"), testArgs("a")); err != ErrWrongType {
+		t.Fatalf("BF.ADD on a string returned %v", err)
+	}
+	if _, err := BFExists(db, []byte("bfstring"), testArgs("a")); err != ErrWrongType {
+		t.Fatalf("BF.EXISTS on a string returned %v", err)
+	}
+	if _, err := BFInfo(db, []byte("bfstring"), nil); err != ErrWrongType {
+		t.Fatalf("BF.INFO on a string returned %v", err)
+	}
+
+	if _, err := Del(db, testArgs("bfdefault", "bfstring")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBFNonScaling(t *testing.T) {
+	const db = 5
+
+	reserve, err := ParseBFReserveArgs(testArgs("0.0001", "10", "NONSCALING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := BFReserve(db, []byte("bffull"), reserve); err != nil {
+		t.Fatal(err)
+	}
+
+	// the items past the capacity get an error each, the others are added
+	result, err := BFAdd(db, []byte("bffull"), bfTestItems(0, 12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range result {
+		if i < 10 && r != 1 || i >= 10 && r != errBloomFull {
+			t.Fatalf("item %d got %v", i, r)
+		}
+	}
+
+	reopen(t, db)
+	checkBFInfo(t, db, "bffull", 10, 1, 10, nil)
+
+	if _, err := Del(db, testArgs("bffull")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBFReserveArgs(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"0"}, nil},
+		{[]string{"0", "100"}, errBloomErrorRate},
+		{[]string{"1", "100"}, errBloomErrorRate},
+		{[]string{"x", "100"}, nil},
+		{[]string{"0.01", "0"}, errBloomCapacity},
+		{[]string{"0.01", "x"}, nil},
+		{[]string{"0.01", "100", "expansion", "0"}, errBloomExpansion},
+		{[]string{"0.01", "100", "expansion"}, ErrSyntax},
+		{[]string{"0.01", "100", "expansion", "2", "nonscaling"}, errBloomNonScaling},
+		{[]string{"0.01", "100", "other"}, ErrSyntax},
+	} {
+		_, err := ParseBFReserveArgs(testArgs(c.args...))
+		if err == nil || c.err != nil && err != c.err {
+			t.Fatalf("BF.RESERVE %q returned %v, want %v", c.args, err, c.err)
+		}
+	}
+
+	reserve, err := ParseBFReserveArgs(testArgs("0.01", "100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserve.ErrorRate != 0.01 || reserve.Capacity != 100 || reserve.Expansion != 2 || reserve.NonScaling {
+		t.Fatalf("parsed %+v", reserve)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+	ErrNotFloat   = errors.New("ERR value is not a valid float")
+	ErrNaN        = errors.New("ERR increment would produce NaN or Infinity")
+)
+
+// ParseInt parses a Redis integer: no spaces, no leading '+' and no overflow
+func ParseInt(b []byte) (int64, error) {
+	if len(b) == 0 || b[0] == '+' {
+		return 0, ErrNotInteger
+	}
+
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+
+	return n, nil
+}
+
+// ParseFloat parses a Redis float, rejecting NaN
+func ParseFloat(b []byte) (float64, error) {
+	if len(b) == 0 || b[0] == ' ' || b[len(b)-1] == ' ' {
+		return 0, ErrNotFloat
+	}
+
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, ErrNotFloat
+	}
+
+	return f, nil
+}
+
+// FormatFloat formats a float the way Redis replies with it
+func FormatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// IncrBy atomically adds delta to the integer stored at keyName,
+// a missing key counts as 0
+func IncrBy(dbNum int, keyName []byte, delta int64) (int64, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	value, err := getValue(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int64
+	if value != nil {
+		if current, err = ParseInt(value); err != nil {
+			return 0, err
+		}
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrNotInteger
+	}
+	current += delta
+
+	if err := setValueAtomic(key, []byte(strconv.FormatInt(current, 10))); err != nil {
+		return 0, err
+	}
+
+	return current, nil
+}
+
+// IncrByFloat atomically adds delta to the float stored at keyName,
+// a missing key counts as 0
+func IncrByFloat(dbNum int, keyName []byte, delta float64) ([]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	value, err := getValue(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var current float64
+	if value != nil {
+		if current, err = ParseFloat(value); err != nil {
+			return nil, err
+		}
+	}
+
+	current += delta
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return nil, ErrNaN
+	}
+
+	result := []byte(FormatFloat(current))
+	if err := setValueAtomic(key, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
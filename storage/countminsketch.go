@@ -0,0 +1,324 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+// Count-Min Sketches are dirs holding an alg.CountMinSketch file,
+// whose counters are updated in place
+
+const cmsFileName = "sketch"
+
+var (
+	errCMSExists      = errors.New("ERR CMS: key already exists")
+	errCMSNotFound    = errors.New("ERR CMS: key does not exist")
+	errCMSWidth       = errors.New("ERR CMS: invalid width")
+	errCMSDepth       = errors.New("ERR CMS: invalid depth")
+	errCMSErrorRate   = errors.New("ERR CMS: invalid overestimation value")
+	errCMSProbability = errors.New("ERR CMS: invalid prob value")
+	errCMSNumber      = errors.New("ERR CMS: Cannot parse number")
+	errCMSNumKeys     = errors.New("ERR CMS: invalid numkeys")
+	errCMSWeight      = errors.New("ERR CMS: invalid weight value")
+	errCMSDimensions  = errors.New("ERR CMS: width/depth is not equal")
+	errCMSIncrBy      = errors.New("ERR CMS: INCRBY overflow")
+	errCMSMerge       = errors.New("ERR CMS: MERGE overflow")
+)
+
+// parseUint32 parses a positive 32 bits integer, returning err if invalid
+func parseUint32(b []byte, err error) (uint32, error) {
+	n, parseErr := ParseInt(b)
+	if parseErr != nil || n < 1 || n > math.MaxUint32 {
+		return 0, err
+	}
+
+	return uint32(n), nil
+}
+
+// ParseCMSInitByDimArgs parses the width and depth of CMS.INITBYDIM
+func ParseCMSInitByDimArgs(args [][]byte) (uint32, uint32, error) {
+	width, err := parseUint32(args[0], errCMSWidth)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	depth, err := parseUint32(args[1], errCMSDepth)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return width, depth, nil
+}
+
+// ParseCMSInitByProbArgs parses the error rate and probability of
+// CMS.INITBYPROB, returning the width and depth they need
+func ParseCMSInitByProbArgs(args [][]byte) (uint32, uint32, error) {
+	errorRate, err := ParseFloat(args[0])
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		return 0, 0, errCMSErrorRate
+	}
+
+	probability, err := ParseFloat(args[1])
+	if err != nil || probability <= 0 || probability >= 1 {
+		return 0, 0, errCMSProbability
+	}
+
+	width, depth := alg.CMSDimensions(errorRate, probability)
+
+	return width, depth, nil
+}
+
+// ParseCMSIncrByArgs parses the item/increment pairs of CMS.INCRBY
+func ParseCMSIncrByArgs(args [][]byte) ([][]byte, []uint32, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, nil, errors.New("wrong number of arguments for 'cms.incrby' command")
+	}
+
+	items := make([][]byte, 0, len(args)/2)
+	increments := make([]uint32, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		increment, err := ParseInt(args[i+1])
+		if err != nil || increment < 0 || increment > math.MaxUint32 {
+			return nil, nil, errCMSNumber
+		}
+
+		items = append(items, args[i])
+		increments = append(increments, uint32(increment))
+	}
+
+	return items, increments, nil
+}
+
+// ParseCMSMergeArgs parses the arguments of CMS.MERGE following the
+// destination, returning the sources and their weights
+func ParseCMSMergeArgs(args [][]byte) ([][]byte, []int64, error) {
+	numKeys, err := ParseInt(args[0])
+	if err != nil || numKeys < 1 || numKeys > int64(len(args)-1) {
+		return nil, nil, errCMSNumKeys
+	}
+
+	sources := args[1 : 1+numKeys]
+	args = args[1+numKeys:]
+
+	weights := make([]int64, len(sources))
+	for i := range weights {
+		weights[i] = 1
+	}
+
+	if len(args) == 0 {
+		return sources, weights, nil
+	}
+
+	if strings.ToLower(string(args[0])) != "weights" || len(args)-1 != len(sources) {
+		return nil, nil, ErrSyntax
+	}
+
+	for i, arg := range args[1:] {
+		// bounded so that a counter times a weight fits in an int64
+		if weights[i], err = ParseInt(arg); err != nil || weights[i] < math.MinInt32 || weights[i] > math.MaxInt32 {
+			return nil, nil, errCMSWeight
+		}
+	}
+
+	return sources, weights, nil
+}
+
+// openCMS opens the sketch at key, nil if the key does not exist.
+// The caller must hold at least cache.FSRWL.RLock and close the sketch.
+func openCMS(key alg.Key) (*alg.CountMinSketch, error) {
+	found, err := checkType(key, TypeCMS)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return alg.OpenCountMinSketch(filepath.Join(key.FilePath(), cmsFileName))
+}
+
+// CMSInit creates a sketch of the given dimensions at keyName
+func CMSInit(dbNum int, keyName []byte, width, depth uint32) error {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	typ, err := keyType(key)
+	if err != nil {
+		return err
+	}
+	if typ != TypeNone {
+		return errCMSExists
+	}
+
+	if err := createTyped(key, TypeCMS, nil); err != nil {
+		return err
+	}
+
+	touch(key)
+
+	c, err := alg.CreateCountMinSketch(filepath.Join(key.FilePath(), cmsFileName), width, depth)
+	if err != nil {
+		return err
+	}
+
+	return c.Close()
+}
+
+// CMSIncrBy increments the counts of items, returning their new estimated
+// counts. It stops at the first item whose counters would overflow.
+func CMSIncrBy(dbNum int, keyName []byte, items [][]byte, increments []uint32) ([]int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	c, err := openCMS(key)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errCMSNotFound
+	}
+	defer c.Close()
+
+	touch(key)
+
+	counts := make([]int, len(items))
+	for i, item := range items {
+		count, err := c.IncrBy(item, increments[i])
+		if err == alg.ErrCMSOverflow {
+			return nil, errCMSIncrBy
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		counts[i] = int(count)
+	}
+
+	return counts, nil
+}
+
+// CMSQuery returns the estimated counts of items
+func CMSQuery(dbNum int, keyName []byte, items [][]byte) ([]int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	c, err := openCMS(key)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errCMSNotFound
+	}
+	defer c.Close()
+
+	counts := make([]int, len(items))
+	for i, item := range items {
+		count, err := c.Query(item)
+		if err != nil {
+			return nil, err
+		}
+
+		counts[i] = int(count)
+	}
+
+	return counts, nil
+}
+
+// CMSMerge overwrites the sketch at dstName with the weighted sum of the
+// sketches at sources, all of them having the same dimensions
+func CMSMerge(dbNum int, dstName []byte, sources [][]byte, weights []int64) error {
+	dst := cache.NewKey(dbNum, dstName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	c, err := openCMS(dst)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return errCMSNotFound
+	}
+	defer c.Close()
+
+	sketches := make([]*alg.CountMinSketch, 0, len(sources))
+	defer func() {
+		for _, sketch := range sketches {
+			sketch.Close()
+		}
+	}()
+
+	for _, keyName := range sources {
+		sketch, err := openCMS(cache.NewKey(dbNum, keyName))
+		if err != nil {
+			return err
+		}
+		if sketch == nil {
+			return errCMSNotFound
+		}
+
+		sketches = append(sketches, sketch)
+
+		if sketch.Width != c.Width || sketch.Depth != c.Depth {
+			return errCMSDimensions
+		}
+	}
+
+	if err := c.Merge(sketches, weights); err != nil {
+		if err == alg.ErrCMSOverflow {
+			return errCMSMerge
+		}
+		return err
+	}
+
+	touch(dst)
+
+	return nil
+}
+
+// CMSInfo returns the field/value pairs replied by CMS.INFO
+func CMSInfo(dbNum int, keyName []byte) ([]interface{}, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	c, err := openCMS(key)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errCMSNotFound
+	}
+	defer c.Close()
+
+	return []interface{}{
+		[]byte("width"), int(c.Width),
+		[]byte("depth"), int(c.Depth),
+		[]byte("count"), int(c.Count),
+	}, nil
+}
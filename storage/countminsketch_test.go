@@ -0,0 +1,226 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func checkCMSCounts(t *testing.T, db int, keyName string, items []string, want ...int) {
+	t.Helper()
+
+	counts, err := CMSQuery(db, []byte(keyName), testArgs(items...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Fatalf("%s counts %d in %s, want %d", items[i], counts[i], keyName, want[i])
+		}
+	}
+}
+
+func cmsTestIncrBy(t *testing.T, db int, keyName string, args ...string) []int {
+	t.Helper()
+
+	items, increments, err := ParseCMSIncrByArgs(testArgs(args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := CMSIncrBy(db, []byte(keyName), items, increments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return counts
+}
+
+func TestCMSLayout(t *testing.T) {
+	const db = 5
+
+	width, depth, err := ParseCMSInitByProbArgs(testArgs("0.001", "0.01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CMSInit(db, []byte("cms"), width, depth); err != nil {
+		t.Fatal(err)
+	}
+	if err := CMSInit(db, []byte("cms"), width, depth); err != errCMSExists {
+		t.Fatalf("creating an existing sketch returned %v", err)
+	}
+
+	// a dir with the type and the sketch file
+	dir := testKeyPath(db, "cms")
+	if typ, err := os.ReadFile(filepath.Join(dir, typeFileName)); err != nil || string(typ) != TypeCMS {
+		t.Fatalf("the type file holds %q: %v", typ, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, cmsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(24 + 4*2000*7); info.Size() != want {
+		t.Fatalf("the sketch file is %d bytes, want %d", info.Size(), want)
+	}
+
+	if counts := cmsTestIncrBy(t, db, "cms", "a", "5", "b", "3", "a", "2"); counts[0] != 5 || counts[1] != 3 || counts[2] != 7 {
+		t.Fatalf("CMS.INCRBY replied %v", counts)
+	}
+
+	reopen(t, db)
+
+	checkCMSCounts(t, db, "cms", []string{"a", "b", "c"}, 7, 3, 0)
+	result, err := CMSInfo(db, []byte("cms"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 6 || result[1] != 2000 || result[3] != 7 || result[5] != 10 {
+		t.Fatalf("CMS.INFO replied %v", result)
+	}
+	if typ, err := Type(db, []byte("cms")); err != nil || typ != TypeCMS {
+		t.Fatalf("the type is %s: %v", typ, err)
+	}
+
+	if _, err := Del(db, testArgs("cms")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCMSErrors(t *testing.T) {
+	const db = 5
+
+	if err := CMSInit(db, []byte("cmserr"), 10, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// the items before an overflow are counted
+	max := strconv.FormatInt(math.MaxUint32, 10)
+	cmsTestIncrBy(t, db, "cmserr", "a", max)
+	items, increments, err := ParseCMSIncrByArgs(testArgs("b", "1", "a", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CMSIncrBy(db, []byte("cmserr"), items, increments); err != errCMSIncrBy {
+		t.Fatalf("overflowing returned %v", err)
+	}
+	checkCMSCounts(t, db, "cmserr", []string{"a", "b"}, math.MaxUint32, 1)
+
+	for _, f := range []func() error{
+		func() error { _, err := CMSQuery(db, []byte("cmsmissing"), testArgs("a")); return err },
+		func() error { _, err := CMSIncrBy(db, []byte("cmsmissing"), items, increments); return err },
+		func() error { _, err := CMSInfo(db, []byte("cmsmissing")); return err },
+		func() error { return CMSMerge(db, []byte("cmsmissing"), testArgs("cmserr"), []int64{1}) },
+		func() error { return CMSMerge(db, []byte("cmserr"), testArgs("cmsmissing"), []int64{1}) },
+	} {
+		if err := f(); err != errCMSNotFound {
+			t.Fatalf("a command on a missing sketch returned %v", err)
+		}
+	}
+
+	if _, _, err := Set(db, testArgs("cmsstring", "value"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CMSQuery(db, []byte("cmsstring"), testArgs("a")); err != ErrWrongType {
+		t.Fatalf("CMS.QUERY on a string returned %v", err)
+	}
+	if err := CMSInit(db, []byte("cmsstring"), 10, 2); err != errCMSExists {
+		t.Fatalf("CMS.INITBYDIM on a string returned %v", err)
+	}
+
+	for _, args := range [][]string{{"0", "1"}, {"1", "0"}, {"x", "1"}, {"4294967296", "1"}} {
+		if _, _, err := ParseCMSInitByDimArgs(testArgs(args...)); err == nil {
+			t.Fatalf("CMS.INITBYDIM %q did not fail", args)
+		}
+	}
+	for _, args := range [][]string{{"0", "0.1"}, {"1", "0.1"}, {"0.1", "0"}, {"0.1", "1"}, {"x", "0.1"}} {
+		if _, _, err := ParseCMSInitByProbArgs(testArgs(args...)); err == nil {
+			t.Fatalf("CMS.INITBYPROB %q did not fail", args)
+		}
+	}
+	for _, args := range [][]string{{}, {"a"}, {"a", "-1"}, {"a", "4294967296"}, {"a", "x"}} {
+		if _, _, err := ParseCMSIncrByArgs(testArgs(args...)); err == nil {
+			t.Fatalf("CMS.INCRBY %q did not fail", args)
+		}
+	}
+	for _, args := range [][]string{
+		{"0", "a"}, {"2", "a"}, {"x", "a"},
+		{"1", "a", "weights"}, {"1", "a", "weights", "1", "2"}, {"1", "a", "other", "1"},
+		{"1", "a", "weights", "x"}, {"1", "a", "weights", "4294967296"},
+	} {
+		if _, _, err := ParseCMSMergeArgs(testArgs(args...)); err == nil {
+			t.Fatalf("CMS.MERGE %q did not fail", args)
+		}
+	}
+
+	if _, err := Del(db, testArgs("cmserr", "cmsstring")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCMSMerge(t *testing.T) {
+	const db = 5
+
+	for _, keyName := range []string{"cmsa", "cmsb", "cmsdst"} {
+		if err := CMSInit(db, []byte(keyName), 100, 4); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CMSInit(db, []byte("cmsother"), 50, 4); err != nil {
+		t.Fatal(err)
+	}
+	cmsTestIncrBy(t, db, "cmsa", "x", "10", "y", "20")
+	cmsTestIncrBy(t, db, "cmsb", "x", "5")
+
+	merge := func(dst string, args ...string) error {
+		sources, weights, err := ParseCMSMergeArgs(testArgs(args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return CMSMerge(db, []byte(dst), sources, weights)
+	}
+
+	if err := merge("cmsdst", "2", "cmsa", "cmsb", "WEIGHTS", "1", "3"); err != nil {
+		t.Fatal(err)
+	}
+	reopen(t, db)
+	checkCMSCounts(t, db, "cmsdst", []string{"x", "y"}, 25, 20)
+
+	// the destination can be a source
+	if err := merge("cmsa", "2", "cmsa", "cmsb", "weights", "1", "-2"); err != nil {
+		t.Fatal(err)
+	}
+	checkCMSCounts(t, db, "cmsa", []string{"x", "y"}, 0, 20)
+
+	// errors change nothing
+	if err := merge("cmsdst", "1", "cmsb", "weights", "-1"); err != errCMSMerge {
+		t.Fatalf("underflowing returned %v", err)
+	}
+	if err := merge("cmsdst", "2", "cmsa", "cmsother"); err != errCMSDimensions {
+		t.Fatalf("merging other dimensions returned %v", err)
+	}
+	checkCMSCounts(t, db, "cmsdst", []string{"x", "y"}, 25, 20)
+
+	if _, err := Del(db, testArgs("cmsa", "cmsb", "cmsdst", "cmsother")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,540 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+// Geo indexes are sorted sets whose scores are the 52 bits geohashes of
+// their members, see alg/geohash.go
+
+var (
+	errGeoUnit       = errors.New("ERR unsupported unit provided. please use M, KM, FT, MI")
+	errGeoMember     = errors.New("ERR could not decode requested zset member")
+	errGeoFrom       = errors.New("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+	errGeoBy         = errors.New("ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+	errGeoAny        = errors.New("ERR the ANY argument requires COUNT argument")
+	errGeoCount      = errors.New("ERR COUNT must be > 0")
+	errGeoRadius     = errors.New("ERR radius cannot be negative")
+	errGeoBox        = errors.New("ERR height or width cannot be negative")
+	errGeoStoreWith  = errors.New("ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+	errGeoNotNumeric = errors.New("ERR value is not a valid float")
+)
+
+func errGeoCoordinates(lon, lat float64) error {
+	return fmt.Errorf("ERR invalid longitude,latitude pair %f,%f", lon, lat)
+}
+
+// ParseGeoUnit returns how many meters a unit is
+func ParseGeoUnit(b []byte) (float64, error) {
+	switch strings.ToLower(string(b)) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+
+	return 0, errGeoUnit
+}
+
+// parseGeoCoordinates parses a longitude latitude pair
+func parseGeoCoordinates(lonArg, latArg []byte) (float64, float64, error) {
+	lon, err := ParseFloat(lonArg)
+	if err != nil {
+		return 0, 0, errGeoNotNumeric
+	}
+
+	lat, err := ParseFloat(latArg)
+	if err != nil {
+		return 0, 0, errGeoNotNumeric
+	}
+
+	if !alg.GeoValid(lon, lat) {
+		return 0, 0, errGeoCoordinates(lon, lat)
+	}
+
+	return lon, lat, nil
+}
+
+// GeoAdd adds the longitude latitude member triplets following the NX,
+// XX and CH flags in args, see ZAdd
+func GeoAdd(dbNum int, keyName []byte, args [][]byte) (int, error) {
+	var opts ZAddOptions
+
+	i := 0
+loop:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			opts.NX = true
+		case "xx":
+			opts.XX = true
+		case "ch":
+			opts.CH = true
+		default:
+			break loop
+		}
+	}
+	args = args[i:]
+
+	if opts.NX && opts.XX {
+		return 0, errors.New("ERR XX and NX options at the same time are not compatible")
+	}
+	if len(args) == 0 || len(args)%3 != 0 {
+		return 0, ErrSyntax
+	}
+
+	pairs := make([][]byte, 0, len(args)/3*2)
+	for i := 0; i < len(args); i += 3 {
+		lon, lat, err := parseGeoCoordinates(args[i], args[i+1])
+		if err != nil {
+			return 0, err
+		}
+
+		score := alg.GeoEncode(lon, lat, alg.GeoStep).Bits
+		pairs = append(pairs, []byte(strconv.FormatUint(score, 10)), args[i+2])
+	}
+
+	added, _, err := ZAdd(dbNum, keyName, opts, pairs)
+
+	return added, err
+}
+
+// geoScores returns the scores of members, negative for the missing ones
+func geoScores(dbNum int, keyName []byte, members [][]byte) ([]float64, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	scores := make([]float64, len(members))
+	for i := range scores {
+		scores[i] = -1
+	}
+
+	z, err := openZSet(key)
+	if err != nil || z == nil {
+		return scores, err
+	}
+	defer z.close()
+
+	for i, member := range members {
+		score, found, err := z.score(member)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			scores[i] = score
+		}
+	}
+
+	return scores, nil
+}
+
+// GeoPos returns the longitude and latitude of members, nil for the
+// missing ones
+func GeoPos(dbNum int, keyName []byte, members [][]byte) ([][]float64, error) {
+	scores, err := geoScores(dbNum, keyName, members)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := make([][]float64, len(members))
+	for i, score := range scores {
+		if score >= 0 {
+			lon, lat := alg.GeoDecodeScore(uint64(score))
+			positions[i] = []float64{lon, lat}
+		}
+	}
+
+	return positions, nil
+}
+
+// GeoHash returns the standard geohash strings of members, nil for the
+// missing ones
+func GeoHash(dbNum int, keyName []byte, members [][]byte) ([][]byte, error) {
+	scores, err := geoScores(dbNum, keyName, members)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([][]byte, len(members))
+	for i, score := range scores {
+		if score >= 0 {
+			hashes[i] = []byte(alg.GeoHashString(alg.GeoDecodeScore(uint64(score))))
+		}
+	}
+
+	return hashes, nil
+}
+
+// GeoDist returns the distance in meters between two members, false if
+// any of them is missing
+func GeoDist(dbNum int, keyName, member1, member2 []byte) (float64, bool, error) {
+	scores, err := geoScores(dbNum, keyName, [][]byte{member1, member2})
+	if err != nil || scores[0] < 0 || scores[1] < 0 {
+		return 0, false, err
+	}
+
+	lon1, lat1 := alg.GeoDecodeScore(uint64(scores[0]))
+	lon2, lat2 := alg.GeoDecodeScore(uint64(scores[1]))
+
+	return alg.GeoDistance(lon1, lat1, lon2, lat2), true, nil
+}
+
+// GeoSearchArgs are the arguments of GEOSEARCH and GEOSEARCHSTORE
+// following the key. Distances are in Unit.
+type GeoSearchArgs struct {
+	FromMember    []byte
+	FromLonLat    bool
+	Lon, Lat      float64
+	ByBox         bool
+	Radius        float64
+	Width, Height float64
+	Unit          float64 // in meters
+	Sort          int     // 1 for ASC, -1 for DESC
+	Count         int
+	Any           bool
+	WithCoord     bool
+	WithDist      bool
+	WithHash      bool
+	StoreDist     bool
+}
+
+// ParseGeoSearchArgs parses the arguments of GEOSEARCH, or of
+// GEOSEARCHSTORE if store is set
+func ParseGeoSearchArgs(args [][]byte, store bool) (*GeoSearchArgs, error) {
+	search := &GeoSearchArgs{}
+	byRadius := false
+
+	for i := 0; i < len(args); i++ {
+		left := len(args) - i - 1
+
+		switch strings.ToLower(string(args[i])) {
+		case "frommember":
+			if left < 1 {
+				return nil, ErrSyntax
+			}
+			if search.FromMember != nil || search.FromLonLat {
+				return nil, errGeoFrom
+			}
+
+			search.FromMember = args[i+1]
+			i++
+		case "fromlonlat":
+			if left < 2 {
+				return nil, ErrSyntax
+			}
+			if search.FromMember != nil || search.FromLonLat {
+				return nil, errGeoFrom
+			}
+
+			lon, lat, err := parseGeoCoordinates(args[i+1], args[i+2])
+			if err != nil {
+				return nil, err
+			}
+			search.FromLonLat, search.Lon, search.Lat = true, lon, lat
+			i += 2
+		case "byradius":
+			if left < 2 {
+				return nil, ErrSyntax
+			}
+			if byRadius || search.ByBox {
+				return nil, errGeoBy
+			}
+
+			radius, err := ParseFloat(args[i+1])
+			if err != nil {
+				return nil, errors.New("ERR need numeric radius")
+			}
+			if radius < 0 {
+				return nil, errGeoRadius
+			}
+
+			unit, err := ParseGeoUnit(args[i+2])
+			if err != nil {
+				return nil, err
+			}
+			byRadius, search.Radius, search.Unit = true, radius, unit
+			i += 2
+		case "bybox":
+			if left < 3 {
+				return nil, ErrSyntax
+			}
+			if byRadius || search.ByBox {
+				return nil, errGeoBy
+			}
+
+			width, err := ParseFloat(args[i+1])
+			if err != nil {
+				return nil, errors.New("ERR need numeric width")
+			}
+
+			height, err := ParseFloat(args[i+2])
+			if err != nil {
+				return nil, errors.New("ERR need numeric height")
+			}
+
+			if width < 0 || height < 0 {
+				return nil, errGeoBox
+			}
+
+			unit, err := ParseGeoUnit(args[i+3])
+			if err != nil {
+				return nil, err
+			}
+			search.ByBox, search.Width, search.Height, search.Unit = true, width, height, unit
+			i += 3
+		case "asc":
+			search.Sort = 1
+		case "desc":
+			search.Sort = -1
+		case "count":
+			if left < 1 {
+				return nil, ErrSyntax
+			}
+
+			count, err := ParseInt(args[i+1])
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+			if count <= 0 {
+				return nil, errGeoCount
+			}
+			search.Count = int(count)
+			i++
+
+			if left > 1 && strings.ToLower(string(args[i+1])) == "any" {
+				search.Any = true
+				i++
+			}
+		case "any":
+			return nil, errGeoAny
+		case "withcoord":
+			search.WithCoord = true
+		case "withdist":
+			search.WithDist = true
+		case "withhash":
+			search.WithHash = true
+		case "storedist":
+			if !store {
+				return nil, ErrSyntax
+			}
+			search.StoreDist = true
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	switch {
+	case search.FromMember == nil && !search.FromLonLat:
+		return nil, errGeoFrom
+	case !byRadius && !search.ByBox:
+		return nil, errGeoBy
+	case store && (search.WithCoord || search.WithDist || search.WithHash):
+		return nil, errGeoStoreWith
+	}
+
+	// like Redis, a COUNT without ANY needs the closest points
+	if search.Count > 0 && !search.Any && search.Sort == 0 {
+		search.Sort = 1
+	}
+
+	return search, nil
+}
+
+// GeoPoint is a result of GEOSEARCH
+type GeoPoint struct {
+	Member   []byte
+	Score    uint64
+	Lon, Lat float64
+	Dist     float64 // in meters
+}
+
+// geoSearch returns the points of z matching search, the caller must hold
+// at least cache.FSRWL.RLock
+func geoSearch(z *zset, search *GeoSearchArgs) ([]GeoPoint, error) {
+	shape := alg.GeoShape{
+		Lon:    search.Lon,
+		Lat:    search.Lat,
+		Box:    search.ByBox,
+		Radius: search.Radius * search.Unit,
+		Width:  search.Width * search.Unit,
+		Height: search.Height * search.Unit,
+	}
+
+	if search.FromMember != nil {
+		score, found, err := z.score(search.FromMember)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errGeoMember
+		}
+
+		shape.Lon, shape.Lat = alg.GeoDecodeScore(uint64(score))
+	}
+
+	points := []GeoPoint{}
+	for _, area := range shape.Areas() {
+		min, max := alg.GeoScoreRange(area)
+
+		from, to, err := z.scoreRanks(ZScoreBound{Value: float64(min)}, ZScoreBound{Value: float64(max), Exclusive: true})
+		if err != nil {
+			return nil, err
+		}
+
+		err = z.iterate(from, to, false, func(member []byte, score float64) bool {
+			lon, lat := alg.GeoDecodeScore(uint64(score))
+
+			dist, ok := shape.Contains(lon, lat)
+			if ok {
+				points = append(points, GeoPoint{
+					Member: member,
+					Score:  uint64(score),
+					Lon:    lon,
+					Lat:    lat,
+					Dist:   dist,
+				})
+			}
+
+			return !search.Any || len(points) < search.Count
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if search.Any && len(points) >= search.Count {
+			break
+		}
+	}
+
+	if search.Sort != 0 {
+		sort.SliceStable(points, func(i, j int) bool {
+			if search.Sort > 0 {
+				return points[i].Dist < points[j].Dist
+			}
+			return points[i].Dist > points[j].Dist
+		})
+	}
+
+	if search.Count > 0 && len(points) > search.Count {
+		points = points[:search.Count]
+	}
+
+	return points, nil
+}
+
+// GeoSearch returns the points of the geo index at keyName inside the area
+// described by search
+func GeoSearch(dbNum int, keyName []byte, search *GeoSearchArgs) ([]GeoPoint, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	z, err := openZSet(key)
+	if err != nil || z == nil {
+		return []GeoPoint{}, err
+	}
+	defer z.close()
+
+	return geoSearch(z, search)
+}
+
+// GeoSearchStore stores at dst the points of the geo index at src inside
+// the area described by search, with their distance as score if
+// StoreDist is set, returning how many they are
+func GeoSearchStore(dbNum int, dst, src []byte, search *GeoSearchArgs) (int, error) {
+	srcKey := cache.NewKey(dbNum, src)
+	dstKey := cache.NewKey(dbNum, dst)
+
+	// purged once the lock is released
+	var trashed string
+	defer func() {
+		purgeAsync([]string{trashed})
+	}()
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	z, err := openZSet(srcKey)
+	if err != nil {
+		return 0, err
+	}
+
+	points := []GeoPoint{}
+	if z != nil {
+		points, err = geoSearch(z, search)
+		z.close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	tmp, err := newTempZSet(dstKey)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, point := range points {
+		score := float64(point.Score)
+		if search.StoreDist {
+			score = point.Dist / search.Unit
+		}
+
+		if _, err = tmp.set(point.Member, score); err == nil {
+			err = tmp.bulkCommit()
+		}
+		if err != nil {
+			tmp.close()
+			os.RemoveAll(tmp.dir)
+			return 0, err
+		}
+	}
+
+	card, trashed, err := tmp.storeAt(dstKey)
+	return card, err
+}
+
+// FormatGeoCoordinate formats a coordinate the way Redis replies with it
+func FormatGeoCoordinate(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+
+	return strings.TrimSuffix(s, ".")
+}
+
+// FormatGeoDistance formats a distance in meters as unit, the way Redis
+// replies with it
+func FormatGeoDistance(meters, unit float64) string {
+	return strconv.FormatFloat(meters/unit, 'f', 4, 64)
+}
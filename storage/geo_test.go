@@ -0,0 +1,383 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+// geoTestAddSicily adds the points of the GEOADD Sicily example of the
+// Redis documentation, and two more
+func geoTestAddSicily(t *testing.T, db int, keyName string) {
+	t.Helper()
+
+	added, err := GeoAdd(db, []byte(keyName), testArgs(
+		"13.361389", "38.115556", "Palermo",
+		"15.087269", "37.502669", "Catania",
+		"12.758489", "38.788135", "edge1",
+		"17.241510", "38.788135", "edge2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 4 {
+		t.Fatalf("added %d points, want 4", added)
+	}
+}
+
+// geoTestSearch runs GEOSEARCH keyName args
+func geoTestSearch(t *testing.T, db int, keyName string, args ...string) []GeoPoint {
+	t.Helper()
+
+	search, err := ParseGeoSearchArgs(testArgs(args...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := GeoSearch(db, []byte(keyName), search)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return points
+}
+
+// checkGeoPoints checks the members of points and, when given, their
+// distances in km
+func checkGeoPoints(t *testing.T, points []GeoPoint, members []string, dists ...string) {
+	t.Helper()
+
+	if len(points) != len(members) {
+		t.Fatalf("got %d points, want %d", len(points), len(members))
+	}
+	for i, point := range points {
+		if string(point.Member) != members[i] {
+			t.Fatalf("point %d is %s, want %s", i, point.Member, members[i])
+		}
+		if dists != nil {
+			if dist := FormatGeoDistance(point.Dist, 1000); dist != dists[i] {
+				t.Fatalf("%s is %s km away, want %s", point.Member, dist, dists[i])
+			}
+		}
+	}
+}
+
+// checkGeoLayout checks that the tree of the geo index at keyName holds
+// a member and a score entry for each point, the score being its geohash
+func checkGeoLayout(t *testing.T, db int, keyName string, scores map[string]uint64) {
+	t.Helper()
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	if typ, err := Type(db, []byte(keyName)); err != nil || typ != TypeZSet {
+		t.Fatalf("%s is a %s: %v", keyName, typ, err)
+	}
+
+	tree, err := alg.OpenBTree(filepath.Join(testKeyPath(db, keyName), zsetTreeFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if n := tree.Len(); n != 2*len(scores) {
+		t.Fatalf("the tree of %s has %d entries, want %d", keyName, n, 2*len(scores))
+	}
+	for member, score := range scores {
+		for _, entry := range [][]byte{
+			zsetMemberKey([]byte(member)),
+			zsetScoreKey(encodeScore(float64(score)), []byte(member)),
+		} {
+			if _, found, err := tree.Get(entry); err != nil || !found {
+				t.Fatalf("no entry %q in the tree of %s: %v", entry, keyName, err)
+			}
+		}
+	}
+}
+
+func TestGeoLayout(t *testing.T) {
+	const db = 14
+
+	geoTestAddSicily(t, db, "sicily")
+
+	scores := map[string]uint64{}
+	for member, lonLat := range map[string][2]float64{
+		"Palermo": {13.361389, 38.115556},
+		"Catania": {15.087269, 37.502669},
+		"edge1":   {12.758489, 38.788135},
+		"edge2":   {17.241510, 38.788135},
+	} {
+		scores[member] = alg.GeoEncode(lonLat[0], lonLat[1], alg.GeoStep).Bits
+	}
+	if scores["Palermo"] != 3479099956230698 || scores["Catania"] != 3479447370796909 {
+		t.Fatalf("the scores of Palermo and Catania are %d and %d", scores["Palermo"], scores["Catania"])
+	}
+
+	checkGeoLayout(t, db, "sicily", scores)
+	reopen(t, db)
+	checkGeoLayout(t, db, "sicily", scores)
+
+	// the replies are the ones of a Redis server
+	score, err := ZScore(db, testArgs("sicily", "Palermo"))
+	if err != nil || string(score) != "3479099956230698" {
+		t.Fatalf("the score of Palermo is %s: %v", score, err)
+	}
+
+	positions, err := GeoPos(db, []byte("sicily"), testArgs("Palermo", "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 2 || positions[1] != nil {
+		t.Fatalf("got %d positions, the missing one is %v", len(positions), positions[1])
+	}
+	if lon, lat := FormatGeoCoordinate(positions[0][0]), FormatGeoCoordinate(positions[0][1]); lon != "13.36138933897018433" || lat != "38.11555639549629859" {
+		t.Fatalf("Palermo is at %s,%s", lon, lat)
+	}
+
+	hashes, err := GeoHash(db, []byte("sicily"), testArgs("Palermo", "Catania", "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(hashes[0]) != "sqc8b49rny0" || string(hashes[1]) != "sqdtr74hyu0" || hashes[2] != nil {
+		t.Fatalf("the geohashes are %q", hashes)
+	}
+
+	dist, found, err := GeoDist(db, []byte("sicily"), []byte("Palermo"), []byte("Catania"))
+	if err != nil || !found {
+		t.Fatalf("no distance between Palermo and Catania: %v", err)
+	}
+	if s := FormatGeoDistance(dist, 1000); s != "166.2742" {
+		t.Fatalf("Palermo is %s km from Catania", s)
+	}
+	if _, found, err := GeoDist(db, []byte("sicily"), []byte("Palermo"), []byte("missing")); err != nil || found {
+		t.Fatalf("a distance to a missing member: %v", err)
+	}
+
+	if _, err := Del(db, testArgs("sicily")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoAddOptions(t *testing.T) {
+	const db = 14
+
+	geoTestAddSicily(t, db, "geoadd")
+
+	// NX skips the existing members, XX the new ones, CH counts the moves
+	added, err := GeoAdd(db, []byte("geoadd"), testArgs("nx", "0", "0", "Palermo", "1", "1", "new"))
+	if err != nil || added != 1 {
+		t.Fatalf("NX added %d points, want 1: %v", added, err)
+	}
+	added, err = GeoAdd(db, []byte("geoadd"), testArgs("xx", "ch", "0", "0", "Palermo", "2", "2", "other"))
+	if err != nil || added != 1 {
+		t.Fatalf("XX CH changed %d points, want 1: %v", added, err)
+	}
+	added, err = GeoAdd(db, []byte("geoadd"), testArgs("2", "2", "new"))
+	if err != nil || added != 0 {
+		t.Fatalf("moving a point added %d points: %v", added, err)
+	}
+
+	positions, err := GeoPos(db, []byte("geoadd"), testArgs("Palermo", "new", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if positions[0] == nil || FormatGeoCoordinate(positions[0][0]) != "0.00000268220901489" {
+		t.Fatalf("Palermo did not move: %v", positions[0])
+	}
+	if positions[1] == nil || positions[1][0] < 1.9 || positions[2] != nil {
+		t.Fatalf("the positions are %v", positions)
+	}
+
+	for _, args := range [][]string{
+		{"nx", "xx", "0", "0", "a"},
+		{"0", "0"},
+		{"nx"},
+		{"0", "0", "a", "1"},
+		{"181", "0", "a"},
+		{"0", "86", "a"},
+		{"x", "0", "a"},
+	} {
+		if _, err := GeoAdd(db, []byte("geoadd"), testArgs(args...)); err == nil {
+			t.Fatalf("GEOADD %q did not fail", args)
+		}
+	}
+
+	// a failed GEOADD changes nothing
+	if _, err := GeoAdd(db, []byte("geoadd"), testArgs("3", "3", "ok", "0", "90", "pole")); err == nil {
+		t.Fatal("GEOADD of a pole did not fail")
+	}
+	if card, err := ZCard(db, testArgs("geoadd")); err != nil || card != 5 {
+		t.Fatalf("ZCARD is %d after a failed GEOADD, want 5: %v", card, err)
+	}
+
+	if _, err := Del(db, testArgs("geoadd")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoSearch(t *testing.T) {
+	const db = 14
+
+	geoTestAddSicily(t, db, "geosearch")
+
+	// the examples of the GEOSEARCH and GEORADIUS docs
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "byradius", "200", "km", "asc"),
+		[]string{"Catania", "Palermo"}, "56.4413", "190.4424")
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "asc"),
+		[]string{"Catania", "Palermo", "edge2", "edge1"}, "56.4413", "190.4424", "279.7403", "279.7405")
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "desc"),
+		[]string{"edge1", "edge2", "Palermo", "Catania"})
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "frommember", "Palermo", "byradius", "200", "km", "asc"),
+		[]string{"Palermo", "edge1", "Catania"}, "0.0000", "91.4007", "166.2742")
+
+	// COUNT sorts to keep the closest points, unless ANY is given
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "count", "2"),
+		[]string{"Catania", "Palermo"})
+	if points := geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "bybox", "400", "400", "km", "count", "3", "any"); len(points) != 3 {
+		t.Fatalf("COUNT 3 ANY returned %d points", len(points))
+	}
+
+	// the units are the ones of Redis
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "byradius", "56442", "m"),
+		[]string{"Catania"})
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "byradius", "35.08", "mi"),
+		[]string{"Catania"})
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "byradius", "185200", "ft"),
+		[]string{"Catania"})
+	checkGeoPoints(t, geoTestSearch(t, db, "geosearch", "fromlonlat", "15", "37", "byradius", "56", "km"),
+		[]string{})
+
+	// a missing key has no points, a missing member is an error
+	checkGeoPoints(t, geoTestSearch(t, db, "missing", "fromlonlat", "15", "37", "byradius", "200", "km"),
+		[]string{})
+	search, err := ParseGeoSearchArgs(testArgs("frommember", "missing", "byradius", "1", "km"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GeoSearch(db, []byte("geosearch"), search); err != errGeoMember {
+		t.Fatalf("searching from a missing member returned %v", err)
+	}
+
+	if _, err := Del(db, testArgs("geosearch")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGeoSearchArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{"byradius", "1", "km"},
+		{"fromlonlat", "0", "0"},
+		{"fromlonlat", "0", "0", "frommember", "a", "byradius", "1", "km"},
+		{"fromlonlat", "0", "0", "byradius", "1", "km", "bybox", "1", "1", "km"},
+		{"fromlonlat", "0", "0", "byradius", "-1", "km"},
+		{"fromlonlat", "0", "0", "bybox", "1", "-1", "km"},
+		{"fromlonlat", "0", "0", "byradius", "1", "yd"},
+		{"fromlonlat", "0", "0", "byradius", "1", "km", "count", "0"},
+		{"fromlonlat", "0", "0", "byradius", "1", "km", "any"},
+		{"fromlonlat", "0", "0", "byradius", "1", "km", "storedist"},
+		{"fromlonlat", "0", "90", "byradius", "1", "km"},
+		{"fromlonlat", "0", "0", "byradius", "1"},
+	} {
+		if _, err := ParseGeoSearchArgs(testArgs(args...), false); err == nil {
+			t.Fatalf("GEOSEARCH %q did not fail", args)
+		}
+	}
+
+	if _, err := ParseGeoSearchArgs(testArgs("fromlonlat", "0", "0", "byradius", "1", "km", "withdist"), true); err != errGeoStoreWith {
+		t.Fatalf("GEOSEARCHSTORE WITHDIST returned %v", err)
+	}
+
+	search, err := ParseGeoSearchArgs(testArgs("FROMLONLAT", "1", "2", "BYBOX", "3", "4", "KM", "COUNT", "5", "WITHCOORD", "WITHHASH"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !search.FromLonLat || search.Lon != 1 || search.Lat != 2 || !search.ByBox || search.Width != 3 ||
+		search.Height != 4 || search.Unit != 1000 || search.Count != 5 || search.Any ||
+		search.Sort != 1 || !search.WithCoord || !search.WithHash || search.WithDist {
+		t.Fatalf("parsed %+v", search)
+	}
+}
+
+func TestGeoSearchStore(t *testing.T) {
+	const db = 14
+
+	geoTestAddSicily(t, db, "geosrc")
+
+	store := func(dst string, args ...string) int {
+		t.Helper()
+
+		search, err := ParseGeoSearchArgs(testArgs(args...), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		card, err := GeoSearchStore(db, []byte(dst), []byte("geosrc"), search)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return card
+	}
+
+	// the points keep their geohash, or get their distance with STOREDIST
+	if card := store("geodst", "fromlonlat", "15", "37", "byradius", "200", "km"); card != 2 {
+		t.Fatalf("stored %d points, want 2", card)
+	}
+	if card := store("geodist", "fromlonlat", "15", "37", "byradius", "200", "km", "storedist"); card != 2 {
+		t.Fatalf("stored %d distances, want 2", card)
+	}
+	reopen(t, db)
+
+	checkGeoLayout(t, db, "geodst", map[string]uint64{
+		"Palermo": 3479099956230698,
+		"Catania": 3479447370796909,
+	})
+	checkZSetMembers(t, zsetTestRange(t, db, "geodist", "0", "-1"), "Catania", "Palermo")
+	for member, want := range map[string]string{"Catania": "56.441", "Palermo": "190.442"} {
+		score, err := ZScore(db, testArgs("geodist", member))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(score) < len(want) || string(score[:len(want)]) != want {
+			t.Fatalf("the distance of %s is %s, want %s...", member, score, want)
+		}
+	}
+
+	// storing nothing deletes the destination
+	if card := store("geodst", "fromlonlat", "15", "37", "byradius", "1", "km"); card != 0 {
+		t.Fatalf("stored %d points, want 0", card)
+	}
+	if found, err := Exists(db, testArgs("geodst")); err != nil || found != 0 {
+		t.Fatalf("the empty destination exists: %v", err)
+	}
+
+	// the source can be the destination
+	if card := store("geosrc", "frommember", "Palermo", "byradius", "100", "km"); card != 2 {
+		t.Fatalf("stored %d points over the source, want 2", card)
+	}
+	checkZSetMembers(t, zsetTestRange(t, db, "geosrc", "0", "-1"), "Palermo", "edge1")
+
+	waitDeleters(t)
+	checkEmptyTempDir(t)
+
+	if _, err := Del(db, testArgs("geosrc", "geodist")); err != nil {
+		t.Fatal(err)
+	}
+}
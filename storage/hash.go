@@ -0,0 +1,595 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	A hash is a dir holding one file per field, so that huge fields can be
+	read and written independently. Each field file is named after the
+	sha256 of the field name and contains:
+		4 bytes big endian length of the field name | field name | value
+	The name of the key is kept in a name file next to the fields dir, for
+	the search indexes to find the hashes to index when they are built.
+*/
+
+const (
+	hashFieldsDirName = "fields"
+	hashNameFileName  = "name"
+)
+
+var (
+	errHashNotInteger = errors.New("ERR hash value is not an integer")
+	errHashNotFloat   = errors.New("ERR hash value is not a float")
+)
+
+func hashFieldsDir(key alg.Key) string {
+	return filepath.Join(key.FilePath(), hashFieldsDirName)
+}
+
+func hashFieldPath(key alg.Key, field []byte) string {
+	hashedField := sha256.Sum256(field)
+
+	return filepath.Join(hashFieldsDir(key), hex.EncodeToString(hashedField[:]))
+}
+
+// isHashedName reports whether name is a file named after a sha256,
+// as opposed to e.g. temporary files
+func isHashedName(name string) bool {
+	return len(name) == sha256.Size*2 && name[0] != '.'
+}
+
+func writeHashField(path string, field, value []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(field)))
+
+	for _, chunk := range [][]byte{header, field, value} {
+		if _, err := f.Write(chunk); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// readHashField reads the name of a field and, if withValue is true, its value
+func readHashField(path string, withValue bool) ([]byte, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, nil, err
+	}
+
+	field := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(f, field); err != nil {
+		return nil, nil, err
+	}
+
+	if !withValue {
+		return field, nil, nil
+	}
+
+	value, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return field, value, nil
+}
+
+// hashFieldNames returns the sorted names of the field files of key
+func hashFieldNames(key alg.Key) ([]string, error) {
+	entries, err := os.ReadDir(hashFieldsDir(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if isHashedName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// hashGet returns the value of field, nil if missing.
+// The caller must hold at least cache.FSRWL.RLock.
+func hashGet(key alg.Key, field []byte) ([]byte, error) {
+	_, value, err := readHashField(hashFieldPath(key, field), true)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// hashSet sets field to value creating the hash if needed, it reports
+// whether the field is new. The caller must hold cache.FSRWL.Lock.
+func hashSet(key alg.Key, keyName, field, value []byte) (bool, error) {
+	found, err := checkType(key, TypeHash)
+	if err != nil {
+		return false, err
+	}
+
+	if !found {
+		err := createTyped(key, TypeHash, func(dir string) error {
+			if err := os.Mkdir(filepath.Join(dir, hashFieldsDirName), 0700); err != nil {
+				return err
+			}
+
+			return writeFileAtomic(filepath.Join(dir, hashNameFileName), keyName)
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+
+	path := hashFieldPath(key, field)
+
+	_, err = os.Lstat(path)
+	isNew := os.IsNotExist(err)
+
+	if err := writeHashField(path, field, value); err != nil {
+		return false, err
+	}
+
+	touch(key)
+
+	return isNew, nil
+}
+
+// HSet sets the given field-value pairs, returning how many fields were added
+func HSet(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'hset' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	counter := 0
+	for i := 1; i < len(args); i += 2 {
+		isNew, err := hashSet(key, args[0], args[i], args[i+1])
+		if err != nil {
+			return counter, err
+		}
+
+		if isNew {
+			counter++
+		}
+	}
+
+	return counter, indexHash(key, args[0])
+}
+
+// HSetNX sets a field only if it does not exist yet
+func HSetNX(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 3 {
+		return 0, fmt.Errorf("wrong number of arguments for 'hsetnx' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil {
+		return 0, err
+	}
+
+	if found {
+		if _, err := os.Lstat(hashFieldPath(key, args[1])); err == nil {
+			return 0, nil
+		}
+	}
+
+	if _, err := hashSet(key, args[0], args[1], args[2]); err != nil {
+		return 0, err
+	}
+
+	return 1, indexHash(key, args[0])
+}
+
+func HGet(dbNum int, args [][]byte) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("wrong number of arguments for 'hget' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return hashGet(key, args[1])
+}
+
+// HMGet returns the values of the given fields, nil for the missing ones
+func HMGet(dbNum int, args [][]byte) ([][]byte, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("wrong number of arguments for 'hmget' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, len(args)-1)
+	if !found {
+		return values, nil
+	}
+
+	for i, field := range args[1:] {
+		if values[i], err = hashGet(key, field); err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+// HDel removes the given fields, deleting the hash once it's empty
+func HDel(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("wrong number of arguments for 'hdel' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	counter := 0
+	for _, field := range args[1:] {
+		if err := os.Remove(hashFieldPath(key, field)); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return counter, err
+		}
+
+		counter++
+	}
+
+	if counter > 0 {
+		touch(key)
+
+		names, err := hashFieldNames(key)
+		if err != nil {
+			return counter, err
+		}
+
+		if len(names) == 0 {
+			if _, err := removeKey(key); err != nil {
+				return counter, err
+			}
+		} else if err := indexHash(key, args[0]); err != nil {
+			return counter, err
+		}
+	}
+
+	return counter, nil
+}
+
+func HExists(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 2 {
+		return 0, fmt.Errorf("wrong number of arguments for 'hexists' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	if _, err := os.Lstat(hashFieldPath(key, args[1])); err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+func HLen(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'hlen' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	names, err := hashFieldNames(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(names), nil
+}
+
+// HStrLen returns the length of the value of a field without reading it
+func HStrLen(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 2 {
+		return 0, fmt.Errorf("wrong number of arguments for 'hstrlen' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	path := hashFieldPath(key, args[1])
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return int(info.Size()) - 4 - len(args[1]), nil
+}
+
+// HGetAll returns the fields and/or the values of a hash, depending on
+// withFields and withValues. When both are set, fields and values are
+// interleaved.
+func HGetAll(dbNum int, keyName []byte, withFields, withValues bool) ([][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil || !found {
+		return [][]byte{}, err
+	}
+
+	names, err := hashFieldNames(key)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][]byte, 0, len(names))
+	for _, name := range names {
+		field, value, err := readHashField(filepath.Join(hashFieldsDir(key), name), withValues)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		if withFields {
+			result = append(result, field)
+		}
+		if withValues {
+			result = append(result, value)
+		}
+	}
+
+	return result, nil
+}
+
+// HIncrBy atomically adds delta to the integer stored in a field
+func HIncrBy(dbNum int, keyName, field []byte, delta int64) (int64, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int64
+	if found {
+		value, err := hashGet(key, field)
+		if err != nil {
+			return 0, err
+		}
+
+		if value != nil {
+			if current, err = ParseInt(value); err != nil {
+				return 0, errHashNotInteger
+			}
+		}
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, ErrNotInteger
+	}
+	current += delta
+
+	if _, err := hashSet(key, keyName, field, []byte(strconv.FormatInt(current, 10))); err != nil {
+		return 0, err
+	}
+
+	return current, indexHash(key, keyName)
+}
+
+// HIncrByFloat atomically adds delta to the float stored in a field
+func HIncrByFloat(dbNum int, keyName, field []byte, delta float64) ([]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var current float64
+	if found {
+		value, err := hashGet(key, field)
+		if err != nil {
+			return nil, err
+		}
+
+		if value != nil {
+			if current, err = ParseFloat(value); err != nil {
+				return nil, errHashNotFloat
+			}
+		}
+	}
+
+	current += delta
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return nil, ErrNaN
+	}
+
+	result := []byte(FormatFloat(current))
+	if _, err := hashSet(key, keyName, field, result); err != nil {
+		return nil, err
+	}
+
+	return result, indexHash(key, keyName)
+}
+
+// HScan iterates over the fields of a hash. The cursor is the numeric value
+// of the first 8 bytes of the next field file name, so that it stays valid
+// while the hash is modified between calls.
+func HScan(dbNum int, keyName []byte, cursor uint64, pattern []byte, count int) (uint64, [][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	found, err := checkType(key, TypeHash)
+	if err != nil || !found {
+		return 0, [][]byte{}, err
+	}
+
+	names, err := hashFieldNames(key)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	next, names := scanPage(names, cursor, count)
+
+	result := [][]byte{}
+	for _, name := range names {
+		field, value, err := readHashField(filepath.Join(hashFieldsDir(key), name), true)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, nil, err
+		}
+
+		if pattern != nil && !matchPattern(pattern, field) {
+			continue
+		}
+
+		result = append(result, field, value)
+	}
+
+	return next, result, nil
+}
+
+// scanPage picks up to count names from the sorted list of hashed names,
+// starting at cursor. It returns the cursor of the following page, 0 once
+// there is nothing left.
+func scanPage(names []string, cursor uint64, count int) (uint64, []string) {
+	start := sort.Search(len(names), func(i int) bool {
+		return hashedNameCursor(names[i]) >= cursor
+	})
+
+	end := start + count
+	if end >= len(names) {
+		return 0, names[start:]
+	}
+
+	return hashedNameCursor(names[end]), names[start:end]
+}
+
+func hashedNameCursor(name string) uint64 {
+	cursor, _ := strconv.ParseUint(name[:16], 16, 64)
+
+	return cursor
+}
@@ -0,0 +1,144 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+// loadHyperLogLog loads the HyperLogLog stored at key, nil if missing.
+// The caller must hold at least cache.FSRWL.RLock.
+func loadHyperLogLog(key alg.Key) (*alg.HyperLogLog, error) {
+	value, err := getValue(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	return alg.LoadHyperLogLog(value)
+}
+
+// PFAdd adds elements to the HyperLogLog at keyName, returning 1 if its
+// estimated cardinality may have changed
+func PFAdd(dbNum int, keyName []byte, elements [][]byte) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	h, err := loadHyperLogLog(key)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := h == nil
+	if h == nil {
+		h = alg.NewHyperLogLog()
+	}
+
+	for _, element := range elements {
+		if h.Add(element) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return 0, nil
+	}
+
+	if err := setValueAtomic(key, h.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return 1, nil
+}
+
+// PFCount estimates the cardinality of the union of the HyperLogLogs at keys.
+// With a single key the estimate is cached in the value, like Redis does.
+func PFCount(dbNum int, keys [][]byte) (int, error) {
+	if len(keys) == 1 {
+		key := cache.NewKey(dbNum, keys[0])
+
+		cache.FSRWL.Lock()
+		defer cache.FSRWL.Unlock()
+
+		h, err := loadHyperLogLog(key)
+		if err != nil || h == nil {
+			return 0, err
+		}
+
+		if count, ok := h.CachedCount(); ok {
+			return int(count), nil
+		}
+
+		count := h.Count()
+		if err := setValueAtomic(key, h.Bytes()); err != nil {
+			return 0, err
+		}
+
+		return int(count), nil
+	}
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	union := alg.NewHyperLogLog()
+	for _, keyName := range keys {
+		h, err := loadHyperLogLog(cache.NewKey(dbNum, keyName))
+		if err != nil {
+			return 0, err
+		}
+
+		if h != nil {
+			union.Merge(h)
+		}
+	}
+
+	return int(union.Count()), nil
+}
+
+// PFMerge stores at dstName the union of the HyperLogLogs at dstName and
+// at sources, dense encoded like older Redis versions always do
+func PFMerge(dbNum int, dstName []byte, sources [][]byte) error {
+	dst := cache.NewKey(dbNum, dstName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	union, err := loadHyperLogLog(dst)
+	if err != nil {
+		return err
+	}
+	if union == nil {
+		union = alg.NewHyperLogLog()
+	}
+
+	for _, keyName := range sources {
+		h, err := loadHyperLogLog(cache.NewKey(dbNum, keyName))
+		if err != nil {
+			return err
+		}
+
+		if h != nil {
+			union.Merge(h)
+		}
+	}
+
+	union.SetDense()
+
+	return setValueAtomic(dst, union.Bytes())
+}
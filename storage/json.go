@@ -0,0 +1,560 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+// JSON documents are dirs holding the document encoded as compact JSON,
+// see alg/json.go for the values and the supported paths
+
+const jsonDocumentFileName = "document"
+
+var (
+	errJSONPath     = errors.New("ERR invalid JSON path")
+	errJSONInvalid  = errors.New("ERR invalid JSON value")
+	errJSONNumber   = errors.New("ERR expected a JSON number")
+	errJSONNaN      = errors.New("ERR result is not a number")
+	errJSONNewRoot  = errors.New("ERR new objects must be created at the root")
+	errJSONNotFound = errors.New("ERR could not perform this operation on a key that doesn't exist")
+)
+
+func errJSONPathMissing(path string) error {
+	return fmt.Errorf("ERR Path '%s' does not exist", path)
+}
+
+func errJSONPathType(expected string, found interface{}) error {
+	return fmt.Errorf("ERR wrong type of path value - expected %s but found %s", expected, alg.JSONTypeName(found))
+}
+
+// ParseJSONGetArgs parses the arguments of JSON.GET following the key
+func ParseJSONGetArgs(args [][]byte) (alg.JSONFormat, []string, error) {
+	format := alg.JSONFormat{}
+	paths := []string{}
+
+	for i := 0; i < len(args); i++ {
+		var option *string
+		switch strings.ToLower(string(args[i])) {
+		case "indent":
+			option = &format.Indent
+		case "newline":
+			option = &format.Newline
+		case "space":
+			option = &format.Space
+		default:
+			paths = append(paths, string(args[i]))
+			continue
+		}
+
+		if i+1 == len(args) {
+			return format, nil, ErrSyntax
+		}
+		i++
+
+		*option = string(args[i])
+	}
+
+	return format, paths, nil
+}
+
+// loadJSON returns the document at key, reporting whether it exists.
+// The caller must hold at least cache.FSRWL.RLock.
+func loadJSON(key alg.Key) (interface{}, bool, error) {
+	found, err := checkType(key, TypeJSON)
+	if err != nil || !found {
+		return nil, false, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(key.FilePath(), jsonDocumentFileName))
+	if err != nil {
+		return nil, false, err
+	}
+
+	root, err := alg.ParseJSON(data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return root, true, nil
+}
+
+// saveJSON writes the document at key, creating the key if it does not
+// exist. The caller must hold cache.FSRWL.Lock.
+func saveJSON(key alg.Key, root interface{}, exists bool) error {
+	if !exists {
+		if err := createTyped(key, TypeJSON, nil); err != nil {
+			return err
+		}
+	}
+
+	touch(key)
+
+	return writeFileAtomic(filepath.Join(key.FilePath(), jsonDocumentFileName), alg.MarshalJSON(root, alg.JSONFormat{}))
+}
+
+func parseJSONPath(path string) (*alg.JSONPath, error) {
+	p, err := alg.ParseJSONPath(path)
+	if err != nil {
+		return nil, errJSONPath
+	}
+
+	return p, nil
+}
+
+// JSONSet sets the values at path of the document at keyName, creating the
+// document if path is the root. It reports whether anything was set, which
+// is not the case if the NX or XX conditions did not hold.
+func JSONSet(dbNum int, keyName []byte, path string, value []byte, nx, xx bool) (bool, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return false, err
+	}
+
+	newValue, err := alg.ParseJSON(value)
+	if err != nil {
+		return false, errJSONInvalid
+	}
+
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	root, exists, err := loadJSON(key)
+	if err != nil {
+		return false, err
+	}
+
+	if !exists {
+		if !p.IsRoot() {
+			return false, errJSONNewRoot
+		}
+		if xx {
+			return false, nil
+		}
+	} else if p.IsRoot() && nx {
+		return false, nil
+	}
+
+	if p.IsRoot() {
+		return true, saveJSON(key, newValue, exists)
+	}
+
+	if p.Legacy && len(p.Parent().Find(root)) == 0 {
+		return false, errJSONPathMissing(path)
+	}
+
+	root, set := p.Set(root, newValue, nx, xx)
+	if set == 0 {
+		return false, nil
+	}
+
+	return true, saveJSON(key, root, exists)
+}
+
+// JSONGet returns the values at paths of the document at keyName encoded
+// as JSON, nil if the key does not exist. A legacy path gives its value,
+// a JSONPath the array of the values it matches; more paths give an
+// object with a member per path.
+func JSONGet(dbNum int, keyName []byte, paths []string, format alg.JSONFormat) ([]byte, error) {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	parsed := make([]*alg.JSONPath, len(paths))
+	for i, path := range paths {
+		p, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed[i] = p
+	}
+
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	root, exists, err := loadJSON(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	return getJSON(root, paths, parsed, format)
+}
+
+// getJSON encodes the values at paths of a document for JSONGet
+func getJSON(root interface{}, paths []string, parsed []*alg.JSONPath, format alg.JSONFormat) ([]byte, error) {
+	values := make([]interface{}, len(paths))
+	for i, p := range parsed {
+		refs := p.Find(root)
+
+		if p.Legacy {
+			if len(refs) == 0 {
+				return nil, errJSONPathMissing(paths[i])
+			}
+
+			values[i] = refs[0].Value
+			continue
+		}
+
+		matches := &alg.JSONArray{
+			Values: make([]interface{}, len(refs)),
+		}
+		for j := range refs {
+			matches.Values[j] = refs[j].Value
+		}
+
+		values[i] = matches
+	}
+
+	if len(paths) == 1 {
+		return alg.MarshalJSON(values[0], format), nil
+	}
+
+	result := alg.NewJSONObject()
+	for i, path := range paths {
+		result.Set(path, values[i])
+	}
+
+	return alg.MarshalJSON(result, format), nil
+}
+
+// JSONMGet returns the values at path of the documents at keys, like
+// JSONGet does for a single path, nil for the keys that are missing, are
+// not documents or do not have a legacy path
+func JSONMGet(dbNum int, keys [][]byte, path string) ([][]byte, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	values := make([][]byte, len(keys))
+	for i, keyName := range keys {
+		root, exists, err := loadJSON(cache.NewKey(dbNum, keyName))
+		if err == ErrWrongType {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			// the only error is a missing legacy path
+			values[i], _ = getJSON(root, []string{path}, []*alg.JSONPath{p}, alg.JSONFormat{})
+		}
+	}
+
+	return values, nil
+}
+
+// JSONDel removes the values at path of the document at keyName, the
+// whole key for the root, returning how many were removed
+func JSONDel(dbNum int, keyName []byte, path string) (int, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return 0, err
+	}
+
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	root, exists, err := loadJSON(key)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	if p.IsRoot() {
+		if _, err := removeKey(key); err != nil {
+			return 0, err
+		}
+
+		return 1, nil
+	}
+
+	deleted := p.Delete(root)
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	return deleted, saveJSON(key, root, exists)
+}
+
+// jsonUpdate calls update on the values at path of the document at keyName,
+// saving the document if any update returns true. For a legacy path it
+// returns the only result of update, an error if the path does not exist,
+// otherwise the results for every match.
+func jsonUpdate(dbNum int, keyName []byte, path string, update func(ref *alg.JSONRef) (interface{}, bool, error)) (interface{}, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	root, exists, err := loadJSON(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errJSONNotFound
+	}
+
+	refs := p.Find(root)
+	if p.Legacy {
+		if len(refs) == 0 {
+			return nil, errJSONPathMissing(path)
+		}
+
+		refs = refs[:1]
+	}
+
+	results := make([]interface{}, len(refs))
+	changed := false
+	for i := range refs {
+		result, updated, err := update(&refs[i])
+		if err != nil {
+			return nil, err
+		}
+
+		// the root has no parent to update
+		if updated && refs[i].Parent == nil {
+			root = refs[i].Value
+		}
+
+		results[i] = result
+		changed = changed || updated
+	}
+
+	if changed {
+		if err := saveJSON(key, root, exists); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Legacy {
+		return results[0], nil
+	}
+
+	return results, nil
+}
+
+// JSONArrAppend appends values to the arrays at path of the document at
+// keyName, returning their new lengths, nil for the values that are not
+// arrays
+func JSONArrAppend(dbNum int, keyName []byte, path string, values [][]byte) (interface{}, error) {
+	elements := make([]interface{}, len(values))
+	for i, value := range values {
+		element, err := alg.ParseJSON(value)
+		if err != nil {
+			return nil, errJSONInvalid
+		}
+
+		elements[i] = element
+	}
+
+	legacy := !strings.HasPrefix(path, "$")
+
+	return jsonUpdate(dbNum, keyName, path, func(ref *alg.JSONRef) (interface{}, bool, error) {
+		a, ok := ref.Value.(*alg.JSONArray)
+		if !ok {
+			if legacy {
+				return nil, false, errJSONPathType("array", ref.Value)
+			}
+			return nil, false, nil
+		}
+
+		for _, element := range elements {
+			a.Values = append(a.Values, alg.CloneJSON(element))
+		}
+
+		return len(a.Values), true, nil
+	})
+}
+
+// addJSONNumbers adds two JSON numbers, as integers if both are and the
+// sum does not overflow
+func addJSONNumbers(a, b json.Number) (json.Number, error) {
+	x, errX := strconv.ParseInt(string(a), 10, 64)
+	y, errY := strconv.ParseInt(string(b), 10, 64)
+	if errX == nil && errY == nil {
+		if sum := x + y; (sum > x) == (y > 0) {
+			return json.Number(strconv.FormatInt(sum, 10)), nil
+		}
+	}
+
+	f, _ := strconv.ParseFloat(string(a), 64)
+	g, _ := strconv.ParseFloat(string(b), 64)
+
+	sum := f + g
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return "", errJSONNaN
+	}
+
+	var s string
+	if sum == 0 || (math.Abs(sum) >= 1e-5 && math.Abs(sum) < 1e16) {
+		s = strconv.FormatFloat(sum, 'f', -1, 64)
+	} else {
+		s = strconv.FormatFloat(sum, 'e', -1, 64)
+	}
+
+	// floats stay floats, like RedisJSON does
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+
+	return json.Number(s), nil
+}
+
+// JSONNumIncrBy increments the numbers at path of the document at keyName,
+// returning the new value encoded as JSON for a legacy path, or the array
+// of the new values (null for the values that are not numbers)
+func JSONNumIncrBy(dbNum int, keyName []byte, path string, increment []byte) ([]byte, error) {
+	value, err := alg.ParseJSON(increment)
+	if err != nil {
+		return nil, errJSONNumber
+	}
+
+	by, ok := value.(json.Number)
+	if !ok {
+		return nil, errJSONNumber
+	}
+
+	legacy := !strings.HasPrefix(path, "$")
+
+	result, err := jsonUpdate(dbNum, keyName, path, func(ref *alg.JSONRef) (interface{}, bool, error) {
+		n, ok := ref.Value.(json.Number)
+		if !ok {
+			if legacy {
+				return nil, false, errJSONPathType("a number", ref.Value)
+			}
+			return nil, false, nil
+		}
+
+		sum, err := addJSONNumbers(n, by)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if ref.Parent != nil {
+			ref.Replace(sum)
+		}
+
+		ref.Value = sum
+
+		return sum, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy {
+		return alg.MarshalJSON(result, alg.JSONFormat{}), nil
+	}
+
+	return alg.MarshalJSON(&alg.JSONArray{Values: result.([]interface{})}, alg.JSONFormat{}), nil
+}
+
+// jsonRead calls read on the values at path of the document at keyName.
+// For a legacy path it returns the only result of read, nil if the path
+// does not exist, otherwise the results for every match. It returns nil
+// if the key does not exist.
+func jsonRead(dbNum int, keyName []byte, path string, read func(value interface{}) (interface{}, error)) (interface{}, error) {
+	p, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	root, exists, err := loadJSON(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	refs := p.Find(root)
+	if p.Legacy {
+		if len(refs) == 0 {
+			return nil, nil
+		}
+
+		return read(refs[0].Value)
+	}
+
+	results := make([]interface{}, len(refs))
+	for i, ref := range refs {
+		if results[i], err = read(ref.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+// JSONType returns the types of the values at path of the document at
+// keyName, as a string for a legacy path
+func JSONType(dbNum int, keyName []byte, path string) (interface{}, error) {
+	return jsonRead(dbNum, keyName, path, func(value interface{}) (interface{}, error) {
+		return []byte(alg.JSONTypeName(value)), nil
+	})
+}
+
+// JSONObjKeys returns the keys of the objects at path of the document at
+// keyName, nil for the values that are not objects
+func JSONObjKeys(dbNum int, keyName []byte, path string) (interface{}, error) {
+	legacy := !strings.HasPrefix(path, "$")
+
+	return jsonRead(dbNum, keyName, path, func(value interface{}) (interface{}, error) {
+		o, ok := value.(*alg.JSONObject)
+		if !ok {
+			if legacy {
+				return nil, errJSONPathType("object", value)
+			}
+			return nil, nil
+		}
+
+		keys := make([]interface{}, len(o.Keys()))
+		for i, key := range o.Keys() {
+			keys[i] = []byte(key)
+		}
+
+		return keys, nil
+	})
+}
@@ -0,0 +1,347 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+func jsonTestSet(t *testing.T, db int, keyName, path, value string) {
+	t.Helper()
+
+	set, err := JSONSet(db, []byte(keyName), path, []byte(value), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set {
+		t.Fatalf("JSON.SET %s %s %s set nothing", keyName, path, value)
+	}
+}
+
+func checkJSONGet(t *testing.T, db int, keyName string, want string, paths ...string) {
+	t.Helper()
+
+	value, err := JSONGet(db, []byte(keyName), paths, alg.JSONFormat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != want {
+		t.Fatalf("JSON.GET %s %q is %s, want %s", keyName, paths, value, want)
+	}
+}
+
+func checkJSONDocument(t *testing.T, db int, keyName string, want string) {
+	t.Helper()
+
+	dir := testKeyPath(db, keyName)
+	if typ, err := os.ReadFile(filepath.Join(dir, typeFileName)); err != nil || string(typ) != TypeJSON {
+		t.Fatalf("the type file holds %q: %v", typ, err)
+	}
+
+	document, err := os.ReadFile(filepath.Join(dir, jsonDocumentFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(document) != want {
+		t.Fatalf("the document file holds %s, want %s", document, want)
+	}
+}
+
+func TestJSONLayout(t *testing.T) {
+	const db = 4
+
+	// the document is saved compact, keeping the order of the keys
+	jsonTestSet(t, db, "json", "$", `{ "z": 1, "a": [1, 2.50], "o": {} }`)
+	jsonTestSet(t, db, "json", "$.o.k", `"v"`)
+	checkJSONDocument(t, db, "json", `{"z":1,"a":[1,2.50],"o":{"k":"v"}}`)
+
+	reopen(t, db)
+
+	checkJSONGet(t, db, "json", `{"z":1,"a":[1,2.50],"o":{"k":"v"}}`)
+	checkJSONGet(t, db, "json", `[1,2.50]`, "a")
+	checkJSONGet(t, db, "json", `[[1,2.50]]`, "$.a")
+	checkJSONGet(t, db, "json", `{"$.z":[1],".o.k":"v"}`, "$.z", ".o.k")
+	checkJSONGet(t, db, "missing", ``)
+
+	value, err := JSONGet(db, []byte("json"), []string{"$.o"}, alg.JSONFormat{Indent: "\t", Newline: "\n", Space: " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "[\n\t{\n\t\t\"k\": \"v\"\n\t}\n]" {
+		t.Fatalf("the formatted value is %q", value)
+	}
+
+	if typ, err := Type(db, []byte("json")); err != nil || typ != TypeJSON {
+		t.Fatalf("the type is %s: %v", typ, err)
+	}
+
+	// the string commands do not read documents, and the other way round
+	if _, err := Get(db, testArgs("json")); err != ErrWrongType {
+		t.Fatalf("GET of a document returned %v", err)
+	}
+	if _, _, err := Set(db, testArgs("jsonstring", `{"a":1}`), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := JSONGet(db, []byte("jsonstring"), nil, alg.JSONFormat{}); err != ErrWrongType {
+		t.Fatalf("JSON.GET of a string returned %v", err)
+	}
+	if _, err := JSONSet(db, []byte("jsonstring"), "$", []byte("1"), false, false); err != ErrWrongType {
+		t.Fatalf("JSON.SET of a string returned %v", err)
+	}
+
+	values, err := JSONMGet(db, testArgs("json", "jsonstring", "missing"), "$.z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values[0]) != "[1]" || values[1] != nil || values[2] != nil {
+		t.Fatalf("JSON.MGET replied %q", values)
+	}
+	if values, err = JSONMGet(db, testArgs("json"), "missing"); err != nil || values[0] != nil {
+		t.Fatalf("JSON.MGET of a missing legacy path replied %q: %v", values, err)
+	}
+
+	if _, err := Del(db, testArgs("json", "jsonstring")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONSetConditions(t *testing.T) {
+	const db = 4
+
+	set := func(keyName, path, value string, nx, xx bool) (bool, error) {
+		return JSONSet(db, []byte(keyName), path, []byte(value), nx, xx)
+	}
+
+	// only the root creates a document
+	if _, err := set("jsonset", "$.a", "1", false, false); err != errJSONNewRoot {
+		t.Fatalf("JSON.SET of a path of a missing key returned %v", err)
+	}
+	if ok, err := set("jsonset", "$", "{}", false, true); err != nil || ok {
+		t.Fatalf("JSON.SET XX of a missing key set %v: %v", ok, err)
+	}
+	if ok, err := set("jsonset", "$", `{"a":1}`, true, false); err != nil || !ok {
+		t.Fatalf("JSON.SET NX of a missing key set %v: %v", ok, err)
+	}
+	if ok, err := set("jsonset", "$", `{}`, true, false); err != nil || ok {
+		t.Fatalf("JSON.SET NX of an existing key set %v: %v", ok, err)
+	}
+
+	if ok, err := set("jsonset", "$.a", "2", true, false); err != nil || ok {
+		t.Fatalf("JSON.SET NX of an existing member set %v: %v", ok, err)
+	}
+	if ok, err := set("jsonset", "$.b", "2", false, true); err != nil || ok {
+		t.Fatalf("JSON.SET XX of a missing member set %v: %v", ok, err)
+	}
+	if ok, err := set("jsonset", "$.b", "2", true, false); err != nil || !ok {
+		t.Fatalf("JSON.SET NX of a missing member set %v: %v", ok, err)
+	}
+
+	// a legacy path needs its parent, a JSONPath sets nothing without it
+	if _, err := set("jsonset", ".x.y", "1", false, false); err == nil || err.Error() != "ERR Path '.x.y' does not exist" {
+		t.Fatalf("JSON.SET of a missing legacy parent returned %v", err)
+	}
+	if ok, err := set("jsonset", "$.x.y", "1", false, false); err != nil || ok {
+		t.Fatalf("JSON.SET of a missing parent set %v: %v", ok, err)
+	}
+
+	if _, err := set("jsonset", "$", "{", false, false); err != errJSONInvalid {
+		t.Fatalf("JSON.SET of invalid JSON returned %v", err)
+	}
+	if _, err := set("jsonset", "$[", "1", false, false); err != errJSONPath {
+		t.Fatalf("JSON.SET of an invalid path returned %v", err)
+	}
+
+	reopen(t, db)
+	checkJSONDocument(t, db, "jsonset", `{"a":1,"b":2}`)
+
+	if _, err := Del(db, testArgs("jsonset")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONDel(t *testing.T) {
+	const db = 4
+
+	jsonTestSet(t, db, "jsondel", "$", `{"a":[1,2,3],"b":{"a":4},"c":5}`)
+
+	for _, c := range []struct {
+		path    string
+		deleted int
+		want    string
+	}{
+		{"$.missing", 0, `{"a":[1,2,3],"b":{"a":4},"c":5}`},
+		{"$.a[0]", 1, `{"a":[2,3],"b":{"a":4},"c":5}`},
+		{"$..a", 2, `{"b":{},"c":5}`},
+		{"c", 1, `{"b":{}}`},
+	} {
+		deleted, err := JSONDel(db, []byte("jsondel"), c.path)
+		if err != nil || deleted != c.deleted {
+			t.Fatalf("JSON.DEL %s deleted %d, want %d: %v", c.path, deleted, c.deleted, err)
+		}
+		checkJSONDocument(t, db, "jsondel", c.want)
+	}
+
+	// deleting the root deletes the key
+	if deleted, err := JSONDel(db, []byte("jsondel"), "$"); err != nil || deleted != 1 {
+		t.Fatalf("JSON.DEL $ deleted %d: %v", deleted, err)
+	}
+	if found, err := Exists(db, testArgs("jsondel")); err != nil || found != 0 {
+		t.Fatalf("the deleted document exists: %v", err)
+	}
+	if deleted, err := JSONDel(db, []byte("jsondel"), "$"); err != nil || deleted != 0 {
+		t.Fatalf("JSON.DEL of a missing key deleted %d: %v", deleted, err)
+	}
+}
+
+func TestJSONArrAppendAndNumIncrBy(t *testing.T) {
+	const db = 4
+
+	jsonTestSet(t, db, "jsonops", "$", `{"a":[1],"b":{"a":"x"},"n":1,"f":1.5,"big":9223372036854775807,"m":{"n":2}}`)
+
+	lengths, err := JSONArrAppend(db, []byte("jsonops"), "$..a", testArgs("2", `{"c":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := lengths.([]interface{}); len(l) != 2 || l[0] != 3 || l[1] != nil {
+		t.Fatalf("JSON.ARRAPPEND $..a replied %v", lengths)
+	}
+	if length, err := JSONArrAppend(db, []byte("jsonops"), "a", testArgs("4")); err != nil || length != 4 {
+		t.Fatalf("JSON.ARRAPPEND a replied %v: %v", length, err)
+	}
+	if _, err := JSONArrAppend(db, []byte("jsonops"), ".b.a", testArgs("4")); err == nil || err.Error() != "ERR wrong type of path value - expected array but found string" {
+		t.Fatalf("JSON.ARRAPPEND of a string returned %v", err)
+	}
+	if _, err := JSONArrAppend(db, []byte("jsonops"), "$.a", testArgs("x")); err != errJSONInvalid {
+		t.Fatalf("JSON.ARRAPPEND of invalid JSON returned %v", err)
+	}
+	if _, err := JSONArrAppend(db, []byte("jsonmissing"), "$.a", testArgs("1")); err != errJSONNotFound {
+		t.Fatalf("JSON.ARRAPPEND of a missing key returned %v", err)
+	}
+
+	for _, c := range []struct {
+		path, by, want string
+	}{
+		{"n", "2", `3`},
+		{"$.n", "-5", `[-2]`},
+		{"$.f", "1", `[2.5]`},
+		{"$.f", "0.5", `[3.0]`},
+		{"$..n", "1", `[-1,3]`},
+		{"$.*", "1", `[null,null,0,4.0,9.223372036854776e+18,null]`},
+		{"$.missing", "1", `[]`},
+	} {
+		value, err := JSONNumIncrBy(db, []byte("jsonops"), c.path, []byte(c.by))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != c.want {
+			t.Fatalf("JSON.NUMINCRBY %s %s replied %s, want %s", c.path, c.by, value, c.want)
+		}
+	}
+	if _, err := JSONNumIncrBy(db, []byte("jsonops"), "$.n", []byte(`"1"`)); err != errJSONNumber {
+		t.Fatalf("JSON.NUMINCRBY by a string returned %v", err)
+	}
+	if _, err := JSONNumIncrBy(db, []byte("jsonops"), ".b", []byte("1")); err == nil {
+		t.Fatal("JSON.NUMINCRBY of an object did not fail")
+	}
+	if _, err := JSONNumIncrBy(db, []byte("jsonops"), ".big", []byte("1e308")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := JSONNumIncrBy(db, []byte("jsonops"), ".big", []byte("1e308")); err != errJSONNaN {
+		t.Fatalf("JSON.NUMINCRBY to infinity returned %v", err)
+	}
+
+	reopen(t, db)
+	checkJSONDocument(t, db, "jsonops", `{"a":[1,2,{"c":3},4],"b":{"a":"x"},"n":0,"f":4.0,"big":1e+308,"m":{"n":3}}`)
+
+	// the root can be incremented too
+	jsonTestSet(t, db, "jsonnum", "$", "1")
+	if value, err := JSONNumIncrBy(db, []byte("jsonnum"), "$", []byte("2")); err != nil || string(value) != "[3]" {
+		t.Fatalf("JSON.NUMINCRBY $ replied %s: %v", value, err)
+	}
+	checkJSONDocument(t, db, "jsonnum", `3`)
+
+	if _, err := Del(db, testArgs("jsonops", "jsonnum")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONTypeAndObjKeys(t *testing.T) {
+	const db = 4
+
+	jsonTestSet(t, db, "jsontype", "$", `{"o":{"b":1,"a":null},"s":"x","i":1,"f":1.5,"t":true,"l":[]}`)
+
+	types, err := JSONType(db, []byte("jsontype"), "$.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"object", "string", "integer", "number", "boolean", "array"}
+	for i, typ := range types.([]interface{}) {
+		if string(typ.([]byte)) != want[i] {
+			t.Fatalf("the type of member %d is %s, want %s", i, typ, want[i])
+		}
+	}
+	if typ, err := JSONType(db, []byte("jsontype"), ".o.a"); err != nil || string(typ.([]byte)) != "null" {
+		t.Fatalf("the type of .o.a is %s: %v", typ, err)
+	}
+	if typ, err := JSONType(db, []byte("jsontype"), ".missing"); err != nil || typ != nil {
+		t.Fatalf("the type of a missing path is %v: %v", typ, err)
+	}
+	if typ, err := JSONType(db, []byte("missing"), "$"); err != nil || typ != nil {
+		t.Fatalf("the type of a missing key is %v: %v", typ, err)
+	}
+
+	keys, err := JSONObjKeys(db, []byte("jsontype"), "o")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := keys.([]interface{}); len(k) != 2 || string(k[0].([]byte)) != "b" || string(k[1].([]byte)) != "a" {
+		t.Fatalf("JSON.OBJKEYS o replied %q", keys)
+	}
+	keys, err = JSONObjKeys(db, []byte("jsontype"), "$..*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k := keys.([]interface{}); len(k) != 8 || k[0] == nil || k[1] != nil {
+		t.Fatalf("JSON.OBJKEYS $..* replied %q", keys)
+	}
+	if _, err := JSONObjKeys(db, []byte("jsontype"), ".s"); err == nil {
+		t.Fatal("JSON.OBJKEYS of a string did not fail")
+	}
+
+	if _, err := Del(db, testArgs("jsontype")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJSONGetArgs(t *testing.T) {
+	format, paths, err := ParseJSONGetArgs(testArgs("INDENT", "  ", "$.a", "newline", "\n", "b", "SPACE", " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format.Indent != "  " || format.Newline != "\n" || format.Space != " " || len(paths) != 2 || paths[0] != "$.a" || paths[1] != "b" {
+		t.Fatalf("parsed %+v %q", format, paths)
+	}
+
+	if _, _, err := ParseJSONGetArgs(testArgs("$", "indent")); err != ErrSyntax {
+		t.Fatalf("JSON.GET with a missing INDENT value returned %v", err)
+	}
+}
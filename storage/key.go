@@ -18,14 +18,17 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/RcrdBrt/gobigdis/alg"
 )
 
+var ErrSyntax = errors.New("ERR syntax error")
+
 type ExpiringKey struct {
 	alg.Key
 	Expire time.Time
@@ -41,24 +44,47 @@ func Get(dbNum int, args [][]byte) ([]byte, error) {
 	cache.FSRWL.RLock()
 	defer cache.FSRWL.RUnlock()
 
-	if !cache.Match(key) {
-		return nil, nil
-	}
+	return getValue(key)
+}
 
-	value, err := os.ReadFile(key.FilePath())
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, nil
+// SetOptions are the flags of the SET command
+type SetOptions struct {
+	NX      bool // only set the key if it does not already exist
+	XX      bool // only set the key if it already exists
+	Get     bool // return the old value
+	KeepTTL bool // no-op as long as keys don't expire
+}
+
+// ParseSetOptions parses the flags following the value of the SET command
+func ParseSetOptions(args [][]byte) (SetOptions, error) {
+	var opts SetOptions
+	for _, arg := range args {
+		switch strings.ToLower(string(arg)) {
+		case "nx":
+			opts.NX = true
+		case "xx":
+			opts.XX = true
+		case "get":
+			opts.Get = true
+		case "keepttl":
+			opts.KeepTTL = true
+		default:
+			return opts, ErrSyntax
 		}
-		return nil, err
 	}
 
-	return value, nil
+	if opts.NX && opts.XX {
+		return opts, ErrSyntax
+	}
+
+	return opts, nil
 }
 
-func Set(dbNum int, args [][]byte) error {
+// Set stores the value of a key honouring opts. It returns whether
+// the value has been written and, if opts.Get is set, the old value.
+func Set(dbNum int, args [][]byte, opts SetOptions) (bool, []byte, error) {
 	if len(args) < 2 {
-		return fmt.Errorf("wrong command syntax")
+		return false, nil, fmt.Errorf("wrong command syntax")
 	}
 
 	cache.FSRWL.Lock()
@@ -66,51 +92,326 @@ func Set(dbNum int, args [][]byte) error {
 
 	key := cache.NewKey(dbNum, args[0])
 
-	if !cache.Match(key) {
-		if err := os.MkdirAll(key.ParentPath(), 0700); err != nil {
-			return err
+	var old []byte
+	if opts.Get || opts.NX || opts.XX {
+		found, err := exists(key)
+		if err != nil {
+			return false, nil, err
 		}
 
-		cache.Add(key)
+		if opts.Get && found {
+			if old, err = getValue(key); err != nil {
+				return false, nil, err
+			}
+		}
+
+		if (opts.NX && found) || (opts.XX && !found) {
+			return false, old, nil
+		}
 	}
 
-	if err := os.WriteFile(key.FilePath(), args[1], 0600); err != nil {
-		return err
+	if err := setValue(key, args[1]); err != nil {
+		return false, nil, err
 	}
 
-	return nil
+	return true, old, indexString(key, args[0])
 }
 
-func Del(dbNum int, args [][]byte) (int, error) {
+// GetDel returns the value of a key and deletes it
+func GetDel(dbNum int, args [][]byte) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("wrong number of arguments for 'getdel' command")
+	}
+
 	key := cache.NewKey(dbNum, args[0])
 
 	cache.FSRWL.Lock()
 	defer cache.FSRWL.Unlock()
 
+	value, err := getValue(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+
+	if err := os.Remove(key.FilePath()); err != nil {
+		return nil, err
+	}
+
+	cache.Resize(key.DB, -1)
+	touch(key)
+
+	return value, unindexKey(key)
+}
+
+// MGet returns the values of all the given keys, nil for the missing ones
+// and for the ones that are not strings
+func MGet(dbNum int, args [][]byte) ([][]byte, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("wrong number of arguments for 'mget' command")
+	}
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	values := make([][]byte, len(args))
+	for i := range args {
+		value, err := getValue(cache.NewKey(dbNum, args[i]))
+		if err != nil && err != ErrWrongType {
+			return nil, err
+		}
+
+		values[i] = value
+	}
+
+	return values, nil
+}
+
+// MSet sets all the given key-value pairs at once
+func MSet(dbNum int, args [][]byte) error {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return fmt.Errorf("wrong number of arguments for 'mset' command")
+	}
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	for i := 0; i < len(args); i += 2 {
+		key := cache.NewKey(dbNum, args[i])
+		if err := setValue(key, args[i+1]); err != nil {
+			return err
+		}
+
+		if err := indexString(key, args[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MSetNX is like MSet but it doesn't set anything
+// if at least one of the keys already exists
+func MSetNX(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 2 || len(args)%2 != 0 {
+		return 0, fmt.Errorf("wrong number of arguments for 'msetnx' command")
+	}
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	for i := 0; i < len(args); i += 2 {
+		found, err := exists(cache.NewKey(dbNum, args[i]))
+		if err != nil {
+			return 0, err
+		}
+
+		if found {
+			return 0, nil
+		}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		key := cache.NewKey(dbNum, args[i])
+		if err := setValue(key, args[i+1]); err != nil {
+			return 0, err
+		}
+
+		if err := indexString(key, args[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	return 1, nil
+}
+
+// Exists returns how many of the given keys exist,
+// counting the repeated ones multiple times
+func Exists(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'exists' command")
+	}
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
 	counter := 0
+	for i := range args {
+		found, err := exists(cache.NewKey(dbNum, args[i]))
+		if err != nil {
+			return 0, err
+		}
 
-	if err := os.Remove(key.FilePath()); err != nil && !os.IsNotExist(err) {
-		return counter, err
-	} else {
-		if !os.IsNotExist(err) {
+		if found {
 			counter++
 		}
 	}
 
-	go func() {
-		cache.FSRWL.RLock()
-		fileList, err := os.ReadDir(key.ParentPath())
-		cache.FSRWL.RUnlock()
-		if err != nil && !os.IsNotExist(err) {
-			log.Println(err)
-			return
+	return counter, nil
+}
+
+// Del deletes keys, returning how many existed. The strings are deleted
+// right away, while the dirs of the other types, which can hold any number
+// of files, are moved in the trash and left to the deleters.
+func Del(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'del' command")
+	}
+
+	return deleteKeys(dbNum, args, false)
+}
+
+// Unlink deletes keys like Del, but it moves the strings in the trash too
+func Unlink(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'unlink' command")
+	}
+
+	return deleteKeys(dbNum, args, true)
+}
+
+func deleteKeys(dbNum int, args [][]byte, unlinkStrings bool) (int, error) {
+	keys := make([]alg.Key, len(args))
+	for i := range args {
+		keys[i] = cache.NewKey(dbNum, args[i])
+	}
+
+	// queued once the lock is released
+	jobs := []trashJob{}
+	defer func() {
+		enqueueTrash(jobs...)
+	}()
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	counter := 0
+
+	for _, key := range keys {
+		typ, err := keyType(key)
+		if err != nil {
+			return counter, err
 		}
 
-		if len(fileList) == 0 {
-			// deepest folder is empty, update the cache
-			cache.Set(key, false)
+		switch {
+		case typ == TypeNone:
+		case typ == TypeString && !unlinkStrings:
+			if _, err := removeKey(key); err != nil {
+				return counter, err
+			}
+
+			counter++
+			jobs = append(jobs, trashJob{key: key, prune: true})
+		default:
+			path, err := unlinkKey(key)
+			if path != "" {
+				counter++
+				jobs = append(jobs, trashJob{path: path, key: key, prune: true})
+			}
+			if err != nil {
+				return counter, err
+			}
 		}
-	}()
+	}
 
 	return counter, nil
 }
+
+// getValue reads the value of key, the caller must hold at least cache.FSRWL.RLock
+func getValue(key alg.Key) ([]byte, error) {
+	if !cache.Match(key) {
+		return nil, nil
+	}
+
+	value, err := os.ReadFile(key.FilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if info, statErr := os.Lstat(key.FilePath()); statErr == nil && info.IsDir() {
+			return nil, ErrWrongType
+		}
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// setValue writes the value of key, the caller must hold cache.FSRWL.Lock
+func setValue(key alg.Key, value []byte) error {
+	if err := prepareStringKey(key); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(key.FilePath(), value, 0600); err != nil {
+		return err
+	}
+
+	touch(key)
+
+	return nil
+}
+
+// setValueAtomic is like setValue but survives crashes halfway through
+// the write, the caller must hold cache.FSRWL.Lock
+func setValueAtomic(key alg.Key, value []byte) error {
+	if err := prepareStringKey(key); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(key.FilePath(), value); err != nil {
+		return err
+	}
+
+	touch(key)
+
+	return nil
+}
+
+// prepareStringKey makes sure key can be written as a plain file:
+// its parent dirs exist and any value of another type is gone
+func prepareStringKey(key alg.Key) error {
+	if !cache.Match(key) {
+		if err := os.MkdirAll(key.ParentPath(), 0700); err != nil {
+			return err
+		}
+
+		cache.Add(key)
+		cache.Resize(key.DB, 1)
+
+		return nil
+	}
+
+	info, err := os.Lstat(key.FilePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		// the key is about to be created
+		cache.Resize(key.DB, 1)
+	} else if info.IsDir() {
+		// SET overwrites values of any type
+		if err := os.RemoveAll(key.FilePath()); err != nil {
+			return err
+		}
+	}
+
+	// the value is about to change, SET and the like index it again
+	return unindexKey(key)
+}
+
+// exists reports whether key is stored, the caller must hold at least cache.FSRWL.RLock
+func exists(key alg.Key) (bool, error) {
+	if !cache.Match(key) {
+		return false, nil
+	}
+
+	if _, err := os.Lstat(key.FilePath()); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,248 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMGetWrongType(t *testing.T) {
+	const db = 1
+
+	if _, _, err := Set(db, testArgs("mget-str", "value"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := HSet(db, testArgs("mget-hash", "field", "value")); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := MGet(db, testArgs("mget-str", "mget-hash", "mget-missing"))
+	if err != nil {
+		t.Fatalf("MGet failed: %v", err)
+	}
+
+	if len(values) != 3 {
+		t.Fatalf("got %d values, want 3", len(values))
+	}
+
+	if string(values[0]) != "value" {
+		t.Errorf("string value is %q, want %q", values[0], "value")
+	}
+
+	if values[1] != nil {
+		t.Errorf("hash value is %q, want nil", values[1])
+	}
+
+	if values[2] != nil {
+		t.Errorf("missing value is %q, want nil", values[2])
+	}
+}
+
+func TestMSetLayout(t *testing.T) {
+	const db = 1
+
+	if err := MSet(db, testArgs("mset-a", "1", "mset-b", "2", "mset-a", "3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := MSet(db, testArgs("mset-a", "1", "mset-b")); err == nil {
+		t.Fatal("MSET accepted an odd number of arguments")
+	}
+
+	reopen(t, db)
+
+	// the last value of a repeated key wins, and strings are plain files
+	for keyName, want := range map[string]string{"mset-a": "3", "mset-b": "2"} {
+		content, err := os.ReadFile(testKeyPath(db, keyName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Fatalf("the file of %s holds %q, want %q", keyName, content, want)
+		}
+	}
+
+	values, err := MGet(db, testArgs("mset-a", "mset-missing", "mset-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 3 || string(values[0]) != "3" || values[1] != nil || string(values[2]) != "2" {
+		t.Fatalf("MGET returned %q", values)
+	}
+
+	if _, err := Del(db, testArgs("mset-a", "mset-b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMSetNXSetsAllOrNothing(t *testing.T) {
+	const db = 1
+
+	if _, _, err := Set(db, testArgs("msetnx-taken", "old"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := MSetNX(db, testArgs("msetnx-new", "v", "msetnx-taken", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set != 0 {
+		t.Fatal("MSETNX set the keys despite an existing one")
+	}
+	if found, err := Exists(db, testArgs("msetnx-new")); err != nil || found != 0 {
+		t.Fatalf("MSETNX set a key despite an existing one: %v", err)
+	}
+	if value, err := Get(db, testArgs("msetnx-taken")); err != nil || string(value) != "old" {
+		t.Fatalf("the existing key is %q, want %q: %v", value, "old", err)
+	}
+
+	if set, err = MSetNX(db, testArgs("msetnx-new", "v", "msetnx-other", "w")); err != nil || set != 1 {
+		t.Fatalf("MSETNX returned %d with new keys only, want 1: %v", set, err)
+	}
+
+	reopen(t, db)
+
+	if found, err := Exists(db, testArgs("msetnx-new", "msetnx-other", "msetnx-taken")); err != nil || found != 3 {
+		t.Fatalf("%d keys exist after MSETNX, want 3: %v", found, err)
+	}
+
+	if _, err := Del(db, testArgs("msetnx-new", "msetnx-other", "msetnx-taken")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultiKeyCounts(t *testing.T) {
+	const db = 1
+
+	if err := MSet(db, testArgs("multi-a", "1", "multi-b", "2", "multi-c", "3")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(db, testArgs("multi-list", "x"), false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// EXISTS counts the repeated keys every time, DEL and UNLINK only once
+	if found, err := Exists(db, testArgs("multi-a", "multi-a", "multi-list", "multi-missing")); err != nil || found != 3 {
+		t.Fatalf("EXISTS returned %d, want 3: %v", found, err)
+	}
+	if deleted, err := Del(db, testArgs("multi-a", "multi-a", "multi-list", "multi-missing")); err != nil || deleted != 2 {
+		t.Fatalf("DEL returned %d, want 2: %v", deleted, err)
+	}
+	if unlinked, err := Unlink(db, testArgs("multi-b", "multi-c", "multi-b")); err != nil || unlinked != 2 {
+		t.Fatalf("UNLINK returned %d, want 2: %v", unlinked, err)
+	}
+
+	reopen(t, db)
+
+	for _, keyName := range []string{"multi-a", "multi-b", "multi-c", "multi-list"} {
+		if _, err := os.Lstat(testKeyPath(db, keyName)); !os.IsNotExist(err) {
+			t.Fatalf("%s is still on disk: %v", keyName, err)
+		}
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	const db = 1
+
+	if _, err := ParseSetOptions(testArgs("nx", "XX")); err != ErrSyntax {
+		t.Fatalf("NX with XX returned %v, want a syntax error", err)
+	}
+	if _, err := ParseSetOptions(testArgs("px", "100")); err != ErrSyntax {
+		t.Fatalf("PX returned %v, want a syntax error", err)
+	}
+	if opts, err := ParseSetOptions(testArgs("KeepTTL", "get")); err != nil || !opts.KeepTTL || !opts.Get {
+		t.Fatalf("KEEPTTL GET parsed as %+v: %v", opts, err)
+	}
+
+	steps := []struct {
+		value string
+		opts  SetOptions
+		done  bool
+		old   string // "" for nil
+		after string // the value once set, "" if missing
+	}{
+		{"1", SetOptions{XX: true}, false, "", ""},
+		{"2", SetOptions{NX: true, Get: true}, true, "", "2"},
+		{"3", SetOptions{NX: true}, false, "", "2"},
+		{"4", SetOptions{NX: true, Get: true}, false, "2", "2"},
+		{"5", SetOptions{XX: true, Get: true}, true, "2", "5"},
+		{"6", SetOptions{Get: true, KeepTTL: true}, true, "5", "6"},
+	}
+
+	for i, step := range steps {
+		done, old, err := Set(db, testArgs("set-opts", step.value), step.opts)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if done != step.done || string(old) != step.old || (old == nil) != (step.old == "") {
+			t.Fatalf("step %d: SET returned %v and %q, want %v and %q", i, done, old, step.done, step.old)
+		}
+
+		value, err := Get(db, testArgs("set-opts"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(value) != step.after {
+			t.Fatalf("step %d: the value is %q, want %q", i, value, step.after)
+		}
+	}
+
+	reopen(t, db)
+
+	if content, err := os.ReadFile(testKeyPath(db, "set-opts")); err != nil || string(content) != "6" {
+		t.Fatalf("the file holds %q, want %q: %v", content, "6", err)
+	}
+
+	value, err := GetDel(db, testArgs("set-opts"))
+	if err != nil || string(value) != "6" {
+		t.Fatalf("GETDEL returned %q, want %q: %v", value, "6", err)
+	}
+	if value, err := GetDel(db, testArgs("set-opts")); err != nil || value != nil {
+		t.Fatalf("GETDEL of a missing key returned %q: %v", value, err)
+	}
+
+	reopen(t, db)
+
+	if _, err := os.Lstat(testKeyPath(db, "set-opts")); !os.IsNotExist(err) {
+		t.Fatalf("the key is still on disk after GETDEL: %v", err)
+	}
+}
+
+func TestSetGetWrongType(t *testing.T) {
+	const db = 1
+
+	if _, err := HSet(db, testArgs("set-get-hash", "field", "value")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := Set(db, testArgs("set-get-hash", "v"), SetOptions{Get: true}); err != ErrWrongType {
+		t.Fatalf("SET GET of a hash returned %v, want %v", err, ErrWrongType)
+	}
+	if _, err := GetDel(db, testArgs("set-get-hash")); err != ErrWrongType {
+		t.Fatalf("GETDEL of a hash returned %v, want %v", err, ErrWrongType)
+	}
+
+	if typ, err := Type(db, []byte("set-get-hash")); err != nil || typ != TypeHash {
+		t.Fatalf("the hash became a %s: %v", typ, err)
+	}
+
+	if _, err := Del(db, testArgs("set-get-hash")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,354 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+	"github.com/RcrdBrt/gobigdis/config"
+)
+
+/*
+	RENAME, COPY and MOVE relocate whole keys: a string file or the dir of
+	any other type is renamed from the path of a key to the one of another,
+	in the same DB or not. Copies are cloned in the internal temp dir with
+	reflinks where the filesystem supports them, and byte by byte
+	otherwise, before being renamed in place. Hardlinks are never used,
+	since most types update their files in place.
+	Whatever refers to a key by name or by DB is updated afterwards: the
+	name file of the hashes, the search indexes, the registry and the
+	compaction rules of the time series and the blocked clients.
+*/
+
+var errSameObject = errors.New("ERR source and destination objects are the same")
+
+type CopyOptions struct {
+	DB      int
+	Replace bool
+}
+
+// ParseCopyOptions parses the [DB destination-db] [REPLACE] options of COPY,
+// the destination DB defaulting to dbNum
+func ParseCopyOptions(dbNum int, args [][]byte) (CopyOptions, error) {
+	opts := CopyOptions{
+		DB: dbNum,
+	}
+
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "DB":
+			if i+1 >= len(args) {
+				return opts, ErrSyntax
+			}
+
+			db, err := ParseDBIndex(args[i+1])
+			if err != nil {
+				return opts, err
+			}
+
+			opts.DB = db
+			i++
+		case "REPLACE":
+			opts.Replace = true
+		default:
+			return opts, ErrSyntax
+		}
+	}
+
+	return opts, nil
+}
+
+// ParseDBIndex parses the index of a DB, checking it is in range
+func ParseDBIndex(b []byte) (int, error) {
+	db, err := ParseInt(b)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+
+	if db < 0 || db >= int64(config.Config.DBConfig.DBMaxNum) {
+		return 0, ErrDBIndex
+	}
+
+	return int(db), nil
+}
+
+// Rename renames srcName to dstName, replacing it unless nx is set.
+// It reports whether the key has been renamed.
+func Rename(dbNum int, srcName, dstName []byte, nx bool) (bool, error) {
+	src := cache.NewKey(dbNum, srcName)
+	dst := cache.NewKey(dbNum, dstName)
+
+	// purged once the lock is released
+	var trashed string
+	defer func() {
+		purgeAsync([]string{trashed})
+	}()
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	found, err := exists(src)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		return false, ErrNoSuchKey
+	}
+
+	if src == dst {
+		return !nx, nil
+	}
+
+	if nx {
+		if found, err := exists(dst); err != nil || found {
+			return false, err
+		}
+	}
+
+	trashed, err = relocateKey(src, srcName, dst, dstName, false)
+	return true, err
+}
+
+// Copy copies srcName to dstName in the DB of opts, reporting whether
+// it did: it doesn't if srcName doesn't exist or dstName exists and
+// opts.Replace is not set
+func Copy(dbNum int, srcName, dstName []byte, opts CopyOptions) (bool, error) {
+	src := cache.NewKey(dbNum, srcName)
+	dst := cache.NewKey(opts.DB, dstName)
+
+	if src == dst {
+		return false, errSameObject
+	}
+
+	// purged once the lock is released
+	var trashed string
+	defer func() {
+		purgeAsync([]string{trashed})
+	}()
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	if found, err := exists(src); err != nil || !found {
+		return false, err
+	}
+
+	if !opts.Replace {
+		if found, err := exists(dst); err != nil || found {
+			return false, err
+		}
+	}
+
+	trashed, err := relocateKey(src, srcName, dst, dstName, true)
+	return true, err
+}
+
+// Move moves keyName to the DB dstDB, reporting whether it did: it doesn't
+// if keyName doesn't exist or already exists in dstDB
+func Move(dbNum int, keyName []byte, dstDB int) (bool, error) {
+	if dbNum == dstDB {
+		return false, errSameObject
+	}
+
+	src := cache.NewKey(dbNum, keyName)
+	dst := cache.NewKey(dstDB, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	if found, err := exists(src); err != nil || !found {
+		return false, err
+	}
+
+	if found, err := exists(dst); err != nil || found {
+		return false, err
+	}
+
+	_, err := relocateKey(src, keyName, dst, keyName, false)
+	return true, err
+}
+
+// Touch returns how many of the given keys exist. There is no access time
+// to update, as keys are never evicted.
+func Touch(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 1 {
+		return 0, errors.New("wrong number of arguments for 'touch' command")
+	}
+
+	return Exists(dbNum, args)
+}
+
+// relocateKey moves the existing key src to dst, or copies it if keep is
+// set, replacing whatever is at dst. The previous value of dst is moved in
+// the trash, the returned path is to be purged once cache.FSRWL is
+// released. The caller must hold cache.FSRWL.Lock.
+func relocateKey(src alg.Key, srcName []byte, dst alg.Key, dstName []byte, keep bool) (string, error) {
+	typ, err := keyType(src)
+	if err != nil {
+		return "", err
+	}
+
+	path := src.FilePath()
+	if keep {
+		if path, err = cloneToTemp(src, typ); err != nil {
+			return "", err
+		}
+	}
+
+	trashed, err := storeTemp(path, dst)
+	if err != nil {
+		if keep {
+			os.RemoveAll(path)
+		}
+		return trashed, err
+	}
+
+	if !keep {
+		cache.Resize(src.DB, -1)
+		touch(src)
+
+		if err := unindexKey(src); err != nil {
+			return trashed, err
+		}
+	}
+
+	return trashed, relocated(src, srcName, dst, dstName, typ, keep)
+}
+
+// relocated indexes the key dst of type typ moved or copied from src, and
+// wakes up the clients waiting for it.
+// The caller must hold cache.FSRWL.Lock.
+func relocated(src alg.Key, srcName []byte, dst alg.Key, dstName []byte, typ string, keep bool) error {
+	switch typ {
+	case TypeString:
+		return indexString(dst, dstName)
+	case TypeHash:
+		if err := writeFileAtomic(filepath.Join(dst.FilePath(), hashNameFileName), dstName); err != nil {
+			return err
+		}
+
+		return indexHash(dst, dstName)
+	case TypeList:
+		signalKeyReady(dst)
+	case TypeStream:
+		signalStreamWaiters(dst)
+	case TypeTS:
+		return relocateTimeSeries(src, srcName, dst, dstName, keep)
+	}
+
+	return nil
+}
+
+// cloneToTemp copies the key src of type typ in the internal temp dir,
+// returning the path of the copy. The caller must hold cache.FSRWL.Lock.
+func cloneToTemp(src alg.Key, typ string) (string, error) {
+	if typ == TypeString {
+		tmp, err := createTempFile("copy")
+		if err != nil {
+			return "", err
+		}
+
+		if err := cloneFile(src.FilePath(), tmp); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return "", err
+		}
+
+		return tmp.Name(), tmp.Close()
+	}
+
+	tmpDir, err := internalTempDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp(tmpDir, typ)
+	if err != nil {
+		return "", err
+	}
+
+	if err := cloneDir(src.FilePath(), dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// cloneDir copies the content of the dir src in the existing dir dst
+func cloneDir(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		srcPath := filepath.Join(src, entry.Name())
+		dstPath := filepath.Join(dst, entry.Name())
+
+		if entry.IsDir() {
+			if err := os.Mkdir(dstPath, 0700); err != nil {
+				return err
+			}
+
+			if err := cloneDir(srcPath, dstPath); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		f, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+
+		err = cloneFile(srcPath, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// cloneFile copies the file at path to the empty file dst, sharing its
+// blocks if the filesystem supports reflinks
+func cloneFile(path string, dst *os.File) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := reflink(dst, src); err == nil {
+		return nil
+	}
+
+	_, err = io.Copy(dst, src)
+
+	return err
+}
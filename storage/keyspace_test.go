@@ -0,0 +1,328 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkKeyPath checks whether keyName has a file or dir of type typ,
+// TypeNone for none
+func checkKeyPath(t *testing.T, db int, keyName, typ string) {
+	t.Helper()
+
+	info, err := os.Stat(testKeyPath(db, keyName))
+	switch {
+	case typ == TypeNone && os.IsNotExist(err):
+		return
+	case err != nil:
+		t.Fatalf("%s in DB %d: %v", keyName, db, err)
+	case typ == TypeNone:
+		t.Fatalf("%s is still in DB %d", keyName, db)
+	case info.IsDir() != (typ != TypeString):
+		t.Fatalf("%s in DB %d is a dir: %v", keyName, db, info.IsDir())
+	}
+
+	if found, err := Type(db, []byte(keyName)); err != nil || found != typ {
+		t.Fatalf("%s in DB %d is a %s, want a %s: %v", keyName, db, found, typ, err)
+	}
+}
+
+func checkHashName(t *testing.T, db int, keyName string) {
+	t.Helper()
+
+	name, err := os.ReadFile(filepath.Join(testKeyPath(db, keyName), hashNameFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(name) != keyName {
+		t.Fatalf("the name file of %s holds %s", keyName, name)
+	}
+}
+
+func TestRename(t *testing.T) {
+	const db = 1
+
+	if _, _, err := Set(db, testArgs("ks-str", "value"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := HSet(db, testArgs("ks-hash", "f", "v")); err != nil {
+		t.Fatal(err)
+	}
+	size := DBSize(db)
+
+	// the file or dir moves to the path of the new name
+	if ok, err := Rename(db, []byte("ks-str"), []byte("ks-str2"), false); err != nil || !ok {
+		t.Fatalf("RENAME of a string returned %v: %v", ok, err)
+	}
+	if ok, err := Rename(db, []byte("ks-hash"), []byte("ks-hash2"), true); err != nil || !ok {
+		t.Fatalf("RENAMENX of a hash returned %v: %v", ok, err)
+	}
+	if DBSize(db) != size {
+		t.Fatalf("DBSIZE is %d after renaming, want %d", DBSize(db), size)
+	}
+
+	reopen(t, db)
+
+	checkKeyPath(t, db, "ks-str", TypeNone)
+	checkKeyPath(t, db, "ks-str2", TypeString)
+	checkKeyPath(t, db, "ks-hash", TypeNone)
+	checkKeyPath(t, db, "ks-hash2", TypeHash)
+	checkHashName(t, db, "ks-hash2")
+
+	if value, err := Get(db, testArgs("ks-str2")); err != nil || string(value) != "value" {
+		t.Fatalf("the renamed string is %q: %v", value, err)
+	}
+	if value, err := HGet(db, testArgs("ks-hash2", "f")); err != nil || string(value) != "v" {
+		t.Fatalf("the renamed hash holds %q: %v", value, err)
+	}
+
+	// RENAMENX does not replace, RENAME does whatever the type
+	if ok, err := Rename(db, []byte("ks-str2"), []byte("ks-hash2"), true); err != nil || ok {
+		t.Fatalf("RENAMENX over an existing key returned %v: %v", ok, err)
+	}
+	checkKeyPath(t, db, "ks-str2", TypeString)
+	checkKeyPath(t, db, "ks-hash2", TypeHash)
+
+	if ok, err := Rename(db, []byte("ks-str2"), []byte("ks-hash2"), false); err != nil || !ok {
+		t.Fatalf("RENAME over an existing key returned %v: %v", ok, err)
+	}
+	checkKeyPath(t, db, "ks-str2", TypeNone)
+	checkKeyPath(t, db, "ks-hash2", TypeString)
+	if DBSize(db) != size-1 {
+		t.Fatalf("DBSIZE is %d after renaming over a key, want %d", DBSize(db), size-1)
+	}
+
+	// renaming a key to itself changes nothing
+	if ok, err := Rename(db, []byte("ks-hash2"), []byte("ks-hash2"), false); err != nil || !ok {
+		t.Fatalf("RENAME to itself returned %v: %v", ok, err)
+	}
+	if ok, err := Rename(db, []byte("ks-hash2"), []byte("ks-hash2"), true); err != nil || ok {
+		t.Fatalf("RENAMENX to itself returned %v: %v", ok, err)
+	}
+	checkKeyPath(t, db, "ks-hash2", TypeString)
+
+	if _, err := Rename(db, []byte("ks-missing"), []byte("ks-other"), false); err != ErrNoSuchKey {
+		t.Fatalf("RENAME of a missing key returned %v", err)
+	}
+
+	if _, err := Del(db, testArgs("ks-hash2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	const db, otherDB = 1, 14
+
+	if _, _, err := Set(db, testArgs("ks-copy-str", "value"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := HSet(db, testArgs("ks-copy-hash", "f", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(db, testArgs("ks-copy-list", "a", "b"), false, false); err != nil {
+		t.Fatal(err)
+	}
+	size, otherSize := DBSize(db), DBSize(otherDB)
+
+	for _, c := range []struct {
+		src, dst string
+		opts     CopyOptions
+	}{
+		{"ks-copy-str", "ks-copy-str2", CopyOptions{DB: db}},
+		{"ks-copy-hash", "ks-copy-hash2", CopyOptions{DB: db}},
+		{"ks-copy-hash", "ks-copy-hash", CopyOptions{DB: otherDB}},
+		{"ks-copy-list", "ks-copy-list2", CopyOptions{DB: otherDB}},
+	} {
+		if ok, err := Copy(db, []byte(c.src), []byte(c.dst), c.opts); err != nil || !ok {
+			t.Fatalf("COPY %s %s DB %d returned %v: %v", c.src, c.dst, c.opts.DB, ok, err)
+		}
+	}
+	if DBSize(db) != size+2 || DBSize(otherDB) != otherSize+2 {
+		t.Fatalf("DBSIZE is %d and %d after copying, want %d and %d", DBSize(db), DBSize(otherDB), size+2, otherSize+2)
+	}
+	checkEmptyTempDir(t)
+
+	reopen(t, db)
+	reopen(t, otherDB)
+
+	checkKeyPath(t, db, "ks-copy-str2", TypeString)
+	checkKeyPath(t, db, "ks-copy-hash2", TypeHash)
+	checkKeyPath(t, otherDB, "ks-copy-hash", TypeHash)
+	checkKeyPath(t, otherDB, "ks-copy-list2", TypeList)
+	checkHashName(t, db, "ks-copy-hash2")
+	checkHashName(t, otherDB, "ks-copy-hash")
+
+	// the copies do not share their files with the source
+	if _, err := HSet(db, testArgs("ks-copy-hash", "f", "changed")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Pop(db, []byte("ks-copy-list"), 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := HGet(otherDB, testArgs("ks-copy-hash", "f")); err != nil || string(value) != "v" {
+		t.Fatalf("the copied hash holds %q: %v", value, err)
+	}
+	if elements, err := LRange(otherDB, []byte("ks-copy-list2"), 0, -1); err != nil || len(elements) != 2 {
+		t.Fatalf("the copied list holds %q: %v", elements, err)
+	}
+
+	// without REPLACE an existing destination is kept
+	if ok, err := Copy(db, []byte("ks-copy-str"), []byte("ks-copy-hash2"), CopyOptions{DB: db}); err != nil || ok {
+		t.Fatalf("COPY over an existing key returned %v: %v", ok, err)
+	}
+	checkKeyPath(t, db, "ks-copy-hash2", TypeHash)
+
+	if ok, err := Copy(db, []byte("ks-copy-str"), []byte("ks-copy-hash2"), CopyOptions{DB: db, Replace: true}); err != nil || !ok {
+		t.Fatalf("COPY REPLACE over an existing key returned %v: %v", ok, err)
+	}
+	checkKeyPath(t, db, "ks-copy-hash2", TypeString)
+
+	if ok, err := Copy(db, []byte("ks-missing"), []byte("ks-other"), CopyOptions{DB: db}); err != nil || ok {
+		t.Fatalf("COPY of a missing key returned %v: %v", ok, err)
+	}
+	if _, err := Copy(db, []byte("ks-copy-str"), []byte("ks-copy-str"), CopyOptions{DB: db, Replace: true}); err != errSameObject {
+		t.Fatalf("COPY to itself returned %v", err)
+	}
+
+	waitDeleters(t)
+	checkEmptyTempDir(t)
+
+	if _, err := Del(db, testArgs("ks-copy-str", "ks-copy-str2", "ks-copy-hash", "ks-copy-hash2", "ks-copy-list")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Del(otherDB, testArgs("ks-copy-hash", "ks-copy-list2")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	const db, otherDB = 1, 14
+
+	if _, err := HSet(db, testArgs("ks-move", "f", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Set(db, testArgs("ks-move-str", "here"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Set(otherDB, testArgs("ks-move-str", "there"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	size, otherSize := DBSize(db), DBSize(otherDB)
+
+	if ok, err := Move(db, []byte("ks-move"), otherDB); err != nil || !ok {
+		t.Fatalf("MOVE returned %v: %v", ok, err)
+	}
+	if DBSize(db) != size-1 || DBSize(otherDB) != otherSize+1 {
+		t.Fatalf("DBSIZE is %d and %d after moving, want %d and %d", DBSize(db), DBSize(otherDB), size-1, otherSize+1)
+	}
+
+	reopen(t, db)
+	reopen(t, otherDB)
+
+	checkKeyPath(t, db, "ks-move", TypeNone)
+	checkKeyPath(t, otherDB, "ks-move", TypeHash)
+	checkHashName(t, otherDB, "ks-move")
+	if value, err := HGet(otherDB, testArgs("ks-move", "f")); err != nil || string(value) != "v" {
+		t.Fatalf("the moved hash holds %q: %v", value, err)
+	}
+
+	// a key existing in the destination DB is not replaced
+	if ok, err := Move(db, []byte("ks-move-str"), otherDB); err != nil || ok {
+		t.Fatalf("MOVE over an existing key returned %v: %v", ok, err)
+	}
+	for d, want := range map[int]string{db: "here", otherDB: "there"} {
+		if value, err := Get(d, testArgs("ks-move-str")); err != nil || string(value) != want {
+			t.Fatalf("the string in DB %d is %q, want %q: %v", d, value, want, err)
+		}
+	}
+
+	if ok, err := Move(db, []byte("ks-missing"), otherDB); err != nil || ok {
+		t.Fatalf("MOVE of a missing key returned %v: %v", ok, err)
+	}
+	if _, err := Move(db, []byte("ks-move-str"), db); err != errSameObject {
+		t.Fatalf("MOVE to the same DB returned %v", err)
+	}
+
+	if _, err := Del(db, testArgs("ks-move-str")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Del(otherDB, testArgs("ks-move", "ks-move-str")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypeExistsTouch(t *testing.T) {
+	const db = 1
+
+	if _, _, err := Set(db, testArgs("ks-a", "1"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SAdd(db, testArgs("ks-b", "m")); err != nil {
+		t.Fatal(err)
+	}
+
+	for keyName, want := range map[string]string{"ks-a": TypeString, "ks-b": TypeSet, "ks-missing": TypeNone} {
+		if typ, err := Type(db, []byte(keyName)); err != nil || typ != want {
+			t.Fatalf("TYPE %s is %s, want %s: %v", keyName, typ, want, err)
+		}
+	}
+
+	// the repeated keys count every time
+	args := testArgs("ks-a", "ks-b", "ks-missing", "ks-a")
+	if n, err := Exists(db, args); err != nil || n != 3 {
+		t.Fatalf("EXISTS counted %d keys, want 3: %v", n, err)
+	}
+	if n, err := Touch(db, args); err != nil || n != 3 {
+		t.Fatalf("TOUCH counted %d keys, want 3: %v", n, err)
+	}
+	if _, err := Touch(db, nil); err == nil {
+		t.Fatal("TOUCH without keys did not fail")
+	}
+
+	if _, err := Del(db, testArgs("ks-a", "ks-b")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseCopyOptions(t *testing.T) {
+	opts, err := ParseCopyOptions(1, testArgs("db", "3", "REPLACE"))
+	if err != nil || opts.DB != 3 || !opts.Replace {
+		t.Fatalf("parsed %+v: %v", opts, err)
+	}
+	if opts, err = ParseCopyOptions(1, nil); err != nil || opts.DB != 1 || opts.Replace {
+		t.Fatalf("parsed %+v: %v", opts, err)
+	}
+
+	for _, c := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"db"}, ErrSyntax},
+		{[]string{"db", "x"}, ErrNotInteger},
+		{[]string{"db", "-1"}, ErrDBIndex},
+		{[]string{"db", "16"}, ErrDBIndex},
+		{[]string{"other"}, ErrSyntax},
+	} {
+		if _, err := ParseCopyOptions(1, testArgs(c.args...)); err != c.err {
+			t.Fatalf("COPY options %q returned %v, want %v", c.args, err, c.err)
+		}
+	}
+}
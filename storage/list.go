@@ -0,0 +1,1012 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	A list is a dir holding a sequence of chunk files plus a small meta file.
+	Chunks are numbered: pushing on the left of a full head chunk creates the
+	chunk head-1, pushing on the right of a full tail chunk creates tail+1.
+	All the chunks but the head and the tail ones are always full, so the
+	meta file only needs the ids and the lengths of those two to locate any
+	index of the list: pushes and pops touch a single chunk and LINDEX or
+	LRANGE can seek straight to the right chunk.
+	Operations in the middle of the list (LINSERT, LREM) rewrite the chunks
+	one at a time to keep the invariant.
+
+	Meta file: head id (int64) | tail id (int64) | head len (uint32) | tail len (uint32)
+	Chunk file: a sequence of 4 bytes big endian length | element
+*/
+
+const (
+	listChunkSize     = 128
+	listMetaFileName  = "meta"
+	listChunksDirName = "chunks"
+)
+
+var (
+	ErrNoSuchKey     = errors.New("ERR no such key")
+	ErrIndexOutRange = errors.New("ERR index out of range")
+)
+
+type list struct {
+	key     alg.Key
+	head    int64
+	tail    int64
+	headLen int
+	tailLen int
+}
+
+// loadList reads the meta of the list at key. The returned list is nil if
+// the key does not exist. The caller must hold at least cache.FSRWL.RLock.
+func loadList(key alg.Key) (*list, error) {
+	found, err := checkType(key, TypeList)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	meta, err := os.ReadFile(filepath.Join(key.FilePath(), listMetaFileName))
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) != 24 {
+		return nil, fmt.Errorf("corrupted list meta file for key %s", key.Encode())
+	}
+
+	return &list{
+		key:     key,
+		head:    int64(binary.BigEndian.Uint64(meta[0:8])),
+		tail:    int64(binary.BigEndian.Uint64(meta[8:16])),
+		headLen: int(binary.BigEndian.Uint32(meta[16:20])),
+		tailLen: int(binary.BigEndian.Uint32(meta[20:24])),
+	}, nil
+}
+
+// newList creates an empty list at key, the caller must hold cache.FSRWL.Lock
+func newList(key alg.Key) (*list, error) {
+	err := createTyped(key, TypeList, func(dir string) error {
+		return os.Mkdir(filepath.Join(dir, listChunksDirName), 0700)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &list{
+		key: key,
+	}, nil
+}
+
+func (l *list) saveMeta() error {
+	meta := make([]byte, 24)
+	binary.BigEndian.PutUint64(meta[0:8], uint64(l.head))
+	binary.BigEndian.PutUint64(meta[8:16], uint64(l.tail))
+	binary.BigEndian.PutUint32(meta[16:20], uint32(l.headLen))
+	binary.BigEndian.PutUint32(meta[20:24], uint32(l.tailLen))
+
+	return os.WriteFile(filepath.Join(l.key.FilePath(), listMetaFileName), meta, 0600)
+}
+
+func (l *list) length() int {
+	if l.head == l.tail {
+		return l.headLen
+	}
+
+	return l.headLen + int(l.tail-l.head-1)*listChunkSize + l.tailLen
+}
+
+func (l *list) chunkLen(id int64) int {
+	switch id {
+	case l.head:
+		return l.headLen
+	case l.tail:
+		return l.tailLen
+	default:
+		return listChunkSize
+	}
+}
+
+func (l *list) setChunkLen(id int64, n int) {
+	if id == l.head {
+		l.headLen = n
+	}
+	if id == l.tail {
+		l.tailLen = n
+	}
+}
+
+// locate returns the chunk holding the index-th element and its position
+// inside the chunk. index must be in [0, l.length()).
+func (l *list) locate(index int) (int64, int) {
+	if index < l.headLen {
+		return l.head, index
+	}
+	index -= l.headLen
+
+	return l.head + 1 + int64(index/listChunkSize), index % listChunkSize
+}
+
+// normalizeIndex turns a negative index into a positive one,
+// it returns -1 if index is out of range
+func (l *list) normalizeIndex(index int) int {
+	if index < 0 {
+		index += l.length()
+	}
+	if index < 0 || index >= l.length() {
+		return -1
+	}
+
+	return index
+}
+
+func (l *list) chunkPath(id int64) string {
+	return filepath.Join(l.key.FilePath(), listChunksDirName, strconv.FormatInt(id, 10))
+}
+
+func (l *list) readChunk(id int64) ([][]byte, error) {
+	content, err := os.ReadFile(l.chunkPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return decodeChunk(content)
+}
+
+func (l *list) writeChunk(id int64, elements [][]byte) error {
+	return os.WriteFile(l.chunkPath(id), encodeChunk(elements), 0600)
+}
+
+func encodeChunk(elements [][]byte) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 4)
+	for _, element := range elements {
+		binary.BigEndian.PutUint32(header, uint32(len(element)))
+		buf.Write(header)
+		buf.Write(element)
+	}
+
+	return buf.Bytes()
+}
+
+func decodeChunk(content []byte) ([][]byte, error) {
+	var elements [][]byte
+	for len(content) > 0 {
+		if len(content) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := int(binary.BigEndian.Uint32(content))
+		content = content[4:]
+		if len(content) < size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		elements = append(elements, content[:size:size])
+		content = content[size:]
+	}
+
+	return elements, nil
+}
+
+func (l *list) pushLeft(values [][]byte) error {
+	chunk, err := l.readChunk(l.head)
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		if len(chunk) == listChunkSize {
+			if err := l.writeChunk(l.head, chunk); err != nil {
+				return err
+			}
+			l.head--
+			chunk = nil
+		}
+
+		chunk = append([][]byte{value}, chunk...)
+		l.setChunkLen(l.head, len(chunk))
+	}
+
+	if err := l.writeChunk(l.head, chunk); err != nil {
+		return err
+	}
+
+	return l.saveMeta()
+}
+
+func (l *list) pushRight(values [][]byte) error {
+	chunk, err := l.readChunk(l.tail)
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		if len(chunk) == listChunkSize {
+			if err := l.writeChunk(l.tail, chunk); err != nil {
+				return err
+			}
+			l.tail++
+			chunk = nil
+		}
+
+		chunk = append(chunk, value)
+		l.setChunkLen(l.tail, len(chunk))
+	}
+
+	if err := l.writeChunk(l.tail, chunk); err != nil {
+		return err
+	}
+
+	return l.saveMeta()
+}
+
+// dropHead removes the head chunk, which must not be the tail one too
+func (l *list) dropHead() error {
+	if err := os.Remove(l.chunkPath(l.head)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l.head++
+	if l.head == l.tail {
+		l.headLen = l.tailLen
+	} else {
+		l.headLen = listChunkSize
+	}
+
+	return nil
+}
+
+// dropTail removes the tail chunk, which must not be the head one too
+func (l *list) dropTail() error {
+	if err := os.Remove(l.chunkPath(l.tail)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l.tail--
+	if l.head == l.tail {
+		l.tailLen = l.headLen
+	} else {
+		l.tailLen = listChunkSize
+	}
+
+	return nil
+}
+
+// popLeft removes count elements from the head of the list. The removed
+// elements are returned only if collect is true, otherwise whole chunks
+// are dropped without reading them.
+func (l *list) popLeft(count int, collect bool) ([][]byte, error) {
+	var result [][]byte
+	for count > 0 && l.length() > 0 {
+		if count >= l.headLen && l.head != l.tail && !collect {
+			count -= l.headLen
+			if err := l.dropHead(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		chunk, err := l.readChunk(l.head)
+		if err != nil {
+			return nil, err
+		}
+
+		n := count
+		if n > len(chunk) {
+			n = len(chunk)
+		}
+		if collect {
+			result = append(result, chunk[:n]...)
+		}
+		chunk = chunk[n:]
+		count -= n
+
+		if len(chunk) == 0 && l.head != l.tail {
+			if err := l.dropHead(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := l.writeChunk(l.head, chunk); err != nil {
+			return nil, err
+		}
+		l.setChunkLen(l.head, len(chunk))
+	}
+
+	if err := l.saveMeta(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// popRight is the same as popLeft, starting from the tail of the list.
+// The collected elements are in popping order, from the last one.
+func (l *list) popRight(count int, collect bool) ([][]byte, error) {
+	var result [][]byte
+	for count > 0 && l.length() > 0 {
+		if count >= l.tailLen && l.head != l.tail && !collect {
+			count -= l.tailLen
+			if err := l.dropTail(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		chunk, err := l.readChunk(l.tail)
+		if err != nil {
+			return nil, err
+		}
+
+		n := count
+		if n > len(chunk) {
+			n = len(chunk)
+		}
+		if collect {
+			for i := len(chunk) - 1; i >= len(chunk)-n; i-- {
+				result = append(result, chunk[i])
+			}
+		}
+		chunk = chunk[:len(chunk)-n]
+		count -= n
+
+		if len(chunk) == 0 && l.head != l.tail {
+			if err := l.dropTail(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := l.writeChunk(l.tail, chunk); err != nil {
+			return nil, err
+		}
+		l.setChunkLen(l.tail, len(chunk))
+	}
+
+	if err := l.saveMeta(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// rangeItems returns the elements between the normalized indexes start and stop
+func (l *list) rangeItems(start, stop int) ([][]byte, error) {
+	result := make([][]byte, 0, stop-start+1)
+
+	id, pos := l.locate(start)
+	for remaining := stop - start + 1; remaining > 0; id++ {
+		chunk, err := l.readChunk(id)
+		if err != nil {
+			return nil, err
+		}
+		if pos >= len(chunk) {
+			return nil, fmt.Errorf("corrupted list chunk %d for key %s", id, l.key.Encode())
+		}
+
+		end := pos + remaining
+		if end > len(chunk) {
+			end = len(chunk)
+		}
+		result = append(result, chunk[pos:end]...)
+		remaining -= end - pos
+		pos = 0
+	}
+
+	return result, nil
+}
+
+// iterate calls fn on every element, from the head or from the tail
+// if reverse is set, until fn returns false
+func (l *list) iterate(reverse bool, fn func(index int, element []byte) bool) error {
+	if !reverse {
+		index := 0
+		for id := l.head; id <= l.tail; id++ {
+			chunk, err := l.readChunk(id)
+			if err != nil {
+				return err
+			}
+
+			for _, element := range chunk {
+				if !fn(index, element) {
+					return nil
+				}
+				index++
+			}
+		}
+
+		return nil
+	}
+
+	index := l.length() - 1
+	for id := l.tail; id >= l.head; id-- {
+		chunk, err := l.readChunk(id)
+		if err != nil {
+			return err
+		}
+
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if !fn(index, chunk[i]) {
+				return nil
+			}
+			index--
+		}
+	}
+
+	return nil
+}
+
+// rewrite streams the list through transform, which returns the elements
+// that replace each element, and writes the result as brand new full chunks.
+// Only one chunk at a time is kept in memory.
+func (l *list) rewrite(transform func(index int, element []byte) [][]byte) error {
+	chunksDir := filepath.Join(l.key.FilePath(), listChunksDirName)
+	newChunksDir := chunksDir + ".new"
+
+	if err := os.RemoveAll(newChunksDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(newChunksDir, 0700); err != nil {
+		return err
+	}
+
+	rewritten := &list{
+		key: l.key,
+	}
+	var (
+		chunk [][]byte
+		err   error
+	)
+	flush := func() error {
+		if len(chunk) < listChunkSize {
+			return nil
+		}
+		if err := os.WriteFile(filepath.Join(newChunksDir, strconv.FormatInt(rewritten.tail, 10)), encodeChunk(chunk), 0600); err != nil {
+			return err
+		}
+		rewritten.tail++
+		chunk = nil
+		return nil
+	}
+
+	if iterErr := l.iterate(false, func(index int, element []byte) bool {
+		for _, replacement := range transform(index, element) {
+			chunk = append(chunk, replacement)
+			if err = flush(); err != nil {
+				return false
+			}
+		}
+		return true
+	}); iterErr != nil {
+		return iterErr
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(chunk) > 0:
+		if err := os.WriteFile(filepath.Join(newChunksDir, strconv.FormatInt(rewritten.tail, 10)), encodeChunk(chunk), 0600); err != nil {
+			return err
+		}
+		rewritten.tailLen = len(chunk)
+	case rewritten.tail > 0:
+		// the last chunk has been flushed as soon as it got full
+		rewritten.tail--
+		rewritten.tailLen = listChunkSize
+	}
+
+	if rewritten.head == rewritten.tail {
+		rewritten.headLen = rewritten.tailLen
+	} else {
+		rewritten.headLen = listChunkSize
+	}
+
+	if err := os.RemoveAll(chunksDir); err != nil {
+		return err
+	}
+	if err := os.Rename(newChunksDir, chunksDir); err != nil {
+		return err
+	}
+
+	l.head, l.tail, l.headLen, l.tailLen = rewritten.head, rewritten.tail, rewritten.headLen, rewritten.tailLen
+
+	return l.saveMeta()
+}
+
+// listPush pushes values on the left or on the right of the list at key,
+// creating it unless onlyExisting is set. It returns the new length of the
+// list. The caller must hold cache.FSRWL.Lock.
+func listPush(key alg.Key, values [][]byte, left, onlyExisting bool) (int, error) {
+	l, err := loadList(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if l == nil {
+		if onlyExisting {
+			return 0, nil
+		}
+
+		if l, err = newList(key); err != nil {
+			return 0, err
+		}
+	}
+
+	if left {
+		err = l.pushLeft(values)
+	} else {
+		err = l.pushRight(values)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	touch(key)
+	signalKeyReady(key)
+
+	return l.length(), nil
+}
+
+// listPop pops up to count elements from one end of the list at key,
+// deleting the key once the list is empty. The result is nil if the key
+// does not exist. The caller must hold cache.FSRWL.Lock.
+func listPop(key alg.Key, count int, left bool) ([][]byte, error) {
+	l, err := loadList(key)
+	if err != nil || l == nil {
+		return nil, err
+	}
+
+	var result [][]byte
+	if left {
+		result, err = l.popLeft(count, true)
+	} else {
+		result, err = l.popRight(count, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		// the key exists, set it apart from a missing one
+		result = [][]byte{}
+	}
+
+	if err := l.deleteIfEmpty(); err != nil {
+		return nil, err
+	}
+
+	touch(key)
+
+	return result, nil
+}
+
+func (l *list) deleteIfEmpty() error {
+	if l.length() > 0 {
+		return nil
+	}
+
+	_, err := removeKey(l.key)
+
+	return err
+}
+
+// Push implements LPUSH, RPUSH, LPUSHX and RPUSHX
+func Push(dbNum int, args [][]byte, left, onlyExisting bool) (int, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("wrong number of arguments")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	return listPush(key, args[1:], left, onlyExisting)
+}
+
+// Pop implements LPOP and RPOP, the result is nil if the key does not exist
+func Pop(dbNum int, keyName []byte, count int, left bool) ([][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	return listPop(key, count, left)
+}
+
+func LLen(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'llen' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	l, err := loadList(key)
+	if err != nil || l == nil {
+		return 0, err
+	}
+
+	return l.length(), nil
+}
+
+func LIndex(dbNum int, keyName []byte, index int) ([]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	l, err := loadList(key)
+	if err != nil || l == nil {
+		return nil, err
+	}
+
+	if index = l.normalizeIndex(index); index < 0 {
+		return nil, nil
+	}
+
+	id, pos := l.locate(index)
+
+	chunk, err := l.readChunk(id)
+	if err != nil {
+		return nil, err
+	}
+	if pos >= len(chunk) {
+		return nil, fmt.Errorf("corrupted list chunk %d for key %s", id, key.Encode())
+	}
+
+	return chunk[pos], nil
+}
+
+// clampRange turns the start and stop arguments of LRANGE and LTRIM
+// into indexes inside [0, length), it returns false if the range is empty
+func clampRange(start, stop, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+
+	return start, stop, start <= stop && start < length
+}
+
+func LRange(dbNum int, keyName []byte, start, stop int) ([][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	l, err := loadList(key)
+	if err != nil || l == nil {
+		return [][]byte{}, err
+	}
+
+	start, stop, ok := clampRange(start, stop, l.length())
+	if !ok {
+		return [][]byte{}, nil
+	}
+
+	return l.rangeItems(start, stop)
+}
+
+// LTrim keeps only the elements between start and stop, dropping
+// whole chunks at both ends without reading them
+func LTrim(dbNum int, keyName []byte, start, stop int) error {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	l, err := loadList(key)
+	if err != nil || l == nil {
+		return err
+	}
+
+	length := l.length()
+	start, stop, ok := clampRange(start, stop, length)
+	if !ok {
+		_, err := removeKey(key)
+		return err
+	}
+
+	if _, err := l.popRight(length-1-stop, false); err != nil {
+		return err
+	}
+	if _, err := l.popLeft(start, false); err != nil {
+		return err
+	}
+
+	touch(key)
+
+	return l.deleteIfEmpty()
+}
+
+func LSet(dbNum int, keyName []byte, index int, value []byte) error {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	l, err := loadList(key)
+	if err != nil {
+		return err
+	}
+	if l == nil {
+		return ErrNoSuchKey
+	}
+
+	if index = l.normalizeIndex(index); index < 0 {
+		return ErrIndexOutRange
+	}
+
+	id, pos := l.locate(index)
+
+	chunk, err := l.readChunk(id)
+	if err != nil {
+		return err
+	}
+	if pos >= len(chunk) {
+		return fmt.Errorf("corrupted list chunk %d for key %s", id, key.Encode())
+	}
+
+	chunk[pos] = value
+	if err := l.writeChunk(id, chunk); err != nil {
+		return err
+	}
+
+	touch(key)
+
+	return nil
+}
+
+// LInsert inserts value before or after the first occurrence of pivot.
+// It returns the new length, -1 if pivot was not found and 0 if the key
+// does not exist.
+func LInsert(dbNum int, keyName []byte, before bool, pivot, value []byte) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	l, err := loadList(key)
+	if err != nil || l == nil {
+		return 0, err
+	}
+
+	pivotIndex := -1
+	if err := l.iterate(false, func(index int, element []byte) bool {
+		if bytes.Equal(element, pivot) {
+			pivotIndex = index
+			return false
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	if pivotIndex < 0 {
+		return -1, nil
+	}
+
+	switch {
+	case pivotIndex == 0 && before:
+		err = l.pushLeft([][]byte{value})
+	case pivotIndex == l.length()-1 && !before:
+		err = l.pushRight([][]byte{value})
+	default:
+		err = l.rewrite(func(index int, element []byte) [][]byte {
+			switch {
+			case index != pivotIndex:
+				return [][]byte{element}
+			case before:
+				return [][]byte{value, element}
+			default:
+				return [][]byte{element, value}
+			}
+		})
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	touch(key)
+
+	return l.length(), nil
+}
+
+// LRem removes the first count occurrences of element, the last ones
+// if count is negative or all of them if count is 0
+func LRem(dbNum int, keyName []byte, count int, element []byte) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	l, err := loadList(key)
+	if err != nil || l == nil {
+		return 0, err
+	}
+
+	// first pass: find out which occurrences have to go
+	matches := 0
+	if err := l.iterate(false, func(index int, e []byte) bool {
+		if bytes.Equal(e, element) {
+			matches++
+		}
+		return true
+	}); err != nil {
+		return 0, err
+	}
+
+	if matches == 0 {
+		return 0, nil
+	}
+
+	first, last := 0, matches-1
+	switch {
+	case count > 0 && count < matches:
+		last = count - 1
+	case count < 0 && -count < matches:
+		first = matches + count
+	}
+
+	occurrence := 0
+	if err := l.rewrite(func(index int, e []byte) [][]byte {
+		if !bytes.Equal(e, element) {
+			return [][]byte{e}
+		}
+
+		occurrence++
+		if occurrence-1 >= first && occurrence-1 <= last {
+			return nil
+		}
+		return [][]byte{e}
+	}); err != nil {
+		return 0, err
+	}
+
+	touch(key)
+
+	if err := l.deleteIfEmpty(); err != nil {
+		return 0, err
+	}
+
+	return last - first + 1, nil
+}
+
+// LPos returns the indexes of the matching elements. A negative rank
+// searches from the tail, count 0 means all the matches and maxLen 0
+// means the whole list.
+func LPos(dbNum int, keyName, element []byte, rank, count, maxLen int) ([]int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	l, err := loadList(key)
+	if err != nil || l == nil {
+		return nil, err
+	}
+
+	reverse := rank < 0
+	if reverse {
+		rank = -rank
+	}
+
+	var (
+		result  []int
+		scanned int
+	)
+	if err := l.iterate(reverse, func(index int, e []byte) bool {
+		if maxLen > 0 && scanned >= maxLen {
+			return false
+		}
+		scanned++
+
+		if bytes.Equal(e, element) {
+			if rank > 1 {
+				rank--
+				return true
+			}
+			result = append(result, index)
+			if count > 0 && len(result) >= count {
+				return false
+			}
+		}
+		return true
+	}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// LMove atomically pops an element from one end of src and pushes it on
+// one end of dst. The result is nil if src does not exist.
+func LMove(dbNum int, src, dst []byte, fromLeft, toLeft bool) ([]byte, error) {
+	srcKey := cache.NewKey(dbNum, src)
+	dstKey := cache.NewKey(dbNum, dst)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	return listMove(srcKey, dstKey, fromLeft, toLeft)
+}
+
+// listMove is LMove for callers already holding cache.FSRWL.Lock
+func listMove(srcKey, dstKey alg.Key, fromLeft, toLeft bool) ([]byte, error) {
+	l, err := loadList(srcKey)
+	if err != nil || l == nil {
+		return nil, err
+	}
+
+	// check the destination type before touching the source
+	if _, err := checkType(dstKey, TypeList); err != nil {
+		return nil, err
+	}
+
+	popped, err := listPop(srcKey, 1, fromLeft)
+	if err != nil || len(popped) == 0 {
+		return nil, err
+	}
+
+	if err := listPushOrRestore(srcKey, dstKey, popped[0], fromLeft, toLeft); err != nil {
+		return nil, err
+	}
+
+	return popped[0], nil
+}
+
+// listPushOrRestore pushes value, just popped from srcKey, to dstKey. If
+// that fails value is pushed back where it was, so that it can't get lost.
+// The caller must hold cache.FSRWL.Lock.
+func listPushOrRestore(srcKey, dstKey alg.Key, value []byte, fromLeft, toLeft bool) error {
+	_, err := listPush(dstKey, [][]byte{value}, toLeft, false)
+	if err == nil {
+		return nil
+	}
+
+	if _, restoreErr := listPush(srcKey, [][]byte{value}, fromLeft, false); restoreErr != nil {
+		log.Println(restoreErr)
+	}
+
+	return err
+}
@@ -0,0 +1,249 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// checkListChunks checks that the list at keyName holds want, with all its
+// chunks but the head and the tail ones full and no other chunk file
+func checkListChunks(t *testing.T, db int, keyName string, want []string) {
+	t.Helper()
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	l, err := loadList(cache.NewKey(db, []byte(keyName)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l == nil {
+		if len(want) > 0 {
+			t.Fatalf("the list is missing, want %d elements", len(want))
+		}
+		return
+	}
+	if l.length() != len(want) {
+		t.Fatalf("the list has %d elements, want %d", l.length(), len(want))
+	}
+
+	entries, err := os.ReadDir(filepath.Join(l.key.FilePath(), listChunksDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != int(l.tail-l.head+1) {
+		t.Fatalf("%d chunk files for the chunks %d to %d", len(entries), l.head, l.tail)
+	}
+
+	i := 0
+	for id := l.head; id <= l.tail; id++ {
+		chunk, err := l.readChunk(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) != l.chunkLen(id) {
+			t.Fatalf("chunk %d holds %d elements, want %d", id, len(chunk), l.chunkLen(id))
+		}
+		if id != l.head && id != l.tail && len(chunk) != listChunkSize {
+			t.Fatalf("the inner chunk %d holds %d elements", id, len(chunk))
+		}
+
+		for _, element := range chunk {
+			if string(element) != want[i] {
+				t.Fatalf("element %d is %q, want %q", i, element, want[i])
+			}
+			i++
+		}
+	}
+}
+
+func listTestElements(prefix string, from, to int) []string {
+	elements := []string{}
+	for i := from; i < to; i++ {
+		elements = append(elements, prefix+strconv.Itoa(i))
+	}
+
+	return elements
+}
+
+func TestListChunks(t *testing.T) {
+	const db = 3
+	const key = "list-chunks"
+
+	right := listTestElements("r", 0, 300)
+	if n, err := Push(db, testArgs(append([]string{key}, right...)...), false, false); err != nil || n != 300 {
+		t.Fatalf("RPUSH returned %d: %v", n, err)
+	}
+
+	// LPUSH pushes the elements one at a time, so they end up reversed
+	left := listTestElements("l", 0, 200)
+	if _, err := Push(db, testArgs(append([]string{key}, left...)...), true, false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{}
+	for i := len(left) - 1; i >= 0; i-- {
+		want = append(want, left[i])
+	}
+	want = append(want, right...)
+
+	checkListChunks(t, db, key, want)
+	reopen(t, db)
+	checkListChunks(t, db, key, want)
+
+	// ranges and indexes across the chunk boundaries
+	values, err := LRange(db, []byte(key), 100, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 301 || string(values[0]) != want[100] || string(values[300]) != want[400] {
+		t.Fatalf("LRANGE 100 400 returned %d elements", len(values))
+	}
+	for _, index := range []int{0, 127, 128, -1, -300, 499} {
+		value, err := LIndex(db, []byte(key), index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := index
+		if i < 0 {
+			i += len(want)
+		}
+		if string(value) != want[i] {
+			t.Fatalf("LINDEX %d returned %q, want %q", index, value, want[i])
+		}
+	}
+	if value, err := LIndex(db, []byte(key), 500); err != nil || value != nil {
+		t.Fatalf("LINDEX out of range returned %q: %v", value, err)
+	}
+
+	// pops emptying whole chunks at both ends
+	popped, err := Pop(db, []byte(key), 250, true)
+	if err != nil || len(popped) != 250 || string(popped[249]) != want[249] {
+		t.Fatalf("LPOP 250 returned %d elements: %v", len(popped), err)
+	}
+	want = want[250:]
+	if popped, err = Pop(db, []byte(key), 130, false); err != nil || len(popped) != 130 || string(popped[0]) != want[len(want)-1] {
+		t.Fatalf("RPOP 130 returned %d elements: %v", len(popped), err)
+	}
+	want = want[:len(want)-130]
+	checkListChunks(t, db, key, want)
+
+	if err := LTrim(db, []byte(key), 5, -6); err != nil {
+		t.Fatal(err)
+	}
+	want = want[5 : len(want)-5]
+	checkListChunks(t, db, key, want)
+
+	if err := LSet(db, []byte(key), -1, []byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	want[len(want)-1] = "last"
+	if err := LSet(db, []byte(key), len(want), []byte("out")); err != ErrIndexOutRange {
+		t.Fatalf("LSET out of range returned %v", err)
+	}
+	checkListChunks(t, db, key, want)
+
+	if popped, err := Pop(db, []byte(key), len(want)+10, true); err != nil || len(popped) != len(want) {
+		t.Fatalf("LPOP of everything returned %d elements: %v", len(popped), err)
+	}
+	if _, err := os.Lstat(testKeyPath(db, key)); !os.IsNotExist(err) {
+		t.Fatalf("the emptied list is still on disk: %v", err)
+	}
+	if popped, err := Pop(db, []byte(key), 1, true); err != nil || popped != nil {
+		t.Fatalf("LPOP of a missing list returned %q: %v", popped, err)
+	}
+}
+
+func TestListMiddleOperations(t *testing.T) {
+	const db = 3
+	const key = "list-middle"
+
+	// dup is in the first, a middle and the last chunks
+	want := listTestElements("e", 0, 400)
+	want[3], want[200], want[398] = "dup", "dup", "dup"
+	if _, err := Push(db, testArgs(append([]string{key}, want...)...), false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := LInsert(db, []byte(key), true, []byte("e130"), []byte("before")); err != nil || n != 401 {
+		t.Fatalf("LINSERT returned %d: %v", n, err)
+	}
+	want = append(want[:130], append([]string{"before"}, want[130:]...)...)
+	if n, err := LInsert(db, []byte(key), false, []byte("missing"), []byte("x")); err != nil || n != -1 {
+		t.Fatalf("LINSERT with a missing pivot returned %d: %v", n, err)
+	}
+	checkListChunks(t, db, key, want)
+
+	positions, err := LPos(db, []byte(key), []byte("dup"), 1, 0, 0)
+	if err != nil || len(positions) != 3 || positions[0] != 3 || positions[1] != 201 || positions[2] != 399 {
+		t.Fatalf("LPOS returned %v: %v", positions, err)
+	}
+	if positions, err = LPos(db, []byte(key), []byte("dup"), -1, 1, 0); err != nil || len(positions) != 1 || positions[0] != 399 {
+		t.Fatalf("LPOS RANK -1 returned %v: %v", positions, err)
+	}
+	if positions, err = LPos(db, []byte(key), []byte("dup"), 1, 0, 100); err != nil || len(positions) != 1 {
+		t.Fatalf("LPOS MAXLEN 100 returned %v: %v", positions, err)
+	}
+
+	// the last occurrence first, then the others
+	if n, err := LRem(db, []byte(key), -1, []byte("dup")); err != nil || n != 1 {
+		t.Fatalf("LREM -1 removed %d: %v", n, err)
+	}
+	want = append(want[:399], want[400:]...)
+	checkListChunks(t, db, key, want)
+
+	if n, err := LRem(db, []byte(key), 0, []byte("dup")); err != nil || n != 2 {
+		t.Fatalf("LREM 0 removed %d: %v", n, err)
+	}
+	want = append(want[:201], want[202:]...)
+	want = append(want[:3], want[4:]...)
+	checkListChunks(t, db, key, want)
+
+	reopen(t, db)
+	checkListChunks(t, db, key, want)
+
+	// LMOVE rotates the list, and moves the elements to another one
+	if value, err := LMove(db, []byte(key), []byte(key), true, false); err != nil || string(value) != want[0] {
+		t.Fatalf("LMOVE rotated %q: %v", value, err)
+	}
+	want = append(want[1:], want[0])
+	if value, err := LMove(db, []byte(key), []byte("list-moved"), false, true); err != nil || string(value) != want[len(want)-1] {
+		t.Fatalf("LMOVE moved %q: %v", value, err)
+	}
+	checkListChunks(t, db, "list-moved", []string{want[len(want)-1]})
+	want = want[:len(want)-1]
+	checkListChunks(t, db, key, want)
+
+	if _, _, err := Set(db, testArgs("list-string", "v"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Push(db, testArgs("list-string", "x"), true, false); err != ErrWrongType {
+		t.Fatalf("LPUSH on a string returned %v", err)
+	}
+	if _, err := LMove(db, []byte(key), []byte("list-string"), true, true); err != ErrWrongType {
+		t.Fatalf("LMOVE to a string returned %v", err)
+	}
+	checkListChunks(t, db, key, want)
+
+	if _, err := Del(db, testArgs(key, "list-moved", "list-string")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,1029 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+	"github.com/RcrdBrt/gobigdis/config"
+)
+
+/*
+	A search index indexes the fields of the hashes whose name starts with
+	one of its prefixes, or the whole value of the strings for the indexes
+	ON STRING. Indexes are dirs under the internal dir, named after the hex
+	of the index name, holding a meta file with the definition encoded as
+	JSON and an alg.BTree with:
+	- 'd' + hashed key -> nothing, for every indexed hash
+	- 't' + field + 0 + term + 0 + hashed key -> frequency of the term
+	- 'g' + field + 0 + tag + 0 + hashed key -> nothing
+	- 'n' + field + 0 + number + hashed key -> nothing, numbers encoded
+	  like the scores of the sorted sets
+	A docs dir holds a file per indexed hash, named after the hex of its
+	hashed key, with the name of the key and the tree entries added for it,
+	so that they can be removed when the hash changes or is deleted.
+	The VECTOR fields have an alg.VectorFile each instead, see searchvector.go.
+
+	The definitions are loaded in memory at startup. The hooks in the
+	write path of the hashes keep the indexes up to date, while the hashes
+	already existing when an index is created are indexed by a background
+	task which scans the DB dir a bit at a time. Strings have no place to
+	keep their name, so only the ones written after the creation of an
+	index ON STRING are indexed.
+*/
+
+const (
+	searchDirName      = "search"
+	searchMetaFileName = "meta"
+	searchTreeFileName = "index"
+	searchDocsDirName  = "docs"
+
+	searchDocPrefix     = 'd'
+	searchTermPrefix    = 't'
+	searchTagPrefix     = 'g'
+	searchNumericPrefix = 'n'
+
+	SearchText    = "TEXT"
+	SearchTag     = "TAG"
+	SearchNumeric = "NUMERIC"
+	SearchVector  = "VECTOR"
+
+	SearchOnHash   = "HASH"
+	SearchOnString = "STRING"
+)
+
+var (
+	errSearchUnknownIndex = errors.New("ERR Unknown index name")
+	errSearchIndexExists  = errors.New("ERR Index already exists")
+	errSearchOn           = errors.New("ERR Only HASH and STRING indexes are supported")
+	errSearchNoFields     = errors.New("ERR Fields arguments are missing")
+	errSearchDupField     = errors.New("ERR Duplicate field in schema")
+	errSearchSyntax       = errors.New("ERR Syntax error in query")
+)
+
+type SearchField struct {
+	Name          string
+	Type          string
+	Weight        float64 `json:",omitempty"` // TEXT only
+	Separator     string  `json:",omitempty"` // TAG only
+	CaseSensitive bool    `json:",omitempty"` // TAG only
+	Sortable      bool    `json:",omitempty"`
+
+	// VECTOR only
+	Algorithm      string `json:",omitempty"`
+	Dim            int    `json:",omitempty"`
+	DistanceMetric string `json:",omitempty"`
+	M              int    `json:",omitempty"`
+	EFConstruction int    `json:",omitempty"`
+	EFRuntime      int    `json:",omitempty"`
+}
+
+type SearchIndexDef struct {
+	On       string
+	Prefixes []string
+	Fields   []SearchField
+}
+
+type searchMeta struct {
+	Name string
+	SearchIndexDef
+	Built bool
+}
+
+type searchIndex struct {
+	db   int
+	dir  string
+	meta searchMeta
+
+	// tree is opened on first use and kept open until the index is
+	// dropped, flushed or moved, or the server shuts down. The commands
+	// holding cache.FSRWL.RLock must hold treeMu to use it, since it caches
+	// its pages.
+	tree     *alg.BTree
+	treeMu   sync.Mutex
+	vectors  map[string]*searchVectors // by field name
+	dropped  bool
+	progress int // top level dirs of the DB scanned by the build so far
+}
+
+// searchIndexes are the indexes of every DB by name, guarded by cache.FSRWL
+var searchIndexes = map[int]map[string]*searchIndex{}
+
+// ParseFTCreateArgs parses the arguments of FT.CREATE following the
+// index name: [ON HASH] [PREFIX count prefix...] SCHEMA field type [options]...
+func ParseFTCreateArgs(args [][]byte) (*SearchIndexDef, error) {
+	def := &SearchIndexDef{
+		On: SearchOnHash,
+	}
+
+	i := 0
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "ON":
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			i++
+
+			def.On = strings.ToUpper(string(args[i]))
+			if def.On != SearchOnHash && def.On != SearchOnString {
+				return nil, errSearchOn
+			}
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+
+			count, err := ParseInt(args[i+1])
+			if err != nil || count < 1 || count > int64(len(args)-i-2) {
+				return nil, ErrSyntax
+			}
+
+			for _, prefix := range args[i+2 : i+2+int(count)] {
+				def.Prefixes = append(def.Prefixes, string(prefix))
+			}
+			i += 1 + int(count)
+		case "SCHEMA":
+			fields, err := parseSearchSchema(args[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			def.Fields = fields
+
+			return def, nil
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	return nil, errSearchNoFields
+}
+
+func parseSearchSchema(args [][]byte) ([]SearchField, error) {
+	if len(args) == 0 {
+		return nil, errSearchNoFields
+	}
+
+	fields := []SearchField{}
+	names := map[string]bool{}
+	for i := 0; i < len(args); {
+		if i+1 >= len(args) {
+			return nil, ErrSyntax
+		}
+
+		field := SearchField{
+			Name: string(args[i]),
+			Type: strings.ToUpper(string(args[i+1])),
+		}
+		if names[field.Name] {
+			return nil, errSearchDupField
+		}
+		if field.Name == "" || strings.IndexByte(field.Name, 0) >= 0 {
+			return nil, ErrSyntax
+		}
+		names[field.Name] = true
+
+		switch field.Type {
+		case SearchText:
+			field.Weight = 1
+		case SearchTag:
+			field.Separator = ","
+		case SearchNumeric:
+		case SearchVector:
+			n, err := parseSearchVectorField(&field, args[i+2:])
+			if err != nil {
+				return nil, err
+			}
+			i += n
+		default:
+			return nil, fmt.Errorf("ERR Invalid field type for field `%s`", field.Name)
+		}
+
+		i += 2
+	options:
+		for ; i < len(args); i++ {
+			option := strings.ToUpper(string(args[i]))
+			switch {
+			case option == "SORTABLE":
+				field.Sortable = true
+			case option == "NOSTEM" && field.Type == SearchText:
+			case option == "WEIGHT" && field.Type == SearchText && i+1 < len(args):
+				weight, err := ParseFloat(args[i+1])
+				if err != nil || weight < 0 {
+					return nil, ErrSyntax
+				}
+				field.Weight = weight
+				i++
+			case option == "SEPARATOR" && field.Type == SearchTag && i+1 < len(args):
+				if len(args[i+1]) != 1 {
+					return nil, ErrSyntax
+				}
+				field.Separator = string(args[i+1])
+				i++
+			case option == "CASESENSITIVE" && field.Type == SearchTag:
+				field.CaseSensitive = true
+			default:
+				break options
+			}
+		}
+
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func searchDBDir(dbNum int) string {
+	return filepath.Join(config.Config.DBConfig.InternalDirPath, searchDirName, strconv.Itoa(dbNum))
+}
+
+// loadSearchIndexes loads the definitions of the indexes, resuming the
+// builds interrupted by a shutdown
+func loadSearchIndexes() error {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	for dbNum := 0; dbNum < config.Config.DBConfig.DBMaxNum; dbNum++ {
+		entries, err := os.ReadDir(searchDBDir(dbNum))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		for _, entry := range entries {
+			idx := &searchIndex{
+				db:  dbNum,
+				dir: filepath.Join(searchDBDir(dbNum), entry.Name()),
+			}
+
+			meta, err := os.ReadFile(filepath.Join(idx.dir, searchMetaFileName))
+			if err != nil {
+				if os.IsNotExist(err) {
+					// FT.CREATE did not complete
+					if err := os.RemoveAll(idx.dir); err != nil {
+						return err
+					}
+					continue
+				}
+				return err
+			}
+
+			if err := json.Unmarshal(meta, &idx.meta); err != nil {
+				return fmt.Errorf("corrupted search index meta file %s", idx.dir)
+			}
+
+			if err := idx.openVectors(); err != nil {
+				return err
+			}
+
+			if searchIndexes[dbNum] == nil {
+				searchIndexes[dbNum] = map[string]*searchIndex{}
+			}
+			searchIndexes[dbNum][idx.meta.Name] = idx
+
+			if !idx.meta.Built {
+				go idx.build()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (idx *searchIndex) saveMeta() error {
+	meta, err := json.Marshal(idx.meta)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(idx.dir, searchMetaFileName), meta)
+}
+
+// openTree returns the tree of the index, opening it if needed. The caller
+// must hold cache.FSRWL.Lock, or cache.FSRWL.RLock and idx.treeMu.
+func (idx *searchIndex) openTree() (*alg.BTree, error) {
+	if idx.tree == nil {
+		tree, err := alg.OpenBTree(filepath.Join(idx.dir, searchTreeFileName))
+		if err != nil {
+			return nil, err
+		}
+		idx.tree = tree
+	}
+
+	return idx.tree, nil
+}
+
+// closeTree closes the tree of the index, dropping the changes not
+// committed. The caller must hold cache.FSRWL.Lock.
+func (idx *searchIndex) closeTree() error {
+	if idx.tree == nil {
+		return nil
+	}
+
+	err := idx.tree.Close()
+	idx.tree = nil
+
+	return err
+}
+
+// commitTree commits the changes made to the tree of the index, or drops
+// them if err is not nil or the commit fails.
+// The caller must hold cache.FSRWL.Lock.
+func (idx *searchIndex) commitTree(err error) error {
+	if err == nil {
+		err = idx.tree.Commit()
+	}
+
+	if err != nil {
+		// the journal left by a failed commit is rolled back on reopening
+		idx.closeTree()
+	}
+
+	return err
+}
+
+func (idx *searchIndex) matches(keyName []byte) bool {
+	if len(idx.meta.Prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range idx.meta.Prefixes {
+		if bytes.HasPrefix(keyName, []byte(prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (idx *searchIndex) field(name string) (SearchField, bool) {
+	for _, field := range idx.meta.Fields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+
+	return SearchField{}, false
+}
+
+// fieldValue returns the value of a field of the hash at key, or the
+// whole value of the string at key for the indexes ON STRING.
+// The caller must hold at least cache.FSRWL.RLock.
+func (idx *searchIndex) fieldValue(key alg.Key, field string) ([]byte, error) {
+	if idx.meta.On == SearchOnString {
+		return getValue(key)
+	}
+
+	return hashGet(key, []byte(field))
+}
+
+func (idx *searchIndex) docPath(hashedKey []byte) string {
+	name := hex.EncodeToString(hashedKey)
+
+	return filepath.Join(idx.dir, searchDocsDirName, name[:2], name)
+}
+
+// readSearchDoc reads the name of an indexed key and the tree entries
+// added for it, nil if the key is not indexed
+func (idx *searchIndex) readDoc(hashedKey []byte) ([]byte, [][]byte, error) {
+	content, err := os.ReadFile(idx.docPath(hashedKey))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	values := [][]byte{}
+	for len(content) > 0 {
+		if len(content) < 4 || int(binary.BigEndian.Uint32(content)) > len(content)-4 {
+			return nil, nil, fmt.Errorf("corrupted search index doc file %s", idx.docPath(hashedKey))
+		}
+
+		size := int(binary.BigEndian.Uint32(content))
+		values = append(values, content[4:4+size])
+		content = content[4+size:]
+	}
+
+	if len(values) == 0 {
+		return nil, nil, fmt.Errorf("corrupted search index doc file %s", idx.docPath(hashedKey))
+	}
+
+	return values[0], values[1:], nil
+}
+
+func (idx *searchIndex) writeDoc(hashedKey, keyName []byte, entries [][]byte) error {
+	path := idx.docPath(hashedKey)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	content := []byte{}
+	for _, value := range append([][]byte{keyName}, entries...) {
+		content = append(content, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(content[len(content)-4:], uint32(len(value)))
+		content = append(content, value...)
+	}
+
+	return writeFileAtomic(path, content)
+}
+
+func searchDocKey(hashedKey []byte) []byte {
+	return append([]byte{searchDocPrefix}, hashedKey...)
+}
+
+// searchFieldKey is the start of the keys of the entries of a field
+func searchFieldKey(prefix byte, field string) []byte {
+	key := append([]byte{prefix}, field...)
+
+	return append(key, 0)
+}
+
+// unindex removes the entries of key from the tree, the caller must hold
+// cache.FSRWL.Lock and commit the tree
+func (idx *searchIndex) unindex(tree *alg.BTree, key alg.Key) error {
+	keyName, entries, err := idx.readDoc(key.HashedKey[:])
+	if err != nil || keyName == nil {
+		return err
+	}
+
+	for _, entry := range append(entries, searchDocKey(key.HashedKey[:])) {
+		if _, err := tree.Delete(entry); err != nil {
+			return err
+		}
+	}
+
+	for _, vectors := range idx.vectors {
+		if err := vectors.remove(key.HashedKey); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(idx.docPath(key.HashedKey[:]))
+}
+
+// index replaces the entries of the hash or string at key with the ones
+// of its current value. The caller must hold cache.FSRWL.Lock and commit
+// the tree.
+func (idx *searchIndex) index(tree *alg.BTree, key alg.Key, keyName []byte) error {
+	if err := idx.unindex(tree, key); err != nil {
+		return err
+	}
+
+	hashedKey := key.HashedKey[:]
+	entries := [][]byte{}
+	values := [][]byte{}
+	for _, field := range idx.meta.Fields {
+		value, err := idx.fieldValue(key, field.Name)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+
+		switch field.Type {
+		case SearchText:
+			frequencies := map[string]uint32{}
+			for _, term := range searchTokens(value) {
+				frequencies[term]++
+			}
+
+			for term, frequency := range frequencies {
+				entry := append(searchFieldKey(searchTermPrefix, field.Name), term...)
+				entry = append(append(entry, 0), hashedKey...)
+
+				encoded := make([]byte, 4)
+				binary.BigEndian.PutUint32(encoded, frequency)
+				entries, values = append(entries, entry), append(values, encoded)
+			}
+		case SearchTag:
+			for _, tag := range searchTags(value, field) {
+				entry := append(searchFieldKey(searchTagPrefix, field.Name), tag...)
+				entry = append(append(entry, 0), hashedKey...)
+				entries, values = append(entries, entry), append(values, nil)
+			}
+		case SearchNumeric:
+			number, err := ParseFloat(value)
+			if err != nil {
+				// not indexed, like a missing field
+				continue
+			}
+
+			entry := append(searchFieldKey(searchNumericPrefix, field.Name), encodeScore(number)...)
+			entry = append(entry, hashedKey...)
+			entries, values = append(entries, entry), append(values, nil)
+		case SearchVector:
+			// blobs of the wrong size are not indexed
+			if vector := alg.DecodeVector(value, field.Dim); vector != nil {
+				if err := idx.vectors[field.Name].set(key.HashedKey, vector); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	added := [][]byte{}
+	for i, entry := range entries {
+		if _, err := tree.Put(entry, values[i]); err != nil {
+			if err == alg.ErrBTreeEntryTooBig {
+				// terms and tags too long to be searched for anyway
+				continue
+			}
+			return err
+		}
+
+		added = append(added, entry)
+	}
+
+	if _, err := tree.Put(searchDocKey(hashedKey), nil); err != nil {
+		return err
+	}
+
+	return idx.writeDoc(hashedKey, keyName, added)
+}
+
+// searchTokens splits a text in lower case terms made of letters and digits
+func searchTokens(text []byte) []string {
+	return strings.FieldsFunc(strings.ToLower(string(text)), isSearchTermRune)
+}
+
+func isSearchTermRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// searchTags splits the value of a tag field by its separator
+func searchTags(value []byte, field SearchField) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(string(value), field.Separator) {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+
+		if !field.CaseSensitive {
+			tag = strings.ToLower(tag)
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags
+}
+
+// indexHash updates the indexes matching the name of the hash at key
+// after it changed. The caller must hold cache.FSRWL.Lock.
+func indexHash(key alg.Key, keyName []byte) error {
+	return indexKey(key, keyName, SearchOnHash)
+}
+
+// indexString is indexHash for the strings
+func indexString(key alg.Key, keyName []byte) error {
+	return indexKey(key, keyName, SearchOnString)
+}
+
+func indexKey(key alg.Key, keyName []byte, on string) error {
+	for _, idx := range searchIndexes[key.DB] {
+		if idx.meta.On != on || !idx.matches(keyName) {
+			continue
+		}
+
+		tree, err := idx.openTree()
+		if err != nil {
+			return err
+		}
+
+		if err := idx.commitTree(idx.index(tree, key, keyName)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexKey removes key from the indexes of its DB after it was deleted.
+// The caller must hold cache.FSRWL.Lock.
+func unindexKey(key alg.Key) error {
+	for _, idx := range searchIndexes[key.DB] {
+		if _, err := os.Lstat(idx.docPath(key.HashedKey[:])); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		tree, err := idx.openTree()
+		if err != nil {
+			return err
+		}
+
+		if err := idx.commitTree(idx.unindex(tree, key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeSearchIndexes closes the files of every index.
+// The caller must hold cache.FSRWL.Lock.
+func closeSearchIndexes() error {
+	var err error
+	for _, indexes := range searchIndexes {
+		for _, idx := range indexes {
+			if closeErr := idx.closeTree(); err == nil {
+				err = closeErr
+			}
+
+			if closeErr := idx.closeVectors(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+
+	return err
+}
+
+// clearSearchIndexes empties the indexes of a flushed DB, keeping their
+// definitions, and returns the paths to purge.
+// The caller must hold cache.FSRWL.Lock.
+func clearSearchIndexes(dbNum int) ([]string, error) {
+	paths := []string{}
+
+	for _, idx := range searchIndexes[dbNum] {
+		if err := idx.closeTree(); err != nil {
+			return paths, err
+		}
+
+		if err := idx.closeVectors(); err != nil {
+			return paths, err
+		}
+
+		names := []string{searchTreeFileName, searchTreeFileName + "-journal", searchDocsDirName}
+		for _, field := range idx.meta.Fields {
+			if field.Type == SearchVector {
+				names = append(names, filepath.Base(idx.vectorFilePath(field)))
+			}
+		}
+
+		for _, name := range names {
+			path, err := trash(filepath.Join(idx.dir, name))
+			if err != nil {
+				return paths, err
+			}
+
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+
+		if err := idx.openVectors(); err != nil {
+			return paths, err
+		}
+	}
+
+	return paths, nil
+}
+
+// swapSearchIndexes makes the indexes of two DBs follow the swap of their
+// dirs. The caller must hold cache.FSRWL.Lock.
+func swapSearchIndexes(a, b int) {
+	searchIndexes[a], searchIndexes[b] = searchIndexes[b], searchIndexes[a]
+
+	for _, dbNum := range []int{a, b} {
+		for _, idx := range searchIndexes[dbNum] {
+			// the trees are reopened from the new dir, where their
+			// journals belong
+			if err := idx.closeTree(); err != nil {
+				log.Println(err)
+			}
+
+			idx.db = dbNum
+			idx.dir = filepath.Join(searchDBDir(dbNum), filepath.Base(idx.dir))
+		}
+	}
+}
+
+// build indexes the hashes existing when the index was created, taking
+// the lock for a dir of keys at a time to let the commands run in between
+func (idx *searchIndex) build() {
+	if idx.meta.On == SearchOnString {
+		// the names of the strings are not known
+		cache.FSRWL.Lock()
+		defer cache.FSRWL.Unlock()
+
+		idx.meta.Built = true
+		if err := idx.saveMeta(); err != nil {
+			log.Println(err)
+		}
+
+		return
+	}
+
+	for level := 0; level < 256; level++ {
+		cache.FSRWL.RLock()
+		// the DB of the index changes with SWAPDB
+		levelDir := filepath.Join(dbDirPath(idx.db), hex.EncodeToString([]byte{byte(level)}))
+		entries, err := os.ReadDir(levelDir)
+		cache.FSRWL.RUnlock()
+		if err != nil && !os.IsNotExist(err) {
+			log.Println(err)
+			return
+		}
+
+		for _, entry := range entries {
+			if err := idx.buildDir(filepath.Join(levelDir, entry.Name())); err != nil {
+				log.Println(err)
+				return
+			}
+		}
+
+		cache.FSRWL.Lock()
+		if idx.dropped {
+			cache.FSRWL.Unlock()
+			return
+		}
+		idx.progress = level + 1
+		cache.FSRWL.Unlock()
+	}
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	if idx.dropped {
+		return
+	}
+
+	idx.meta.Built = true
+	if err := idx.saveMeta(); err != nil {
+		log.Println(err)
+	}
+}
+
+// buildDir indexes the hashes found under dir
+func (idx *searchIndex) buildDir(dir string) error {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	if idx.dropped {
+		return nil
+	}
+
+	var tree *alg.BTree
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !entry.IsDir() || !isHashedName(entry.Name()) {
+			return nil
+		}
+
+		// the dir of a key
+		typ, err := os.ReadFile(filepath.Join(path, typeFileName))
+		if err != nil || string(typ) != TypeHash {
+			return filepath.SkipDir
+		}
+
+		keyName, err := os.ReadFile(filepath.Join(path, hashNameFileName))
+		if err != nil || !idx.matches(keyName) {
+			return filepath.SkipDir
+		}
+
+		key := cache.NewKey(idx.db, keyName)
+		if key.Encode() != entry.Name() {
+			return filepath.SkipDir
+		}
+
+		if tree == nil {
+			if tree, err = idx.openTree(); err != nil {
+				return err
+			}
+		}
+
+		if err := idx.index(tree, key, keyName); err != nil {
+			return err
+		}
+
+		return filepath.SkipDir
+	})
+	if tree == nil {
+		return err
+	}
+
+	return idx.commitTree(err)
+}
+
+// FTCreate creates an index and starts indexing the existing hashes
+func FTCreate(dbNum int, name []byte, def *SearchIndexDef) error {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	if _, ok := searchIndexes[dbNum][string(name)]; ok {
+		return errSearchIndexExists
+	}
+
+	idx := &searchIndex{
+		db:  dbNum,
+		dir: filepath.Join(searchDBDir(dbNum), hex.EncodeToString(name)),
+		meta: searchMeta{
+			Name:           string(name),
+			SearchIndexDef: *def,
+		},
+	}
+
+	// leftovers of an index dropped while its build was running
+	if err := os.RemoveAll(idx.dir); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(idx.dir, 0700); err != nil {
+		return err
+	}
+
+	if err := idx.saveMeta(); err != nil {
+		return err
+	}
+
+	if err := idx.openVectors(); err != nil {
+		return err
+	}
+
+	if searchIndexes[dbNum] == nil {
+		searchIndexes[dbNum] = map[string]*searchIndex{}
+	}
+	searchIndexes[dbNum][idx.meta.Name] = idx
+
+	go idx.build()
+
+	return nil
+}
+
+// FTDropIndex deletes an index and, if deleteDocs is true, the hashes it indexes
+func FTDropIndex(dbNum int, name []byte, deleteDocs bool) error {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	idx, ok := searchIndexes[dbNum][string(name)]
+	if !ok {
+		return errSearchUnknownIndex
+	}
+
+	idx.dropped = true
+	delete(searchIndexes[dbNum], idx.meta.Name)
+
+	if err := idx.closeTree(); err != nil {
+		return err
+	}
+
+	if err := idx.closeVectors(); err != nil {
+		return err
+	}
+
+	if deleteDocs {
+		err := filepath.WalkDir(filepath.Join(idx.dir, searchDocsDirName), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if entry.IsDir() {
+				return nil
+			}
+
+			hashedKey, err := hex.DecodeString(entry.Name())
+			if err != nil {
+				return nil
+			}
+
+			keyName, _, err := idx.readDoc(hashedKey)
+			if err != nil || keyName == nil {
+				return err
+			}
+
+			_, err = removeKey(cache.NewKey(dbNum, keyName))
+
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(idx.dir)
+}
+
+type FTIndexInfo struct {
+	Name           string
+	SearchIndexDef SearchIndexDef
+	NumDocs        int
+	Indexing       bool
+	PercentIndexed float64
+}
+
+// FTInfo returns the definition and the state of an index
+func FTInfo(dbNum int, name []byte) (*FTIndexInfo, error) {
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	idx, ok := searchIndexes[dbNum][string(name)]
+	if !ok {
+		return nil, errSearchUnknownIndex
+	}
+
+	idx.treeMu.Lock()
+	defer idx.treeMu.Unlock()
+
+	tree, err := idx.openTree()
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := searchDocCount(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &FTIndexInfo{
+		Name:           idx.meta.Name,
+		SearchIndexDef: idx.meta.SearchIndexDef,
+		NumDocs:        docs,
+		Indexing:       !idx.meta.Built,
+		PercentIndexed: 1,
+	}
+	if info.Indexing {
+		info.PercentIndexed = float64(idx.progress) / 256
+	}
+
+	return info, nil
+}
+
+func searchDocCount(tree *alg.BTree) (int, error) {
+	from, err := tree.Rank([]byte{searchDocPrefix})
+	if err != nil {
+		return 0, err
+	}
+
+	to, err := tree.Rank([]byte{searchDocPrefix + 1})
+	if err != nil {
+		return 0, err
+	}
+
+	return to - from, nil
+}
+
+// scanSearchTree calls fn with the entries of the tree starting with
+// prefix, from the first one not lower than start, until fn returns false
+func scanSearchTree(tree *alg.BTree, prefix, start []byte, fn func(key, value []byte) bool) error {
+	c, err := tree.Seek(start)
+	if err != nil {
+		return err
+	}
+
+	for c.Valid() && bytes.HasPrefix(c.Key(), prefix) {
+		if !fn(c.Key(), c.Value()) {
+			return nil
+		}
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
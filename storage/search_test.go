@@ -0,0 +1,157 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// createTestIndex creates an index on the tag field color of the hashes
+// prefixed by prefix and waits for its build to finish
+func createTestIndex(t *testing.T, db int, name, prefix string) {
+	t.Helper()
+
+	def, err := ParseFTCreateArgs(testArgs("ON", "HASH", "PREFIX", "1", prefix, "SCHEMA", "color", "TAG"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FTCreate(db, []byte(name), def); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info, err := FTInfo(db, []byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.Indexing {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("index %s still building", name)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// searchKeys returns the sorted keys matching query in the index name
+func searchKeys(t *testing.T, db int, name, query string) []string {
+	t.Helper()
+
+	args, err := ParseFTSearchArgs(testArgs(query, "NOCONTENT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, matches, err := FTSearch(db, []byte(name), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, len(matches))
+	for i, match := range matches {
+		keys[i] = string(match.Key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func checkKeys(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got keys %q, want %q", got, want)
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got keys %q, want %q", got, want)
+		}
+	}
+}
+
+func TestFTCreateIndexesExistingHashes(t *testing.T) {
+	const db = 13
+
+	for _, name := range []string{"old:1", "old:2", "other:1"} {
+		if _, err := HSet(db, testArgs(name, "color", "red")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	createTestIndex(t, db, "existing", "old:")
+
+	checkKeys(t, searchKeys(t, db, "existing", "@color:{red}"), "old:1", "old:2")
+}
+
+func TestSearchTreeStaysOpen(t *testing.T) {
+	const db = 0
+
+	createTestIndex(t, db, "open", "open:")
+
+	if _, err := HSet(db, testArgs("open:1", "color", "green")); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := searchIndexes[db]["open"]
+	tree := idx.tree
+	if tree == nil {
+		t.Fatal("tree closed after a write")
+	}
+
+	if _, err := HSet(db, testArgs("open:2", "color", "green")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Del(db, testArgs("open:1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if idx.tree != tree {
+		t.Fatal("tree reopened by the writes")
+	}
+
+	checkKeys(t, searchKeys(t, db, "open", "@color:{green}"), "open:2")
+
+	// the flush trashes the tree file, the next write opens a new one
+	if err := FlushDB(db, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := HSet(db, testArgs("open:3", "color", "green")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkKeys(t, searchKeys(t, db, "open", "@color:{green}"), "open:3")
+
+	if err := FTDropIndex(db, []byte("open"), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if idx.tree != nil {
+		t.Fatal("tree still open after FT.DROPINDEX")
+	}
+}
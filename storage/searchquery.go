@@ -0,0 +1,932 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	The queries of FT.SEARCH are a subset of the RediSearch syntax:
+	- words are searched in every TEXT field, word* searches the words
+	  starting with word
+	- @field:word searches a single TEXT field, @field:(...) a group
+	- @field:{tag | tag} matches the hashes with any of the tags
+	- @field:[min max] matches a range of a NUMERIC field, a bound preceded
+	  by ( is excluded and -inf and +inf are allowed
+	- * matches every hash
+	Terms next to each other must all match, | matches either side, a term
+	preceded by - excludes the hashes it matches and parentheses group
+	terms. Words are scored with TF-IDF, the other terms add nothing.
+*/
+
+const (
+	searchQueryAll = iota
+	searchQueryTerm
+	searchQueryPrefix
+	searchQueryTag
+	searchQueryRange
+	searchQueryAnd
+	searchQueryOr
+	searchQueryNot
+)
+
+type searchQuery struct {
+	op       int
+	field    string   // empty to search every TEXT field
+	values   []string // the word or the tags
+	min, max ZScoreBound
+	children []*searchQuery
+}
+
+type searchQueryParser struct {
+	query []byte
+	pos   int
+	field string // of the enclosing @field:(...) group
+}
+
+func parseSearchQuery(query []byte) (*searchQuery, error) {
+	p := &searchQueryParser{
+		query: query,
+	}
+
+	q, err := p.union()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.skipSpaces(); p.pos < len(p.query) {
+		return nil, errSearchSyntax
+	}
+
+	return q, nil
+}
+
+// isSearchQuerySpace reports whether c separates terms, that is it is
+// neither part of a word nor special
+func isSearchQuerySpace(c byte) bool {
+	return !isSearchQueryWordByte(c) && strings.IndexByte("()|-@{}[]*", c) < 0
+}
+
+func isSearchQueryWordByte(c byte) bool {
+	return c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func (p *searchQueryParser) skipSpaces() {
+	for p.pos < len(p.query) && isSearchQuerySpace(p.query[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *searchQueryParser) union() (*searchQuery, error) {
+	q, err := p.intersection()
+	if err != nil {
+		return nil, err
+	}
+
+	union := &searchQuery{
+		op:       searchQueryOr,
+		children: []*searchQuery{q},
+	}
+	for p.skipSpaces(); p.pos < len(p.query) && p.query[p.pos] == '|'; p.skipSpaces() {
+		p.pos++
+
+		if q, err = p.intersection(); err != nil {
+			return nil, err
+		}
+		union.children = append(union.children, q)
+	}
+
+	if len(union.children) == 1 {
+		return union.children[0], nil
+	}
+
+	return union, nil
+}
+
+func (p *searchQueryParser) intersection() (*searchQuery, error) {
+	intersection := &searchQuery{
+		op: searchQueryAnd,
+	}
+	for p.skipSpaces(); p.pos < len(p.query) && p.query[p.pos] != '|' && p.query[p.pos] != ')'; p.skipSpaces() {
+		q, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		intersection.children = append(intersection.children, q)
+	}
+
+	switch len(intersection.children) {
+	case 0:
+		return nil, errSearchSyntax
+	case 1:
+		return intersection.children[0], nil
+	}
+
+	return intersection, nil
+}
+
+func (p *searchQueryParser) unary() (*searchQuery, error) {
+	if p.query[p.pos] != '-' {
+		return p.atom()
+	}
+
+	p.pos++
+	if p.pos == len(p.query) {
+		return nil, errSearchSyntax
+	}
+
+	q, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	return &searchQuery{
+		op:       searchQueryNot,
+		children: []*searchQuery{q},
+	}, nil
+}
+
+func (p *searchQueryParser) atom() (*searchQuery, error) {
+	switch c := p.query[p.pos]; {
+	case c == '(':
+		p.pos++
+
+		q, err := p.union()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.pos == len(p.query) || p.query[p.pos] != ')' {
+			return nil, errSearchSyntax
+		}
+		p.pos++
+
+		return q, nil
+	case c == '*':
+		p.pos++
+
+		return &searchQuery{
+			op: searchQueryAll,
+		}, nil
+	case c == '@':
+		return p.fieldTerm()
+	case isSearchQueryWordByte(c):
+		return p.word()
+	}
+
+	return nil, errSearchSyntax
+}
+
+// fieldTerm parses the terms starting with @field:
+func (p *searchQueryParser) fieldTerm() (*searchQuery, error) {
+	end := bytes.IndexByte(p.query[p.pos:], ':')
+	if end < 2 {
+		return nil, errSearchSyntax
+	}
+
+	field := string(p.query[p.pos+1 : p.pos+end])
+	p.pos += end + 1
+	if p.skipSpaces(); p.pos == len(p.query) {
+		return nil, errSearchSyntax
+	}
+
+	switch c := p.query[p.pos]; {
+	case c == '{':
+		tags, err := p.tags()
+		if err != nil {
+			return nil, err
+		}
+
+		return &searchQuery{
+			op:     searchQueryTag,
+			field:  field,
+			values: tags,
+		}, nil
+	case c == '[':
+		end := bytes.IndexByte(p.query[p.pos:], ']')
+		if end < 0 {
+			return nil, errSearchSyntax
+		}
+
+		bounds := strings.Fields(strings.ReplaceAll(string(p.query[p.pos+1:p.pos+end]), ",", " "))
+		p.pos += end + 1
+		if len(bounds) != 2 {
+			return nil, errSearchSyntax
+		}
+
+		q := &searchQuery{
+			op:    searchQueryRange,
+			field: field,
+		}
+
+		var err error
+		if q.min, err = ParseZScoreBound([]byte(bounds[0])); err != nil {
+			return nil, errSearchSyntax
+		}
+		if q.max, err = ParseZScoreBound([]byte(bounds[1])); err != nil {
+			return nil, errSearchSyntax
+		}
+
+		return q, nil
+	case c == '(' || isSearchQueryWordByte(c):
+		enclosing := p.field
+		p.field = field
+		defer func() {
+			p.field = enclosing
+		}()
+
+		return p.atom()
+	}
+
+	return nil, errSearchSyntax
+}
+
+// tags parses {tag | tag ...}, \ escaping the next byte
+func (p *searchQueryParser) tags() ([]string, error) {
+	tags := []string{}
+	tag := []byte{}
+	for p.pos++; p.pos < len(p.query); p.pos++ {
+		switch c := p.query[p.pos]; c {
+		case '\\':
+			if p.pos++; p.pos < len(p.query) {
+				tag = append(tag, p.query[p.pos])
+			}
+		case '|', '}':
+			if trimmed := strings.TrimSpace(string(tag)); trimmed != "" {
+				tags = append(tags, trimmed)
+			}
+			tag = tag[:0]
+
+			if c == '}' {
+				p.pos++
+				if len(tags) == 0 {
+					return nil, errSearchSyntax
+				}
+
+				return tags, nil
+			}
+		default:
+			tag = append(tag, c)
+		}
+	}
+
+	return nil, errSearchSyntax
+}
+
+// word parses a word, maybe followed by * to search for a prefix
+func (p *searchQueryParser) word() (*searchQuery, error) {
+	start := p.pos
+	for p.pos < len(p.query) && isSearchQueryWordByte(p.query[p.pos]) {
+		p.pos++
+	}
+
+	terms := searchTokens(p.query[start:p.pos])
+	if len(terms) == 0 {
+		return nil, errSearchSyntax
+	}
+
+	prefix := p.pos < len(p.query) && p.query[p.pos] == '*'
+	if prefix {
+		p.pos++
+	}
+
+	intersection := &searchQuery{
+		op: searchQueryAnd,
+	}
+	for i, term := range terms {
+		q := &searchQuery{
+			op:     searchQueryTerm,
+			field:  p.field,
+			values: []string{term},
+		}
+		if prefix && i == len(terms)-1 {
+			q.op = searchQueryPrefix
+		}
+
+		intersection.children = append(intersection.children, q)
+	}
+
+	if len(intersection.children) == 1 {
+		return intersection.children[0], nil
+	}
+
+	return intersection, nil
+}
+
+// searchResults are the scores of the matching hashes by hashed key
+type searchResults map[[32]byte]float64
+
+type searchEval struct {
+	idx  *searchIndex
+	tree *alg.BTree
+	docs int
+}
+
+func searchResultKey(key []byte) [32]byte {
+	var hashedKey [32]byte
+	copy(hashedKey[:], key[len(key)-len(hashedKey):])
+
+	return hashedKey
+}
+
+func (e *searchEval) eval(q *searchQuery) (searchResults, error) {
+	switch q.op {
+	case searchQueryAll:
+		return e.all()
+	case searchQueryTerm, searchQueryPrefix:
+		return e.words(q)
+	case searchQueryTag:
+		return e.tags(q)
+	case searchQueryRange:
+		return e.numbers(q)
+	case searchQueryOr:
+		results := searchResults{}
+		for _, child := range q.children {
+			childResults, err := e.eval(child)
+			if err != nil {
+				return nil, err
+			}
+
+			for hashedKey, score := range childResults {
+				results[hashedKey] += score
+			}
+		}
+
+		return results, nil
+	case searchQueryNot:
+		return e.intersect([]*searchQuery{q})
+	}
+
+	return e.intersect(q.children)
+}
+
+// intersect returns the hashes matching every query, evaluating the
+// negated ones last to only remove their matches
+func (e *searchEval) intersect(queries []*searchQuery) (searchResults, error) {
+	var results searchResults
+	for _, q := range queries {
+		if q.op == searchQueryNot {
+			continue
+		}
+
+		childResults, err := e.eval(q)
+		if err != nil {
+			return nil, err
+		}
+
+		if results == nil {
+			results = childResults
+			continue
+		}
+
+		for hashedKey, score := range results {
+			if childScore, ok := childResults[hashedKey]; ok {
+				results[hashedKey] = score + childScore
+			} else {
+				delete(results, hashedKey)
+			}
+		}
+	}
+
+	if results == nil {
+		var err error
+		if results, err = e.all(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, q := range queries {
+		if q.op != searchQueryNot || len(results) == 0 {
+			continue
+		}
+
+		excluded, err := e.eval(q.children[0])
+		if err != nil {
+			return nil, err
+		}
+
+		for hashedKey := range excluded {
+			delete(results, hashedKey)
+		}
+	}
+
+	return results, nil
+}
+
+func (e *searchEval) all() (searchResults, error) {
+	results := searchResults{}
+	prefix := []byte{searchDocPrefix}
+	err := scanSearchTree(e.tree, prefix, prefix, func(key, value []byte) bool {
+		results[searchResultKey(key)] = 0
+
+		return true
+	})
+
+	return results, err
+}
+
+// field returns the field of the index named name, checking its type
+func (e *searchEval) field(name, typ string) (SearchField, error) {
+	field, ok := e.idx.field(name)
+	if !ok {
+		return field, fmt.Errorf("ERR Unknown field `%s`", name)
+	}
+
+	if field.Type != typ {
+		return field, fmt.Errorf("ERR Field `%s` is not a %s field", name, typ)
+	}
+
+	return field, nil
+}
+
+func (e *searchEval) words(q *searchQuery) (searchResults, error) {
+	fields := []SearchField{}
+	if q.field == "" {
+		for _, field := range e.idx.meta.Fields {
+			if field.Type == SearchText {
+				fields = append(fields, field)
+			}
+		}
+	} else {
+		field, err := e.field(q.field, SearchText)
+		if err != nil {
+			return nil, err
+		}
+
+		fields = append(fields, field)
+	}
+
+	results := searchResults{}
+	for _, field := range fields {
+		prefix := append(searchFieldKey(searchTermPrefix, field.Name), q.values[0]...)
+		if q.op == searchQueryTerm {
+			prefix = append(prefix, 0)
+		}
+
+		frequencies := map[[32]byte]uint32{}
+		err := scanSearchTree(e.tree, prefix, prefix, func(key, value []byte) bool {
+			if len(value) == 4 {
+				frequencies[searchResultKey(key)] += binary.BigEndian.Uint32(value)
+			}
+
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(frequencies) == 0 {
+			continue
+		}
+
+		idf := math.Log(1 + float64(e.docs)/float64(len(frequencies)))
+		for hashedKey, frequency := range frequencies {
+			results[hashedKey] += field.Weight * float64(frequency) * idf
+		}
+	}
+
+	return results, nil
+}
+
+func (e *searchEval) tags(q *searchQuery) (searchResults, error) {
+	field, err := e.field(q.field, SearchTag)
+	if err != nil {
+		return nil, err
+	}
+
+	results := searchResults{}
+	for _, tag := range q.values {
+		if !field.CaseSensitive {
+			tag = strings.ToLower(tag)
+		}
+
+		prefix := append(searchFieldKey(searchTagPrefix, field.Name), tag...)
+		prefix = append(prefix, 0)
+		err := scanSearchTree(e.tree, prefix, prefix, func(key, value []byte) bool {
+			results[searchResultKey(key)] = 0
+
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func (e *searchEval) numbers(q *searchQuery) (searchResults, error) {
+	field, err := e.field(q.field, SearchNumeric)
+	if err != nil {
+		return nil, err
+	}
+
+	results := searchResults{}
+	prefix := searchFieldKey(searchNumericPrefix, field.Name)
+	start := append(append([]byte{}, prefix...), encodeScore(q.min.Value)...)
+	err = scanSearchTree(e.tree, prefix, start, func(key, value []byte) bool {
+		number := decodeScore(key[len(prefix) : len(prefix)+8])
+		if number > q.max.Value || (q.max.Exclusive && number == q.max.Value) {
+			return false
+		}
+
+		if !q.min.Exclusive || number != q.min.Value {
+			results[searchResultKey(key)] = 0
+		}
+
+		return true
+	})
+
+	return results, err
+}
+
+type FTSearchArgs struct {
+	Query      []byte
+	NoContent  bool
+	WithScores bool
+	Return     [][]byte // nil to return every field
+	SortBy     string
+	SortDesc   bool
+	Offset     int
+	Num        int
+	Params     map[string][]byte
+}
+
+// ParseFTSearchArgs parses the arguments of FT.SEARCH following the index
+// name: query [NOCONTENT] [WITHSCORES] [RETURN count field...]
+// [SORTBY field [ASC|DESC]] [LIMIT offset num] [PARAMS count name value...]
+// [DIALECT dialect]
+func ParseFTSearchArgs(args [][]byte) (*FTSearchArgs, error) {
+	if len(args) == 0 {
+		return nil, ErrSyntax
+	}
+
+	result := &FTSearchArgs{
+		Query:  args[0],
+		Num:    10,
+		Params: map[string][]byte{},
+	}
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NOCONTENT":
+			result.NoContent = true
+		case "WITHSCORES":
+			result.WithScores = true
+		case "RETURN":
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+
+			count, err := ParseInt(args[i+1])
+			if err != nil || count < 0 || count > int64(len(args)-i-2) {
+				return nil, ErrSyntax
+			}
+
+			result.Return = append([][]byte{}, args[i+2:i+2+int(count)]...)
+			i += 1 + int(count)
+		case "SORTBY":
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+
+			result.SortBy = string(args[i+1])
+			i++
+
+			if i+1 < len(args) {
+				switch strings.ToUpper(string(args[i+1])) {
+				case "ASC":
+					i++
+				case "DESC":
+					result.SortDesc = true
+					i++
+				}
+			}
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return nil, ErrSyntax
+			}
+
+			offset, err := ParseInt(args[i+1])
+			if err != nil || offset < 0 {
+				return nil, ErrSyntax
+			}
+
+			num, err := ParseInt(args[i+2])
+			if err != nil || num < 0 {
+				return nil, ErrSyntax
+			}
+
+			result.Offset, result.Num = int(offset), int(num)
+			i += 2
+		case "PARAMS":
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+
+			count, err := ParseInt(args[i+1])
+			if err != nil || count < 0 || count%2 != 0 || count > int64(len(args)-i-2) {
+				return nil, ErrSyntax
+			}
+
+			params := args[i+2 : i+2+int(count)]
+			for j := 0; j < len(params); j += 2 {
+				result.Params[string(params[j])] = params[j+1]
+			}
+			i += 1 + int(count)
+		case "DIALECT":
+			// every dialect is parsed the same way
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+
+			if _, err := ParseInt(args[i+1]); err != nil {
+				return nil, ErrSyntax
+			}
+			i++
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if len(result.Return) == 0 && result.Return != nil {
+		result.NoContent = true
+	}
+
+	return result, nil
+}
+
+type SearchMatch struct {
+	Key    []byte
+	Score  float64
+	Fields [][]byte // names and values interleaved
+
+	hashedKey [32]byte
+	sortValue []byte // nil if the hash has no SORTBY field
+}
+
+// FTSearch runs a query, returning the total number of matches and the
+// requested page of them. The matches of a KNN query are scored with their
+// distance, closest first, and the distance is returned as a field too.
+func FTSearch(dbNum int, name []byte, args *FTSearchArgs) (int, []SearchMatch, error) {
+	query := args.Query
+	var knn *searchKNN
+	if i := bytes.Index(query, []byte("=>")); i >= 0 {
+		var err error
+		if knn, err = parseSearchKNN(query[i+2:], args.Params); err != nil {
+			return 0, nil, err
+		}
+
+		query = query[:i]
+	}
+
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	idx, ok := searchIndexes[dbNum][string(name)]
+	if !ok {
+		return 0, nil, errSearchUnknownIndex
+	}
+
+	var sortBy SearchField
+	if args.SortBy != "" && (knn == nil || args.SortBy != knn.alias) {
+		if sortBy, ok = idx.field(args.SortBy); !ok {
+			return 0, nil, fmt.Errorf("ERR Property `%s` not loaded nor in schema", args.SortBy)
+		}
+	}
+
+	idx.treeMu.Lock()
+	defer idx.treeMu.Unlock()
+
+	tree, err := idx.openTree()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	e := &searchEval{
+		idx:  idx,
+		tree: tree,
+	}
+	if e.docs, err = searchDocCount(tree); err != nil {
+		return 0, nil, err
+	}
+
+	// KNN queries without a filter do not need the list of every key
+	var results searchResults
+	if knn == nil || q.op != searchQueryAll {
+		if results, err = e.eval(q); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	var matches []SearchMatch
+	if knn != nil {
+		if matches, err = idx.knn(knn, results); err != nil {
+			return 0, nil, err
+		}
+	} else {
+		matches = make([]SearchMatch, 0, len(results))
+		for hashedKey, score := range results {
+			matches = append(matches, SearchMatch{
+				Score:     score,
+				hashedKey: hashedKey,
+			})
+		}
+	}
+
+	if knn != nil && (args.SortBy == "" || args.SortBy == knn.alias) {
+		if args.SortDesc {
+			for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+				matches[i], matches[j] = matches[j], matches[i]
+			}
+		}
+	} else if args.SortBy == "" {
+		sort.Slice(matches, func(i, j int) bool {
+			if matches[i].Score != matches[j].Score {
+				return matches[i].Score > matches[j].Score
+			}
+
+			return bytes.Compare(matches[i].hashedKey[:], matches[j].hashedKey[:]) < 0
+		})
+	} else if err := idx.sortMatches(matches, sortBy, args.SortDesc); err != nil {
+		return 0, nil, err
+	}
+
+	page := []SearchMatch{}
+	if args.Offset < len(matches) {
+		page = matches[args.Offset:]
+		if len(page) > args.Num {
+			page = page[:args.Num]
+		}
+	}
+
+	for i := range page {
+		if err := idx.loadMatch(&page[i], args); err != nil {
+			return 0, nil, err
+		}
+
+		if knn != nil && page[i].Fields != nil && (args.Return == nil || searchReturns(args.Return, knn.alias)) {
+			distance := strconv.FormatFloat(page[i].Score, 'g', -1, 32)
+			page[i].Fields = append([][]byte{[]byte(knn.alias), []byte(distance)}, page[i].Fields...)
+		}
+	}
+
+	return len(matches), page, nil
+}
+
+func searchReturns(fields [][]byte, name string) bool {
+	for _, field := range fields {
+		if string(field) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sortMatches sorts the matches by the value of a field, the hashes
+// without it coming last. The caller must hold at least cache.FSRWL.RLock.
+func (idx *searchIndex) sortMatches(matches []SearchMatch, field SearchField, desc bool) error {
+	for i := range matches {
+		keyName, _, err := idx.readDoc(matches[i].hashedKey[:])
+		if err != nil {
+			return err
+		}
+		if keyName == nil {
+			continue
+		}
+
+		matches[i].Key = keyName
+		if matches[i].sortValue, err = idx.fieldValue(cache.NewKey(idx.db, keyName), field.Name); err != nil {
+			return err
+		}
+	}
+
+	compare := func(a, b []byte) int {
+		if field.Type == SearchNumeric {
+			x, xErr := ParseFloat(a)
+			y, yErr := ParseFloat(b)
+			if xErr == nil && yErr == nil {
+				switch {
+				case x < y:
+					return -1
+				case x > y:
+					return 1
+				}
+
+				return 0
+			}
+		}
+
+		return bytes.Compare(a, b)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i].sortValue, matches[j].sortValue
+		if (a == nil) != (b == nil) {
+			return b == nil
+		}
+
+		if c := compare(a, b); c != 0 {
+			return (c < 0) != desc
+		}
+
+		return bytes.Compare(matches[i].hashedKey[:], matches[j].hashedKey[:]) < 0
+	})
+
+	return nil
+}
+
+// loadMatch reads the name and the requested fields of a matching hash.
+// The caller must hold at least cache.FSRWL.RLock.
+func (idx *searchIndex) loadMatch(match *SearchMatch, args *FTSearchArgs) error {
+	if match.Key == nil {
+		keyName, _, err := idx.readDoc(match.hashedKey[:])
+		if err != nil {
+			return err
+		}
+		match.Key = keyName
+	}
+
+	if args.NoContent || match.Key == nil {
+		return nil
+	}
+
+	key := cache.NewKey(idx.db, match.Key)
+	match.Fields = [][]byte{}
+
+	if args.Return != nil {
+		for _, field := range args.Return {
+			if _, ok := idx.field(string(field)); !ok && idx.meta.On == SearchOnString {
+				continue
+			}
+
+			value, err := idx.fieldValue(key, string(field))
+			if err != nil {
+				return err
+			}
+
+			if value != nil {
+				match.Fields = append(match.Fields, field, value)
+			}
+		}
+
+		return nil
+	}
+
+	if idx.meta.On == SearchOnString {
+		// the values are returned with GET
+		return nil
+	}
+
+	names, err := hashFieldNames(key)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		field, value, err := readHashField(filepath.Join(hashFieldsDir(key), name), true)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		match.Fields = append(match.Fields, field, value)
+	}
+
+	return nil
+}
@@ -0,0 +1,404 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	The VECTOR fields of a search index hold float32 blobs, little endian
+	like the ones RediSearch takes. Each field keeps its vectors in an
+	alg.VectorFile in the index dir, kept open, and the slot of every
+	indexed key in memory. The FLAT fields are searched scanning the whole
+	file, the HNSW ones through an alg.HNSW graph, built in memory when
+	the index is loaded at startup. KNN queries with a filter scan the
+	vectors of the matching keys only.
+*/
+
+const (
+	searchVectorFlat = "FLAT"
+	searchVectorHNSW = "HNSW"
+
+	searchDefaultM              = 16
+	searchDefaultEFConstruction = 200
+	searchDefaultEFRuntime      = 10
+)
+
+var errSearchVectorType = errors.New("ERR Only FLOAT32 vectors are supported")
+
+type searchVectors struct {
+	file  *alg.VectorFile
+	slots map[[32]byte]uint32
+	free  []uint32
+	graph *alg.HNSW // HNSW fields only
+}
+
+// parseSearchVectorField parses "FLAT|HNSW count attribute value..."
+// following the VECTOR type in a schema, returning how many arguments
+// it used
+func parseSearchVectorField(field *SearchField, args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, ErrSyntax
+	}
+
+	field.Algorithm = strings.ToUpper(string(args[0]))
+	if field.Algorithm != searchVectorFlat && field.Algorithm != searchVectorHNSW {
+		return 0, fmt.Errorf("ERR Bad arguments for vector similarity algorithm: `%s`", args[0])
+	}
+
+	count, err := ParseInt(args[1])
+	if err != nil || count < 0 || count%2 != 0 || count > int64(len(args)-2) {
+		return 0, ErrSyntax
+	}
+
+	if field.Algorithm == searchVectorHNSW {
+		field.M = searchDefaultM
+		field.EFConstruction = searchDefaultEFConstruction
+		field.EFRuntime = searchDefaultEFRuntime
+	}
+
+	attributes := args[2 : 2+count]
+	for i := 0; i < len(attributes); i += 2 {
+		attribute, value := strings.ToUpper(string(attributes[i])), attributes[i+1]
+
+		switch attribute {
+		case "TYPE":
+			if strings.ToUpper(string(value)) != "FLOAT32" {
+				return 0, errSearchVectorType
+			}
+		case "DISTANCE_METRIC":
+			field.DistanceMetric = strings.ToUpper(string(value))
+			if field.DistanceMetric != alg.VectorL2 && field.DistanceMetric != alg.VectorIP &&
+				field.DistanceMetric != alg.VectorCosine {
+				return 0, fmt.Errorf("ERR Bad arguments for vector similarity metric: `%s`", value)
+			}
+		case "DIM", "INITIAL_CAP", "BLOCK_SIZE", "M", "EF_CONSTRUCTION", "EF_RUNTIME":
+			n, err := ParseInt(value)
+			if err != nil || n < 1 || n > 1<<20 {
+				return 0, fmt.Errorf("ERR Bad arguments for vector similarity attribute `%s`", attribute)
+			}
+
+			switch {
+			case attribute == "DIM":
+				field.Dim = int(n)
+			case attribute == "M" && field.Algorithm == searchVectorHNSW && n > 1:
+				field.M = int(n)
+			case attribute == "EF_CONSTRUCTION" && field.Algorithm == searchVectorHNSW:
+				field.EFConstruction = int(n)
+			case attribute == "EF_RUNTIME" && field.Algorithm == searchVectorHNSW:
+				field.EFRuntime = int(n)
+			case attribute == "INITIAL_CAP" || attribute == "BLOCK_SIZE":
+				// the file grows as needed
+			default:
+				return 0, fmt.Errorf("ERR Bad arguments for vector similarity attribute `%s`", attribute)
+			}
+		case "EPSILON":
+			// range queries are not supported
+		default:
+			return 0, fmt.Errorf("ERR Bad arguments for vector similarity attribute `%s`", attribute)
+		}
+	}
+
+	if field.Dim == 0 || field.DistanceMetric == "" {
+		return 0, errors.New("ERR Missing mandatory parameter: cannot create vector index without specifying TYPE, DIM and DISTANCE_METRIC")
+	}
+
+	return 2 + int(count), nil
+}
+
+func (idx *searchIndex) vectorFilePath(field SearchField) string {
+	return filepath.Join(idx.dir, "vectors-"+hex.EncodeToString([]byte(field.Name)))
+}
+
+// openVectors opens the vector files of the VECTOR fields, building
+// their graphs. The caller must hold cache.FSRWL.Lock.
+func (idx *searchIndex) openVectors() error {
+	idx.vectors = map[string]*searchVectors{}
+
+	for _, field := range idx.meta.Fields {
+		if field.Type != SearchVector {
+			continue
+		}
+
+		file, err := alg.OpenVectorFile(idx.vectorFilePath(field), field.Dim)
+		if err != nil {
+			idx.closeVectors()
+			return err
+		}
+
+		v := &searchVectors{
+			file:  file,
+			slots: map[[32]byte]uint32{},
+		}
+		if field.Algorithm == searchVectorHNSW {
+			v.graph = alg.NewHNSW(field.DistanceMetric, field.M, field.EFConstruction)
+		}
+		idx.vectors[field.Name] = v
+
+		used := make([]bool, file.Slots())
+		err = file.Scan(func(slot uint32, id [32]byte, vector []float32) bool {
+			v.slots[id] = slot
+			used[slot] = true
+
+			if v.graph != nil {
+				v.graph.Add(id, vector)
+			}
+
+			return true
+		})
+		if err != nil {
+			idx.closeVectors()
+			return err
+		}
+
+		for slot, isUsed := range used {
+			if !isUsed {
+				v.free = append(v.free, uint32(slot))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (idx *searchIndex) closeVectors() error {
+	var err error
+	for _, v := range idx.vectors {
+		if closeErr := v.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	idx.vectors = nil
+
+	return err
+}
+
+// set stores the vector of the key hashed as id.
+// The caller must hold cache.FSRWL.Lock.
+func (v *searchVectors) set(id [32]byte, vector []float32) error {
+	slot, ok := v.slots[id]
+	if !ok {
+		if len(v.free) > 0 {
+			slot = v.free[len(v.free)-1]
+			v.free = v.free[:len(v.free)-1]
+		} else {
+			slot = v.file.Slots()
+		}
+	}
+
+	if err := v.file.Write(slot, id, vector); err != nil {
+		return err
+	}
+	v.slots[id] = slot
+
+	if v.graph != nil {
+		v.graph.Add(id, vector)
+	}
+
+	return nil
+}
+
+// remove forgets the vector of the key hashed as id, if any.
+// The caller must hold cache.FSRWL.Lock.
+func (v *searchVectors) remove(id [32]byte) error {
+	slot, ok := v.slots[id]
+	if !ok {
+		return nil
+	}
+
+	if err := v.file.Free(slot); err != nil {
+		return err
+	}
+
+	delete(v.slots, id)
+	v.free = append(v.free, slot)
+
+	if v.graph != nil {
+		v.graph.Remove(id)
+	}
+
+	return nil
+}
+
+// nearest returns the k vectors closest to query among the ones of the
+// keys in filter, or among all of them if filter is nil.
+// The caller must hold at least cache.FSRWL.RLock.
+func (v *searchVectors) nearest(field SearchField, query []float32, k, ef int, filter searchResults) ([]alg.VectorResult, error) {
+	if filter == nil && v.graph != nil {
+		return v.graph.Search(query, k, ef), nil
+	}
+
+	distance := alg.VectorDistance(field.DistanceMetric)
+	nearest := alg.NewNearestVectors(k)
+
+	if filter == nil {
+		err := v.file.Scan(func(slot uint32, id [32]byte, vector []float32) bool {
+			nearest.Add(id, distance(query, vector))
+
+			return true
+		})
+
+		return nearest.Results(), err
+	}
+
+	for id := range filter {
+		slot, ok := v.slots[id]
+		if !ok {
+			continue
+		}
+
+		vector, err := v.file.Read(slot)
+		if err != nil {
+			return nil, err
+		}
+
+		if vector != nil {
+			nearest.Add(id, distance(query, vector))
+		}
+	}
+
+	return nearest.Results(), nil
+}
+
+type searchKNN struct {
+	k     int
+	field string
+	blob  []byte
+	ef    int
+	alias string
+}
+
+// parseSearchKNN parses the [KNN k @field $blob [EF_RUNTIME ef] [AS alias]]
+// clause following => in a query, k and ef can be parameters too
+func parseSearchKNN(clause []byte, params map[string][]byte) (*searchKNN, error) {
+	clause = bytes.TrimSpace(clause)
+	if len(clause) < 2 || clause[0] != '[' || clause[len(clause)-1] != ']' {
+		return nil, errSearchSyntax
+	}
+
+	param := func(s string) ([]byte, error) {
+		if !strings.HasPrefix(s, "$") {
+			return []byte(s), nil
+		}
+
+		value, ok := params[s[1:]]
+		if !ok {
+			return nil, fmt.Errorf("ERR No such parameter `%s`", s[1:])
+		}
+
+		return value, nil
+	}
+
+	args := strings.Fields(string(clause[1 : len(clause)-1]))
+	if len(args) < 4 || strings.ToUpper(args[0]) != "KNN" || !strings.HasPrefix(args[2], "@") ||
+		!strings.HasPrefix(args[3], "$") {
+		return nil, errSearchSyntax
+	}
+
+	k, err := param(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	knn := &searchKNN{
+		field: args[2][1:],
+		alias: "__" + args[2][1:] + "_score",
+	}
+
+	n, err := strconv.Atoi(string(k))
+	if err != nil || n < 0 {
+		return nil, errSearchSyntax
+	}
+	knn.k = n
+
+	if knn.blob, err = param(args[3]); err != nil {
+		return nil, err
+	}
+
+	for i := 4; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, errSearchSyntax
+		}
+
+		switch strings.ToUpper(args[i]) {
+		case "EF_RUNTIME":
+			ef, err := param(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+
+			if knn.ef, err = strconv.Atoi(string(ef)); err != nil || knn.ef < 1 {
+				return nil, errSearchSyntax
+			}
+		case "AS":
+			knn.alias = args[i+1]
+		default:
+			return nil, errSearchSyntax
+		}
+	}
+
+	return knn, nil
+}
+
+// knn returns the matches of a KNN query, closest first, among the
+// results of its filter or every key if filter is nil.
+// The caller must hold at least cache.FSRWL.RLock.
+func (idx *searchIndex) knn(knn *searchKNN, filter searchResults) ([]SearchMatch, error) {
+	field, ok := idx.field(knn.field)
+	if !ok {
+		return nil, fmt.Errorf("ERR Unknown field `%s`", knn.field)
+	}
+	if field.Type != SearchVector {
+		return nil, fmt.Errorf("ERR Field `%s` is not a %s field", knn.field, SearchVector)
+	}
+
+	query := alg.DecodeVector(knn.blob, field.Dim)
+	if query == nil {
+		return nil, fmt.Errorf("ERR Error parsing vector similarity query: query vector blob size (%d) does not match index's expected size (%d).", len(knn.blob), 4*field.Dim)
+	}
+
+	ef := knn.ef
+	if ef == 0 {
+		ef = field.EFRuntime
+	}
+
+	results, err := idx.vectors[field.Name].nearest(field, query, knn.k, ef, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]SearchMatch, len(results))
+	for i, result := range results {
+		matches[i] = SearchMatch{
+			Score:     float64(result.Distance),
+			hashedKey: result.ID,
+		}
+	}
+
+	return matches, nil
+}
@@ -0,0 +1,903 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	A set is a dir holding one file per member, spread over two levels of
+	subdirs the same way keys are: the member file is named after the sha256
+	of the member and lives in members/FIRST_BYTE_OF_SHA/SECOND_BYTE_OF_SHA.
+	Checking a member is a single stat, no matter how big the set is.
+	The file contains the member itself, the cardinality of the set is kept
+	in the card file so that SCARD doesn't have to count the members.
+*/
+
+const (
+	setMembersDirName = "members"
+	setCardFileName   = "card"
+)
+
+type set struct {
+	key alg.Key
+	dir string // the dir of the set, usually key.FilePath()
+}
+
+// loadSet returns the set at key, nil if the key does not exist.
+// The caller must hold at least cache.FSRWL.RLock.
+func loadSet(key alg.Key) (*set, error) {
+	found, err := checkType(key, TypeSet)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &set{
+		key: key,
+		dir: key.FilePath(),
+	}, nil
+}
+
+// loadOrCreateSet returns the set at key, creating it if needed.
+// The caller must hold cache.FSRWL.Lock.
+func loadOrCreateSet(key alg.Key) (*set, error) {
+	s, err := loadSet(key)
+	if err != nil || s != nil {
+		return s, err
+	}
+
+	err = createTyped(key, TypeSet, func(dir string) error {
+		empty := &set{
+			key: key,
+			dir: dir,
+		}
+
+		return empty.setCard(0)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &set{
+		key: key,
+		dir: key.FilePath(),
+	}, nil
+}
+
+// newTempSet creates an empty set to be moved to key by storeAt.
+// The caller must hold cache.FSRWL.Lock.
+func newTempSet(key alg.Key) (*set, error) {
+	dir, err := createTempTyped(TypeSet)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &set{
+		key: key,
+		dir: dir,
+	}
+
+	return s, s.setCard(0)
+}
+
+// storeAt replaces whatever is at key with the temp set s, or deletes the
+// key if s is empty. The previous value is moved in the trash, the returned
+// path is to be purged once cache.FSRWL is released.
+// The caller must hold cache.FSRWL.Lock.
+func (s *set) storeAt(key alg.Key) (int, string, error) {
+	card, err := s.card()
+	if err != nil {
+		os.RemoveAll(s.dir)
+		return 0, "", err
+	}
+
+	if card == 0 {
+		trashed, err := unlinkKey(key)
+		if err != nil {
+			os.RemoveAll(s.dir)
+			return 0, trashed, err
+		}
+
+		return 0, trashed, os.RemoveAll(s.dir)
+	}
+
+	trashed, err := storeTemp(s.dir, key)
+	if err != nil {
+		return 0, trashed, err
+	}
+
+	s.key, s.dir = key, key.FilePath()
+
+	return card, trashed, nil
+}
+
+func (s *set) memberDir(member alg.Key) string {
+	return filepath.Join(s.dir, setMembersDirName, member.Level(0), member.Level(1))
+}
+
+func (s *set) memberPath(member []byte) string {
+	hashed := cache.NewKey(s.key.DB, member)
+
+	return filepath.Join(s.memberDir(hashed), hashed.Encode())
+}
+
+func (s *set) card() (int, error) {
+	content, err := os.ReadFile(filepath.Join(s.dir, setCardFileName))
+	if err != nil {
+		return 0, err
+	}
+	if len(content) != 8 {
+		return 0, fmt.Errorf("corrupted set card file for key %s", s.key.Encode())
+	}
+
+	return int(binary.BigEndian.Uint64(content)), nil
+}
+
+func (s *set) setCard(card int) error {
+	content := make([]byte, 8)
+	binary.BigEndian.PutUint64(content, uint64(card))
+
+	return os.WriteFile(filepath.Join(s.dir, setCardFileName), content, 0600)
+}
+
+func (s *set) has(member []byte) (bool, error) {
+	if _, err := os.Lstat(s.memberPath(member)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// add adds members to the set, returning how many of them were new
+func (s *set) add(members ...[]byte) (int, error) {
+	added := 0
+	for _, member := range members {
+		hashed := cache.NewKey(s.key.DB, member)
+		path := filepath.Join(s.memberDir(hashed), hashed.Encode())
+
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+
+		if err := os.MkdirAll(s.memberDir(hashed), 0700); err != nil {
+			return added, err
+		}
+
+		if err := os.WriteFile(path, member, 0600); err != nil {
+			return added, err
+		}
+
+		added++
+	}
+
+	if added == 0 {
+		return 0, nil
+	}
+
+	card, err := s.card()
+	if err != nil {
+		return added, err
+	}
+
+	return added, s.setCard(card + added)
+}
+
+// remove removes members from the set, returning how many of them were
+// there. The set is deleted once empty.
+func (s *set) remove(members ...[]byte) (int, error) {
+	removed := 0
+	for _, member := range members {
+		hashed := cache.NewKey(s.key.DB, member)
+		dir := s.memberDir(hashed)
+
+		if err := os.Remove(filepath.Join(dir, hashed.Encode())); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+
+		removed++
+
+		// the dirs left empty would only slow down random, removing a
+		// dir that is not empty fails
+		if os.Remove(dir) == nil {
+			os.Remove(filepath.Dir(dir))
+		}
+	}
+
+	if removed == 0 {
+		return 0, nil
+	}
+
+	card, err := s.card()
+	if err != nil {
+		return removed, err
+	}
+
+	if card-removed <= 0 {
+		_, err := removeKey(s.key)
+		return removed, err
+	}
+
+	return removed, s.setCard(card - removed)
+}
+
+// iterate calls fn on every member, in the order of their sha256,
+// until fn returns false
+func (s *set) iterate(fn func(member []byte) bool) error {
+	errStop := fmt.Errorf("stop")
+
+	err := filepath.WalkDir(filepath.Join(s.dir, setMembersDirName), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !isHashedName(d.Name()) {
+			return nil
+		}
+
+		member, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !fn(member) {
+			return errStop
+		}
+
+		return nil
+	})
+	if err == errStop || os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// random returns a random member without walking the whole set, nil if
+// the set is empty. The distribution is only roughly uniform.
+func (s *set) random() ([]byte, error) {
+	return randomMember(filepath.Join(s.dir, setMembersDirName), 0)
+}
+
+// randomMember returns a random member file found under dir, the members
+// dir of a set or one of its subdirs at depth level, or nil if there is
+// none. Subdirs without members are skipped for the others.
+func randomMember(dir string, level int) ([]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, i := range rand.Perm(len(entries)) {
+		name := entries[i].Name()
+
+		if level < 2 {
+			member, err := randomMember(filepath.Join(dir, name), level+1)
+			if err != nil || member != nil {
+				return member, err
+			}
+			continue
+		}
+
+		if isHashedName(name) {
+			return os.ReadFile(filepath.Join(dir, name))
+		}
+	}
+
+	return nil, nil
+}
+
+// scan returns up to count member file paths in hash order, starting at
+// cursor, and the cursor of the following page
+func (s *set) scan(cursor uint64, count int) (uint64, []string, error) {
+	membersDir := filepath.Join(s.dir, setMembersDirName)
+	start0 := fmt.Sprintf("%02x", byte(cursor>>56))
+	start1 := fmt.Sprintf("%02x", byte(cursor>>48))
+
+	level0, err := os.ReadDir(membersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil, nil
+		}
+		return 0, nil, err
+	}
+
+	names := []string{}
+	for _, l0 := range level0 {
+		if l0.Name() < start0 {
+			continue
+		}
+
+		level1, err := os.ReadDir(filepath.Join(membersDir, l0.Name()))
+		if err != nil {
+			return 0, nil, err
+		}
+
+		for _, l1 := range level1 {
+			if l0.Name() == start0 && l1.Name() < start1 {
+				continue
+			}
+
+			entries, err := os.ReadDir(filepath.Join(membersDir, l0.Name(), l1.Name()))
+			if err != nil {
+				return 0, nil, err
+			}
+
+			for _, entry := range entries {
+				if isHashedName(entry.Name()) && hashedNameCursor(entry.Name()) >= cursor {
+					names = append(names, entry.Name())
+				}
+			}
+
+			// one name more than needed gives the next cursor
+			if len(names) > count {
+				next, page := scanPage(names, cursor, count)
+				return next, s.namesToPaths(page), nil
+			}
+		}
+	}
+
+	return 0, s.namesToPaths(names), nil
+}
+
+func (s *set) namesToPaths(names []string) []string {
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		paths = append(paths, filepath.Join(s.dir, setMembersDirName, name[:2], name[2:4], name))
+	}
+
+	return paths
+}
+
+// members returns all the members of the set
+func (s *set) members() ([][]byte, error) {
+	result := [][]byte{}
+	err := s.iterate(func(member []byte) bool {
+		result = append(result, member)
+		return true
+	})
+
+	return result, err
+}
+
+// sample returns count distinct random members, all of them if count
+// is not lower than the cardinality
+func (s *set) sample(count int) ([][]byte, error) {
+	card, err := s.card()
+	if err != nil {
+		return nil, err
+	}
+
+	if count >= card {
+		return s.members()
+	}
+
+	// picking a small share of the set at random is cheap, a big share
+	// would mostly hit members already taken and is better served by a
+	// reservoir pass over the whole set
+	if count*3 < card {
+		seen := make(map[string]struct{}, count)
+		result := make([][]byte, 0, count)
+		for attempts := 0; attempts < count*16 && len(result) < count; attempts++ {
+			member, err := s.random()
+			if err != nil {
+				return nil, err
+			}
+			if member == nil {
+				break
+			}
+
+			if _, ok := seen[string(member)]; ok {
+				continue
+			}
+
+			seen[string(member)] = struct{}{}
+			result = append(result, member)
+		}
+
+		if len(result) == count {
+			return result, nil
+		}
+	}
+
+	result := make([][]byte, 0, count)
+	i := 0
+	err = s.iterate(func(member []byte) bool {
+		if i < count {
+			result = append(result, member)
+		} else if j := rand.Intn(i + 1); j < count {
+			result[j] = member
+		}
+		i++
+
+		return true
+	})
+
+	return result, err
+}
+
+// SAdd adds the members to the set, returning how many of them were new
+func SAdd(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("wrong number of arguments for 'sadd' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, err := loadOrCreateSet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	added, err := s.add(args[1:]...)
+	if added > 0 {
+		touch(key)
+	}
+
+	return added, err
+}
+
+// SRem removes the members from the set, deleting the set once it's empty
+func SRem(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("wrong number of arguments for 'srem' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, err := loadSet(key)
+	if err != nil || s == nil {
+		return 0, err
+	}
+
+	removed, err := s.remove(args[1:]...)
+	if removed > 0 {
+		touch(key)
+	}
+
+	return removed, err
+}
+
+func SIsMember(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 2 {
+		return 0, fmt.Errorf("wrong number of arguments for 'sismember' command")
+	}
+
+	result, err := SMIsMember(dbNum, args)
+	if err != nil {
+		return 0, err
+	}
+
+	return result[0], nil
+}
+
+// SMIsMember returns 1 for every given member in the set, 0 otherwise
+func SMIsMember(dbNum int, args [][]byte) ([]int, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("wrong number of arguments for 'smismember' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := loadSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]int, len(args)-1)
+	if s == nil {
+		return result, nil
+	}
+
+	for i, member := range args[1:] {
+		found, err := s.has(member)
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			result[i] = 1
+		}
+	}
+
+	return result, nil
+}
+
+func SMembers(dbNum int, args [][]byte) ([][]byte, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("wrong number of arguments for 'smembers' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := loadSet(key)
+	if err != nil || s == nil {
+		return [][]byte{}, err
+	}
+
+	return s.members()
+}
+
+func SCard(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'scard' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := loadSet(key)
+	if err != nil || s == nil {
+		return 0, err
+	}
+
+	return s.card()
+}
+
+const (
+	setInter = iota
+	setUnion
+	setDiff
+)
+
+// setOperation calls fn on the members of the inter, union or diff of the
+// sets at keys. The members of a union may be passed more than once.
+// The caller must hold at least cache.FSRWL.RLock.
+func setOperation(dbNum int, keys [][]byte, op int, fn func(member []byte) error) error {
+	sets := make([]*set, 0, len(keys))
+	for _, keyName := range keys {
+		s, err := loadSet(cache.NewKey(dbNum, keyName))
+		if err != nil {
+			return err
+		}
+
+		sets = append(sets, s)
+	}
+
+	var iterated []*set
+	var others []*set
+	switch op {
+	case setInter:
+		// the smallest set is the one to walk, any missing key makes
+		// the intersection empty
+		for _, s := range sets {
+			if s == nil {
+				return nil
+			}
+		}
+
+		smallest, smallestCard := 0, -1
+		for i, s := range sets {
+			card, err := s.card()
+			if err != nil {
+				return err
+			}
+
+			if smallestCard < 0 || card < smallestCard {
+				smallest, smallestCard = i, card
+			}
+		}
+
+		sets[0], sets[smallest] = sets[smallest], sets[0]
+		iterated, others = sets[:1], sets[1:]
+	case setUnion:
+		iterated = sets
+	case setDiff:
+		iterated, others = sets[:1], sets[1:]
+	}
+
+	var opErr error
+	for _, s := range iterated {
+		if s == nil {
+			continue
+		}
+
+		err := s.iterate(func(member []byte) bool {
+			for _, other := range others {
+				if other == nil {
+					continue
+				}
+
+				found, err := other.has(member)
+				if err != nil {
+					opErr = err
+					return false
+				}
+
+				if found != (op == setInter) {
+					return true
+				}
+			}
+
+			if err := fn(member); err != nil {
+				opErr = err
+				return false
+			}
+
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if opErr != nil {
+			return opErr
+		}
+	}
+
+	return nil
+}
+
+// SetOperation returns the inter (SINTER), union (SUNION) or diff (SDIFF)
+// of the sets at keys
+func SetOperation(dbNum int, keys [][]byte, op string) ([][]byte, error) {
+	opCode, err := parseSetOperation(op)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	seen := make(map[string]struct{})
+	result := [][]byte{}
+	err = setOperation(dbNum, keys, opCode, func(member []byte) error {
+		if _, ok := seen[string(member)]; ok {
+			return nil
+		}
+
+		seen[string(member)] = struct{}{}
+		result = append(result, member)
+
+		return nil
+	})
+
+	return result, err
+}
+
+// SetOperationStore stores the inter, union or diff of the sets at keys
+// in dst, returning the cardinality of the result. The result is built
+// aside, so dst can be one of keys.
+func SetOperationStore(dbNum int, dst []byte, keys [][]byte, op string) (int, error) {
+	opCode, err := parseSetOperation(op)
+	if err != nil {
+		return 0, err
+	}
+
+	dstKey := cache.NewKey(dbNum, dst)
+
+	// purged once the lock is released
+	var trashed string
+	defer func() {
+		purgeAsync([]string{trashed})
+	}()
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	tmp, err := newTempSet(dstKey)
+	if err != nil {
+		return 0, err
+	}
+
+	err = setOperation(dbNum, keys, opCode, func(member []byte) error {
+		_, err := tmp.add(member)
+		return err
+	})
+	if err != nil {
+		os.RemoveAll(tmp.dir)
+		return 0, err
+	}
+
+	card, trashed, err := tmp.storeAt(dstKey)
+	return card, err
+}
+
+func parseSetOperation(op string) (int, error) {
+	switch op {
+	case "inter":
+		return setInter, nil
+	case "union":
+		return setUnion, nil
+	case "diff":
+		return setDiff, nil
+	}
+
+	return 0, fmt.Errorf("unknown set operation %s", op)
+}
+
+// SRandMember returns count distinct random members if count is positive,
+// -count random members that may repeat otherwise
+func SRandMember(dbNum int, keyName []byte, count int) ([][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := loadSet(key)
+	if err != nil || s == nil || count == 0 {
+		return [][]byte{}, err
+	}
+
+	if count > 0 {
+		return s.sample(count)
+	}
+
+	result := make([][]byte, 0, -count)
+	for len(result) < -count {
+		member, err := s.random()
+		if err != nil {
+			return nil, err
+		}
+		if member == nil {
+			break
+		}
+
+		result = append(result, member)
+	}
+
+	return result, nil
+}
+
+// SPop removes and returns count random members
+func SPop(dbNum int, keyName []byte, count int) ([][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, err := loadSet(key)
+	if err != nil || s == nil || count == 0 {
+		return [][]byte{}, err
+	}
+
+	members, err := s.sample(count)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.remove(members...); err != nil {
+		return nil, err
+	}
+	touch(key)
+
+	return members, nil
+}
+
+// SMove moves member from the set at src to the one at dst
+func SMove(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 3 {
+		return 0, fmt.Errorf("wrong number of arguments for 'smove' command")
+	}
+
+	srcKey := cache.NewKey(dbNum, args[0])
+	dstKey := cache.NewKey(dbNum, args[1])
+	member := args[2]
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	src, err := loadSet(srcKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// the destination has to be a set even when nothing is moved
+	if _, err := checkType(dstKey, TypeSet); err != nil {
+		return 0, err
+	}
+
+	if src == nil {
+		return 0, nil
+	}
+
+	found, err := src.has(member)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	if srcKey == dstKey {
+		return 1, nil
+	}
+
+	if _, err := src.remove(member); err != nil {
+		return 0, err
+	}
+	touch(srcKey)
+
+	dst, err := loadOrCreateSet(dstKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := dst.add(member); err != nil {
+		return 0, err
+	}
+	touch(dstKey)
+
+	return 1, nil
+}
+
+// SScan returns a page of the members of the set, see HScan
+func SScan(dbNum int, keyName []byte, cursor uint64, pattern []byte, count int) (uint64, [][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := loadSet(key)
+	if err != nil || s == nil {
+		return 0, [][]byte{}, err
+	}
+
+	next, paths, err := s.scan(cursor, count)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	result := [][]byte{}
+	for _, path := range paths {
+		member, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, nil, err
+		}
+
+		if pattern != nil && !matchPattern(pattern, member) {
+			continue
+		}
+
+		result = append(result, member)
+	}
+
+	return next, result, nil
+}
@@ -0,0 +1,282 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setTestMembers returns the args of SADD and SREM for the members of
+// the range [from, to) of key
+func setTestMembers(key string, from, to int) [][]byte {
+	args := testArgs(key)
+	for i := from; i < to; i++ {
+		args = append(args, []byte(fmt.Sprintf("member:%d", i)))
+	}
+
+	return args
+}
+
+// checkMembers checks that members are distinct members of the range
+// [from, to)
+func checkMembers(t *testing.T, members [][]byte, from, to int) {
+	t.Helper()
+
+	want := map[string]bool{}
+	for _, member := range setTestMembers("", from, to)[1:] {
+		want[string(member)] = true
+	}
+
+	seen := map[string]bool{}
+	for _, member := range members {
+		if !want[string(member)] {
+			t.Fatalf("unexpected member %q", member)
+		}
+
+		if seen[string(member)] {
+			t.Fatalf("member %q returned twice", member)
+		}
+		seen[string(member)] = true
+	}
+}
+
+func TestSetRandomAfterRemoval(t *testing.T) {
+	const db = 1
+	const key = "set-removal"
+
+	if _, err := SAdd(db, setTestMembers(key, 0, 3000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SRem(db, setTestMembers(key, 5, 3000)); err != nil {
+		t.Fatal(err)
+	}
+
+	if card, err := SCard(db, testArgs(key)); err != nil || card != 5 {
+		t.Fatalf("SCARD is %d, %v, want 5", card, err)
+	}
+
+	// the members removed take their dirs with them
+	setKey := cache.NewKey(db, []byte(key))
+	setDir := filepath.Join(setKey.FilePath(), setMembersDirName)
+	err := filepath.WalkDir(setDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return err
+		}
+
+		entries, err := os.ReadDir(path)
+		if err == nil && len(entries) == 0 && path != setDir {
+			t.Errorf("empty dir %s left", path)
+		}
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		members, err := SRandMember(db, []byte(key), -5)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(members) != 5 {
+			t.Fatalf("SRANDMEMBER -5 returned %d members", len(members))
+		}
+
+		if members, err = SRandMember(db, []byte(key), 3); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(members) != 3 {
+			t.Fatalf("SRANDMEMBER 3 returned %d members", len(members))
+		}
+		checkMembers(t, members, 0, 5)
+	}
+
+	members, err := SPop(db, []byte(key), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMembers(t, members, 0, 5)
+
+	rest, err := SPop(db, []byte(key), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(members)+len(rest) != 5 {
+		t.Fatalf("SPOP returned %d and %d members, want 5", len(members), len(rest))
+	}
+	checkMembers(t, append(members, rest...), 0, 5)
+
+	if typ, err := Type(db, []byte(key)); err != nil || typ != TypeNone {
+		t.Fatalf("emptied set has type %q, %v", typ, err)
+	}
+}
+
+func TestSetRandomWithEmptyDirs(t *testing.T) {
+	const db = 1
+	const key = "set-empty-dirs"
+
+	if _, err := SAdd(db, testArgs(key, "only")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the empty dirs left by older versions are skipped
+	setKey := cache.NewKey(db, []byte(key))
+	setDir := filepath.Join(setKey.FilePath(), setMembersDirName)
+	for i := 0; i < 256; i++ {
+		for _, sub := range []string{"00", "ff"} {
+			if err := os.MkdirAll(filepath.Join(setDir, fmt.Sprintf("%02x", i), sub), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		members, err := SRandMember(db, []byte(key), -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(members) != 1 || string(members[0]) != "only" {
+			t.Fatalf("SRANDMEMBER -1 returned %q", members)
+		}
+	}
+}
+
+func TestSetSPopMany(t *testing.T) {
+	const db = 1
+	const key = "set-spop"
+
+	if _, err := SAdd(db, setTestMembers(key, 0, 2000)); err != nil {
+		t.Fatal(err)
+	}
+
+	popped := [][]byte{}
+	for len(popped) < 2000 {
+		members, err := SPop(db, []byte(key), 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(members) == 0 {
+			t.Fatalf("SPOP returned nothing after %d members", len(popped))
+		}
+		popped = append(popped, members...)
+
+		card, err := SCard(db, testArgs(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if card != 2000-len(popped) {
+			t.Fatalf("SCARD is %d after popping %d members", card, len(popped))
+		}
+	}
+
+	checkMembers(t, popped, 0, 2000)
+}
+
+func TestSetOperationStore(t *testing.T) {
+	const db = 1
+
+	if _, err := SAdd(db, setTestMembers("set-op-a", 0, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SAdd(db, setTestMembers("set-op-b", 50, 150)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		op       string
+		from, to int
+	}{
+		{"inter", 50, 100},
+		{"union", 0, 150},
+		{"diff", 0, 50},
+	} {
+		// the destination is one of the sources
+		dst := "set-op-" + test.op
+		if _, err := SAdd(db, setTestMembers(dst, 0, 100)); err != nil {
+			t.Fatal(err)
+		}
+
+		card, err := SetOperationStore(db, []byte(dst), testArgs(dst, "set-op-b"), test.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if card != test.to-test.from {
+			t.Fatalf("%s stored %d members, want %d", test.op, card, test.to-test.from)
+		}
+
+		members, err := SMembers(db, testArgs(dst))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(members) != card {
+			t.Fatalf("%s has %d members, want %d", test.op, len(members), card)
+		}
+		checkMembers(t, members, test.from, test.to)
+
+		result, err := SetOperation(db, testArgs("set-op-a", "set-op-b"), test.op)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result) != card {
+			t.Fatalf("%s returned %d members, want %d", test.op, len(result), card)
+		}
+		checkMembers(t, result, test.from, test.to)
+	}
+
+	// an empty result deletes the destination
+	if _, err := SetOperationStore(db, []byte("set-op-union"), testArgs("set-op-a", "set-op-missing"), "inter"); err != nil {
+		t.Fatal(err)
+	}
+
+	if typ, err := Type(db, []byte("set-op-union")); err != nil || typ != TypeNone {
+		t.Fatalf("empty result stored as %q, %v", typ, err)
+	}
+}
+
+func TestSMIsMember(t *testing.T) {
+	const db = 1
+
+	if _, err := SAdd(db, testArgs("set-mismember", "a", "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := SMIsMember(db, testArgs("set-mismember", "a", "c", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(got) != "[1 0 1]" {
+		t.Fatalf("SMISMEMBER returned %v", got)
+	}
+}
@@ -19,10 +19,13 @@
 package storage
 
 import (
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/RcrdBrt/gobigdis/alg"
@@ -31,6 +34,8 @@ import (
 
 var cache *alg.Cache
 
+var ErrDBIndex = errors.New("ERR DB index is out of range")
+
 func Init() {
 	versionFilePath := filepath.Join(config.Config.DBConfig.InternalDirPath, "VERSION")
 
@@ -72,35 +77,189 @@ func Init() {
 		log.Fatal(err)
 	}
 
+	if err := recoverSwapDB(); err != nil {
+		log.Fatal(err)
+	}
+
 	cache = &alg.Cache{
 		MaxDBNum: config.Config.DBConfig.DBMaxNum,
 		Root:     config.Config.DBConfig.DBDirPath,
 	}
 	cache.BuildCacheData()
 
+	// listed before anything else can be moved in the trash
+	paths, err := recoverTrash()
+	if err != nil {
+		log.Fatal(err)
+	}
+	startDeleters(trashWorkers)
+	go purgeAsync(paths)
+
 	go cache.Vacuum(config.Config.DBConfig.DBMaxNum, 10*time.Minute)
+	go RetainTimeSeries(tsRetentionInterval)
+
+	if err := loadSearchIndexes(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Close closes the files kept open by the search indexes once the running
+// commands are done, for the server to shut down
+func Close() error {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	return closeSearchIndexes()
 }
 
 func NewDB(dbNum int) error {
-	dbPath := filepath.Join(config.Config.DBConfig.DBDirPath, strconv.FormatInt(int64(dbNum), 10))
+	if dbNum < 0 || dbNum >= config.Config.DBConfig.DBMaxNum {
+		return ErrDBIndex
+	}
 
 	cache.FSRWL.Lock()
 	defer cache.FSRWL.Unlock()
 
-	if err := os.MkdirAll(dbPath, 0700); err != nil {
+	if err := os.MkdirAll(dbDirPath(dbNum), 0700); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func FlushDB(dbNum int) error {
+// ParseFlushMode parses the [ASYNC|SYNC] option of FLUSHDB and FLUSHALL,
+// reporting whether the flush is asynchronous
+func ParseFlushMode(args [][]byte) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	if len(args) == 1 {
+		switch strings.ToUpper(string(args[0])) {
+		case "ASYNC":
+			return true, nil
+		case "SYNC":
+			return false, nil
+		}
+	}
+
+	return false, ErrSyntax
+}
+
+// FlushDB deletes every key of a DB. The files are deleted in background
+// if async is set, before returning otherwise, but in both cases the other
+// clients are blocked only while the DB is moved in the trash.
+func FlushDB(dbNum int, async bool) error {
+	return flush([]int{dbNum}, async)
+}
+
+// FlushAll deletes every key of every DB, like FlushDB
+func FlushAll(async bool) error {
+	return flush(nil, async)
+}
+
+func flush(dbNums []int, async bool) error {
+	paths, err := trashDBs(dbNums)
+
+	if async {
+		purgeAsync(paths)
+	} else {
+		purge(paths)
+	}
+
+	return err
+}
+
+// trashDBs moves the keys of the DBs in the trash, along with their
+// time series registries and the content of their search indexes,
+// returning the paths to purge. A nil dbNums means all the DBs.
+func trashDBs(dbNums []int) ([]string, error) {
 	cache.FSRWL.Lock()
 	defer cache.FSRWL.Unlock()
 
-	if err := os.RemoveAll(filepath.Join(config.Config.DBConfig.DBDirPath, strconv.FormatInt(int64(dbNum), 10))); err != nil {
-		return err
+	paths := []string{}
+
+	if dbNums == nil {
+		var err error
+		if dbNums, err = usedDBs(); err != nil {
+			return paths, err
+		}
 	}
 
-	return nil
+	for _, dbNum := range dbNums {
+		for _, dir := range []string{dbDirPath(dbNum), tsRegistryDBDir(dbNum)} {
+			path, err := trash(dir)
+			if err != nil {
+				return paths, err
+			}
+
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+
+		cache.ClearDB(dbNum)
+		touchDB(dbNum)
+
+		indexPaths, err := clearSearchIndexes(dbNum)
+		paths = append(paths, indexPaths...)
+		if err != nil {
+			return paths, err
+		}
+	}
+
+	return paths, nil
+}
+
+// usedDBs returns the DBs having a dir of keys, a time series registry
+// or search indexes, the others having nothing to flush.
+// The caller must hold at least cache.FSRWL.RLock.
+func usedDBs() ([]int, error) {
+	used := map[int]bool{}
+
+	for _, root := range []string{
+		config.Config.DBConfig.DBDirPath,
+		filepath.Join(config.Config.DBConfig.InternalDirPath, tsRegistryDirName),
+	} {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			dbNum, err := strconv.Atoi(entry.Name())
+			if err != nil || !entry.IsDir() || strconv.Itoa(dbNum) != entry.Name() {
+				// the internal dir or a leftover
+				continue
+			}
+
+			if dbNum >= 0 && dbNum < config.Config.DBConfig.DBMaxNum {
+				used[dbNum] = true
+			}
+		}
+	}
+
+	for dbNum := range searchIndexes {
+		used[dbNum] = true
+	}
+
+	dbNums := make([]int, 0, len(used))
+	for dbNum := range used {
+		dbNums = append(dbNums, dbNum)
+	}
+	sort.Ints(dbNums)
+
+	return dbNums, nil
+}
+
+// DBSize returns the number of keys of a DB
+func DBSize(dbNum int) int {
+	return int(cache.DBSize(dbNum))
+}
+
+func dbDirPath(dbNum int) string {
+	return filepath.Join(config.Config.DBConfig.DBDirPath, strconv.Itoa(dbNum))
 }
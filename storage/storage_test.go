@@ -0,0 +1,112 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/RcrdBrt/gobigdis/config"
+)
+
+// TestMain runs the tests against a DB in a temporary dir
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "gobigdis-test")
+	if err != nil {
+		panic(err)
+	}
+
+	config.Init("", dir, "", 0)
+	Init()
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testArgs is a shorthand for the arguments of the commands
+func testArgs(args ...string) [][]byte {
+	result := make([][]byte, len(args))
+	for i, arg := range args {
+		result[i] = []byte(arg)
+	}
+
+	return result
+}
+
+// testKeyPath returns the path of the file or dir of keyName
+func testKeyPath(db int, keyName string) string {
+	key := cache.NewKey(db, []byte(keyName))
+
+	return key.FilePath()
+}
+
+// reopen builds the cache again from the files, like a restart does,
+// checking that the number of keys of db did not change
+func reopen(t *testing.T, db int) {
+	t.Helper()
+
+	waitDeleters(t)
+
+	size := DBSize(db)
+	cache.BuildCacheData()
+
+	if reopened := DBSize(db); reopened != size {
+		t.Fatalf("DBSIZE of DB %d is %d after reopening, it was %d", db, reopened, size)
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	const used, unused = 12, 15
+
+	if _, _, err := Set(used, testArgs("flushall-key", "v"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.FSRWL.RLock()
+	dbNums, err := usedDBs()
+	cache.FSRWL.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, dbNum := range dbNums {
+		found = found || dbNum == used
+		if dbNum == unused {
+			t.Fatalf("DB %d is among the used ones %v", unused, dbNums)
+		}
+	}
+	if !found {
+		t.Fatalf("DB %d is not among the used ones %v", used, dbNums)
+	}
+
+	if err := FlushAll(false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dbNum := range dbNums {
+		if size := DBSize(dbNum); size != 0 {
+			t.Errorf("DBSIZE of DB %d is %d after FLUSHALL", dbNum, size)
+		}
+		if _, err := os.Stat(dbDirPath(dbNum)); !os.IsNotExist(err) {
+			t.Errorf("the dir of DB %d survived FLUSHALL: %v", dbNum, err)
+		}
+	}
+}
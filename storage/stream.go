@@ -0,0 +1,941 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	A stream is a dir holding its entries in append-only segment files,
+	segments/SEGMENT_NUMBER, and an alg.BTree index mapping the ID of every
+	entry to where it is stored. Deleted and trimmed entries are only removed
+	from the index, a segment file is deleted once trimming went past its
+	last entry. The meta file keeps the last generated ID, which must
+	survive the deletion of the entry, and the segment being written.
+*/
+
+const (
+	streamMetaFileName    = "meta"
+	streamIndexFileName   = "index"
+	streamSegmentsDirName = "segments"
+	streamSegmentMaxSize  = 4 << 20
+	streamMetaSize        = 16 + 8 + 16 + 8
+)
+
+var (
+	ErrInvalidStreamID  = errors.New("ERR Invalid stream ID specified as stream command argument")
+	errStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	errStreamIDZero     = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	errStreamExhausted  = errors.New("ERR The stream has exhausted the last possible ID, unable to add more items")
+)
+
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+var maxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// next returns the ID following id, false if id is the last possible one
+func (id StreamID) next() (StreamID, bool) {
+	switch {
+	case id == maxStreamID:
+		return id, false
+	case id.Seq == math.MaxUint64:
+		return StreamID{id.Ms + 1, 0}, true
+	}
+
+	return StreamID{id.Ms, id.Seq + 1}, true
+}
+
+// prev returns the ID preceding id, false if id is 0-0
+func (id StreamID) prev() (StreamID, bool) {
+	switch {
+	case id == StreamID{}:
+		return id, false
+	case id.Seq == 0:
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	}
+
+	return StreamID{id.Ms, id.Seq - 1}, true
+}
+
+func (id StreamID) encode() []byte {
+	encoded := make([]byte, 16)
+	binary.BigEndian.PutUint64(encoded, id.Ms)
+	binary.BigEndian.PutUint64(encoded[8:], id.Seq)
+
+	return encoded
+}
+
+func decodeStreamID(encoded []byte) StreamID {
+	return StreamID{
+		Ms:  binary.BigEndian.Uint64(encoded),
+		Seq: binary.BigEndian.Uint64(encoded[8:]),
+	}
+}
+
+func parseUint64(b []byte) (uint64, error) {
+	if len(b) == 0 || b[0] < '0' || b[0] > '9' {
+		return 0, ErrInvalidStreamID
+	}
+
+	n, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return 0, ErrInvalidStreamID
+	}
+
+	return n, nil
+}
+
+// ParseStreamID parses an ID in the ms-seq form, the seq part may be
+// left out and then it's missingSeq
+func ParseStreamID(b []byte, missingSeq uint64) (StreamID, error) {
+	var id StreamID
+	var err error
+
+	parts := strings.SplitN(string(b), "-", 2)
+	if id.Ms, err = parseUint64([]byte(parts[0])); err != nil {
+		return id, err
+	}
+
+	if len(parts) == 1 {
+		id.Seq = missingSeq
+		return id, nil
+	}
+
+	id.Seq, err = parseUint64([]byte(parts[1]))
+
+	return id, err
+}
+
+// ParseStreamRangeBound parses the start (or end) of an XRANGE interval:
+// an ID, - or +, optionally preceded by ( to exclude it
+func ParseStreamRangeBound(b []byte, start bool) (StreamID, error) {
+	switch string(b) {
+	case "-":
+		return StreamID{}, nil
+	case "+":
+		return maxStreamID, nil
+	}
+
+	exclusive := len(b) > 0 && b[0] == '('
+	if exclusive {
+		b = b[1:]
+	}
+
+	missingSeq := uint64(0)
+	if !start {
+		missingSeq = math.MaxUint64
+	}
+
+	id, err := ParseStreamID(b, missingSeq)
+	if err != nil || !exclusive {
+		return id, err
+	}
+
+	ok := false
+	if start {
+		id, ok = id.next()
+		if !ok {
+			return id, errors.New("ERR invalid start ID for the interval")
+		}
+	} else {
+		id, ok = id.prev()
+		if !ok {
+			return id, errors.New("ERR invalid end ID for the interval")
+		}
+	}
+
+	return id, nil
+}
+
+// StreamTrim is the trimming strategy of XADD and XTRIM
+type StreamTrim struct {
+	ByMinID bool     // MINID instead of MAXLEN
+	MaxLen  int      // for MAXLEN
+	MinID   StreamID // for MINID
+	Limit   int      // max number of entries to trim, 0 for no limit
+}
+
+// parseStreamTrim parses MAXLEN|MINID [=|~] threshold [LIMIT count] at the
+// start of args, returning the number of arguments used. The trimming is
+// always exact, ~ is accepted but only enables LIMIT.
+func parseStreamTrim(args [][]byte) (*StreamTrim, int, error) {
+	trim := &StreamTrim{
+		ByMinID: strings.ToLower(string(args[0])) == "minid",
+	}
+
+	i := 1
+	approx := false
+	if i < len(args) && (string(args[i]) == "=" || string(args[i]) == "~") {
+		approx = string(args[i]) == "~"
+		i++
+	}
+
+	if i >= len(args) {
+		return nil, 0, ErrSyntax
+	}
+
+	if trim.ByMinID {
+		minID, err := ParseStreamID(args[i], 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		trim.MinID = minID
+	} else {
+		maxLen, err := ParseInt(args[i])
+		if err != nil {
+			return nil, 0, ErrNotInteger
+		}
+		if maxLen < 0 {
+			return nil, 0, errors.New("ERR The MAXLEN argument must be >= 0.")
+		}
+		trim.MaxLen = int(maxLen)
+	}
+	i++
+
+	if i+1 < len(args) && strings.ToLower(string(args[i])) == "limit" {
+		if !approx {
+			return nil, 0, errors.New("ERR syntax error, LIMIT cannot be used without the special ~ option")
+		}
+
+		limit, err := ParseInt(args[i+1])
+		if err != nil || limit < 0 {
+			return nil, 0, errors.New("ERR The LIMIT argument must be >= 0.")
+		}
+		trim.Limit = int(limit)
+		i += 2
+	}
+
+	return trim, i, nil
+}
+
+// ParseXTrimArgs parses the arguments of XTRIM following the key
+func ParseXTrimArgs(args [][]byte) (*StreamTrim, error) {
+	if len(args) == 0 {
+		return nil, ErrSyntax
+	}
+
+	switch strings.ToLower(string(args[0])) {
+	case "maxlen", "minid":
+	default:
+		return nil, ErrSyntax
+	}
+
+	trim, used, err := parseStreamTrim(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if used != len(args) {
+		return nil, ErrSyntax
+	}
+
+	return trim, nil
+}
+
+// XAddArgs are the parsed arguments of XADD following the key
+type XAddArgs struct {
+	NoMkStream bool
+	Trim       *StreamTrim
+	ID         StreamID
+	AutoMs     bool // *
+	AutoSeq    bool // * or ms-*
+	Fields     [][]byte
+}
+
+func ParseXAddArgs(args [][]byte) (*XAddArgs, error) {
+	xadd := &XAddArgs{}
+
+	i := 0
+loop:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nomkstream":
+			xadd.NoMkStream = true
+		case "maxlen", "minid":
+			trim, used, err := parseStreamTrim(args[i:])
+			if err != nil {
+				return nil, err
+			}
+
+			xadd.Trim = trim
+			i += used - 1
+		default:
+			break loop
+		}
+	}
+
+	if i >= len(args) || len(args[i+1:]) == 0 || len(args[i+1:])%2 != 0 {
+		return nil, fmt.Errorf("wrong number of arguments for 'xadd' command")
+	}
+
+	id := args[i]
+	switch {
+	case string(id) == "*":
+		xadd.AutoMs, xadd.AutoSeq = true, true
+	case strings.HasSuffix(string(id), "-*"):
+		ms, err := parseUint64(id[:len(id)-2])
+		if err != nil {
+			return nil, err
+		}
+		xadd.ID.Ms, xadd.AutoSeq = ms, true
+	default:
+		parsed, err := ParseStreamID(id, 0)
+		if err != nil {
+			return nil, err
+		}
+		xadd.ID = parsed
+	}
+
+	xadd.Fields = args[i+1:]
+
+	return xadd, nil
+}
+
+// StreamEntry is an entry of a stream, Fields holds the field value pairs.
+// Fields is nil for the pending entries of a group deleted from the stream.
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+type stream struct {
+	key   alg.Key
+	dir   string
+	index *alg.BTree
+
+	lastID       StreamID
+	entriesAdded uint64
+	maxDeletedID StreamID
+	segment      uint64 // the segment being written
+}
+
+// openStream opens the stream at key, nil if the key does not exist.
+// The caller must hold at least cache.FSRWL.RLock and close the stream.
+func openStream(key alg.Key) (*stream, error) {
+	found, err := checkType(key, TypeStream)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	s := &stream{
+		key: key,
+		dir: key.FilePath(),
+	}
+
+	meta, err := os.ReadFile(filepath.Join(s.dir, streamMetaFileName))
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) != streamMetaSize {
+		return nil, fmt.Errorf("corrupted stream meta file for key %s", key.Encode())
+	}
+
+	s.lastID = decodeStreamID(meta)
+	s.entriesAdded = binary.BigEndian.Uint64(meta[16:])
+	s.maxDeletedID = decodeStreamID(meta[24:])
+	s.segment = binary.BigEndian.Uint64(meta[40:])
+
+	if s.index, err = alg.OpenBTree(filepath.Join(s.dir, streamIndexFileName)); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// createStream creates an empty stream at key.
+// The caller must hold cache.FSRWL.Lock and close the stream.
+func createStream(key alg.Key) (*stream, error) {
+	if err := createTyped(key, TypeStream, nil); err != nil {
+		return nil, err
+	}
+
+	s := &stream{
+		key: key,
+		dir: key.FilePath(),
+	}
+
+	if err := os.Mkdir(filepath.Join(s.dir, streamSegmentsDirName), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := s.saveMeta(); err != nil {
+		return nil, err
+	}
+
+	index, err := alg.OpenBTree(filepath.Join(s.dir, streamIndexFileName))
+	if err != nil {
+		return nil, err
+	}
+	s.index = index
+
+	return s, nil
+}
+
+func (s *stream) close() error {
+	return s.index.Close()
+}
+
+func (s *stream) saveMeta() error {
+	meta := make([]byte, 0, streamMetaSize)
+	meta = append(meta, s.lastID.encode()...)
+	meta = append(meta, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(meta[16:], s.entriesAdded)
+	meta = append(meta, s.maxDeletedID.encode()...)
+	meta = append(meta, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(meta[40:], s.segment)
+
+	return writeFileAtomic(filepath.Join(s.dir, streamMetaFileName), meta)
+}
+
+// commit saves the index and the meta file
+func (s *stream) commit() error {
+	if err := s.index.Commit(); err != nil {
+		return err
+	}
+
+	if err := s.saveMeta(); err != nil {
+		return err
+	}
+
+	touch(s.key)
+
+	return nil
+}
+
+func (s *stream) length() int {
+	return s.index.Len()
+}
+
+func (s *stream) segmentPath(segment uint64) string {
+	return filepath.Join(s.dir, streamSegmentsDirName, fmt.Sprintf("%016x", segment))
+}
+
+// nextID returns the ID of the entry XADD is adding
+func (s *stream) nextID(xadd *XAddArgs) (StreamID, error) {
+	id := xadd.ID
+
+	switch {
+	case xadd.AutoMs:
+		id = StreamID{uint64(time.Now().UnixNano() / int64(time.Millisecond)), 0}
+		if id.Ms <= s.lastID.Ms {
+			next, ok := s.lastID.next()
+			if !ok {
+				return id, errStreamExhausted
+			}
+			id = next
+		}
+	case xadd.AutoSeq:
+		if id.Ms < s.lastID.Ms {
+			return id, errStreamIDTooSmall
+		}
+
+		if id.Ms == s.lastID.Ms {
+			if s.lastID.Seq == math.MaxUint64 {
+				return id, errStreamIDTooSmall
+			}
+			id.Seq = s.lastID.Seq + 1
+		}
+	default:
+		if id == (StreamID{}) {
+			return id, errStreamIDZero
+		}
+	}
+
+	if !s.lastID.Less(id) {
+		return id, errStreamIDTooSmall
+	}
+
+	return id, nil
+}
+
+// add appends an entry to the current segment and indexes it
+func (s *stream) add(id StreamID, fields [][]byte) error {
+	record := make([]byte, 0, 20)
+	record = append(record, id.encode()...)
+	record = append(record, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(record[16:], uint32(len(fields)))
+	for _, field := range fields {
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(field)))
+		record = append(record, size...)
+		record = append(record, field...)
+	}
+
+	file, err := os.OpenFile(s.segmentPath(s.segment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if info.Size() >= streamSegmentMaxSize {
+		file.Close()
+
+		s.segment++
+		if file, err = os.OpenFile(s.segmentPath(s.segment), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+
+		if info, err = file.Stat(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if _, err := file.Write(record); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	location := make([]byte, 20)
+	binary.BigEndian.PutUint64(location, s.segment)
+	binary.BigEndian.PutUint64(location[8:], uint64(info.Size()))
+	binary.BigEndian.PutUint32(location[16:], uint32(len(record)))
+
+	if _, err := s.index.Put(id.encode(), location); err != nil {
+		return err
+	}
+
+	s.lastID = id
+	s.entriesAdded++
+
+	return nil
+}
+
+// segmentReader reads entries from the segment files, keeping them open
+type segmentReader struct {
+	s     *stream
+	files map[uint64]*os.File
+}
+
+func (s *stream) newSegmentReader() *segmentReader {
+	return &segmentReader{
+		s:     s,
+		files: make(map[uint64]*os.File),
+	}
+}
+
+func (r *segmentReader) close() {
+	for _, file := range r.files {
+		file.Close()
+	}
+}
+
+// read reads the entry at the location stored in the index
+func (r *segmentReader) read(location []byte) (StreamEntry, error) {
+	var entry StreamEntry
+
+	segment := binary.BigEndian.Uint64(location)
+	file, ok := r.files[segment]
+	if !ok {
+		var err error
+		if file, err = os.Open(r.s.segmentPath(segment)); err != nil {
+			return entry, err
+		}
+		r.files[segment] = file
+	}
+
+	record := make([]byte, binary.BigEndian.Uint32(location[16:]))
+	if _, err := file.ReadAt(record, int64(binary.BigEndian.Uint64(location[8:]))); err != nil {
+		return entry, err
+	}
+
+	corrupted := fmt.Errorf("corrupted stream segment for key %s", r.s.key.Encode())
+	if len(record) < 20 {
+		return entry, corrupted
+	}
+
+	entry.ID = decodeStreamID(record)
+	entry.Fields = make([][]byte, binary.BigEndian.Uint32(record[16:]))
+
+	offset := 20
+	for i := range entry.Fields {
+		if offset+4 > len(record) {
+			return entry, corrupted
+		}
+		size := int(binary.BigEndian.Uint32(record[offset:]))
+		offset += 4
+
+		if offset+size > len(record) {
+			return entry, corrupted
+		}
+		entry.Fields[i] = record[offset : offset+size]
+		offset += size
+	}
+
+	return entry, nil
+}
+
+// rangeEntries returns up to count (no limit if negative) entries with
+// an ID between start and end, from the end if rev is set
+func (s *stream) rangeEntries(start, end StreamID, count int, rev bool) ([]StreamEntry, error) {
+	result := []StreamEntry{}
+	if end.Less(start) || count == 0 {
+		return result, nil
+	}
+
+	var c *alg.BTreeCursor
+	var err error
+	if rev {
+		last := s.length()
+		if next, ok := end.next(); ok {
+			if last, err = s.index.Rank(next.encode()); err != nil {
+				return nil, err
+			}
+		}
+		c, err = s.index.SeekIndex(last - 1)
+	} else {
+		c, err = s.index.Seek(start.encode())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	reader := s.newSegmentReader()
+	defer reader.close()
+
+	for c.Valid() && (count < 0 || len(result) < count) {
+		id := decodeStreamID(c.Key())
+		if id.Less(start) || end.Less(id) {
+			break
+		}
+
+		entry, err := reader.read(c.Value())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+
+		if rev {
+			err = c.Prev()
+		} else {
+			err = c.Next()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// trim removes the oldest entries as asked by t, returning how many
+func (s *stream) trim(t *StreamTrim) (int, error) {
+	trimmed := 0
+	for s.length() > 0 && (t.Limit == 0 || trimmed < t.Limit) {
+		c, err := s.index.SeekIndex(0)
+		if err != nil {
+			return trimmed, err
+		}
+
+		id := decodeStreamID(c.Key())
+		if (t.ByMinID && !id.Less(t.MinID)) || (!t.ByMinID && s.length() <= t.MaxLen) {
+			break
+		}
+
+		if _, err := s.index.Delete(id.encode()); err != nil {
+			return trimmed, err
+		}
+		trimmed++
+	}
+
+	if trimmed == 0 {
+		return 0, nil
+	}
+
+	return trimmed, s.removeOldSegments()
+}
+
+// removeOldSegments deletes the segments before the one holding the
+// first entry
+func (s *stream) removeOldSegments() error {
+	first := s.segment
+	if s.length() > 0 {
+		c, err := s.index.SeekIndex(0)
+		if err != nil {
+			return err
+		}
+		first = binary.BigEndian.Uint64(c.Value())
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, streamSegmentsDirName))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		segment, err := strconv.ParseUint(entry.Name(), 16, 64)
+		if err != nil || segment >= first {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, streamSegmentsDirName, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// XAdd appends an entry, returning its ID or nil if the stream does not
+// exist and NOMKSTREAM is given
+func XAdd(dbNum int, keyName []byte, xadd *XAddArgs) ([]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, err := openStream(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if s == nil {
+		if xadd.NoMkStream {
+			return nil, nil
+		}
+
+		// the ID is checked before creating the key
+		if !xadd.AutoSeq && xadd.ID == (StreamID{}) {
+			return nil, errStreamIDZero
+		}
+
+		if s, err = createStream(key); err != nil {
+			return nil, err
+		}
+	}
+	defer s.close()
+
+	id, err := s.nextID(xadd)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.add(id, xadd.Fields); err != nil {
+		return nil, err
+	}
+
+	if xadd.Trim != nil {
+		if _, err := s.trim(xadd.Trim); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.commit(); err != nil {
+		return nil, err
+	}
+
+	signalStreamWaiters(key)
+
+	return []byte(id.String()), nil
+}
+
+func XLen(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'xlen' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := openStream(key)
+	if err != nil || s == nil {
+		return 0, err
+	}
+	defer s.close()
+
+	return s.length(), nil
+}
+
+// XRange returns up to count (no limit if negative) entries with an ID
+// between start and end, from the end if rev is set
+func XRange(dbNum int, keyName []byte, start, end StreamID, count int, rev bool) ([]StreamEntry, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := openStream(key)
+	if err != nil || s == nil {
+		return []StreamEntry{}, err
+	}
+	defer s.close()
+
+	return s.rangeEntries(start, end, count, rev)
+}
+
+// XDel deletes the entries with the given IDs, returning how many existed
+func XDel(dbNum int, keyName []byte, ids []StreamID) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, err := openStream(key)
+	if err != nil || s == nil {
+		return 0, err
+	}
+	defer s.close()
+
+	deleted := 0
+	for _, id := range ids {
+		found, err := s.index.Delete(id.encode())
+		if err != nil {
+			return 0, err
+		}
+
+		if found {
+			deleted++
+			if s.maxDeletedID.Less(id) {
+				s.maxDeletedID = id
+			}
+		}
+	}
+
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	if err := s.removeOldSegments(); err != nil {
+		return 0, err
+	}
+
+	return deleted, s.commit()
+}
+
+// XTrim trims the stream, returning the number of removed entries
+func XTrim(dbNum int, keyName []byte, trim *StreamTrim) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, err := openStream(key)
+	if err != nil || s == nil {
+		return 0, err
+	}
+	defer s.close()
+
+	trimmed, err := s.trim(trim)
+	if err != nil || trimmed == 0 {
+		return 0, err
+	}
+
+	return trimmed, s.commit()
+}
+
+// StreamRead is what XREAD returns for a single stream
+type StreamRead struct {
+	Key     []byte
+	Entries []StreamEntry
+}
+
+// XRead returns up to count (no limit if not positive) entries following
+// ids[i] from every stream at keys[i]. The ID of a stream with last[i]
+// set is its last ID, ids and last are updated so that a later call
+// reads the same entries. If there is nothing to read and block is set,
+// it also returns a StreamWaiter to wait for the streams on.
+func XRead(dbNum int, keys [][]byte, ids []StreamID, last []bool, count int, block bool) ([]StreamRead, *StreamWaiter, error) {
+	if count <= 0 {
+		count = -1
+	}
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	streamKeys := make([]alg.Key, len(keys))
+	result := []StreamRead{}
+	for i, keyName := range keys {
+		streamKeys[i] = cache.NewKey(dbNum, keyName)
+
+		s, err := openStream(streamKeys[i])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if last[i] {
+			last[i] = false
+			if s != nil {
+				ids[i] = s.lastID
+			}
+		}
+
+		if s == nil {
+			continue
+		}
+
+		var entries []StreamEntry
+		if start, ok := ids[i].next(); ok {
+			entries, err = s.rangeEntries(start, maxStreamID, count, false)
+		}
+		s.close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(entries) > 0 {
+			result = append(result, StreamRead{
+				Key:     keyName,
+				Entries: entries,
+			})
+		}
+	}
+
+	if len(result) > 0 || !block {
+		return result, nil, nil
+	}
+
+	return result, registerStreamWaiter(streamKeys), nil
+}
@@ -0,0 +1,241 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// xaddTest runs XADD with the arguments following the key, returning the
+// ID of the new entry
+func xaddTest(t *testing.T, db int, keyName string, args ...string) (string, error) {
+	t.Helper()
+
+	xadd, err := ParseXAddArgs(testArgs(args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := XAdd(db, []byte(keyName), xadd)
+
+	return string(id), err
+}
+
+func streamTestID(t *testing.T, s string) StreamID {
+	t.Helper()
+
+	id, err := ParseStreamID([]byte(s), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func streamTestSegments(t *testing.T, db int, keyName string) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(testKeyPath(db, keyName), streamSegmentsDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(entries)
+}
+
+func TestStreamIDs(t *testing.T) {
+	const db = 4
+	const key = "stream-ids"
+
+	if id, err := xaddTest(t, db, key, "nomkstream", "*", "f", "v"); err != nil || id != "" {
+		t.Fatalf("XADD NOMKSTREAM of a missing stream returned %q: %v", id, err)
+	}
+	if _, err := xaddTest(t, db, key, "0-0", "f", "v"); err != errStreamIDZero {
+		t.Fatalf("XADD 0-0 returned %v", err)
+	}
+	if found, err := Exists(db, testArgs(key)); err != nil || found != 0 {
+		t.Fatalf("the failed XADDs created the stream: %v", err)
+	}
+
+	for _, step := range []struct{ id, want string }{
+		{"5-1", "5-1"},
+		{"5-*", "5-2"},
+		{"6-*", "6-0"},
+		{"6", "6-1"},
+	} {
+		// a missing seq is 0, which is too small after 6-0
+		id, err := xaddTest(t, db, key, step.id, "f", "v")
+		if step.id == "6" {
+			if err != errStreamIDTooSmall {
+				t.Fatalf("XADD 6 returned %q: %v", id, err)
+			}
+			continue
+		}
+		if err != nil || id != step.want {
+			t.Fatalf("XADD %s returned %q, want %q: %v", step.id, id, step.want, err)
+		}
+	}
+
+	// the last ID survives the deletion of its entry and a reopen
+	if deleted, err := XDel(db, []byte(key), []StreamID{streamTestID(t, "6-0")}); err != nil || deleted != 1 {
+		t.Fatalf("XDEL deleted %d: %v", deleted, err)
+	}
+	reopen(t, db)
+	if _, err := xaddTest(t, db, key, "6-0", "f", "v"); err != errStreamIDTooSmall {
+		t.Fatalf("XADD of the deleted last ID returned %v", err)
+	}
+	if id, err := xaddTest(t, db, key, "*", "f", "v"); err != nil || !streamTestID(t, "6-0").Less(streamTestID(t, id)) {
+		t.Fatalf("XADD * returned %q: %v", id, err)
+	}
+
+	if _, err := xaddTest(t, db, key, "18446744073709551615-18446744073709551615", "f", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := xaddTest(t, db, key, "*", "f", "v"); err != errStreamExhausted {
+		t.Fatalf("XADD * after the last possible ID returned %v", err)
+	}
+
+	if _, err := Del(db, testArgs(key)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamSegments(t *testing.T) {
+	const db = 4
+	const key = "stream-segments"
+
+	value := bytes.Repeat([]byte("v"), 1<<20)
+	for i := 1; i <= 12; i++ {
+		if _, err := xaddTest(t, db, key, strconv.Itoa(i), "n", strconv.Itoa(i), "value", string(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := streamTestSegments(t, db, key); n < 3 {
+		t.Fatalf("12MB of entries in %d segments", n)
+	}
+
+	reopen(t, db)
+
+	entries, err := XRange(db, []byte(key), StreamID{}, maxStreamID, -1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 12 {
+		t.Fatalf("XRANGE returned %d entries, want 12", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.ID != (StreamID{uint64(i + 1), 0}) || string(entry.Fields[1]) != strconv.Itoa(i+1) || !bytes.Equal(entry.Fields[3], value) {
+			t.Fatalf("entry %d is %s", i, entry.ID)
+		}
+	}
+
+	if entries, err = XRange(db, []byte(key), StreamID{3, 0}, StreamID{10, 0}, 2, true); err != nil || len(entries) != 2 || entries[0].ID.Ms != 10 || entries[1].ID.Ms != 9 {
+		t.Fatalf("XREVRANGE 10 3 COUNT 2 returned %d entries: %v", len(entries), err)
+	}
+
+	// MAXLEN trims exactly, and LIMIT needs ~
+	if _, err := ParseXTrimArgs(testArgs("maxlen", "3", "limit", "2")); err == nil {
+		t.Fatal("XTRIM accepted LIMIT without ~")
+	}
+	trim, err := ParseXTrimArgs(testArgs("maxlen", "=", "3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trimmed, err := XTrim(db, []byte(key), trim); err != nil || trimmed != 9 {
+		t.Fatalf("XTRIM MAXLEN 3 trimmed %d: %v", trimmed, err)
+	}
+
+	// only the segment of the first entry left and the following ones remain
+	if n := streamTestSegments(t, db, key); n > 2 {
+		t.Fatalf("%d segments left for 3MB of entries", n)
+	}
+
+	if trim, err = ParseXTrimArgs(testArgs("minid", "~", "12", "limit", "1")); err != nil {
+		t.Fatal(err)
+	}
+	if trimmed, err := XTrim(db, []byte(key), trim); err != nil || trimmed != 1 {
+		t.Fatalf("XTRIM MINID ~ 12 LIMIT 1 trimmed %d: %v", trimmed, err)
+	}
+
+	reopen(t, db)
+
+	if length, err := XLen(db, testArgs(key)); err != nil || length != 2 {
+		t.Fatalf("XLEN is %d, want 2: %v", length, err)
+	}
+	if entries, err = XRange(db, []byte(key), StreamID{}, maxStreamID, -1, false); err != nil || len(entries) != 2 || entries[0].ID.Ms != 11 {
+		t.Fatalf("XRANGE after trimming returned %d entries: %v", len(entries), err)
+	}
+
+	if _, err := Del(db, testArgs(key)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamBlockingRead(t *testing.T) {
+	const db = 4
+	const key = "stream-block"
+
+	if _, err := xaddTest(t, db, key, "1-1", "f", "old"); err != nil {
+		t.Fatal(err)
+	}
+
+	// $ reads the entries following the last one at the time of the call
+	ids, last := []StreamID{{}}, []bool{true}
+	result, waiter, err := XRead(db, testArgs(key), ids, last, 0, true)
+	if err != nil || len(result) != 0 || waiter == nil {
+		t.Fatalf("XREAD BLOCK $ returned %d streams: %v", len(result), err)
+	}
+	if ids[0] != (StreamID{1, 1}) || last[0] {
+		t.Fatalf("$ was turned into %s", ids[0])
+	}
+
+	xadd, err := ParseXAddArgs(testArgs("*", "f", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		XAdd(db, []byte(key), xadd)
+	}()
+
+	if !waiter.Wait(5*time.Second, nil) {
+		t.Fatal("the waiter was not woken up by XADD")
+	}
+
+	result, waiter, err = XRead(db, testArgs(key), ids, last, 0, true)
+	if err != nil || waiter != nil || len(result) != 1 || len(result[0].Entries) != 1 || string(result[0].Entries[0].Fields[1]) != "new" {
+		t.Fatalf("XREAD after the wake up returned %d streams: %v", len(result), err)
+	}
+
+	// a timeout is not a wake up
+	if _, waiter, err = XRead(db, testArgs(key), []StreamID{maxStreamID}, []bool{false}, 0, true); err != nil || waiter == nil {
+		t.Fatalf("XREAD BLOCK after the last ID returned no waiter: %v", err)
+	}
+	if waiter.Wait(10*time.Millisecond, nil) {
+		t.Fatal("the waiter was woken up with no new entry")
+	}
+
+	if _, err := Del(db, testArgs(key)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,1542 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	Every consumer group of a stream is an alg.BTree file in the groups dir
+	of the stream, named after the SHA256 of the group name, holding:
+	- "g" -> last delivered ID | group name
+	- "p" + ID -> delivery time | delivery count | consumer, the pending
+	  entries list of the group
+	- "c" + consumer length + consumer + ID -> nothing, the pending entries
+	  of each consumer
+	- "n" + consumer -> seen time | active time
+	so that whatever a command does to a group is committed at once, and
+	the pending entries of the group or of a consumer are counted in O(log n).
+*/
+
+const streamGroupsDirName = "groups"
+
+const (
+	groupMetaPrefix     = 'g'
+	groupPendingPrefix  = 'p'
+	groupConsumerPrefix = 'c'
+	groupNamePrefix     = 'n'
+)
+
+var (
+	errBusyGroup        = errors.New("BUSYGROUP Consumer Group name already exists")
+	errXGroupKeyMissing = errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+)
+
+func errNoGroup(keyName, group []byte) error {
+	return fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s'", keyName, group)
+}
+
+func errNoGroupForKey(keyName, group []byte) error {
+	return fmt.Errorf("NOGROUP No such consumer group '%s' for key name '%s'", group, keyName)
+}
+
+func nowMs() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+type streamGroup struct {
+	s      *stream
+	name   []byte
+	tree   *alg.BTree
+	lastID StreamID
+}
+
+// PendingEntry is an entry delivered to a consumer and not acknowledged yet
+type PendingEntry struct {
+	ID            StreamID
+	Consumer      []byte
+	DeliveryTime  uint64 // unix time in ms
+	DeliveryCount uint64
+}
+
+// StreamConsumer is a consumer of a group
+type StreamConsumer struct {
+	Name       []byte
+	SeenTime   uint64 // last interaction, unix time in ms
+	ActiveTime uint64 // last successful read or claim, 0 if never
+	Pending    int
+
+	// only set by XINFO STREAM FULL
+	PendingEntries []PendingEntry
+}
+
+func (s *stream) groupPath(name []byte) string {
+	hashed := sha256.Sum256(name)
+
+	return filepath.Join(s.dir, streamGroupsDirName, hex.EncodeToString(hashed[:]))
+}
+
+// openGroup opens the group called name, nil if it does not exist.
+// The caller must close the group.
+func (s *stream) openGroup(name []byte) (*streamGroup, error) {
+	path := s.groupPath(name)
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return s.openGroupFile(path)
+}
+
+func (s *stream) openGroupFile(path string) (*streamGroup, error) {
+	tree, err := alg.OpenBTree(path)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, found, err := tree.Get([]byte{groupMetaPrefix})
+	if err != nil || !found || len(meta) < 16 {
+		tree.Close()
+		if err == nil {
+			err = fmt.Errorf("corrupted consumer group file %s", path)
+		}
+		return nil, err
+	}
+
+	return &streamGroup{
+		s:      s,
+		name:   append([]byte{}, meta[16:]...),
+		tree:   tree,
+		lastID: decodeStreamID(meta),
+	}, nil
+}
+
+// createGroup creates the group called name, nil if it already exists.
+// The caller must close the group.
+func (s *stream) createGroup(name []byte, lastID StreamID) (*streamGroup, error) {
+	path := s.groupPath(name)
+	if _, err := os.Lstat(path); err == nil {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	tree, err := alg.OpenBTree(path)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &streamGroup{
+		s:    s,
+		name: name,
+		tree: tree,
+	}
+
+	if err := g.setLastID(lastID); err != nil {
+		g.close()
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// groups returns all the groups of the stream, the caller must close them
+func (s *stream) groups() ([]*streamGroup, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, streamGroupsDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	groups := []*streamGroup{}
+	for _, entry := range entries {
+		if !isHashedName(entry.Name()) {
+			continue
+		}
+
+		g, err := s.openGroupFile(filepath.Join(s.dir, streamGroupsDirName, entry.Name()))
+		if err != nil {
+			for _, g := range groups {
+				g.close()
+			}
+			return nil, err
+		}
+
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+func (s *stream) groupCount() (int, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, streamGroupsDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		if isHashedName(entry.Name()) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// entry returns the entry with the given ID, nil fields if it was deleted
+func (s *stream) entry(id StreamID, reader *segmentReader) (StreamEntry, error) {
+	location, found, err := s.index.Get(id.encode())
+	if err != nil || !found {
+		return StreamEntry{ID: id}, err
+	}
+
+	return reader.read(location)
+}
+
+// lag returns the number of entries following id
+func (s *stream) lag(id StreamID) (int, error) {
+	next, ok := id.next()
+	if !ok {
+		return 0, nil
+	}
+
+	rank, err := s.index.Rank(next.encode())
+	if err != nil {
+		return 0, err
+	}
+
+	return s.length() - rank, nil
+}
+
+func (g *streamGroup) close() error {
+	return g.tree.Close()
+}
+
+func (g *streamGroup) commit() error {
+	return g.tree.Commit()
+}
+
+func (g *streamGroup) setLastID(id StreamID) error {
+	g.lastID = id
+	_, err := g.tree.Put([]byte{groupMetaPrefix}, append(id.encode(), g.name...))
+
+	return err
+}
+
+// prefixEnd returns the smallest key greater than all the keys starting
+// with prefix, nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	return nil
+}
+
+// rankRange returns the ranks [from, to) of the keys between start and
+// the keys starting with prefix, nil end meaning the end of the tree
+func (g *streamGroup) rankRange(start, end []byte) (int, int, error) {
+	from, err := g.tree.Rank(start)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to := g.tree.Len()
+	if end != nil {
+		if to, err = g.tree.Rank(end); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return from, to, nil
+}
+
+func (g *streamGroup) prefixCount(prefix []byte) (int, error) {
+	from, to, err := g.rankRange(prefix, prefixEnd(prefix))
+
+	return to - from, err
+}
+
+func pendingKey(id StreamID) []byte {
+	return append([]byte{groupPendingPrefix}, id.encode()...)
+}
+
+func consumerPrefix(consumer []byte) []byte {
+	prefix := make([]byte, 3, 3+len(consumer)+16)
+	prefix[0] = groupConsumerPrefix
+	binary.BigEndian.PutUint16(prefix[1:], uint16(len(consumer)))
+
+	return append(prefix, consumer...)
+}
+
+func consumerPendingKey(consumer []byte, id StreamID) []byte {
+	return append(consumerPrefix(consumer), id.encode()...)
+}
+
+func decodePendingEntry(key, value []byte) PendingEntry {
+	return PendingEntry{
+		ID:            decodeStreamID(key[1:]),
+		DeliveryTime:  binary.BigEndian.Uint64(value),
+		DeliveryCount: binary.BigEndian.Uint64(value[8:]),
+		Consumer:      append([]byte{}, value[16:]...),
+	}
+}
+
+func (g *streamGroup) pending(id StreamID) (*PendingEntry, error) {
+	value, found, err := g.tree.Get(pendingKey(id))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	entry := decodePendingEntry(pendingKey(id), value)
+
+	return &entry, nil
+}
+
+// setPending adds or updates an entry of the pending entries list,
+// moving it to entry.Consumer if it belonged to someone else
+func (g *streamGroup) setPending(entry PendingEntry) error {
+	old, err := g.pending(entry.ID)
+	if err != nil {
+		return err
+	}
+
+	if old != nil && string(old.Consumer) != string(entry.Consumer) {
+		if _, err := g.tree.Delete(consumerPendingKey(old.Consumer, entry.ID)); err != nil {
+			return err
+		}
+	}
+
+	value := make([]byte, 16, 16+len(entry.Consumer))
+	binary.BigEndian.PutUint64(value, entry.DeliveryTime)
+	binary.BigEndian.PutUint64(value[8:], entry.DeliveryCount)
+	value = append(value, entry.Consumer...)
+
+	if _, err := g.tree.Put(pendingKey(entry.ID), value); err != nil {
+		return err
+	}
+
+	_, err = g.tree.Put(consumerPendingKey(entry.Consumer, entry.ID), nil)
+
+	return err
+}
+
+// ack removes id from the pending entries list, reporting whether it was there
+func (g *streamGroup) ack(id StreamID) (bool, error) {
+	old, err := g.pending(id)
+	if err != nil || old == nil {
+		return false, err
+	}
+
+	if _, err := g.tree.Delete(pendingKey(id)); err != nil {
+		return false, err
+	}
+
+	_, err = g.tree.Delete(consumerPendingKey(old.Consumer, id))
+
+	return true, err
+}
+
+// iteratePending calls fn on the pending entries with an ID between start
+// and end, only the ones of consumer if not nil, until fn returns false
+func (g *streamGroup) iteratePending(start, end StreamID, consumer []byte, fn func(entry PendingEntry) bool) error {
+	prefix := []byte{groupPendingPrefix}
+	if consumer != nil {
+		prefix = consumerPrefix(consumer)
+	}
+
+	c, err := g.tree.Seek(append(append([]byte{}, prefix...), start.encode()...))
+	if err != nil {
+		return err
+	}
+
+	for ; c.Valid(); err = c.Next() {
+		if err != nil {
+			return err
+		}
+
+		key := c.Key()
+		if len(key) != len(prefix)+16 || string(key[:len(prefix)]) != string(prefix) {
+			return nil
+		}
+
+		id := decodeStreamID(key[len(prefix):])
+		if end.Less(id) {
+			return nil
+		}
+
+		value := c.Value()
+		if consumer != nil {
+			// the details are in the group pending entries list
+			found := false
+			if value, found, err = g.tree.Get(pendingKey(id)); err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+		}
+
+		if !fn(decodePendingEntry(pendingKey(id), value)) {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (g *streamGroup) pendingCount() (int, error) {
+	return g.prefixCount([]byte{groupPendingPrefix})
+}
+
+func consumerKey(name []byte) []byte {
+	return append([]byte{groupNamePrefix}, name...)
+}
+
+func (g *streamGroup) consumer(name []byte) (*StreamConsumer, error) {
+	value, found, err := g.tree.Get(consumerKey(name))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	consumer := &StreamConsumer{
+		Name:       name,
+		SeenTime:   binary.BigEndian.Uint64(value),
+		ActiveTime: binary.BigEndian.Uint64(value[8:]),
+	}
+
+	consumer.Pending, err = g.prefixCount(consumerPrefix(name))
+
+	return consumer, err
+}
+
+// seeConsumer records an interaction of the consumer, and that it read or
+// claimed something if active is set. It creates the consumer if needed,
+// reporting whether it did.
+func (g *streamGroup) seeConsumer(name []byte, active bool) (bool, error) {
+	consumer, err := g.consumer(name)
+	if err != nil {
+		return false, err
+	}
+
+	created := consumer == nil
+	if created {
+		consumer = &StreamConsumer{}
+	}
+
+	now := nowMs()
+	consumer.SeenTime = now
+	if active {
+		consumer.ActiveTime = now
+	}
+
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value, consumer.SeenTime)
+	binary.BigEndian.PutUint64(value[8:], consumer.ActiveTime)
+
+	_, err = g.tree.Put(consumerKey(name), value)
+
+	return created, err
+}
+
+// deleteConsumer deletes a consumer along with its pending entries,
+// returning how many they were
+func (g *streamGroup) deleteConsumer(name []byte) (int, error) {
+	found, err := g.tree.Delete(consumerKey(name))
+	if err != nil || !found {
+		return 0, err
+	}
+
+	ids := []StreamID{}
+	err = g.iteratePending(StreamID{}, maxStreamID, name, func(entry PendingEntry) bool {
+		ids = append(ids, entry.ID)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if _, err := g.ack(id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(ids), nil
+}
+
+func (g *streamGroup) consumers() ([]*StreamConsumer, error) {
+	c, err := g.tree.Seek([]byte{groupNamePrefix})
+	if err != nil {
+		return nil, err
+	}
+
+	names := [][]byte{}
+	for ; c.Valid() && c.Key()[0] == groupNamePrefix; err = c.Next() {
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, append([]byte{}, c.Key()[1:]...))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	consumers := make([]*StreamConsumer, 0, len(names))
+	for _, name := range names {
+		consumer, err := g.consumer(name)
+		if err != nil {
+			return nil, err
+		}
+
+		consumers = append(consumers, consumer)
+	}
+
+	return consumers, nil
+}
+
+// openStreamGroup opens the stream at key and its group, returning
+// errNoGroup if any of them does not exist. The caller must close both.
+func openStreamGroup(key alg.Key, keyName, group []byte) (*stream, *streamGroup, error) {
+	s, err := openStream(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s == nil {
+		return nil, nil, errNoGroup(keyName, group)
+	}
+
+	g, err := s.openGroup(group)
+	if err != nil || g == nil {
+		s.close()
+		if err == nil {
+			err = errNoGroup(keyName, group)
+		}
+		return nil, nil, err
+	}
+
+	return s, g, nil
+}
+
+// parseGroupID parses the ID of XGROUP CREATE and SETID, $ being the
+// last ID of the stream
+func (s *stream) parseGroupID(arg []byte) (StreamID, error) {
+	if string(arg) == "$" {
+		return s.lastID, nil
+	}
+
+	return ParseStreamID(arg, 0)
+}
+
+// XGroup runs the XGROUP subcommands
+func XGroup(dbNum int, args [][]byte) (interface{}, error) {
+	subcommand := strings.ToLower(string(args[0]))
+
+	arity := map[string]int{
+		"create":         4,
+		"setid":          4,
+		"destroy":        3,
+		"createconsumer": 4,
+		"delconsumer":    4,
+	}
+	if _, ok := arity[subcommand]; !ok {
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try XGROUP HELP.", args[0])
+	}
+	if len(args) < arity[subcommand] || (subcommand != "create" && subcommand != "setid" && len(args) != arity[subcommand]) {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'xgroup|%s' command", subcommand)
+	}
+
+	keyName, group := args[1], args[2]
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, err := openStream(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if subcommand == "create" {
+		mkStream := false
+		for i := 4; i < len(args); i++ {
+			switch strings.ToLower(string(args[i])) {
+			case "mkstream":
+				mkStream = true
+			case "entriesread":
+				// the lag is always computed from the index
+				if i+1 >= len(args) {
+					return nil, ErrSyntax
+				}
+				i++
+			default:
+				return nil, ErrSyntax
+			}
+		}
+
+		if s == nil {
+			if !mkStream {
+				return nil, errXGroupKeyMissing
+			}
+
+			if s, err = createStream(key); err != nil {
+				return nil, err
+			}
+		}
+		defer s.close()
+
+		id, err := s.parseGroupID(args[3])
+		if err != nil {
+			return nil, err
+		}
+
+		g, err := s.createGroup(group, id)
+		if err != nil {
+			return nil, err
+		}
+		if g == nil {
+			return nil, errBusyGroup
+		}
+		defer g.close()
+
+		if err := g.commit(); err != nil {
+			return nil, err
+		}
+		touch(key)
+
+		return "OK", nil
+	}
+
+	if s == nil {
+		return nil, errXGroupKeyMissing
+	}
+	defer s.close()
+
+	if subcommand == "destroy" {
+		path := s.groupPath(group)
+		if _, err := os.Lstat(path); err != nil {
+			if os.IsNotExist(err) {
+				return 0, nil
+			}
+			return nil, err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		touch(key)
+
+		return 1, nil
+	}
+
+	g, err := s.openGroup(group)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return nil, errNoGroupForKey(keyName, group)
+	}
+	defer g.close()
+
+	var result interface{}
+	switch subcommand {
+	case "setid":
+		if len(args) != 4 && !(len(args) == 6 && strings.ToLower(string(args[4])) == "entriesread") {
+			return nil, ErrSyntax
+		}
+
+		id, err := s.parseGroupID(args[3])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := g.setLastID(id); err != nil {
+			return nil, err
+		}
+		result = "OK"
+	case "createconsumer":
+		consumer, err := g.consumer(args[3])
+		if err != nil {
+			return nil, err
+		}
+		if consumer != nil {
+			return 0, nil
+		}
+
+		if _, err := g.seeConsumer(args[3], false); err != nil {
+			return nil, err
+		}
+		result = 1
+	case "delconsumer":
+		deleted, err := g.deleteConsumer(args[3])
+		if err != nil {
+			return nil, err
+		}
+		result = deleted
+	}
+
+	if err := g.commit(); err != nil {
+		return nil, err
+	}
+	touch(key)
+
+	return result, nil
+}
+
+// XReadGroup reads as consumer of group, see XRead. An ID in ids with
+// newOnly set (">") reads the entries never delivered to the group,
+// any other ID reads the pending entries of the consumer following it.
+func XReadGroup(dbNum int, group, consumer []byte, keys [][]byte, ids []StreamID, newOnly []bool, count int, noAck, block bool) ([]StreamRead, *StreamWaiter, error) {
+	if count <= 0 {
+		count = -1
+	}
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	streamKeys := make([]alg.Key, len(keys))
+	streams := make([]*stream, len(keys))
+	groups := make([]*streamGroup, len(keys))
+	defer func() {
+		for i := range keys {
+			if groups[i] != nil {
+				groups[i].close()
+			}
+			if streams[i] != nil {
+				streams[i].close()
+			}
+		}
+	}()
+
+	for i, keyName := range keys {
+		streamKeys[i] = cache.NewKey(dbNum, keyName)
+
+		s, g, err := openStreamGroup(streamKeys[i], keyName, group)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				err = fmt.Errorf("%s in XREADGROUP with GROUP option", err)
+			}
+			return nil, nil, err
+		}
+
+		streams[i], groups[i] = s, g
+	}
+
+	result := []StreamRead{}
+	for i, keyName := range keys {
+		s, g := streams[i], groups[i]
+
+		var entries []StreamEntry
+		var err error
+		if newOnly[i] {
+			entries, err = g.deliverNew(consumer, count, noAck)
+		} else {
+			entries, err = g.readHistory(consumer, ids[i], count)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := g.commit(); err != nil {
+			return nil, nil, err
+		}
+		if len(entries) > 0 {
+			touch(s.key)
+		}
+
+		if len(entries) > 0 || !newOnly[i] {
+			result = append(result, StreamRead{
+				Key:     keyName,
+				Entries: entries,
+			})
+		}
+	}
+
+	if len(result) > 0 || !block {
+		return result, nil, nil
+	}
+
+	return result, registerStreamWaiter(streamKeys), nil
+}
+
+// deliverNew delivers to consumer up to count entries never delivered
+// to the group, adding them to the pending entries list unless noAck
+func (g *streamGroup) deliverNew(consumer []byte, count int, noAck bool) ([]StreamEntry, error) {
+	var entries []StreamEntry
+	if start, ok := g.lastID.next(); ok {
+		var err error
+		if entries, err = g.s.rangeEntries(start, maxStreamID, count, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := g.seeConsumer(consumer, len(entries) > 0); err != nil {
+		return nil, err
+	}
+
+	if len(entries) == 0 {
+		return entries, nil
+	}
+
+	now := nowMs()
+	for _, entry := range entries {
+		if noAck {
+			continue
+		}
+
+		err := g.setPending(PendingEntry{
+			ID:            entry.ID,
+			Consumer:      consumer,
+			DeliveryTime:  now,
+			DeliveryCount: 1,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, g.setLastID(entries[len(entries)-1].ID)
+}
+
+// readHistory returns up to count pending entries of consumer following
+// after, entries deleted from the stream have nil fields. The entries
+// still in the stream count as delivered once more.
+func (g *streamGroup) readHistory(consumer []byte, after StreamID, count int) ([]StreamEntry, error) {
+	if _, err := g.seeConsumer(consumer, false); err != nil {
+		return nil, err
+	}
+
+	entries := []StreamEntry{}
+	start, ok := after.next()
+	if !ok {
+		return entries, nil
+	}
+
+	pending := []PendingEntry{}
+	err := g.iteratePending(start, maxStreamID, consumer, func(entry PendingEntry) bool {
+		pending = append(pending, entry)
+		return count < 0 || len(pending) < count
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reader := g.s.newSegmentReader()
+	defer reader.close()
+
+	now := nowMs()
+	for _, p := range pending {
+		entry, err := g.s.entry(p.ID, reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if entry.Fields != nil {
+			p.DeliveryTime = now
+			p.DeliveryCount++
+			if err := g.setPending(p); err != nil {
+				return nil, err
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// XAck acknowledges the given entries, returning how many were pending
+func XAck(dbNum int, keyName, group []byte, ids []StreamID) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, g, err := openStreamGroup(key, keyName, group)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer s.close()
+	defer g.close()
+
+	acked := 0
+	for _, id := range ids {
+		found, err := g.ack(id)
+		if err != nil {
+			return 0, err
+		}
+
+		if found {
+			acked++
+		}
+	}
+
+	if acked == 0 {
+		return 0, nil
+	}
+
+	if err := g.commit(); err != nil {
+		return 0, err
+	}
+	touch(key)
+
+	return acked, nil
+}
+
+// XPendingSummary is the reply of XPENDING without a range
+type XPendingSummary struct {
+	Count     int
+	First     StreamID
+	Last      StreamID
+	Consumers []*StreamConsumer // only the ones with pending entries
+}
+
+func XPendingSummaryOf(dbNum int, keyName, group []byte) (*XPendingSummary, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, g, err := openStreamGroup(key, keyName, group)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	defer g.close()
+
+	summary := &XPendingSummary{}
+	if summary.Count, err = g.pendingCount(); err != nil || summary.Count == 0 {
+		return summary, err
+	}
+
+	from, to, err := g.rankRange([]byte{groupPendingPrefix}, []byte{groupPendingPrefix + 1})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, id := range []*StreamID{&summary.First, &summary.Last} {
+		c, err := g.tree.SeekIndex([]int{from, to - 1}[i])
+		if err != nil {
+			return nil, err
+		}
+		if !c.Valid() {
+			return nil, fmt.Errorf("corrupted consumer group of key %s", keyName)
+		}
+
+		*id = decodeStreamID(c.Key()[1:])
+	}
+
+	consumers, err := g.consumers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, consumer := range consumers {
+		if consumer.Pending > 0 {
+			summary.Consumers = append(summary.Consumers, consumer)
+		}
+	}
+
+	return summary, nil
+}
+
+// XPending returns up to count pending entries with an ID between start
+// and end, idle for at least minIdle ms, only the ones of consumer if
+// not nil
+func XPending(dbNum int, keyName, group []byte, minIdle uint64, start, end StreamID, count int, consumer []byte) ([]PendingEntry, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, g, err := openStreamGroup(key, keyName, group)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	defer g.close()
+
+	result := []PendingEntry{}
+	if count <= 0 {
+		return result, nil
+	}
+
+	now := nowMs()
+	err = g.iteratePending(start, end, consumer, func(entry PendingEntry) bool {
+		if minIdle > 0 && idleTime(now, entry.DeliveryTime) < minIdle {
+			return true
+		}
+
+		result = append(result, entry)
+		return len(result) < count
+	})
+
+	return result, err
+}
+
+func idleTime(now, since uint64) uint64 {
+	if since > now {
+		return 0
+	}
+
+	return now - since
+}
+
+// XClaimArgs are the options of XCLAIM
+type XClaimArgs struct {
+	IDs        []StreamID
+	Idle       *uint64 // the idle time to set, in ms
+	Time       *uint64 // the delivery time to set, unix time in ms
+	RetryCount *uint64
+	Force      bool
+	JustID     bool
+	LastID     *StreamID
+}
+
+// ParseXClaimArgs parses the arguments of XCLAIM following min-idle-time
+func ParseXClaimArgs(args [][]byte) (*XClaimArgs, error) {
+	claim := &XClaimArgs{}
+
+	i := 0
+	for ; i < len(args); i++ {
+		id, err := ParseStreamID(args[i], 0)
+		if err != nil {
+			break
+		}
+		claim.IDs = append(claim.IDs, id)
+	}
+	if len(claim.IDs) == 0 {
+		return nil, ErrInvalidStreamID
+	}
+
+	number := func(arg []byte) (*uint64, error) {
+		n, err := ParseInt(arg)
+		if err != nil || n < 0 {
+			return nil, errors.New("ERR Invalid " + strings.ToUpper(string(args[i-1])) + " option argument for XCLAIM")
+		}
+
+		value := uint64(n)
+		return &value, nil
+	}
+
+	for ; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch option {
+		case "force":
+			claim.Force = true
+			continue
+		case "justid":
+			claim.JustID = true
+			continue
+		case "idle", "time", "retrycount", "lastid":
+		default:
+			return nil, fmt.Errorf("ERR Unrecognized XCLAIM option '%s'", args[i])
+		}
+
+		if i+1 >= len(args) {
+			return nil, ErrSyntax
+		}
+		i++
+
+		var err error
+		switch option {
+		case "idle":
+			claim.Idle, err = number(args[i])
+		case "time":
+			claim.Time, err = number(args[i])
+		case "retrycount":
+			claim.RetryCount, err = number(args[i])
+		case "lastid":
+			var id StreamID
+			if id, err = ParseStreamID(args[i], 0); err == nil {
+				claim.LastID = &id
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return claim, nil
+}
+
+// claim moves the pending entry id to consumer if it has been idle for at
+// least minIdle ms. An entry deleted from the stream is dropped from the
+// pending entries list. It reports whether the entry has been claimed and
+// whether it was deleted.
+func (g *streamGroup) claim(id StreamID, consumer []byte, minIdle, now uint64, args *XClaimArgs) (bool, bool, error) {
+	pending, err := g.pending(id)
+	if err != nil {
+		return false, false, err
+	}
+
+	_, exists, err := g.s.index.Get(id.encode())
+	if err != nil {
+		return false, false, err
+	}
+
+	if !exists {
+		if pending != nil {
+			if _, err := g.ack(id); err != nil {
+				return false, false, err
+			}
+		}
+		return false, true, nil
+	}
+
+	if pending == nil {
+		if !args.Force {
+			return false, false, nil
+		}
+
+		pending = &PendingEntry{
+			ID: id,
+		}
+	} else if minIdle > 0 && idleTime(now, pending.DeliveryTime) < minIdle {
+		return false, false, nil
+	}
+
+	pending.Consumer = consumer
+	pending.DeliveryTime = now
+	switch {
+	case args.Idle != nil:
+		pending.DeliveryTime = now - *args.Idle
+		if *args.Idle > now {
+			pending.DeliveryTime = 0
+		}
+	case args.Time != nil:
+		pending.DeliveryTime = *args.Time
+	}
+
+	switch {
+	case args.RetryCount != nil:
+		pending.DeliveryCount = *args.RetryCount
+	case !args.JustID:
+		pending.DeliveryCount++
+	}
+
+	return true, false, g.setPending(*pending)
+}
+
+// XClaim gives the pending entries idle for at least minIdle ms to
+// consumer, returning them (only their IDs with JUSTID)
+func XClaim(dbNum int, keyName, group, consumer []byte, minIdle uint64, args *XClaimArgs) ([]StreamEntry, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, g, err := openStreamGroup(key, keyName, group)
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	defer g.close()
+
+	if args.LastID != nil && g.lastID.Less(*args.LastID) {
+		if err := g.setLastID(*args.LastID); err != nil {
+			return nil, err
+		}
+	}
+
+	now := nowMs()
+	claimed := []StreamID{}
+	for _, id := range args.IDs {
+		ok, _, err := g.claim(id, consumer, minIdle, now, args)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			claimed = append(claimed, id)
+		}
+	}
+
+	if _, err := g.seeConsumer(consumer, len(claimed) > 0); err != nil {
+		return nil, err
+	}
+
+	entries, err := g.claimedEntries(claimed, args.JustID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := g.commit(); err != nil {
+		return nil, err
+	}
+	touch(key)
+
+	return entries, nil
+}
+
+func (g *streamGroup) claimedEntries(ids []StreamID, justID bool) ([]StreamEntry, error) {
+	entries := make([]StreamEntry, 0, len(ids))
+
+	reader := g.s.newSegmentReader()
+	defer reader.close()
+
+	for _, id := range ids {
+		entry := StreamEntry{
+			ID: id,
+		}
+
+		if !justID {
+			var err error
+			if entry, err = g.s.entry(id, reader); err != nil {
+				return nil, err
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// XAutoClaim claims up to count entries idle for at least minIdle ms,
+// scanning the pending entries list from start. It returns the ID to
+// continue the scan from (0-0 once done), the claimed entries and the
+// IDs of the entries deleted from the stream found along the way.
+func XAutoClaim(dbNum int, keyName, group, consumer []byte, minIdle uint64, start StreamID, count int, justID bool) (StreamID, []StreamEntry, []StreamID, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	s, g, err := openStreamGroup(key, keyName, group)
+	if err != nil {
+		return StreamID{}, nil, nil, err
+	}
+	defer s.close()
+	defer g.close()
+
+	// like Redis, look at most at 10 times count entries per call, one
+	// more tells where the next call starts from
+	candidates := []StreamID{}
+	err = g.iteratePending(start, maxStreamID, nil, func(entry PendingEntry) bool {
+		candidates = append(candidates, entry.ID)
+		return len(candidates) <= count*10
+	})
+	if err != nil {
+		return StreamID{}, nil, nil, err
+	}
+
+	now := nowMs()
+	args := &XClaimArgs{
+		JustID: justID,
+	}
+	claimed, deleted := []StreamID{}, []StreamID{}
+	i := 0
+	for ; i < len(candidates) && i < count*10 && len(claimed) < count; i++ {
+		ok, gone, err := g.claim(candidates[i], consumer, minIdle, now, args)
+		if err != nil {
+			return StreamID{}, nil, nil, err
+		}
+
+		switch {
+		case ok:
+			claimed = append(claimed, candidates[i])
+		case gone:
+			deleted = append(deleted, candidates[i])
+		}
+	}
+
+	next := StreamID{}
+	if i < len(candidates) {
+		next = candidates[i]
+	}
+
+	if _, err := g.seeConsumer(consumer, len(claimed) > 0); err != nil {
+		return StreamID{}, nil, nil, err
+	}
+
+	entries, err := g.claimedEntries(claimed, justID)
+	if err != nil {
+		return StreamID{}, nil, nil, err
+	}
+
+	if err := g.commit(); err != nil {
+		return StreamID{}, nil, nil, err
+	}
+	touch(key)
+
+	return next, entries, deleted, nil
+}
+
+// StreamGroupInfo describes a consumer group for XINFO
+type StreamGroupInfo struct {
+	Name            []byte
+	Consumers       int
+	Pending         int
+	LastDeliveredID StreamID
+	EntriesRead     int
+	Lag             int
+
+	// only set by XINFO STREAM FULL
+	PendingEntries []PendingEntry
+	ConsumerInfos  []*StreamConsumer
+}
+
+// StreamInfo describes a stream for XINFO STREAM
+type StreamInfo struct {
+	Length               int
+	LastGeneratedID      StreamID
+	MaxDeletedID         StreamID
+	EntriesAdded         uint64
+	RecordedFirstEntryID StreamID
+	Groups               int
+	FirstEntry           *StreamEntry
+	LastEntry            *StreamEntry
+
+	// only set by XINFO STREAM FULL
+	Entries    []StreamEntry
+	GroupInfos []*StreamGroupInfo
+}
+
+// info describes the group, with its pending entries and consumers if full
+// is set, up to count of them if positive
+func (g *streamGroup) info(full bool, count int) (*StreamGroupInfo, error) {
+	info := &StreamGroupInfo{
+		Name:            g.name,
+		LastDeliveredID: g.lastID,
+	}
+
+	consumers, err := g.consumers()
+	if err != nil {
+		return nil, err
+	}
+	info.Consumers = len(consumers)
+
+	if info.Pending, err = g.pendingCount(); err != nil {
+		return nil, err
+	}
+
+	if info.Lag, err = g.s.lag(g.lastID); err != nil {
+		return nil, err
+	}
+
+	// deleted entries are counted as read, so it's exact only without XDEL
+	if g.lastID != (StreamID{}) && int(g.s.entriesAdded) > info.Lag {
+		info.EntriesRead = int(g.s.entriesAdded) - info.Lag
+	}
+
+	if !full {
+		return info, nil
+	}
+
+	collect := func(consumer []byte) ([]PendingEntry, error) {
+		entries := []PendingEntry{}
+		err := g.iteratePending(StreamID{}, maxStreamID, consumer, func(entry PendingEntry) bool {
+			entries = append(entries, entry)
+			return count <= 0 || len(entries) < count
+		})
+
+		return entries, err
+	}
+
+	if info.PendingEntries, err = collect(nil); err != nil {
+		return nil, err
+	}
+
+	for _, consumer := range consumers {
+		if consumer.PendingEntries, err = collect(consumer.Name); err != nil {
+			return nil, err
+		}
+	}
+	info.ConsumerInfos = consumers
+
+	return info, nil
+}
+
+// XInfoStream describes the stream at keyName, with its entries and groups
+// if full is set, up to count of each list if positive
+func XInfoStream(dbNum int, keyName []byte, full bool, count int) (*StreamInfo, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := openStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrNoSuchKey
+	}
+	defer s.close()
+
+	info := &StreamInfo{
+		Length:          s.length(),
+		LastGeneratedID: s.lastID,
+		MaxDeletedID:    s.maxDeletedID,
+		EntriesAdded:    s.entriesAdded,
+	}
+
+	if !full {
+		if info.Groups, err = s.groupCount(); err != nil {
+			return nil, err
+		}
+
+		for _, rev := range []bool{false, true} {
+			entries, err := s.rangeEntries(StreamID{}, maxStreamID, 1, rev)
+			if err != nil {
+				return nil, err
+			}
+			if len(entries) == 0 {
+				break
+			}
+
+			if rev {
+				info.LastEntry = &entries[0]
+			} else {
+				info.FirstEntry = &entries[0]
+				info.RecordedFirstEntryID = entries[0].ID
+			}
+		}
+
+		return info, nil
+	}
+
+	if count <= 0 {
+		count = -1
+	}
+	if info.Entries, err = s.rangeEntries(StreamID{}, maxStreamID, count, false); err != nil {
+		return nil, err
+	}
+	if len(info.Entries) > 0 {
+		info.RecordedFirstEntryID = info.Entries[0].ID
+	}
+
+	groups, err := s.groups()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, g := range groups {
+			g.close()
+		}
+	}()
+
+	for _, g := range groups {
+		group, err := g.info(true, count)
+		if err != nil {
+			return nil, err
+		}
+
+		info.GroupInfos = append(info.GroupInfos, group)
+	}
+	info.Groups = len(groups)
+
+	return info, nil
+}
+
+// XInfoGroups describes the groups of the stream at keyName
+func XInfoGroups(dbNum int, keyName []byte) ([]*StreamGroupInfo, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := openStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrNoSuchKey
+	}
+	defer s.close()
+
+	groups, err := s.groups()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, g := range groups {
+			g.close()
+		}
+	}()
+
+	infos := make([]*StreamGroupInfo, 0, len(groups))
+	for _, g := range groups {
+		info, err := g.info(false, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// XInfoConsumers describes the consumers of group
+func XInfoConsumers(dbNum int, keyName, group []byte) ([]*StreamConsumer, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	s, err := openStream(key)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrNoSuchKey
+	}
+	defer s.close()
+
+	g, err := s.openGroup(group)
+	if err != nil {
+		return nil, err
+	}
+	if g == nil {
+		return nil, errNoGroupForKey(keyName, group)
+	}
+	defer g.close()
+
+	return g.consumers()
+}
@@ -0,0 +1,203 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"testing"
+)
+
+func xgroupTest(t *testing.T, db int, args ...string) (interface{}, error) {
+	t.Helper()
+
+	return XGroup(db, testArgs(args...))
+}
+
+func readGroupTest(t *testing.T, db int, key, consumer, id string) []StreamEntry {
+	t.Helper()
+
+	ids := []StreamID{{}}
+	newOnly := []bool{id == ">"}
+	if id != ">" {
+		ids[0] = streamTestID(t, id)
+	}
+
+	result, _, err := XReadGroup(db, []byte("group"), []byte(consumer), testArgs(key), ids, newOnly, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+
+	return result[0].Entries
+}
+
+func checkStreamIDs(t *testing.T, ids []StreamID, want ...string) {
+	t.Helper()
+
+	if len(ids) != len(want) {
+		t.Fatalf("got the IDs %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != streamTestID(t, want[i]) {
+			t.Fatalf("got the IDs %v, want %v", ids, want)
+		}
+	}
+}
+
+func entryIDs(entries []StreamEntry) []StreamID {
+	ids := make([]StreamID, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+	}
+
+	return ids
+}
+
+func TestStreamGroups(t *testing.T) {
+	const db = 4
+	const key = "stream-groups"
+
+	if _, err := xgroupTest(t, db, "create", key, "group", "$"); err != errXGroupKeyMissing {
+		t.Fatalf("XGROUP CREATE of a missing key returned %v", err)
+	}
+	if reply, err := xgroupTest(t, db, "create", key, "group", "$", "mkstream"); err != nil || reply != "OK" {
+		t.Fatalf("XGROUP CREATE MKSTREAM returned %v: %v", reply, err)
+	}
+	if _, err := xgroupTest(t, db, "create", key, "group", "$"); err != errBusyGroup {
+		t.Fatalf("XGROUP CREATE of an existing group returned %v", err)
+	}
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		if _, err := xaddTest(t, db, key, id, "f", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := []StreamID{{}}
+	result, _, err := XReadGroup(db, []byte("group"), []byte("alice"), testArgs(key), ids, []bool{true}, 3, false, false)
+	if err != nil || len(result) != 1 {
+		t.Fatalf("XREADGROUP returned %d streams: %v", len(result), err)
+	}
+	checkStreamIDs(t, entryIDs(result[0].Entries), "1", "2", "3")
+	checkStreamIDs(t, entryIDs(readGroupTest(t, db, key, "bob", ">")), "4", "5")
+	if entries := readGroupTest(t, db, key, "bob", ">"); len(entries) != 0 {
+		t.Fatalf("XREADGROUP > delivered %d entries twice", len(entries))
+	}
+
+	// the pending entries survive a reopen
+	reopen(t, db)
+
+	summary, err := XPendingSummaryOf(db, []byte(key), []byte("group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Count != 5 || summary.First != streamTestID(t, "1") || summary.Last != streamTestID(t, "5") || len(summary.Consumers) != 2 {
+		t.Fatalf("XPENDING summary is %+v", summary)
+	}
+	if string(summary.Consumers[0].Name) != "alice" || summary.Consumers[0].Pending != 3 || summary.Consumers[1].Pending != 2 {
+		t.Fatalf("XPENDING consumers are %s with %d and %s with %d",
+			summary.Consumers[0].Name, summary.Consumers[0].Pending, summary.Consumers[1].Name, summary.Consumers[1].Pending)
+	}
+
+	if acked, err := XAck(db, []byte(key), []byte("group"), []StreamID{{1, 0}, {2, 0}, {9, 0}}); err != nil || acked != 2 {
+		t.Fatalf("XACK acknowledged %d: %v", acked, err)
+	}
+	if acked, err := XAck(db, []byte(key), []byte("group"), []StreamID{{1, 0}}); err != nil || acked != 0 {
+		t.Fatalf("XACK of an acknowledged entry returned %d: %v", acked, err)
+	}
+
+	// reading the history delivers the pending entries once more
+	checkStreamIDs(t, entryIDs(readGroupTest(t, db, key, "alice", "0")), "3")
+	pending, err := XPending(db, []byte(key), []byte("group"), 0, StreamID{}, maxStreamID, 10, []byte("alice"))
+	if err != nil || len(pending) != 1 || pending[0].DeliveryCount != 2 {
+		t.Fatalf("XPENDING of alice returned %+v: %v", pending, err)
+	}
+
+	// the claims skip and drop the entries deleted from the stream
+	if _, err := XDel(db, []byte(key), []StreamID{{4, 0}}); err != nil {
+		t.Fatal(err)
+	}
+	next, claimed, deleted, err := XAutoClaim(db, []byte(key), []byte("group"), []byte("alice"), 0, StreamID{4, 0}, 10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != (StreamID{}) {
+		t.Fatalf("XAUTOCLAIM returned the cursor %s at the end of the scan", next)
+	}
+	checkStreamIDs(t, entryIDs(claimed), "5")
+	checkStreamIDs(t, deleted, "4")
+
+	claim, err := ParseXClaimArgs(testArgs("3", "5", "justid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err = XClaim(db, []byte(key), []byte("group"), []byte("bob"), 3600*1000, claim); err != nil || len(claimed) != 0 {
+		t.Fatalf("XCLAIM of entries not idle enough claimed %d: %v", len(claimed), err)
+	}
+	if claimed, err = XClaim(db, []byte(key), []byte("group"), []byte("bob"), 0, claim); err != nil {
+		t.Fatal(err)
+	}
+	checkStreamIDs(t, entryIDs(claimed), "3", "5")
+
+	reopen(t, db)
+
+	groups, err := XInfoGroups(db, []byte(key))
+	if err != nil || len(groups) != 1 {
+		t.Fatalf("XINFO GROUPS returned %d groups: %v", len(groups), err)
+	}
+	if groups[0].Consumers != 2 || groups[0].Pending != 2 || groups[0].LastDeliveredID != streamTestID(t, "5") {
+		t.Fatalf("XINFO GROUPS returned %+v", groups[0])
+	}
+
+	if reply, err := xgroupTest(t, db, "delconsumer", key, "group", "bob"); err != nil || reply != 2 {
+		t.Fatalf("XGROUP DELCONSUMER returned %v: %v", reply, err)
+	}
+	if summary, err = XPendingSummaryOf(db, []byte(key), []byte("group")); err != nil || summary.Count != 0 {
+		t.Fatalf("XPENDING counts %d entries after DELCONSUMER: %v", summary.Count, err)
+	}
+
+	// every group is a file of the stream dir
+	cache.FSRWL.RLock()
+	s, err := openStream(cache.NewKey(db, []byte(key)))
+	if err != nil {
+		cache.FSRWL.RUnlock()
+		t.Fatal(err)
+	}
+	path := s.groupPath([]byte("group"))
+	s.close()
+	cache.FSRWL.RUnlock()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := xgroupTest(t, db, "destroy", key, "group"); err != nil || reply != 1 {
+		t.Fatalf("XGROUP DESTROY returned %v: %v", reply, err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("the group file survived XGROUP DESTROY: %v", err)
+	}
+	if _, err := XPendingSummaryOf(db, []byte(key), []byte("group")); err == nil {
+		t.Fatal("XPENDING of a destroyed group succeeded")
+	}
+
+	if _, err := Del(db, testArgs(key)); err != nil {
+		t.Fatal(err)
+	}
+}
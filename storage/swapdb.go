@@ -0,0 +1,169 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/RcrdBrt/gobigdis/config"
+)
+
+/*
+	SWAPDB swaps the dirs of two DBs, of their search indexes and of their
+	time series registries, three renames per pair of dirs through a
+	temporary name. The number of renames done is recorded in a journal
+	after each of them, so that a crash in the middle is recovered at the
+	next start by running the remaining ones: a missing source means that
+	the dir did not exist or that the rename was done right before the
+	crash, since only the renames following it can bring back its source.
+	If a rename fails, the ones done are undone in reverse order, updating
+	the journal before each of them.
+*/
+
+const swapJournalFileName = "SWAPDB"
+
+func swapJournalPath() string {
+	return filepath.Join(config.Config.DBConfig.InternalDirPath, swapJournalFileName)
+}
+
+// SwapDB swaps the keys of two DBs, along with their search indexes and
+// time series registries, by renaming their dirs
+func SwapDB(a, b int) error {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	if a == b {
+		return nil
+	}
+
+	if err := writeSwapJournal(a, b, 0); err != nil {
+		return err
+	}
+
+	if err := swapDirs(a, b, 0); err != nil {
+		return err
+	}
+
+	cache.SwapDB(a, b)
+	swapSearchIndexes(a, b)
+
+	for _, dbNum := range []int{a, b} {
+		touchDB(dbNum)
+		signalDBReady(dbNum)
+	}
+
+	return nil
+}
+
+// swapSteps returns the renames swapping the dirs of the DBs a and b
+func swapSteps(a, b int) [][2]string {
+	steps := [][2]string{}
+
+	for _, dirs := range [][2]string{
+		{dbDirPath(a), dbDirPath(b)},
+		{searchDBDir(a), searchDBDir(b)},
+		{tsRegistryDBDir(a), tsRegistryDBDir(b)},
+	} {
+		tmp := dirs[0] + ".swap"
+		steps = append(steps,
+			[2]string{dirs[0], tmp},
+			[2]string{dirs[1], dirs[0]},
+			[2]string{tmp, dirs[1]},
+		)
+	}
+
+	return steps
+}
+
+// swapDirs runs the renames swapping the dirs of the DBs a and b from the
+// done-th on, undoing all of them if one fails. The journal is removed
+// once the dirs are either swapped or back in place.
+func swapDirs(a, b int, done int) error {
+	steps := swapSteps(a, b)
+
+	var err error
+	for ; done < len(steps); done++ {
+		if err = renameDir(steps[done][0], steps[done][1]); err != nil {
+			break
+		}
+
+		if err = writeSwapJournal(a, b, done+1); err != nil {
+			// the rename is done, undo it too
+			done++
+			break
+		}
+	}
+
+	for ; err != nil && done > 0; done-- {
+		if undoErr := writeSwapJournal(a, b, done-1); undoErr != nil {
+			log.Println(undoErr)
+			return err
+		}
+
+		if undoErr := renameDir(steps[done-1][1], steps[done-1][0]); undoErr != nil {
+			// the next start will run the remaining renames again
+			log.Println(undoErr)
+			return err
+		}
+	}
+
+	if removeErr := os.Remove(swapJournalPath()); removeErr != nil && err == nil {
+		return removeErr
+	}
+
+	return err
+}
+
+// renameDir renames the dir src to dst durably, doing nothing if src
+// does not exist
+func renameDir(src, dst string) error {
+	if err := os.Rename(src, dst); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return syncDir(filepath.Dir(dst))
+}
+
+func writeSwapJournal(a, b, done int) error {
+	return writeFileAtomic(swapJournalPath(), []byte(fmt.Sprintf("%d %d %d", a, b, done)))
+}
+
+// recoverSwapDB completes a SWAPDB interrupted by a crash, it must run
+// before anything else reads the dirs of the DBs
+func recoverSwapDB() error {
+	journal, err := os.ReadFile(swapJournalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var a, b, done int
+	if _, err := fmt.Sscanf(string(journal), "%d %d %d", &a, &b, &done); err != nil {
+		return fmt.Errorf("corrupted SWAPDB journal: %v", err)
+	}
+
+	return swapDirs(a, b, done)
+}
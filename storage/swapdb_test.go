@@ -0,0 +1,137 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkValue(t *testing.T, db int, keyName, want string) {
+	t.Helper()
+
+	value, err := Get(db, testArgs(keyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want == "" && value != nil {
+		t.Fatalf("%s is %q in DB %d, want no value", keyName, value, db)
+	}
+	if want != "" && string(value) != want {
+		t.Fatalf("%s is %q in DB %d, want %q", keyName, value, db, want)
+	}
+}
+
+func checkNoSwapJournal(t *testing.T) {
+	t.Helper()
+
+	if _, err := os.Stat(swapJournalPath()); !os.IsNotExist(err) {
+		t.Fatalf("the SWAPDB journal was left behind: %v", err)
+	}
+}
+
+func TestSwapDB(t *testing.T) {
+	const a, b = 6, 7
+
+	if _, _, err := Set(a, testArgs("swap-key", "a"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SwapDB(a, b); err != nil {
+		t.Fatal(err)
+	}
+
+	checkValue(t, a, "swap-key", "")
+	checkValue(t, b, "swap-key", "a")
+	if DBSize(a) != 0 || DBSize(b) != 1 {
+		t.Fatalf("DBSIZE is %d and %d, want 0 and 1", DBSize(a), DBSize(b))
+	}
+	checkNoSwapJournal(t)
+}
+
+func TestSwapDBRollback(t *testing.T) {
+	const a, b = 8, 9
+
+	if _, _, err := Set(a, testArgs("rollback-key", "a"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the search dirs are swapped after the DB dirs, make them fail
+	if err := os.MkdirAll(searchDBDir(a), 0700); err != nil {
+		t.Fatal(err)
+	}
+	blocker := filepath.Join(searchDBDir(a)+".swap", "blocker")
+	if err := os.MkdirAll(blocker, 0700); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(blocker))
+
+	if err := SwapDB(a, b); err == nil {
+		t.Fatal("SWAPDB succeeded despite the failing rename")
+	}
+
+	checkValue(t, a, "rollback-key", "a")
+	checkValue(t, b, "rollback-key", "")
+	if _, err := os.Stat(searchDBDir(a)); err != nil {
+		t.Fatalf("the search dir did not go back in place: %v", err)
+	}
+	if _, err := os.Stat(dbDirPath(a) + ".swap"); !os.IsNotExist(err) {
+		t.Fatalf("the temporary DB dir was left behind: %v", err)
+	}
+	checkNoSwapJournal(t)
+}
+
+func TestRecoverSwapDB(t *testing.T) {
+	const a, b = 10, 11
+
+	if _, _, err := Set(a, testArgs("recover-key", "a"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash after the second rename, before the journal records it
+	steps := swapSteps(a, b)
+	for _, step := range steps[:2] {
+		if err := renameDir(step[0], step[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeSwapJournal(a, b, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recoverSwapDB(); err != nil {
+		t.Fatal(err)
+	}
+	checkNoSwapJournal(t)
+
+	for _, step := range steps {
+		if filepath.Ext(step[0]) == ".swap" {
+			if _, err := os.Stat(step[0]); !os.IsNotExist(err) {
+				t.Fatalf("%s was left behind: %v", step[0], err)
+			}
+		}
+	}
+
+	// the recovery runs before the cache is built
+	cache.BuildCacheData()
+
+	checkValue(t, a, "recover-key", "")
+	checkValue(t, b, "recover-key", "a")
+}
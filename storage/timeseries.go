@@ -0,0 +1,1196 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+	"github.com/RcrdBrt/gobigdis/config"
+)
+
+/*
+	Time series are dirs holding a meta file (retention, chunk size,
+	duplicate policy, labels and compaction rules, encoded as JSON) and a
+	dir of alg.GorillaChunk files named after the hex of their first
+	timestamp. Samples are appended in place to the last chunk until it
+	reaches the chunk size; older samples rewrite the chunk they belong to.
+
+	The names of the time series of every DB are registered under the
+	internal dir, as keys are only known by their hash otherwise, so that
+	TS.MRANGE and the retention task can find them.
+*/
+
+const (
+	tsMetaFileName     = "meta"
+	tsChunksDirName    = "chunks"
+	tsRegistryDirName  = "timeseries"
+	tsChunkNameLength  = 16
+	tsDefaultChunkSize = 4096
+	tsMaxChunkSize     = 1048576
+
+	// how often the retention is enforced
+	tsRetentionInterval = 10 * time.Second
+)
+
+var (
+	errTSExists           = errors.New("ERR TSDB: key already exists")
+	errTSNotFound         = errors.New("ERR TSDB: the key does not exist")
+	errTSRetention        = errors.New("ERR TSDB: Couldn't parse RETENTION")
+	errTSChunkSize        = errors.New("ERR TSDB: CHUNK_SIZE value must be a multiple of 8 in the range [48 .. 1048576]")
+	errTSDuplicatePolicy  = errors.New("ERR TSDB: Unknown DUPLICATE_POLICY")
+	errTSTimestamp        = errors.New("ERR TSDB: invalid timestamp")
+	errTSValue            = errors.New("ERR TSDB: invalid value")
+	errTSTooOld           = errors.New("ERR TSDB: Timestamp is older than retention")
+	errTSBlock            = errors.New("ERR TSDB: Error at upsert, update is not supported when DUPLICATE_POLICY is set to BLOCK mode")
+	errTSAggregation      = errors.New("ERR TSDB: Unknown aggregation type")
+	errTSBucket           = errors.New("ERR TSDB: bucketDuration must be greater than zero")
+	errTSCount            = errors.New("ERR TSDB: Couldn't parse COUNT")
+	errTSFilter           = errors.New("ERR TSDB: failed parsing labels")
+	errTSMatcher          = errors.New("ERR TSDB: please provide at least one matcher")
+	errTSSameKey          = errors.New("ERR TSDB: the source key and destination key should be different")
+	errTSDestinationRule  = errors.New("ERR TSDB: the destination key already has a src rule")
+	errTSDestinationRules = errors.New("ERR TSDB: the destination key already has a dst rule")
+	errTSSourceRule       = errors.New("ERR TSDB: the source key already has a source rule")
+	errTSRuleNotFound     = errors.New("ERR TSDB: compaction rule does not exist")
+)
+
+var tsDuplicatePolicies = []string{"block", "first", "last", "min", "max", "sum"}
+
+var tsAggregations = []string{"avg", "sum", "min", "max", "count", "first", "last", "range"}
+
+type TSLabel struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// tsAggregator accumulates the samples of a bucket
+type tsAggregator struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	First float64 `json:"first"`
+	Last  float64 `json:"last"`
+}
+
+func (a *tsAggregator) add(value float64) {
+	if a.Count == 0 {
+		a.Min, a.Max, a.First = value, value, value
+	}
+
+	a.Min = math.Min(a.Min, value)
+	a.Max = math.Max(a.Max, value)
+	a.Sum += value
+	a.Last = value
+	a.Count++
+}
+
+func (a *tsAggregator) value(aggregation string) float64 {
+	switch aggregation {
+	case "avg":
+		return a.Sum / float64(a.Count)
+	case "sum":
+		return a.Sum
+	case "min":
+		return a.Min
+	case "max":
+		return a.Max
+	case "count":
+		return float64(a.Count)
+	case "first":
+		return a.First
+	case "last":
+		return a.Last
+	default:
+		return a.Max - a.Min
+	}
+}
+
+// tsRule compacts the samples of a series into Destination, a sample per
+// bucket of Bucket milliseconds, when the first sample of the next bucket
+// arrives. Samples older than the current bucket are not compacted.
+type tsRule struct {
+	Destination string        `json:"destination"`
+	Aggregation string        `json:"aggregation"`
+	Bucket      int64         `json:"bucket"`
+	BucketStart int64         `json:"bucket_start"`
+	State       *tsAggregator `json:"state,omitempty"`
+}
+
+type tsMeta struct {
+	Retention       int64     `json:"retention"`
+	ChunkSize       uint64    `json:"chunk_size"`
+	DuplicatePolicy string    `json:"duplicate_policy"`
+	Labels          []TSLabel `json:"labels"`
+	Rules           []tsRule  `json:"rules"`
+	Source          string    `json:"source,omitempty"` // of the rule compacting into the series
+}
+
+type TSOptions struct {
+	Retention       int64
+	ChunkSize       uint64
+	DuplicatePolicy string
+	Labels          []TSLabel
+	OnDuplicate     string // for TS.ADD, overrides the policy of the series
+}
+
+// ParseTSOptions parses the options of TS.CREATE, or of TS.ADD if add
+func ParseTSOptions(args [][]byte, add bool) (*TSOptions, error) {
+	opts := &TSOptions{
+		ChunkSize:       tsDefaultChunkSize,
+		DuplicatePolicy: "block",
+	}
+
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		if option != "labels" && i+1 == len(args) {
+			return nil, ErrSyntax
+		}
+
+		switch {
+		case option == "retention":
+			i++
+			retention, err := ParseInt(args[i])
+			if err != nil || retention < 0 {
+				return nil, errTSRetention
+			}
+			opts.Retention = retention
+		case option == "chunk_size":
+			i++
+			size, err := ParseInt(args[i])
+			if err != nil || size < 48 || size > tsMaxChunkSize || size%8 != 0 {
+				return nil, errTSChunkSize
+			}
+			opts.ChunkSize = uint64(size)
+		case option == "duplicate_policy" && !add, option == "on_duplicate" && add:
+			i++
+			policy, err := parseTSDuplicatePolicy(args[i])
+			if err != nil {
+				return nil, err
+			}
+			if add {
+				opts.OnDuplicate = policy
+			} else {
+				opts.DuplicatePolicy = policy
+			}
+		case option == "labels":
+			// the labels take the rest of the arguments
+			rest := args[i+1:]
+			if len(rest)%2 != 0 {
+				return nil, ErrSyntax
+			}
+
+			for j := 0; j < len(rest); j += 2 {
+				opts.Labels = append(opts.Labels, TSLabel{string(rest[j]), string(rest[j+1])})
+			}
+			i = len(args)
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	return opts, nil
+}
+
+func parseTSDuplicatePolicy(b []byte) (string, error) {
+	policy := strings.ToLower(string(b))
+	for _, p := range tsDuplicatePolicies {
+		if p == policy {
+			return policy, nil
+		}
+	}
+
+	return "", errTSDuplicatePolicy
+}
+
+// ParseTSTimestamp parses the timestamp of a sample, * being the current time
+func ParseTSTimestamp(b []byte) (int64, error) {
+	if string(b) == "*" {
+		return time.Now().UnixNano() / int64(time.Millisecond), nil
+	}
+
+	timestamp, err := ParseInt(b)
+	if err != nil || timestamp < 0 {
+		return 0, errTSTimestamp
+	}
+
+	return timestamp, nil
+}
+
+// ParseTSValue parses the value of a sample
+func ParseTSValue(b []byte) (float64, error) {
+	value, err := ParseFloat(b)
+	if err != nil {
+		return 0, errTSValue
+	}
+
+	return value, nil
+}
+
+// parseTSAggregation parses the type and bucket duration following AGGREGATION
+func parseTSAggregation(args [][]byte) (string, int64, error) {
+	if len(args) < 2 {
+		return "", 0, ErrSyntax
+	}
+
+	aggregation := strings.ToLower(string(args[0]))
+	found := false
+	for _, a := range tsAggregations {
+		found = found || a == aggregation
+	}
+	if !found {
+		return "", 0, errTSAggregation
+	}
+
+	bucket, err := ParseInt(args[1])
+	if err != nil || bucket <= 0 {
+		return "", 0, errTSBucket
+	}
+
+	return aggregation, bucket, nil
+}
+
+type tsFilter struct {
+	label  string
+	values []string // the empty string matches a missing label
+	equal  bool
+}
+
+func (f tsFilter) match(labels []TSLabel) bool {
+	value := ""
+	for _, label := range labels {
+		if label.Name == f.label {
+			value = label.Value
+		}
+	}
+
+	in := false
+	for _, v := range f.values {
+		in = in || v == value
+	}
+
+	return in == f.equal
+}
+
+// parseTSFilter parses label=value, label!=value, label=, label!=,
+// label=(value,...) and label!=(value,...)
+func parseTSFilter(b []byte) (tsFilter, error) {
+	s := string(b)
+
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return tsFilter{}, errTSFilter
+	}
+
+	f := tsFilter{
+		label: s[:i],
+		equal: true,
+	}
+	if strings.HasSuffix(f.label, "!") {
+		f.label = f.label[:len(f.label)-1]
+		f.equal = false
+
+		if f.label == "" {
+			return tsFilter{}, errTSFilter
+		}
+	}
+
+	value := s[i+1:]
+	if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+		f.values = strings.Split(value[1:len(value)-1], ",")
+	} else {
+		f.values = []string{value}
+	}
+
+	return f, nil
+}
+
+type TSRangeArgs struct {
+	From        int64
+	To          int64
+	Count       int // 0 for all
+	Aggregation string
+	Bucket      int64
+	WithLabels  bool
+	filters     []tsFilter
+}
+
+// ParseTSRangeArgs parses the arguments of TS.RANGE following the key, or
+// of TS.MRANGE if multi
+func ParseTSRangeArgs(args [][]byte, multi bool) (*TSRangeArgs, error) {
+	if len(args) < 2 {
+		return nil, ErrSyntax
+	}
+
+	r := &TSRangeArgs{
+		To: math.MaxInt64,
+	}
+
+	var err error
+	if string(args[0]) != "-" {
+		if r.From, err = ParseTSTimestamp(args[0]); err != nil {
+			return nil, err
+		}
+	}
+	if string(args[1]) != "+" {
+		if r.To, err = ParseTSTimestamp(args[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToLower(string(args[i])); {
+		case option == "count" && i+1 < len(args):
+			count, err := ParseInt(args[i+1])
+			if err != nil || count <= 0 {
+				return nil, errTSCount
+			}
+			r.Count = int(count)
+			i++
+		case option == "aggregation":
+			if r.Aggregation, r.Bucket, err = parseTSAggregation(args[i+1:]); err != nil {
+				return nil, err
+			}
+			i += 2
+		case option == "withlabels" && multi:
+			r.WithLabels = true
+		case option == "filter" && multi:
+			for _, arg := range args[i+1:] {
+				f, err := parseTSFilter(arg)
+				if err != nil {
+					return nil, err
+				}
+
+				r.filters = append(r.filters, f)
+			}
+			i = len(args)
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if multi {
+		positive := false
+		for _, f := range r.filters {
+			positive = positive || (f.equal && !(len(f.values) == 1 && f.values[0] == ""))
+		}
+
+		if !positive {
+			return nil, errTSMatcher
+		}
+	}
+
+	return r, nil
+}
+
+type timeSeries struct {
+	key  alg.Key
+	dir  string
+	meta tsMeta
+}
+
+func tsRegistryDBDir(dbNum int) string {
+	return filepath.Join(config.Config.DBConfig.InternalDirPath, tsRegistryDirName, strconv.Itoa(dbNum))
+}
+
+func tsRegistryPath(key alg.Key) string {
+	return filepath.Join(tsRegistryDBDir(key.DB), key.Encode())
+}
+
+// registeredTimeSeries returns the names of the time series of a DB,
+// and maybe of former ones. The caller must hold at least cache.FSRWL.RLock.
+func registeredTimeSeries(dbNum int) ([][]byte, error) {
+	dir := tsRegistryDBDir(dbNum)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	names := [][]byte{}
+	for _, entry := range entries {
+		name, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// openTimeSeries opens the time series at key, nil if the key does not
+// exist. The caller must hold at least cache.FSRWL.RLock.
+func openTimeSeries(key alg.Key) (*timeSeries, error) {
+	found, err := checkType(key, TypeTS)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	ts := &timeSeries{
+		key: key,
+		dir: key.FilePath(),
+	}
+
+	meta, err := os.ReadFile(filepath.Join(ts.dir, tsMetaFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(meta, &ts.meta); err != nil {
+		return nil, fmt.Errorf("corrupted time series meta file for key %s", key.Encode())
+	}
+
+	return ts, nil
+}
+
+// createTimeSeries creates an empty time series at key.
+// The caller must hold cache.FSRWL.Lock.
+func createTimeSeries(key alg.Key, keyName []byte, opts *TSOptions) (*timeSeries, error) {
+	if err := createTyped(key, TypeTS, nil); err != nil {
+		return nil, err
+	}
+
+	touch(key)
+
+	ts := &timeSeries{
+		key: key,
+		dir: key.FilePath(),
+		meta: tsMeta{
+			Retention:       opts.Retention,
+			ChunkSize:       opts.ChunkSize,
+			DuplicatePolicy: opts.DuplicatePolicy,
+			Labels:          opts.Labels,
+		},
+	}
+
+	if err := os.Mkdir(filepath.Join(ts.dir, tsChunksDirName), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := ts.saveMeta(); err != nil {
+		return nil, err
+	}
+
+	registryPath := tsRegistryPath(key)
+	if err := os.MkdirAll(filepath.Dir(registryPath), 0700); err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(registryPath, keyName); err != nil {
+		return nil, err
+	}
+
+	return ts, nil
+}
+
+func (ts *timeSeries) saveMeta() error {
+	meta, err := json.Marshal(ts.meta)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(ts.dir, tsMetaFileName), meta)
+}
+
+func (ts *timeSeries) chunkPath(name string) string {
+	return filepath.Join(ts.dir, tsChunksDirName, name)
+}
+
+func tsChunkName(first int64) string {
+	return fmt.Sprintf("%016x", first)
+}
+
+// chunks returns the names of the chunks, oldest first
+func (ts *timeSeries) chunks() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(ts.dir, tsChunksDirName))
+	if err != nil {
+		return nil, err
+	}
+
+	// os.ReadDir sorts by name, that is by first timestamp
+	names := []string{}
+	for _, entry := range entries {
+		if name := entry.Name(); len(name) == tsChunkNameLength && !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// last returns the timestamp of the newest sample, reporting whether there
+// is any sample
+func (ts *timeSeries) last() (int64, bool, error) {
+	names, err := ts.chunks()
+	if err != nil || len(names) == 0 {
+		return 0, false, err
+	}
+
+	c, err := alg.OpenGorillaChunk(ts.chunkPath(names[len(names)-1]))
+	if err != nil {
+		return 0, false, err
+	}
+	defer c.Close()
+
+	return c.Last, c.Count > 0, nil
+}
+
+// add adds a sample, handling one with the timestamp of an existing sample
+// according to policy. The caller must hold cache.FSRWL.Lock.
+func (ts *timeSeries) add(sample alg.Sample, policy string) error {
+	names, err := ts.chunks()
+	if err != nil {
+		return err
+	}
+
+	var last *alg.GorillaChunk
+	if len(names) > 0 {
+		if last, err = alg.OpenGorillaChunk(ts.chunkPath(names[len(names)-1])); err != nil {
+			return err
+		}
+		defer last.Close()
+
+		if ts.meta.Retention > 0 && sample.Timestamp < last.Last-ts.meta.Retention {
+			return errTSTooOld
+		}
+
+		if sample.Timestamp <= last.Last {
+			return ts.upsert(names, sample, policy)
+		}
+	}
+
+	chunk := last
+	if chunk == nil || chunk.Size() >= ts.meta.ChunkSize {
+		if chunk, err = alg.CreateGorillaChunk(ts.chunkPath(tsChunkName(sample.Timestamp))); err != nil {
+			return err
+		}
+		defer chunk.Close()
+	}
+
+	if err := chunk.Append(sample); err != nil {
+		return err
+	}
+
+	touch(ts.key)
+
+	return ts.compact(sample)
+}
+
+// upsert adds a sample older than the newest one by rewriting its chunk
+func (ts *timeSeries) upsert(names []string, sample alg.Sample, policy string) error {
+	// the last chunk starting before the sample, or the first one
+	i := sort.Search(len(names), func(i int) bool {
+		return names[i] > tsChunkName(sample.Timestamp)
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	chunk, err := alg.OpenGorillaChunk(ts.chunkPath(names[i]))
+	if err != nil {
+		return err
+	}
+
+	samples, err := chunk.Samples()
+	chunk.Close()
+	if err != nil {
+		return err
+	}
+
+	j := sort.Search(len(samples), func(j int) bool {
+		return samples[j].Timestamp >= sample.Timestamp
+	})
+
+	if j < len(samples) && samples[j].Timestamp == sample.Timestamp {
+		old := &samples[j].Value
+
+		switch policy {
+		case "block":
+			return errTSBlock
+		case "first":
+			return nil
+		case "last":
+			*old = sample.Value
+		case "min":
+			*old = math.Min(*old, sample.Value)
+		case "max":
+			*old = math.Max(*old, sample.Value)
+		case "sum":
+			*old += sample.Value
+		}
+	} else {
+		samples = append(samples, alg.Sample{})
+		copy(samples[j+1:], samples[j:])
+		samples[j] = sample
+	}
+
+	tmpPath := ts.chunkPath("." + names[i] + ".tmp")
+	os.Remove(tmpPath)
+
+	rewritten, err := alg.CreateGorillaChunk(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range samples {
+		if err := rewritten.Append(s); err != nil {
+			rewritten.Close()
+			return err
+		}
+	}
+
+	if err := rewritten.Close(); err != nil {
+		return err
+	}
+
+	// the chunk is renamed if the sample is its new first one
+	if err := os.Rename(tmpPath, ts.chunkPath(tsChunkName(samples[0].Timestamp))); err != nil {
+		return err
+	}
+	if tsChunkName(samples[0].Timestamp) != names[i] {
+		if err := os.Remove(ts.chunkPath(names[i])); err != nil {
+			return err
+		}
+	}
+
+	touch(ts.key)
+
+	return nil
+}
+
+// compact feeds a sample appended in order to the compaction rules
+func (ts *timeSeries) compact(sample alg.Sample) error {
+	if len(ts.meta.Rules) == 0 {
+		return nil
+	}
+
+	for i := range ts.meta.Rules {
+		rule := &ts.meta.Rules[i]
+		start := sample.Timestamp - sample.Timestamp%rule.Bucket
+
+		if rule.State != nil && start > rule.BucketStart {
+			destination, err := openTimeSeries(cache.NewKey(ts.key.DB, []byte(rule.Destination)))
+			if err != nil && err != ErrWrongType {
+				return err
+			}
+
+			// a deleted destination is just skipped
+			if destination != nil {
+				if err := destination.add(alg.Sample{Timestamp: rule.BucketStart, Value: rule.State.value(rule.Aggregation)}, "last"); err != nil {
+					return err
+				}
+			}
+
+			rule.State = nil
+		}
+
+		if rule.State == nil {
+			rule.State = &tsAggregator{}
+			rule.BucketStart = start
+		}
+
+		rule.State.add(sample.Value)
+	}
+
+	return ts.saveMeta()
+}
+
+// samples returns the samples from from to to, both included, ignoring
+// the ones older than the retention not removed yet
+func (ts *timeSeries) samples(from, to int64) ([]alg.Sample, error) {
+	if ts.meta.Retention > 0 {
+		last, ok, err := ts.last()
+		if err != nil {
+			return nil, err
+		}
+
+		if ok && last-ts.meta.Retention > from {
+			from = last - ts.meta.Retention
+		}
+	}
+
+	names, err := ts.chunks()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []alg.Sample{}
+	for _, name := range names {
+		if name > tsChunkName(to) {
+			break
+		}
+
+		chunk, err := alg.OpenGorillaChunk(ts.chunkPath(name))
+		if err != nil {
+			return nil, err
+		}
+
+		if chunk.Last < from {
+			chunk.Close()
+			continue
+		}
+
+		samples, err := chunk.Samples()
+		chunk.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, sample := range samples {
+			if sample.Timestamp >= from && sample.Timestamp <= to {
+				result = append(result, sample)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// trim removes the chunks whose samples are all older than the retention
+func (ts *timeSeries) trim() error {
+	if ts.meta.Retention == 0 {
+		return nil
+	}
+
+	last, ok, err := ts.last()
+	if err != nil || !ok {
+		return err
+	}
+
+	names, err := ts.chunks()
+	if err != nil {
+		return err
+	}
+
+	// the last chunk always holds the newest sample
+	for _, name := range names[:len(names)-1] {
+		chunk, err := alg.OpenGorillaChunk(ts.chunkPath(name))
+		if err != nil {
+			return err
+		}
+
+		expired := chunk.Last < last-ts.meta.Retention
+		chunk.Close()
+
+		if !expired {
+			break
+		}
+
+		if err := os.Remove(ts.chunkPath(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rangeSamples applies the aggregation and count of r to samples
+func rangeSamples(samples []alg.Sample, r *TSRangeArgs) []alg.Sample {
+	if r.Aggregation != "" {
+		aggregated := []alg.Sample{}
+		var state *tsAggregator
+		start := int64(0)
+
+		for _, sample := range samples {
+			bucket := sample.Timestamp - sample.Timestamp%r.Bucket
+			if state != nil && bucket != start {
+				aggregated = append(aggregated, alg.Sample{Timestamp: start, Value: state.value(r.Aggregation)})
+				state = nil
+			}
+
+			if state == nil {
+				state = &tsAggregator{}
+				start = bucket
+			}
+
+			state.add(sample.Value)
+		}
+
+		if state != nil {
+			aggregated = append(aggregated, alg.Sample{Timestamp: start, Value: state.value(r.Aggregation)})
+		}
+
+		samples = aggregated
+	}
+
+	if r.Count > 0 && len(samples) > r.Count {
+		samples = samples[:r.Count]
+	}
+
+	return samples
+}
+
+// TSCreate creates an empty time series at keyName
+func TSCreate(dbNum int, keyName []byte, opts *TSOptions) error {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	typ, err := keyType(key)
+	if err != nil {
+		return err
+	}
+	if typ != TypeNone {
+		return errTSExists
+	}
+
+	_, err = createTimeSeries(key, keyName, opts)
+
+	return err
+}
+
+// TSAdd adds a sample to the time series at keyName, creating it with opts
+// if it does not exist
+func TSAdd(dbNum int, keyName []byte, sample alg.Sample, opts *TSOptions) error {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	ts, err := openTimeSeries(key)
+	if err != nil {
+		return err
+	}
+
+	if ts == nil {
+		if ts, err = createTimeSeries(key, keyName, opts); err != nil {
+			return err
+		}
+	}
+
+	policy := ts.meta.DuplicatePolicy
+	if opts.OnDuplicate != "" {
+		policy = opts.OnDuplicate
+	}
+
+	return ts.add(sample, policy)
+}
+
+// TSRange returns the samples of the time series at keyName in the range
+func TSRange(dbNum int, keyName []byte, r *TSRangeArgs) ([]alg.Sample, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	ts, err := openTimeSeries(key)
+	if err != nil {
+		return nil, err
+	}
+	if ts == nil {
+		return nil, errTSNotFound
+	}
+
+	samples, err := ts.samples(r.From, r.To)
+	if err != nil {
+		return nil, err
+	}
+
+	return rangeSamples(samples, r), nil
+}
+
+type TSSeries struct {
+	Key     []byte
+	Labels  []TSLabel
+	Samples []alg.Sample
+}
+
+// TSMRange returns the samples in the range of every time series whose
+// labels match the filters of r, sorted by key
+func TSMRange(dbNum int, r *TSRangeArgs) ([]TSSeries, error) {
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	names, err := registeredTimeSeries(dbNum)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []TSSeries{}
+	for _, name := range names {
+		// the registry may still hold keys which are not time series anymore
+		ts, err := openTimeSeries(cache.NewKey(dbNum, name))
+		if err == ErrWrongType || (err == nil && ts == nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		matched := true
+		for _, f := range r.filters {
+			matched = matched && f.match(ts.meta.Labels)
+		}
+		if !matched {
+			continue
+		}
+
+		samples, err := ts.samples(r.From, r.To)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, TSSeries{
+			Key:     name,
+			Labels:  ts.meta.Labels,
+			Samples: rangeSamples(samples, r),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return string(result[i].Key) < string(result[j].Key)
+	})
+
+	return result, nil
+}
+
+// TSCreateRule compacts the new samples of the time series at srcName into
+// the one at dstName
+func TSCreateRule(dbNum int, srcName, dstName []byte, args [][]byte) error {
+	if len(args) != 3 || strings.ToLower(string(args[0])) != "aggregation" {
+		return ErrSyntax
+	}
+
+	aggregation, bucket, err := parseTSAggregation(args[1:])
+	if err != nil {
+		return err
+	}
+
+	if string(srcName) == string(dstName) {
+		return errTSSameKey
+	}
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	src, err := openTimeSeries(cache.NewKey(dbNum, srcName))
+	if err != nil {
+		return err
+	}
+	dst, err := openTimeSeries(cache.NewKey(dbNum, dstName))
+	if err != nil {
+		return err
+	}
+	if src == nil || dst == nil {
+		return errTSNotFound
+	}
+
+	// rules do not chain
+	switch {
+	case dst.meta.Source != "":
+		return errTSDestinationRule
+	case len(dst.meta.Rules) > 0:
+		return errTSDestinationRules
+	case src.meta.Source != "":
+		return errTSSourceRule
+	}
+
+	src.meta.Rules = append(src.meta.Rules, tsRule{
+		Destination: string(dstName),
+		Aggregation: aggregation,
+		Bucket:      bucket,
+	})
+	dst.meta.Source = string(srcName)
+
+	if err := src.saveMeta(); err != nil {
+		return err
+	}
+
+	touch(src.key)
+	touch(dst.key)
+
+	return dst.saveMeta()
+}
+
+// TSDeleteRule removes the compaction of srcName into dstName
+func TSDeleteRule(dbNum int, srcName, dstName []byte) error {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	src, err := openTimeSeries(cache.NewKey(dbNum, srcName))
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return errTSNotFound
+	}
+
+	rules := src.meta.Rules[:0]
+	for _, rule := range src.meta.Rules {
+		if rule.Destination != string(dstName) {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == len(src.meta.Rules) {
+		return errTSRuleNotFound
+	}
+
+	src.meta.Rules = rules
+	if err := src.saveMeta(); err != nil {
+		return err
+	}
+
+	touch(src.key)
+
+	// the destination may have been deleted or replaced
+	dst, err := openTimeSeries(cache.NewKey(dbNum, dstName))
+	if err != nil || dst == nil || dst.meta.Source != string(srcName) {
+		return nil
+	}
+
+	dst.meta.Source = ""
+	touch(dst.key)
+
+	return dst.saveMeta()
+}
+
+// relocateTimeSeries registers the time series moved or copied from src
+// to dst. Compaction rules only link the series of a DB by name: they
+// follow a renamed series, while copies and series moved to another DB
+// leave them behind. The caller must hold cache.FSRWL.Lock.
+func relocateTimeSeries(src alg.Key, srcName []byte, dst alg.Key, dstName []byte, keep bool) error {
+	if !keep {
+		if err := os.Remove(tsRegistryPath(src)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	registryPath := tsRegistryPath(dst)
+	if err := os.MkdirAll(filepath.Dir(registryPath), 0700); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(registryPath, dstName); err != nil {
+		return err
+	}
+
+	ts, err := openTimeSeries(dst)
+	if err != nil || ts == nil {
+		return err
+	}
+
+	if keep || src.DB != dst.DB {
+		if len(ts.meta.Rules) == 0 && ts.meta.Source == "" {
+			return nil
+		}
+
+		// the series left behind skip the deleted destinations
+		ts.meta.Rules = nil
+		ts.meta.Source = ""
+
+		return ts.saveMeta()
+	}
+
+	for _, rule := range ts.meta.Rules {
+		destination, err := openTimeSeries(cache.NewKey(dst.DB, []byte(rule.Destination)))
+		if err != nil && err != ErrWrongType {
+			return err
+		}
+
+		if destination != nil && destination.meta.Source == string(srcName) {
+			destination.meta.Source = string(dstName)
+			if err := destination.saveMeta(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if ts.meta.Source == "" {
+		return nil
+	}
+
+	source, err := openTimeSeries(cache.NewKey(dst.DB, []byte(ts.meta.Source)))
+	if err != nil && err != ErrWrongType {
+		return err
+	}
+	if source == nil {
+		return nil
+	}
+
+	for i := range source.meta.Rules {
+		if source.meta.Rules[i].Destination == string(srcName) {
+			source.meta.Rules[i].Destination = string(dstName)
+		}
+	}
+
+	return source.saveMeta()
+}
+
+// RetainTimeSeries enforces the retention of the time series every d,
+// removing their expired chunks, and forgets the registered keys which
+// are not time series anymore
+func RetainTimeSeries(d time.Duration) {
+	ticker := time.NewTicker(d)
+	for {
+		<-ticker.C
+
+		for dbNum := 0; dbNum < config.Config.DBConfig.DBMaxNum; dbNum++ {
+			cache.FSRWL.RLock()
+			names, err := registeredTimeSeries(dbNum)
+			cache.FSRWL.RUnlock()
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+
+			// the lock is taken for a series at a time to let the
+			// commands run in between
+			for _, name := range names {
+				if err := retainTimeSeries(cache.NewKey(dbNum, name)); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+func retainTimeSeries(key alg.Key) error {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	ts, err := openTimeSeries(key)
+	if err == ErrWrongType || (err == nil && ts == nil) {
+		if err := os.Remove(tsRegistryPath(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return ts.trim()
+}
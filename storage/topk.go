@@ -0,0 +1,261 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+// Top-Ks are dirs holding the alg.TopK buckets file, updated in place,
+// and the heap of the top items, rewritten on every change
+
+const (
+	topKBucketsFileName = "buckets"
+	topKHeapFileName    = "heap"
+
+	// the defaults of RedisBloom for TOPK.RESERVE
+	topKDefaultWidth = 8
+	topKDefaultDepth = 7
+	topKDefaultDecay = 0.9
+
+	topKMaxIncrement = 100000
+)
+
+var (
+	errTopKExists    = errors.New("ERR TopK: key already exists")
+	errTopKNotFound  = errors.New("ERR TopK: key does not exist")
+	errTopKK         = errors.New("ERR TopK: invalid k")
+	errTopKWidth     = errors.New("ERR TopK: invalid width")
+	errTopKDepth     = errors.New("ERR TopK: invalid depth")
+	errTopKDecay     = errors.New("ERR TopK: invalid decay value. must be '<= 1' & '> 0'")
+	errTopKIncrement = errors.New("ERR TopK: increment must be an integer greater or equal to 1 and less than or equal to 100000")
+)
+
+type TopKReserveArgs struct {
+	K     uint32
+	Width uint32
+	Depth uint32
+	Decay float64
+}
+
+// ParseTopKReserveArgs parses the arguments of TOPK.RESERVE following the key
+func ParseTopKReserveArgs(args [][]byte) (*TopKReserveArgs, error) {
+	if len(args) != 1 && len(args) != 4 {
+		return nil, errors.New("wrong number of arguments for 'topk.reserve' command")
+	}
+
+	k, err := parseUint32(args[0], errTopKK)
+	if err != nil {
+		return nil, err
+	}
+
+	reserve := &TopKReserveArgs{
+		K:     k,
+		Width: topKDefaultWidth,
+		Depth: topKDefaultDepth,
+		Decay: topKDefaultDecay,
+	}
+
+	if len(args) == 1 {
+		return reserve, nil
+	}
+
+	if reserve.Width, err = parseUint32(args[1], errTopKWidth); err != nil {
+		return nil, err
+	}
+
+	if reserve.Depth, err = parseUint32(args[2], errTopKDepth); err != nil {
+		return nil, err
+	}
+
+	if reserve.Decay, err = ParseFloat(args[3]); err != nil || reserve.Decay <= 0 || reserve.Decay > 1 {
+		return nil, errTopKDecay
+	}
+
+	return reserve, nil
+}
+
+// ParseTopKIncrByArgs parses the item/increment pairs of TOPK.INCRBY
+func ParseTopKIncrByArgs(args [][]byte) ([][]byte, []uint32, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, nil, errors.New("wrong number of arguments for 'topk.incrby' command")
+	}
+
+	items := make([][]byte, 0, len(args)/2)
+	increments := make([]uint32, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		increment, err := ParseInt(args[i+1])
+		if err != nil || increment < 1 || increment > topKMaxIncrement {
+			return nil, nil, errTopKIncrement
+		}
+
+		items = append(items, args[i])
+		increments = append(increments, uint32(increment))
+	}
+
+	return items, increments, nil
+}
+
+// openTopK opens the Top-K at key, nil if the key does not exist.
+// The caller must hold at least cache.FSRWL.RLock and close the Top-K.
+func openTopK(key alg.Key) (*alg.TopK, error) {
+	found, err := checkType(key, TypeTopK)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	heap, err := os.ReadFile(filepath.Join(key.FilePath(), topKHeapFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	return alg.OpenTopK(filepath.Join(key.FilePath(), topKBucketsFileName), heap)
+}
+
+// TopKReserve creates an empty Top-K at keyName
+func TopKReserve(dbNum int, keyName []byte, reserve *TopKReserveArgs) error {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	typ, err := keyType(key)
+	if err != nil {
+		return err
+	}
+	if typ != TypeNone {
+		return errTopKExists
+	}
+
+	if err := createTyped(key, TypeTopK, nil); err != nil {
+		return err
+	}
+
+	touch(key)
+
+	t, err := alg.CreateTopK(filepath.Join(key.FilePath(), topKBucketsFileName), reserve.K, reserve.Width, reserve.Depth, reserve.Decay)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	return writeFileAtomic(filepath.Join(key.FilePath(), topKHeapFileName), t.HeapBytes())
+}
+
+// TopKIncrBy increments the counts of items, returning for every item the
+// one expelled from the top k because of it, nil if none
+func TopKIncrBy(dbNum int, keyName []byte, items [][]byte, increments []uint32) ([]interface{}, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	t, err := openTopK(key)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, errTopKNotFound
+	}
+	defer t.Close()
+
+	touch(key)
+
+	expelled := make([]interface{}, len(items))
+	for i, item := range items {
+		item, err := t.IncrBy(item, increments[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if item != nil {
+			expelled[i] = item
+		}
+	}
+
+	return expelled, writeFileAtomic(filepath.Join(key.FilePath(), topKHeapFileName), t.HeapBytes())
+}
+
+// TopKQuery reports for every item whether it is in the top k
+func TopKQuery(dbNum int, keyName []byte, items [][]byte) ([]int, error) {
+	return topKRead(dbNum, keyName, items, func(t *alg.TopK, item []byte) (int, error) {
+		found, err := t.Query(item)
+		if err != nil || !found {
+			return 0, err
+		}
+
+		return 1, nil
+	})
+}
+
+// TopKCount returns the estimated counts of items
+func TopKCount(dbNum int, keyName []byte, items [][]byte) ([]int, error) {
+	return topKRead(dbNum, keyName, items, func(t *alg.TopK, item []byte) (int, error) {
+		count, err := t.Count(item)
+
+		return int(count), err
+	})
+}
+
+func topKRead(dbNum int, keyName []byte, items [][]byte, read func(t *alg.TopK, item []byte) (int, error)) ([]int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	t, err := openTopK(key)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, errTopKNotFound
+	}
+	defer t.Close()
+
+	result := make([]int, len(items))
+	for i, item := range items {
+		if result[i], err = read(t, item); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// TopKList returns the top k items, the heaviest first
+func TopKList(dbNum int, keyName []byte) ([]alg.TopKItem, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	t, err := openTopK(key)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, errTopKNotFound
+	}
+	defer t.Close()
+
+	return t.List(), nil
+}
@@ -0,0 +1,189 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkTopKItems(t *testing.T, db int, keyName string, want ...string) {
+	t.Helper()
+
+	items, err := TopKList(db, []byte(keyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(want) {
+		t.Fatalf("got %d items, want %d", len(items), len(want))
+	}
+	for i, item := range items {
+		if string(item.Item) != want[i] {
+			t.Fatalf("item %d is %s, want %s", i, item.Item, want[i])
+		}
+	}
+}
+
+func topKTestIncrBy(t *testing.T, db int, keyName string, args ...string) []interface{} {
+	t.Helper()
+
+	items, increments, err := ParseTopKIncrByArgs(testArgs(args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expelled, err := TopKIncrBy(db, []byte(keyName), items, increments)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return expelled
+}
+
+func TestTopKLayout(t *testing.T) {
+	const db = 5
+
+	reserve, err := ParseTopKReserveArgs(testArgs("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := TopKReserve(db, []byte("topk"), reserve); err != nil {
+		t.Fatal(err)
+	}
+	if err := TopKReserve(db, []byte("topk"), reserve); err != errTopKExists {
+		t.Fatalf("reserving an existing Top-K returned %v", err)
+	}
+
+	// a dir with the type, the buckets and the heap of the top items
+	dir := testKeyPath(db, "topk")
+	if typ, err := os.ReadFile(filepath.Join(dir, typeFileName)); err != nil || string(typ) != TypeTopK {
+		t.Fatalf("the type file holds %q: %v", typ, err)
+	}
+	info, err := os.Stat(filepath.Join(dir, topKBucketsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(28 + 8*topKDefaultWidth*topKDefaultDepth); info.Size() != want {
+		t.Fatalf("the buckets file is %d bytes, want %d", info.Size(), want)
+	}
+	checkTopKItems(t, db, "topk")
+
+	expelled := topKTestIncrBy(t, db, "topk", "a", "10", "b", "20", "c", "30")
+	if expelled[0] != nil || expelled[1] != nil || string(expelled[2].([]byte)) != "a" {
+		t.Fatalf("TOPK.INCRBY replied %q", expelled)
+	}
+
+	heap, err := os.ReadFile(filepath.Join(dir, topKHeapFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(heap) != 2*13 {
+		t.Fatalf("the heap file is %d bytes, want 26", len(heap))
+	}
+
+	reopen(t, db)
+
+	checkTopKItems(t, db, "topk", "c", "b")
+	found, err := TopKQuery(db, []byte("topk"), testArgs("a", "b", "c", "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found[0] != 0 || found[1] != 1 || found[2] != 1 || found[3] != 0 {
+		t.Fatalf("TOPK.QUERY replied %v", found)
+	}
+	counts, err := TopKCount(db, []byte("topk"), testArgs("a", "c", "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[0] != 10 || counts[1] != 30 || counts[2] != 0 {
+		t.Fatalf("TOPK.COUNT replied %v", counts)
+	}
+	if typ, err := Type(db, []byte("topk")); err != nil || typ != TypeTopK {
+		t.Fatalf("the type is %s: %v", typ, err)
+	}
+
+	if _, err := Del(db, testArgs("topk")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTopKErrors(t *testing.T) {
+	const db = 5
+
+	items, increments, err := ParseTopKIncrByArgs(testArgs("a", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []func() error{
+		func() error { _, err := TopKIncrBy(db, []byte("topkmissing"), items, increments); return err },
+		func() error { _, err := TopKQuery(db, []byte("topkmissing"), items); return err },
+		func() error { _, err := TopKCount(db, []byte("topkmissing"), items); return err },
+		func() error { _, err := TopKList(db, []byte("topkmissing")); return err },
+	} {
+		if err := f(); err != errTopKNotFound {
+			t.Fatalf("a command on a missing Top-K returned %v", err)
+		}
+	}
+
+	if _, _, err := Set(db, testArgs("topkstring", "value"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TopKList(db, []byte("topkstring")); err != ErrWrongType {
+		t.Fatalf("TOPK.LIST on a string returned %v", err)
+	}
+	if err := TopKReserve(db, []byte("topkstring"), &TopKReserveArgs{K: 1, Width: 1, Depth: 1, Decay: 1}); err != errTopKExists {
+		t.Fatalf("TOPK.RESERVE on a string returned %v", err)
+	}
+
+	for _, c := range []struct {
+		args []string
+		err  error
+	}{
+		{[]string{"0"}, errTopKK},
+		{[]string{"1", "8"}, nil},
+		{[]string{"1", "0", "7", "0.9"}, errTopKWidth},
+		{[]string{"1", "8", "0", "0.9"}, errTopKDepth},
+		{[]string{"1", "8", "7", "0"}, errTopKDecay},
+		{[]string{"1", "8", "7", "1.1"}, errTopKDecay},
+	} {
+		_, err := ParseTopKReserveArgs(testArgs(c.args...))
+		if err == nil || c.err != nil && err != c.err {
+			t.Fatalf("TOPK.RESERVE %q returned %v, want %v", c.args, err, c.err)
+		}
+	}
+
+	reserve, err := ParseTopKReserveArgs(testArgs("5", "100", "4", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserve.K != 5 || reserve.Width != 100 || reserve.Depth != 4 || reserve.Decay != 1 {
+		t.Fatalf("parsed %+v", reserve)
+	}
+
+	for _, args := range [][]string{{}, {"a"}, {"a", "0"}, {"a", "100001"}, {"a", "x"}} {
+		if _, _, err := ParseTopKIncrByArgs(testArgs(args...)); err == nil {
+			t.Fatalf("TOPK.INCRBY %q did not fail", args)
+		}
+	}
+
+	if _, err := Del(db, testArgs("topkstring")); err != nil {
+		t.Fatal(err)
+	}
+}
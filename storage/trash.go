@@ -0,0 +1,243 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+	"github.com/RcrdBrt/gobigdis/config"
+)
+
+/*
+	Deleting a whole DB can take minutes when it holds millions of files,
+	and so can deleting a big list or hash, so the files to delete are
+	renamed in the trash dir holding the lock, which is as fast as renaming
+	a single file, and deleted afterwards without holding any lock.
+	UNLINK and the ASYNC flushes leave them to a fixed number of deleters,
+	fed by a bounded queue: once it is full, the commands wait for room
+	after releasing the lock, which the deleters need. The deleters also remove
+	the dirs of the keys left empty by DEL and UNLINK, together with their
+	cache entries. Whatever a crash leaves in the trash dir, or half built
+	in the temp dir, is deleted on the next start.
+*/
+
+const (
+	trashDirName   = "trash"
+	tempDirName    = "tmp"
+	trashWorkers   = 4
+	trashQueueSize = 4096
+)
+
+// trashJob is a path to delete and/or the key whose empty dirs to remove
+type trashJob struct {
+	path  string
+	key   alg.Key
+	prune bool
+}
+
+var deleters = struct {
+	sync.Mutex
+	cond    *sync.Cond
+	queue   []trashJob
+	pending int // queued or running jobs
+	freed   int // paths deleted since the start
+}{}
+
+func trashDirPath() string {
+	return filepath.Join(config.Config.DBConfig.InternalDirPath, trashDirName)
+}
+
+// trash moves path in the trash dir, returning the path to delete
+// with purge, or "" if path does not exist.
+// The caller must hold cache.FSRWL.Lock.
+func trash(path string) (string, error) {
+	if _, err := os.Lstat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	if err := os.MkdirAll(trashDirPath(), 0700); err != nil {
+		return "", err
+	}
+
+	// path is renamed inside a new dir so that its name can't clash
+	dir, err := os.MkdirTemp(trashDirPath(), filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+		os.Remove(dir)
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// purge deletes the paths returned by trash, it must not be called
+// holding cache.FSRWL
+func purge(paths []string) {
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// purgeAsync hands the paths returned by trash to the deleters, skipping
+// the empty ones. It must not be called holding cache.FSRWL.
+func purgeAsync(paths []string) {
+	jobs := make([]trashJob, 0, len(paths))
+	for _, path := range paths {
+		if path != "" {
+			jobs = append(jobs, trashJob{path: path})
+		}
+	}
+
+	enqueueTrash(jobs...)
+}
+
+// recoverTrash moves in the trash the values a previous run was building
+// in the temp dir when it stopped, and returns every path left in the
+// trash, to be purged before anything else is moved in it
+func recoverTrash() ([]string, error) {
+	if _, err := trash(tempDirPath()); err != nil {
+		return nil, err
+	}
+
+	return trashed()
+}
+
+// trashed returns the paths left in the trash dir by a previous run
+func trashed() ([]string, error) {
+	entries, err := os.ReadDir(trashDirPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	paths := make([]string, len(entries))
+	for i, entry := range entries {
+		paths[i] = filepath.Join(trashDirPath(), entry.Name())
+	}
+
+	return paths, nil
+}
+
+// startDeleters starts the goroutines running the trash jobs
+func startDeleters(n int) {
+	deleters.cond = sync.NewCond(&deleters.Mutex)
+
+	for i := 0; i < n; i++ {
+		go deleter()
+	}
+}
+
+// enqueueTrash queues jobs for the deleters, waiting for room in the queue
+// if it is full. It must not be called holding cache.FSRWL.
+func enqueueTrash(jobs ...trashJob) {
+	deleters.Lock()
+	defer deleters.Unlock()
+
+	for _, job := range jobs {
+		for len(deleters.queue) >= trashQueueSize {
+			deleters.cond.Wait()
+		}
+
+		deleters.queue = append(deleters.queue, job)
+		deleters.pending++
+
+		deleters.cond.Broadcast()
+	}
+}
+
+func deleter() {
+	for {
+		deleters.Lock()
+		for len(deleters.queue) == 0 {
+			deleters.cond.Wait()
+		}
+
+		job := deleters.queue[0]
+		deleters.queue[0] = trashJob{}
+		deleters.queue = deleters.queue[1:]
+		// wake up the enqueuers waiting for room
+		deleters.cond.Broadcast()
+		deleters.Unlock()
+
+		if job.path != "" {
+			if err := os.RemoveAll(job.path); err != nil {
+				log.Println(err)
+			}
+		}
+
+		if job.prune {
+			pruneKeyDirs(job.key)
+		}
+
+		deleters.Lock()
+		deleters.pending--
+		if job.path != "" {
+			deleters.freed++
+		}
+		deleters.Unlock()
+	}
+}
+
+// pruneKeyDirs removes the level dirs of key left empty, forgetting
+// about them in the cache
+func pruneKeyDirs(key alg.Key) {
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	// the cc, bb and aa dirs
+	dir := key.ParentPath()
+	for level := 0; level < 3; level++ {
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			// not empty
+			return
+		}
+
+		if level == 0 {
+			// keys sharing the dir are created with its parents
+			cache.Set(key, false)
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
+
+// TrashStats returns the number of trash jobs queued or running and the
+// number of paths deleted by the deleters since the start
+func TrashStats() (int, int) {
+	deleters.Lock()
+	defer deleters.Unlock()
+
+	return deleters.pending, deleters.freed
+}
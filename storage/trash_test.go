@@ -0,0 +1,273 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// waitDeleters waits for the deleters to run every queued job
+func waitDeleters(t *testing.T) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if pending, _ := TrashStats(); pending == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the deleters did not empty the queue")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTrashQueueIsBounded(t *testing.T) {
+	dir := t.TempDir()
+
+	jobs := make([]trashJob, 3*trashQueueSize)
+	for i := range jobs {
+		jobs[i].path = filepath.Join(dir, "job"+strconv.Itoa(i))
+		if err := os.WriteFile(jobs[i].path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		enqueueTrash(jobs...)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		deleters.Lock()
+		queued := len(deleters.queue)
+		deleters.Unlock()
+
+		if queued > trashQueueSize {
+			t.Fatalf("%d jobs queued, the queue holds %d", queued, trashQueueSize)
+		}
+	}
+
+	waitDeleters(t)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%d paths left undeleted", len(entries))
+	}
+}
+
+func TestUnlinkPrunesKeyDirs(t *testing.T) {
+	const db = 4
+
+	if _, err := Push(db, testArgs("unlink-list", "a", "b"), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Set(db, testArgs("unlink-str", "v"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	unlinked, err := Unlink(db, testArgs("unlink-list", "unlink-str", "unlink-missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlinked != 2 {
+		t.Fatalf("unlinked %d keys, want 2", unlinked)
+	}
+	if size := DBSize(db); size != 0 {
+		t.Fatalf("DBSIZE is %d after UNLINK, want 0", size)
+	}
+
+	waitDeleters(t)
+
+	entries, err := os.ReadDir(dbDirPath(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("%d level dirs left in the DB dir", len(entries))
+	}
+
+	for _, name := range []string{"unlink-list", "unlink-str"} {
+		if cache.Match(cache.NewKey(db, []byte(name))) {
+			t.Errorf("the cache still matches %s", name)
+		}
+	}
+}
+
+func TestDelTrashesDirs(t *testing.T) {
+	const db = 5
+
+	if _, err := HSet(db, testArgs("del-hash", "f", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Set(db, testArgs("del-str", "v"), SetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDeleters(t)
+	_, freedBefore := TrashStats()
+
+	deleted, err := Del(db, testArgs("del-hash", "del-str", "del-missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 2 {
+		t.Fatalf("deleted %d keys, want 2", deleted)
+	}
+	if found, err := Exists(db, testArgs("del-hash", "del-str")); err != nil || found != 0 {
+		t.Fatalf("%d keys still exist after DEL: %v", found, err)
+	}
+
+	waitDeleters(t)
+
+	// only the hash went through the trash
+	if _, freed := TrashStats(); freed != freedBefore+1 {
+		t.Fatalf("the deleters freed %d paths, want 1", freed-freedBefore)
+	}
+}
+
+func TestOverwriteTrashesDestination(t *testing.T) {
+	const db = 14
+
+	overwrites := []struct {
+		name string
+		fn   func() error
+	}{
+		{"RENAME", func() error {
+			if _, err := SAdd(db, testArgs("overwrite-src", "a", "b")); err != nil {
+				return err
+			}
+			_, err := Rename(db, []byte("overwrite-src"), []byte("overwrite-dst"), false)
+			return err
+		}},
+		{"COPY", func() error {
+			if _, err := HSet(db, testArgs("overwrite-src", "f", "v")); err != nil {
+				return err
+			}
+			_, err := Copy(db, []byte("overwrite-src"), []byte("overwrite-dst"), CopyOptions{DB: db, Replace: true})
+			return err
+		}},
+		{"SUNIONSTORE", func() error {
+			_, err := SetOperationStore(db, []byte("overwrite-dst"), testArgs("overwrite-set"), "union")
+			return err
+		}},
+	}
+
+	if _, err := SAdd(db, testArgs("overwrite-set", "m")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, overwrite := range overwrites {
+		if _, err := Push(db, testArgs("overwrite-dst", "a", "b"), false, false); err != nil {
+			t.Fatal(err)
+		}
+
+		waitDeleters(t)
+		_, freedBefore := TrashStats()
+
+		if err := overwrite.fn(); err != nil {
+			t.Fatalf("%s: %v", overwrite.name, err)
+		}
+		if typ, err := Type(db, []byte("overwrite-dst")); err != nil || typ == TypeList {
+			t.Fatalf("%s: the destination is a %s: %v", overwrite.name, typ, err)
+		}
+
+		waitDeleters(t)
+
+		if _, freed := TrashStats(); freed != freedBefore+1 {
+			t.Fatalf("%s: the deleters freed %d paths, want 1", overwrite.name, freed-freedBefore)
+		}
+
+		if _, err := Del(db, testArgs("overwrite-src", "overwrite-dst")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := Del(db, testArgs("overwrite-set")); err != nil {
+		t.Fatal(err)
+	}
+
+	waitDeleters(t)
+
+	paths, err := trashed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 0 {
+		t.Fatalf("%d paths left in the trash", len(paths))
+	}
+	if size := DBSize(db); size != 0 {
+		t.Fatalf("DBSIZE is %d, want 0", size)
+	}
+}
+
+func TestRecoverTrashEmptiesTempDir(t *testing.T) {
+	waitDeleters(t)
+
+	// a set and a string left half built by a crash
+	dir, err := createTempTyped(TypeSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, setMembersDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	f, err := createTempFile("crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	paths, err := recoverTrash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("%d paths to purge, want the temp dir only", len(paths))
+	}
+	if _, err := os.Stat(tempDirPath()); !os.IsNotExist(err) {
+		t.Fatalf("the temp dir is still there: %v", err)
+	}
+
+	purge(paths)
+
+	if paths, err := trashed(); err != nil || len(paths) != 0 {
+		t.Fatalf("%d paths left in the trash: %v", len(paths), err)
+	}
+
+	// nothing to recover the second time
+	if paths, err := recoverTrash(); err != nil || len(paths) != 0 {
+		t.Fatalf("%d paths to purge after a clean stop: %v", len(paths), err)
+	}
+}
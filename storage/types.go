@@ -0,0 +1,268 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+	"github.com/RcrdBrt/gobigdis/config"
+)
+
+/*
+	Values of the string type are stored as a plain file at the key's FilePath.
+	Every other type is a directory at the same path, holding a typeFileName file
+	with the name of the type and whatever other files the type needs.
+*/
+
+const (
+	TypeNone   = "none"
+	TypeString = "string"
+	TypeHash   = "hash"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+	TypeStream = "stream"
+	TypeBloom  = "MBbloom--"
+	TypeCMS    = "CMSk-TYPE"
+	TypeTopK   = "TopK-TYPE"
+	TypeJSON   = "ReJSON-RL"
+	TypeTS     = "TSDB-TYPE"
+)
+
+const typeFileName = "type"
+
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// Type returns the type of the value stored at keyName
+func Type(dbNum int, keyName []byte) (string, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	return keyType(key)
+}
+
+// keyType returns the type of key, the caller must hold at least cache.FSRWL.RLock
+func keyType(key alg.Key) (string, error) {
+	if !cache.Match(key) {
+		return TypeNone, nil
+	}
+
+	info, err := os.Lstat(key.FilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return TypeNone, nil
+		}
+		return "", err
+	}
+
+	if !info.IsDir() {
+		return TypeString, nil
+	}
+
+	typ, err := os.ReadFile(filepath.Join(key.FilePath(), typeFileName))
+	if err != nil {
+		return "", err
+	}
+
+	return string(typ), nil
+}
+
+// checkType returns ErrWrongType if key exists and is not of type typ.
+// It reports whether the key exists.
+func checkType(key alg.Key, typ string) (bool, error) {
+	found, err := keyType(key)
+	if err != nil {
+		return false, err
+	}
+
+	switch found {
+	case TypeNone:
+		return false, nil
+	case typ:
+		return true, nil
+	default:
+		return false, ErrWrongType
+	}
+}
+
+// createTyped creates the directory of a key of type typ, along with the
+// files init writes in it if not nil. The directory is built by
+// createTempTyped and renamed in place, so that a crash never leaves a key
+// without its type file. The caller must hold cache.FSRWL.Lock.
+func createTyped(key alg.Key, typ string, init func(dir string) error) error {
+	dir, err := createTempTyped(typ)
+	if err != nil {
+		return err
+	}
+
+	if init != nil {
+		if err := init(dir); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	if !cache.Match(key) {
+		if err := os.MkdirAll(key.ParentPath(), 0700); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+
+		cache.Add(key)
+	}
+
+	if err := os.Rename(dir, key.FilePath()); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	cache.Resize(key.DB, 1)
+
+	return syncDir(key.ParentPath())
+}
+
+// createTempTyped creates the directory of a value of type typ outside of
+// the DB dirs, used to build the result of the *STORE commands before
+// moving it to the destination key with storeTemp.
+// The caller must hold cache.FSRWL.Lock.
+func createTempTyped(typ string) (string, error) {
+	tmpDir, err := internalTempDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp(tmpDir, typ)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, typeFileName), []byte(typ)); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// createTempFile creates a file outside of the DB dirs, like createTempTyped
+// does for the values of the other types.
+// The caller must hold cache.FSRWL.Lock.
+func createTempFile(prefix string) (*os.File, error) {
+	tmpDir, err := internalTempDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(tmpDir, prefix)
+}
+
+// tempDirPath is the dir where the new values are built before storeTemp
+// or createTyped moves them in place
+func tempDirPath() string {
+	return filepath.Join(config.Config.DBConfig.InternalDirPath, tempDirName)
+}
+
+func internalTempDir() (string, error) {
+	tmpDir := tempDirPath()
+
+	return tmpDir, os.MkdirAll(tmpDir, 0700)
+}
+
+// storeTemp replaces whatever is at key with the dir built by
+// createTempTyped or the file built by createTempFile. The previous value
+// is moved in the trash, the returned path is to be purged with purgeAsync
+// once cache.FSRWL is released.
+// The caller must hold cache.FSRWL.Lock.
+func storeTemp(dir string, key alg.Key) (string, error) {
+	trashed, err := unlinkKey(key)
+	if err != nil {
+		return trashed, err
+	}
+
+	if !cache.Match(key) {
+		if err := os.MkdirAll(key.ParentPath(), 0700); err != nil {
+			return trashed, err
+		}
+
+		cache.Add(key)
+	}
+
+	if err := os.Rename(dir, key.FilePath()); err != nil {
+		return trashed, err
+	}
+
+	cache.Resize(key.DB, 1)
+	touch(key)
+
+	return trashed, nil
+}
+
+// unlinkKey is like removeKey, but it moves key in the trash instead of
+// deleting it, returning the path to purge or "" if key did not exist.
+// The caller must hold cache.FSRWL.Lock.
+func unlinkKey(key alg.Key) (string, error) {
+	if found, err := exists(key); err != nil || !found {
+		return "", err
+	}
+
+	path, err := trash(key.FilePath())
+	if err != nil || path == "" {
+		return "", err
+	}
+
+	cache.Resize(key.DB, -1)
+	touch(key)
+
+	return path, unindexKey(key)
+}
+
+// removeKey deletes key whatever its type is, reporting whether it existed.
+// The caller must hold cache.FSRWL.Lock.
+func removeKey(key alg.Key) (bool, error) {
+	info, err := os.Lstat(key.FilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if info.IsDir() {
+		err = os.RemoveAll(key.FilePath())
+	} else {
+		err = os.Remove(key.FilePath())
+	}
+	if err != nil {
+		return false, err
+	}
+
+	cache.Resize(key.DB, -1)
+
+	if err := unindexKey(key); err != nil {
+		return false, err
+	}
+
+	touch(key)
+
+	return true, nil
+}
@@ -0,0 +1,105 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateTyped(t *testing.T) {
+	const db = 2
+
+	key := cache.NewKey(db, []byte("create-typed"))
+	size := DBSize(db)
+
+	cache.FSRWL.Lock()
+	errInit := errors.New("init failed")
+	err := createTyped(key, TypeList, func(dir string) error {
+		if err := os.WriteFile(filepath.Join(dir, "partial"), nil, 0600); err != nil {
+			return err
+		}
+
+		return errInit
+	})
+	cache.FSRWL.Unlock()
+
+	if err != errInit {
+		t.Fatalf("got %v, want the error of init", err)
+	}
+
+	// nothing of the failed key is left behind
+	if _, err := os.Lstat(key.FilePath()); !os.IsNotExist(err) {
+		t.Fatalf("key dir left after a failed creation: %v", err)
+	}
+
+	if DBSize(db) != size {
+		t.Fatalf("DBSIZE is %d, want %d", DBSize(db), size)
+	}
+
+	checkEmptyTempDir(t)
+
+	cache.FSRWL.Lock()
+	err = createTyped(key, TypeList, func(dir string) error {
+		return os.WriteFile(filepath.Join(dir, "content"), []byte("x"), 0600)
+	})
+	cache.FSRWL.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if typ, err := Type(db, []byte("create-typed")); err != nil || typ != TypeList {
+		t.Fatalf("type is %q, %v", typ, err)
+	}
+
+	if content, err := os.ReadFile(filepath.Join(key.FilePath(), "content")); err != nil || string(content) != "x" {
+		t.Fatalf("content is %q, %v", content, err)
+	}
+
+	if DBSize(db) != size+1 {
+		t.Fatalf("DBSIZE is %d, want %d", DBSize(db), size+1)
+	}
+
+	checkEmptyTempDir(t)
+
+	if _, err := Del(db, testArgs("create-typed")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkEmptyTempDir checks that the values built aside were all moved
+// in place or deleted
+func checkEmptyTempDir(t *testing.T) {
+	t.Helper()
+
+	tmpDir, err := internalTempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) > 0 {
+		t.Fatalf("%d entries left in %s", len(entries), tmpDir)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"sync"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+// watchedKey keeps the version of a key as long as at least one client
+// is WATCHing it, so unwatched keys don't cost any memory
+type watchedKey struct {
+	refs    int
+	version uint64
+}
+
+var watched = struct {
+	sync.Mutex
+	keys map[alg.Key]*watchedKey
+}{
+	keys: make(map[alg.Key]*watchedKey),
+}
+
+// Watch starts tracking the modifications of a key and returns
+// its current version
+func Watch(dbNum int, keyName []byte) uint64 {
+	key := cache.NewKey(dbNum, keyName)
+
+	watched.Lock()
+	defer watched.Unlock()
+
+	w, ok := watched.keys[key]
+	if !ok {
+		w = &watchedKey{}
+		watched.keys[key] = w
+	}
+	w.refs++
+
+	return w.version
+}
+
+// Unwatch releases a reference previously taken with Watch
+func Unwatch(dbNum int, keyName []byte) {
+	key := cache.NewKey(dbNum, keyName)
+
+	watched.Lock()
+	defer watched.Unlock()
+
+	w, ok := watched.keys[key]
+	if !ok {
+		return
+	}
+
+	w.refs--
+	if w.refs <= 0 {
+		delete(watched.keys, key)
+	}
+}
+
+// Version returns the current version of a watched key
+func Version(dbNum int, keyName []byte) uint64 {
+	key := cache.NewKey(dbNum, keyName)
+
+	watched.Lock()
+	defer watched.Unlock()
+
+	if w, ok := watched.keys[key]; ok {
+		return w.version
+	}
+
+	return 0
+}
+
+// touch signals that key has been modified. It is a no-op
+// for the keys nobody is watching.
+func touch(key alg.Key) {
+	watched.Lock()
+	defer watched.Unlock()
+
+	if w, ok := watched.keys[key]; ok {
+		w.version++
+	}
+}
+
+// touchDB signals that every key of a DB has been modified
+func touchDB(dbNum int) {
+	watched.Lock()
+	defer watched.Unlock()
+
+	for key, w := range watched.keys {
+		if key.DB == dbNum {
+			w.version++
+		}
+	}
+}
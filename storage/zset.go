@@ -0,0 +1,1451 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/RcrdBrt/gobigdis/alg"
+)
+
+/*
+	A sorted set is a dir holding a single alg.BTree file with two kinds
+	of entries:
+	- 'm' + member -> score, to look up the score of a member
+	- 's' + score + member -> nothing, ordered by score and then by member
+	Scores are encoded so that their byte order is their numeric order.
+	Since the tree knows how many entries each subtree holds, ranks and the
+	number of members in a range of scores are found in O(log n), and all
+	the 'm' entries come first so the rank of a score entry minus the
+	cardinality is the rank of the member.
+
+	Members too long for a tree entry are stored whole in a file of the
+	members dir named after their sha256, and the entries hold a ref made
+	of their first bytes followed by the sha256 instead. Refs are longer
+	than any member kept in the tree, so they can't be mistaken for one,
+	and they sort like their member unless two members share the bytes kept
+	in the ref. The file of a removed member is deleted once the removal is
+	committed, so that a rolled back commit never refers to a missing file.
+*/
+
+const (
+	zsetTreeFileName   = "tree"
+	zsetMembersDirName = "members"
+	zsetMemberPrefix   = 'm'
+	zsetScorePrefix    = 's'
+	zsetRefLen         = alg.BTreeMaxEntrySize - 9 // prefix and score
+	zsetMaxInlineLen   = zsetRefLen - 1
+	zsetCommitPages    = 1024 // bulk loads commit once they changed this many pages
+)
+
+var (
+	errZSetNaN        = errors.New("ERR resulting score is not a number (NaN)")
+	errMinMaxNotFloat = errors.New("ERR min or max is not a float")
+	errMinMaxNotLex   = errors.New("ERR min or max not valid string range item")
+	errWeightNotFloat = errors.New("ERR weight value is not a float")
+)
+
+type zset struct {
+	key     alg.Key
+	dir     string // the dir of the sorted set, usually key.FilePath()
+	tree    *alg.BTree
+	removed [][]byte // refs of the long members removed since the last commit
+}
+
+// openZSet opens the sorted set at key, nil if the key does not exist.
+// The caller must hold at least cache.FSRWL.RLock and close the set.
+func openZSet(key alg.Key) (*zset, error) {
+	found, err := checkType(key, TypeZSet)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return openZSetDir(key, key.FilePath())
+}
+
+func openZSetDir(key alg.Key, dir string) (*zset, error) {
+	tree, err := alg.OpenBTree(filepath.Join(dir, zsetTreeFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	return &zset{
+		key:  key,
+		dir:  dir,
+		tree: tree,
+	}, nil
+}
+
+// openOrCreateZSet opens the sorted set at key, creating it if needed.
+// The caller must hold cache.FSRWL.Lock and close the set.
+func openOrCreateZSet(key alg.Key) (*zset, error) {
+	z, err := openZSet(key)
+	if err != nil || z != nil {
+		return z, err
+	}
+
+	if err := createTyped(key, TypeZSet, nil); err != nil {
+		return nil, err
+	}
+
+	return openZSetDir(key, key.FilePath())
+}
+
+// newTempZSet creates an empty sorted set to be moved to key by storeAt.
+// The caller must hold cache.FSRWL.Lock.
+func newTempZSet(key alg.Key) (*zset, error) {
+	dir, err := createTempTyped(TypeZSet)
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := openZSetDir(key, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return z, nil
+}
+
+// storeAt replaces whatever is at key with the temp sorted set z, or
+// deletes the key if z is empty. z is closed. The previous value is moved
+// in the trash, the returned path is to be purged once cache.FSRWL is
+// released. The caller must hold cache.FSRWL.Lock.
+func (z *zset) storeAt(key alg.Key) (int, string, error) {
+	card := z.card()
+
+	err := z.commitTree()
+	if closeErr := z.tree.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || card == 0 {
+		trashed := ""
+		if err == nil {
+			trashed, err = unlinkKey(key)
+		}
+
+		os.RemoveAll(z.dir)
+		return 0, trashed, err
+	}
+
+	trashed, err := storeTemp(z.dir, key)
+	if err != nil {
+		return 0, trashed, err
+	}
+
+	return card, trashed, nil
+}
+
+func (z *zset) close() error {
+	return z.tree.Close()
+}
+
+// commit saves the changes, deleting the key once the set is empty
+func (z *zset) commit() error {
+	if err := z.commitTree(); err != nil {
+		return err
+	}
+
+	if z.card() == 0 {
+		_, err := removeKey(z.key)
+		return err
+	}
+
+	touch(z.key)
+
+	return nil
+}
+
+// bulkCommit commits a temp set being filled once it holds enough changes
+func (z *zset) bulkCommit() error {
+	if z.tree.DirtyPages() < zsetCommitPages {
+		return nil
+	}
+
+	return z.commitTree()
+}
+
+// commitTree commits the tree, then deletes the files of the long members
+// removed since the last commit that were not added back
+func (z *zset) commitTree() error {
+	if err := z.tree.Commit(); err != nil {
+		return err
+	}
+
+	for _, ref := range z.removed {
+		_, found, err := z.tree.Get(append([]byte{zsetMemberPrefix}, ref...))
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			if err := os.Remove(z.memberPath(ref)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	z.removed = nil
+
+	return nil
+}
+
+func (z *zset) card() int {
+	return z.tree.Len() / 2
+}
+
+func encodeScore(score float64) []byte {
+	if score == 0 {
+		score = 0 // -0 sorts as 0
+	}
+
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, bits)
+
+	return encoded
+}
+
+func decodeScore(encoded []byte) float64 {
+	bits := binary.BigEndian.Uint64(encoded)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	return math.Float64frombits(bits)
+}
+
+// zsetRef returns how member is kept in the tree: as is, or as a ref if
+// it is too long
+func zsetRef(member []byte) []byte {
+	if len(member) <= zsetMaxInlineLen {
+		return member
+	}
+
+	hashed := sha256.Sum256(member)
+	ref := make([]byte, 0, zsetRefLen)
+	ref = append(ref, member[:zsetRefLen-len(hashed)]...)
+
+	return append(ref, hashed[:]...)
+}
+
+func isZSetRef(member []byte) bool {
+	return len(member) == zsetRefLen
+}
+
+func zsetMemberKey(member []byte) []byte {
+	return append([]byte{zsetMemberPrefix}, zsetRef(member)...)
+}
+
+func zsetScoreKey(encodedScore, member []byte) []byte {
+	ref := zsetRef(member)
+
+	key := make([]byte, 0, 1+len(encodedScore)+len(ref))
+	key = append(key, zsetScorePrefix)
+	key = append(key, encodedScore...)
+
+	return append(key, ref...)
+}
+
+// memberPath returns the path of the file of the long member of ref
+func (z *zset) memberPath(ref []byte) string {
+	return filepath.Join(z.dir, zsetMembersDirName, hex.EncodeToString(ref[len(ref)-sha256.Size:]))
+}
+
+// member returns the member kept in the tree as treeMember
+func (z *zset) member(treeMember []byte) ([]byte, error) {
+	if !isZSetRef(treeMember) {
+		return append([]byte{}, treeMember...), nil
+	}
+
+	member, err := os.ReadFile(z.memberPath(treeMember))
+	if os.IsNotExist(err) {
+		return nil, alg.ErrBTreeCorrupted
+	}
+
+	return member, err
+}
+
+// storeMember writes the file of member if it is a long one
+func (z *zset) storeMember(member []byte) error {
+	if len(member) <= zsetMaxInlineLen {
+		return nil
+	}
+
+	// the file is still there if the member was removed but not committed
+	path := z.memberPath(zsetRef(member))
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, member)
+}
+
+func (z *zset) score(member []byte) (float64, bool, error) {
+	encoded, found, err := z.tree.Get(zsetMemberKey(member))
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	return decodeScore(encoded), true, nil
+}
+
+// set sets the score of member, returning whether member is new
+func (z *zset) set(member []byte, score float64) (bool, error) {
+	old, found, err := z.score(member)
+	if err != nil {
+		return false, err
+	}
+
+	if found {
+		if old == score {
+			return false, nil
+		}
+
+		if _, err := z.tree.Delete(zsetScoreKey(encodeScore(old), member)); err != nil {
+			return false, err
+		}
+	}
+
+	if !found {
+		if err := z.storeMember(member); err != nil {
+			return false, err
+		}
+	}
+
+	encoded := encodeScore(score)
+	if _, err := z.tree.Put(zsetMemberKey(member), encoded); err != nil {
+		return false, err
+	}
+
+	if _, err := z.tree.Put(zsetScoreKey(encoded, member), nil); err != nil {
+		return false, err
+	}
+
+	return !found, nil
+}
+
+func (z *zset) remove(member []byte) (bool, error) {
+	score, found, err := z.score(member)
+	if err != nil || !found {
+		return false, err
+	}
+
+	if _, err := z.tree.Delete(zsetMemberKey(member)); err != nil {
+		return false, err
+	}
+
+	if _, err := z.tree.Delete(zsetScoreKey(encodeScore(score), member)); err != nil {
+		return false, err
+	}
+
+	if len(member) > zsetMaxInlineLen {
+		z.removed = append(z.removed, zsetRef(member))
+	}
+
+	return true, nil
+}
+
+// rank returns the rank of member by score, lowest first
+func (z *zset) rank(member []byte) (int, bool, error) {
+	score, found, err := z.score(member)
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	rank, err := z.tree.Rank(zsetScoreKey(encodeScore(score), member))
+	if err != nil {
+		return 0, false, err
+	}
+
+	return rank - z.card(), true, nil
+}
+
+// rankOf returns the number of members sorting before the score entry key
+func (z *zset) rankOf(key []byte) (int, error) {
+	rank, err := z.tree.Rank(key)
+	if err != nil {
+		return 0, err
+	}
+
+	return rank - z.card(), nil
+}
+
+// iterate calls fn on the members with rank in [from, to), in reverse
+// order if rev is set, until fn returns false
+func (z *zset) iterate(from, to int, rev bool, fn func(member []byte, score float64) bool) error {
+	if from >= to {
+		return nil
+	}
+
+	start := from
+	if rev {
+		start = to - 1
+	}
+
+	c, err := z.tree.SeekIndex(z.card() + start)
+	if err != nil {
+		return err
+	}
+
+	for i := from; i < to && c.Valid(); i++ {
+		key := c.Key()
+		member, err := z.member(key[9:])
+		if err != nil {
+			return err
+		}
+
+		if !fn(member, decodeScore(key[1:9])) {
+			return nil
+		}
+
+		if rev {
+			err = c.Prev()
+		} else {
+			err = c.Next()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// iterateMembers calls fn on every member, in member order
+func (z *zset) iterateMembers(fn func(member []byte, score float64) bool) error {
+	c, err := z.tree.SeekIndex(0)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < z.card() && c.Valid(); i++ {
+		member, err := z.member(c.Key()[1:])
+		if err != nil {
+			return err
+		}
+
+		if !fn(member, decodeScore(c.Value())) {
+			return nil
+		}
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nextEncodedScore returns the smallest encoded score greater than encoded
+func nextEncodedScore(encoded []byte) []byte {
+	next := make([]byte, 8)
+	binary.BigEndian.PutUint64(next, binary.BigEndian.Uint64(encoded)+1)
+
+	return next
+}
+
+type ZScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// ParseZScoreBound parses a score range item: a float, optionally
+// preceded by ( to exclude it, -inf and +inf included
+func ParseZScoreBound(b []byte) (ZScoreBound, error) {
+	var bound ZScoreBound
+	if len(b) > 0 && b[0] == '(' {
+		bound.Exclusive = true
+		b = b[1:]
+	}
+
+	value, err := ParseFloat(b)
+	if err != nil {
+		return bound, errMinMaxNotFloat
+	}
+	bound.Value = value
+
+	return bound, nil
+}
+
+type ZLexBound struct {
+	Value     []byte
+	Exclusive bool
+	Inf       int // -1 for -, 1 for +
+}
+
+// ParseZLexBound parses a lex range item: - and + or a string preceded
+// by [ to include it or ( to exclude it
+func ParseZLexBound(b []byte) (ZLexBound, error) {
+	var bound ZLexBound
+	if len(b) == 0 {
+		return bound, errMinMaxNotLex
+	}
+
+	switch b[0] {
+	case '-', '+':
+		if len(b) != 1 {
+			return bound, errMinMaxNotLex
+		}
+
+		bound.Inf = 1
+		if b[0] == '-' {
+			bound.Inf = -1
+		}
+	case '(':
+		bound.Exclusive = true
+		bound.Value = b[1:]
+	case '[':
+		bound.Value = b[1:]
+	default:
+		return bound, errMinMaxNotLex
+	}
+
+	return bound, nil
+}
+
+const (
+	ZRangeByIndex = iota
+	ZRangeByScore
+	ZRangeByLex
+)
+
+// ZRangeSpec describes the members selected by ZRANGE and friends
+type ZRangeSpec struct {
+	By         int
+	Start      int // ranks, for ZRangeByIndex
+	Stop       int
+	Min        ZScoreBound // for ZRangeByScore
+	Max        ZScoreBound
+	LexMin     ZLexBound // for ZRangeByLex
+	LexMax     ZLexBound
+	Rev        bool
+	Offset     int
+	Count      int // negative for no limit
+	WithScores bool
+}
+
+// ParseZRangeSpec parses the arguments of ZRANGE (ZRANGESTORE if store is
+// set) following the key: min max [BYSCORE|BYLEX] [REV] [LIMIT offset count]
+// [WITHSCORES]
+func ParseZRangeSpec(args [][]byte, store bool) (*ZRangeSpec, error) {
+	spec := &ZRangeSpec{
+		Count: -1,
+	}
+
+	limit := false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "byscore":
+			if spec.By != ZRangeByIndex {
+				return nil, ErrSyntax
+			}
+			spec.By = ZRangeByScore
+		case "bylex":
+			if spec.By != ZRangeByIndex {
+				return nil, ErrSyntax
+			}
+			spec.By = ZRangeByLex
+		case "rev":
+			spec.Rev = true
+		case "withscores":
+			if store {
+				return nil, ErrSyntax
+			}
+			spec.WithScores = true
+		case "limit":
+			if i+2 >= len(args) {
+				return nil, ErrSyntax
+			}
+
+			offset, err := ParseInt(args[i+1])
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+			count, err := ParseInt(args[i+2])
+			if err != nil {
+				return nil, ErrNotInteger
+			}
+
+			spec.Offset, spec.Count = int(offset), int(count)
+			limit = true
+			i += 2
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	if limit && spec.By == ZRangeByIndex {
+		return nil, errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if spec.WithScores && spec.By == ZRangeByLex {
+		return nil, errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+
+	// with REV, the range is given as max min
+	min, max := args[0], args[1]
+	if spec.Rev && spec.By != ZRangeByIndex {
+		min, max = max, min
+	}
+
+	var err error
+	switch spec.By {
+	case ZRangeByIndex:
+		start, startErr := ParseInt(min)
+		stop, stopErr := ParseInt(max)
+		if startErr != nil || stopErr != nil {
+			return nil, ErrNotInteger
+		}
+		spec.Start, spec.Stop = int(start), int(stop)
+	case ZRangeByScore:
+		if spec.Min, err = ParseZScoreBound(min); err != nil {
+			return nil, err
+		}
+		if spec.Max, err = ParseZScoreBound(max); err != nil {
+			return nil, err
+		}
+	case ZRangeByLex:
+		if spec.LexMin, err = ParseZLexBound(min); err != nil {
+			return nil, err
+		}
+		if spec.LexMax, err = ParseZLexBound(max); err != nil {
+			return nil, err
+		}
+	}
+
+	return spec, nil
+}
+
+// scoreRanks returns the ranks [from, to) of the members with a score
+// between min and max
+func (z *zset) scoreRanks(min, max ZScoreBound) (int, int, error) {
+	lower := encodeScore(min.Value)
+	if min.Exclusive {
+		lower = nextEncodedScore(lower)
+	}
+
+	upper := encodeScore(max.Value)
+	if !max.Exclusive {
+		upper = nextEncodedScore(upper)
+	}
+
+	from, err := z.rankOf(zsetScoreKey(lower, nil))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to, err := z.rankOf(zsetScoreKey(upper, nil))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return from, to, nil
+}
+
+// lexRanks returns the ranks [from, to) of the members between min and
+// max, assuming that all the members have the same score
+func (z *zset) lexRanks(min, max ZLexBound) (int, int, error) {
+	c, err := z.tree.SeekIndex(z.card())
+	if err != nil || !c.Valid() {
+		return 0, 0, err
+	}
+	score := append([]byte{}, c.Key()[1:9]...)
+
+	bound := func(b ZLexBound, upper bool) []byte {
+		switch {
+		case b.Inf < 0:
+			return zsetScoreKey(score, nil)
+		case b.Inf > 0:
+			return zsetScoreKey(nextEncodedScore(score), nil)
+		case b.Exclusive == upper:
+			return zsetScoreKey(score, b.Value)
+		default:
+			// the smallest entry after the one of b.Value
+			return append(zsetScoreKey(score, b.Value), 0)
+		}
+	}
+
+	from, err := z.rankOf(bound(min, false))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to, err := z.rankOf(bound(max, true))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return from, to, nil
+}
+
+// rangeMembers calls fn on the members selected by spec, in order
+func (z *zset) rangeMembers(spec *ZRangeSpec, fn func(member []byte, score float64) bool) error {
+	var from, to int
+	var err error
+
+	switch spec.By {
+	case ZRangeByIndex:
+		start, stop, ok := clampRange(spec.Start, spec.Stop, z.card())
+		if !ok {
+			return nil
+		}
+
+		if spec.Rev {
+			start, stop = z.card()-1-stop, z.card()-1-start
+		}
+		from, to = start, stop+1
+	case ZRangeByScore:
+		from, to, err = z.scoreRanks(spec.Min, spec.Max)
+	case ZRangeByLex:
+		from, to, err = z.lexRanks(spec.LexMin, spec.LexMax)
+	}
+	if err != nil {
+		return err
+	}
+
+	if spec.Offset < 0 || from >= to {
+		return nil
+	}
+
+	// LIMIT skips offset members from the start of the range
+	if spec.Rev {
+		to -= spec.Offset
+		if spec.Count >= 0 && to-spec.Count > from {
+			from = to - spec.Count
+		}
+	} else {
+		from += spec.Offset
+		if spec.Count >= 0 && from+spec.Count < to {
+			to = from + spec.Count
+		}
+	}
+
+	return z.iterate(from, to, spec.Rev, fn)
+}
+
+// ZAddOptions are the flags of ZADD
+type ZAddOptions struct {
+	NX   bool // only add new members
+	XX   bool // only update existing members
+	GT   bool // only update when the new score is greater
+	LT   bool // only update when the new score is lower
+	CH   bool // count the changed members too
+	Incr bool // increment the score like ZINCRBY
+}
+
+// ParseZAddOptions parses the flags at the start of args, returning the
+// score member pairs that follow
+func ParseZAddOptions(args [][]byte) (ZAddOptions, [][]byte, error) {
+	var opts ZAddOptions
+
+	i := 0
+loop:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			opts.NX = true
+		case "xx":
+			opts.XX = true
+		case "gt":
+			opts.GT = true
+		case "lt":
+			opts.LT = true
+		case "ch":
+			opts.CH = true
+		case "incr":
+			opts.Incr = true
+		default:
+			break loop
+		}
+	}
+	pairs := args[i:]
+
+	switch {
+	case opts.NX && opts.XX:
+		return opts, nil, errors.New("ERR XX and NX options at the same time are not compatible")
+	case (opts.GT && opts.LT) || (opts.NX && (opts.GT || opts.LT)):
+		return opts, nil, errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+	case len(pairs) == 0 || len(pairs)%2 != 0:
+		return opts, nil, ErrSyntax
+	case opts.Incr && len(pairs) != 2:
+		return opts, nil, errors.New("ERR INCR option supports a single increment-element pair")
+	}
+
+	return opts, pairs, nil
+}
+
+// ZAdd adds the score member pairs honouring opts. It returns the number
+// of added members (changed ones too with CH) or, with INCR, the new score
+// of the member, nil if it was not updated.
+func ZAdd(dbNum int, keyName []byte, opts ZAddOptions, pairs [][]byte) (int, []byte, error) {
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		score, err := ParseFloat(pairs[i*2])
+		if err != nil {
+			return 0, nil, err
+		}
+		scores[i] = score
+	}
+
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	z, err := openZSet(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if z == nil {
+		if opts.XX {
+			return 0, nil, nil
+		}
+
+		if z, err = openOrCreateZSet(key); err != nil {
+			return 0, nil, err
+		}
+	}
+	defer z.close()
+
+	added, changed := 0, 0
+	var incremented []byte
+	for i, score := range scores {
+		member := pairs[i*2+1]
+
+		old, found, err := z.score(member)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if (opts.NX && found) || (opts.XX && !found) {
+			continue
+		}
+
+		if opts.Incr && found {
+			score += old
+			if math.IsNaN(score) {
+				return 0, nil, errZSetNaN
+			}
+		}
+
+		if found && ((opts.GT && score <= old) || (opts.LT && score >= old)) {
+			continue
+		}
+
+		if _, err := z.set(member, score); err != nil {
+			return 0, nil, err
+		}
+
+		switch {
+		case !found:
+			added++
+		case score != old:
+			changed++
+		}
+		incremented = []byte(FormatFloat(score))
+	}
+
+	if err := z.commit(); err != nil {
+		return 0, nil, err
+	}
+
+	if opts.Incr {
+		return 0, incremented, nil
+	}
+
+	if opts.CH {
+		return added + changed, nil, nil
+	}
+
+	return added, nil, nil
+}
+
+// ZRem removes the given members, deleting the set once it's empty
+func ZRem(dbNum int, args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, fmt.Errorf("wrong number of arguments for 'zrem' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	z, err := openZSet(key)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	defer z.close()
+
+	counter := 0
+	for _, member := range args[1:] {
+		removed, err := z.remove(member)
+		if err != nil {
+			return 0, err
+		}
+
+		if removed {
+			counter++
+		}
+	}
+
+	if counter == 0 {
+		return 0, nil
+	}
+
+	return counter, z.commit()
+}
+
+func ZScore(dbNum int, args [][]byte) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("wrong number of arguments for 'zscore' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	z, err := openZSet(key)
+	if err != nil || z == nil {
+		return nil, err
+	}
+	defer z.close()
+
+	score, found, err := z.score(args[1])
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return []byte(FormatFloat(score)), nil
+}
+
+func ZCard(dbNum int, args [][]byte) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("wrong number of arguments for 'zcard' command")
+	}
+
+	key := cache.NewKey(dbNum, args[0])
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	z, err := openZSet(key)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	defer z.close()
+
+	return z.card(), nil
+}
+
+// ZRank returns the rank of member, from the highest score if rev is set.
+// It reports whether the member exists.
+func ZRank(dbNum int, keyName, member []byte, rev bool) (int, bool, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	z, err := openZSet(key)
+	if err != nil || z == nil {
+		return 0, false, err
+	}
+	defer z.close()
+
+	rank, found, err := z.rank(member)
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	if rev {
+		rank = z.card() - 1 - rank
+	}
+
+	return rank, true, nil
+}
+
+// ZCount returns the number of members with a score between min and max
+func ZCount(dbNum int, keyName []byte, min, max ZScoreBound) (int, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	z, err := openZSet(key)
+	if err != nil || z == nil {
+		return 0, err
+	}
+	defer z.close()
+
+	from, to, err := z.scoreRanks(min, max)
+	if err != nil || from >= to {
+		return 0, err
+	}
+
+	return to - from, nil
+}
+
+// ZRange returns the members selected by spec, followed by their
+// score if spec.WithScores is set
+func ZRange(dbNum int, keyName []byte, spec *ZRangeSpec) ([][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.RLock()
+	defer cache.FSRWL.RUnlock()
+
+	z, err := openZSet(key)
+	if err != nil || z == nil {
+		return [][]byte{}, err
+	}
+	defer z.close()
+
+	result := [][]byte{}
+	err = z.rangeMembers(spec, func(member []byte, score float64) bool {
+		result = append(result, member)
+		if spec.WithScores {
+			result = append(result, []byte(FormatFloat(score)))
+		}
+
+		return true
+	})
+
+	return result, err
+}
+
+// ZRangeStore stores the members of src selected by spec in dst,
+// returning how many they are
+func ZRangeStore(dbNum int, dst, src []byte, spec *ZRangeSpec) (int, error) {
+	srcKey := cache.NewKey(dbNum, src)
+	dstKey := cache.NewKey(dbNum, dst)
+
+	// purged once the lock is released
+	var trashed string
+	defer func() {
+		purgeAsync([]string{trashed})
+	}()
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	z, err := openZSet(srcKey)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := newTempZSet(dstKey)
+	if err != nil {
+		if z != nil {
+			z.close()
+		}
+		return 0, err
+	}
+
+	if z != nil {
+		var setErr error
+		err = z.rangeMembers(spec, func(member []byte, score float64) bool {
+			if _, setErr = tmp.set(member, score); setErr == nil {
+				setErr = tmp.bulkCommit()
+			}
+
+			return setErr == nil
+		})
+		z.close()
+
+		if err == nil {
+			err = setErr
+		}
+		if err != nil {
+			tmp.close()
+			os.RemoveAll(tmp.dir)
+			return 0, err
+		}
+	}
+
+	card, trashed, err := tmp.storeAt(dstKey)
+	return card, err
+}
+
+// ZPop removes and returns the count members with the lowest score, or
+// the highest one if max is set, each followed by its score
+func ZPop(dbNum int, keyName []byte, count int, max bool) ([][]byte, error) {
+	key := cache.NewKey(dbNum, keyName)
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	z, err := openZSet(key)
+	if err != nil || z == nil || count <= 0 {
+		if z != nil {
+			z.close()
+		}
+		return [][]byte{}, err
+	}
+	defer z.close()
+
+	card := z.card()
+	if count > card {
+		count = card
+	}
+
+	from, to := 0, count
+	if max {
+		from, to = card-count, card
+	}
+
+	members := [][]byte{}
+	result := [][]byte{}
+	err = z.iterate(from, to, max, func(member []byte, score float64) bool {
+		members = append(members, member)
+		result = append(result, member, []byte(FormatFloat(score)))
+
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, member := range members {
+		if _, err := z.remove(member); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, z.commit()
+}
+
+// ZIncrBy adds increment to the score of member
+func ZIncrBy(dbNum int, args [][]byte) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("wrong number of arguments for 'zincrby' command")
+	}
+
+	_, score, err := ZAdd(dbNum, args[0], ZAddOptions{Incr: true}, args[1:])
+
+	return score, err
+}
+
+const (
+	zAggregateSum = iota
+	zAggregateMin
+	zAggregateMax
+)
+
+// zstoreSource is a source of ZUNIONSTORE and ZINTERSTORE, plain sets
+// count as sorted sets with all the scores at 1
+type zstoreSource struct {
+	z      *zset
+	s      *set
+	weight float64
+}
+
+func (src *zstoreSource) card() (int, error) {
+	switch {
+	case src.z != nil:
+		return src.z.card(), nil
+	case src.s != nil:
+		return src.s.card()
+	}
+
+	return 0, nil
+}
+
+func (src *zstoreSource) score(member []byte) (float64, bool, error) {
+	switch {
+	case src.z != nil:
+		score, found, err := src.z.score(member)
+		return src.weighted(score), found, err
+	case src.s != nil:
+		found, err := src.s.has(member)
+		return src.weighted(1), found, err
+	}
+
+	return 0, false, nil
+}
+
+func (src *zstoreSource) iterate(fn func(member []byte, score float64) bool) error {
+	switch {
+	case src.z != nil:
+		return src.z.iterateMembers(func(member []byte, score float64) bool {
+			return fn(member, src.weighted(score))
+		})
+	case src.s != nil:
+		return src.s.iterate(func(member []byte) bool {
+			return fn(member, src.weighted(1))
+		})
+	}
+
+	return nil
+}
+
+func (src *zstoreSource) weighted(score float64) float64 {
+	score *= src.weight
+	if math.IsNaN(score) {
+		return 0 // inf * 0
+	}
+
+	return score
+}
+
+func zAggregate(aggregate int, a, b float64) float64 {
+	switch aggregate {
+	case zAggregateMin:
+		return math.Min(a, b)
+	case zAggregateMax:
+		return math.Max(a, b)
+	}
+
+	if sum := a + b; !math.IsNaN(sum) {
+		return sum
+	}
+
+	return 0 // inf + -inf
+}
+
+// ZStore stores the union, or the intersection if inter is set, of the
+// sets in args (numkeys key [key ...] [WEIGHTS weight [weight ...]]
+// [AGGREGATE SUM|MIN|MAX]) in dst, returning its cardinality
+func ZStore(dbNum int, dst []byte, args [][]byte, inter bool) (int, error) {
+	name := "zunionstore"
+	if inter {
+		name = "zinterstore"
+	}
+
+	numKeys, err := ParseInt(args[0])
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	if numKeys < 1 {
+		return 0, fmt.Errorf("ERR at least 1 input key is needed for '%s' command", name)
+	}
+	if int(numKeys) > len(args)-1 {
+		return 0, ErrSyntax
+	}
+
+	keys := args[1 : 1+numKeys]
+	weights := make([]float64, len(keys))
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := zAggregateSum
+
+	for i := 1 + int(numKeys); i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "weights":
+			if i+len(keys) >= len(args) {
+				return 0, ErrSyntax
+			}
+
+			for j := range weights {
+				weight, err := ParseFloat(args[i+1+j])
+				if err != nil {
+					return 0, errWeightNotFloat
+				}
+				weights[j] = weight
+			}
+			i += len(keys)
+		case "aggregate":
+			if i+1 >= len(args) {
+				return 0, ErrSyntax
+			}
+
+			switch strings.ToLower(string(args[i+1])) {
+			case "sum":
+				aggregate = zAggregateSum
+			case "min":
+				aggregate = zAggregateMin
+			case "max":
+				aggregate = zAggregateMax
+			default:
+				return 0, ErrSyntax
+			}
+			i++
+		default:
+			return 0, ErrSyntax
+		}
+	}
+
+	dstKey := cache.NewKey(dbNum, dst)
+
+	// purged once the lock is released
+	var trashed string
+	defer func() {
+		purgeAsync([]string{trashed})
+	}()
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	sources := make([]*zstoreSource, len(keys))
+	defer func() {
+		for _, src := range sources {
+			if src != nil && src.z != nil {
+				src.z.close()
+			}
+		}
+	}()
+
+	for i, keyName := range keys {
+		key := cache.NewKey(dbNum, keyName)
+		src := &zstoreSource{
+			weight: weights[i],
+		}
+
+		typ, err := keyType(key)
+		if err != nil {
+			return 0, err
+		}
+
+		switch typ {
+		case TypeNone:
+		case TypeZSet:
+			if src.z, err = openZSetDir(key, key.FilePath()); err != nil {
+				return 0, err
+			}
+		case TypeSet:
+			if src.s, err = loadSet(key); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, ErrWrongType
+		}
+
+		sources[i] = src
+	}
+
+	tmp, err := newTempZSet(dstKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if inter {
+		err = zInter(tmp, sources, aggregate)
+	} else {
+		err = zUnion(tmp, sources, aggregate)
+	}
+	if err != nil {
+		tmp.close()
+		os.RemoveAll(tmp.dir)
+		return 0, err
+	}
+
+	card, trashed, err := tmp.storeAt(dstKey)
+	return card, err
+}
+
+func zUnion(dst *zset, sources []*zstoreSource, aggregate int) error {
+	for _, src := range sources {
+		var setErr error
+		err := src.iterate(func(member []byte, score float64) bool {
+			old, found, err := dst.score(member)
+			if err != nil {
+				setErr = err
+				return false
+			}
+
+			if found {
+				score = zAggregate(aggregate, old, score)
+			}
+
+			if _, setErr = dst.set(member, score); setErr == nil {
+				setErr = dst.bulkCommit()
+			}
+
+			return setErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		if setErr != nil {
+			return setErr
+		}
+	}
+
+	return nil
+}
+
+func zInter(dst *zset, sources []*zstoreSource, aggregate int) error {
+	// walk the smallest source, looking the members up in the others
+	smallest, smallestCard := 0, -1
+	for i, src := range sources {
+		card, err := src.card()
+		if err != nil {
+			return err
+		}
+
+		if smallestCard < 0 || card < smallestCard {
+			smallest, smallestCard = i, card
+		}
+	}
+
+	if smallestCard == 0 {
+		return nil
+	}
+
+	var setErr error
+	err := sources[smallest].iterate(func(member []byte, _ float64) bool {
+		var score float64
+		for i, src := range sources {
+			other, found, err := src.score(member)
+			if err != nil {
+				setErr = err
+				return false
+			}
+			if !found {
+				return true
+			}
+
+			if i == 0 {
+				score = other
+			} else {
+				score = zAggregate(aggregate, score, other)
+			}
+		}
+
+		if _, setErr = dst.set(member, score); setErr == nil {
+			setErr = dst.bulkCommit()
+		}
+
+		return setErr == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return setErr
+}
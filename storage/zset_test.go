@@ -0,0 +1,244 @@
+/*
+	GoBigdis is a persistent database that implements the Redis server protocol.
+    Copyright (C) 2021  Riccardo Berto
+
+    This program is free software: you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation, either version 3 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License
+    along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zsetTestRange returns the members of keyName selected by the ZRANGE
+// arguments args
+func zsetTestRange(t *testing.T, db int, keyName string, args ...string) [][]byte {
+	t.Helper()
+
+	spec, err := ParseZRangeSpec(testArgs(args...), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := ZRange(db, []byte(keyName), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return members
+}
+
+func checkZSetMembers(t *testing.T, members [][]byte, want ...string) {
+	t.Helper()
+
+	if len(members) != len(want) {
+		t.Fatalf("got %d members, want %d", len(members), len(want))
+	}
+	for i := range want {
+		if string(members[i]) != want[i] {
+			t.Fatalf("member %d is %.20q... of %d bytes, want %.20q... of %d bytes",
+				i, members[i], len(members[i]), want[i], len(want[i]))
+		}
+	}
+}
+
+// zsetTestMemberFiles returns how many long members have a file in the
+// sorted set at keyName
+func zsetTestMemberFiles(t *testing.T, db int, keyName string) int {
+	t.Helper()
+
+	key := cache.NewKey(db, []byte(keyName))
+	entries, err := os.ReadDir(filepath.Join(key.FilePath(), zsetMembersDirName))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	return len(entries)
+}
+
+func TestZSetLongMembers(t *testing.T) {
+	const db = 14
+
+	long := "b" + strings.Repeat("x", 5000)
+	longer := "a" + strings.Repeat("y", 3000)
+	inline := strings.Repeat("c", zsetMaxInlineLen)
+	ref := strings.Repeat("d", zsetRefLen)
+
+	added, _, err := ZAdd(db, []byte("zlong"), ZAddOptions{}, testArgs(
+		"1", long, "2", longer, "3", inline, "4", ref, "5", "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 5 {
+		t.Fatalf("added %d members, want 5", added)
+	}
+
+	checkZSetMembers(t, zsetTestRange(t, db, "zlong", "0", "-1"), long, longer, inline, ref, "e")
+	if n := zsetTestMemberFiles(t, db, "zlong"); n != 3 {
+		t.Fatalf("%d member files, want 3", n)
+	}
+
+	for i, member := range []string{long, longer, inline, ref, "e"} {
+		score, err := ZScore(db, testArgs("zlong", member))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := FormatFloat(float64(i + 1)); string(score) != want {
+			t.Fatalf("the score of member %d is %s, want %s", i, score, want)
+		}
+
+		rank, found, err := ZRank(db, []byte("zlong"), []byte(member), false)
+		if err != nil || !found || rank != i {
+			t.Fatalf("the rank of member %d is %d (found %v), want %d: %v", i, rank, found, i, err)
+		}
+	}
+
+	// a member sharing the bytes kept in the ref is another member
+	if score, err := ZScore(db, testArgs("zlong", long+"z")); err != nil || score != nil {
+		t.Fatalf("a missing long member has score %s: %v", score, err)
+	}
+
+	// updating the score keeps the file, removing the member deletes it
+	if _, _, err := ZAdd(db, []byte("zlong"), ZAddOptions{}, testArgs("10", long)); err != nil {
+		t.Fatal(err)
+	}
+	checkZSetMembers(t, zsetTestRange(t, db, "zlong", "-1", "-1"), long)
+
+	if removed, err := ZRem(db, testArgs("zlong", long, "e")); err != nil || removed != 2 {
+		t.Fatalf("removed %d members, want 2: %v", removed, err)
+	}
+	if n := zsetTestMemberFiles(t, db, "zlong"); n != 2 {
+		t.Fatalf("%d member files after ZREM, want 2", n)
+	}
+	checkZSetMembers(t, zsetTestRange(t, db, "zlong", "0", "-1"), longer, inline, ref)
+
+	// the values built aside keep their member files
+	if _, err := Copy(db, []byte("zlong"), []byte("zcopy"), CopyOptions{DB: db}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ZStore(db, []byte("zunion"), testArgs("2", "zlong", "zcopy"), false); err != nil {
+		t.Fatal(err)
+	}
+	for _, keyName := range []string{"zcopy", "zunion"} {
+		checkZSetMembers(t, zsetTestRange(t, db, keyName, "0", "-1"), longer, inline, ref)
+		if n := zsetTestMemberFiles(t, db, keyName); n != 2 {
+			t.Fatalf("%d member files in %s, want 2", n, keyName)
+		}
+	}
+
+	// long members sort by their bytes within a score
+	if _, _, err := ZAdd(db, []byte("zlex"), ZAddOptions{}, testArgs("0", long, "0", "b", "0", longer)); err != nil {
+		t.Fatal(err)
+	}
+	checkZSetMembers(t, zsetTestRange(t, db, "zlex", "[b", "+", "BYLEX"), "b", long)
+	checkZSetMembers(t, zsetTestRange(t, db, "zlex", "("+longer, "[b", "BYLEX"), "b")
+
+	// and so do geo members
+	if _, err := GeoAdd(db, []byte("zgeo"), testArgs("13.361389", "38.115556", long)); err != nil {
+		t.Fatal(err)
+	}
+	positions, err := GeoPos(db, []byte("zgeo"), testArgs(long))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 1 || positions[0] == nil {
+		t.Fatalf("no position for the long geo member")
+	}
+
+	popped, err := ZPop(db, []byte("zlex"), 3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(popped) != 6 || !bytes.Equal(popped[0], []byte(longer)) || !bytes.Equal(popped[4], []byte(long)) {
+		t.Fatalf("ZPOP returned %d values", len(popped))
+	}
+	if found, err := Exists(db, testArgs("zlex")); err != nil || found != 0 {
+		t.Fatalf("the emptied sorted set still exists: %v", err)
+	}
+
+	if _, err := Del(db, testArgs("zlong", "zcopy", "zunion", "zgeo")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestZSetLongMemberRemovedAndAddedBack(t *testing.T) {
+	const db = 14
+
+	long := strings.Repeat("l", 4000)
+	key := cache.NewKey(db, []byte("zreadd"))
+
+	cache.FSRWL.Lock()
+	defer cache.FSRWL.Unlock()
+
+	z, err := openOrCreateZSet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.close()
+
+	if _, err := z.set([]byte("short"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.set([]byte(long), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file is only deleted if the member is still gone at commit time
+	if _, err := z.remove([]byte(long)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.set([]byte(long), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	members := [][]byte{}
+	err = z.iterate(0, z.card(), false, func(member []byte, score float64) bool {
+		members = append(members, member)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkZSetMembers(t, members, "short", long)
+
+	if _, err := z.remove([]byte(long)); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(z.memberPath(zsetRef([]byte(long)))); !os.IsNotExist(err) {
+		t.Fatalf("the file of the removed member is still there: %v", err)
+	}
+
+	if _, err := z.remove([]byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := exists(key); err != nil || found {
+		t.Fatalf("the emptied sorted set still exists: %v", err)
+	}
+}